@@ -0,0 +1,130 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package chaincode holds the error envelope, argument decoding, transaction time and status lifecycle
+// checks the referral and mortgage chaincodes share.
+package chaincode
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/joerust/mortgage-referrals/ledger"
+)
+
+// Error codes returned in the error envelope. Clients should branch on the code, the message is for people
+// and may change.
+const (
+	ErrCodeInvalidArgument    = "INVALID_ARGUMENT"
+	ErrCodeValidation         = "VALIDATION_FAILED"
+	ErrCodeNotFound           = "NOT_FOUND"
+	ErrCodeAlreadyExists      = "ALREADY_EXISTS"
+	ErrCodeAccessDenied       = "ACCESS_DENIED"
+	ErrCodeInvalidTransition  = "INVALID_TRANSITION"
+	ErrCodeVersionConflict    = "VERSION_CONFLICT"
+	ErrCodeFailedPrecondition = "FAILED_PRECONDITION"
+	ErrCodeUnknownFunction    = "UNKNOWN_FUNCTION"
+	ErrCodeLedger             = "LEDGER_ERROR"
+	ErrCodeInternal           = "INTERNAL"
+)
+
+// MaxClockSkew bounds how far a transaction's timestamp may be from the endorsing peer's clock
+const MaxClockSkew = 5 * time.Minute
+
+// Error is the error envelope every Invoke and Query function fails with. Its Error text is the envelope
+// as JSON, for example {"code":"NOT_FOUND","message":"Referral REF-1 does not exist"}.
+type Error struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+func (e *Error) Error() string {
+	valAsbytes, err := json.Marshal(e)
+	if err != nil {
+		return `{"code":"` + ErrCodeInternal + `","message":"Failed to encode error"}`
+	}
+
+	return string(valAsbytes)
+}
+
+// Coded is implemented by the structured errors that carry their own details
+type Coded interface {
+	error
+	Envelope() *Error
+}
+
+// NewError returns an error envelope without details
+func NewError(code string, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+// NewErrorDetails returns an error envelope carrying details about what went wrong
+func NewErrorDetails(code string, message string, details interface{}) *Error {
+	return &Error{Code: code, Message: message, Details: details}
+}
+
+// AsError converts any error into the envelope. Errors raised outside the chaincode's own checks, such
+// as from the JSON encoder, are reported as internal errors.
+func AsError(err error) *Error {
+	switch e := err.(type) {
+	case *Error:
+		return e
+	case Coded:
+		return e.Envelope()
+	}
+
+	return NewError(ErrCodeInternal, err.Error())
+}
+
+// UnmarshalStrict parses JSON into value, rejecting unknown fields and trailing data
+func UnmarshalStrict(valAsbytes []byte, into interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(valAsbytes))
+	decoder.DisallowUnknownFields()
+
+	err := decoder.Decode(into)
+	if err == nil && decoder.Decode(&struct{}{}) != io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return err
+}
+
+// DecodeStrict parses a JSON argument with UnmarshalStrict, reporting malformed JSON as an invalid argument
+func DecodeStrict(value string, into interface{}) error {
+	err := UnmarshalStrict([]byte(value), into)
+	if err != nil {
+		return NewError(ErrCodeInvalidArgument, "Malformed JSON: "+err.Error())
+	}
+
+	return nil
+}
+
+// TxTime returns the transaction timestamp in seconds since the epoch. The client sets the timestamp in
+// its proposal and the peer does not check it, so it is only accepted within MaxClockSkew of the endorsing
+// peer's clock. A client can still move the times it records by up to that much either way.
+func TxTime(stub ledger.Stub) (int64, error) {
+	timestamp, err := stub.GetTxTimestamp()
+	if err != nil || timestamp == nil {
+		return 0, NewError(ErrCodeLedger, "Failed to get transaction timestamp")
+	}
+
+	skew := timestamp.AsTime().Sub(stub.GetEndorserTime())
+	if skew > MaxClockSkew || skew < -MaxClockSkew {
+		return 0, NewError(ErrCodeInvalidArgument, "Transaction timestamp is more than "+MaxClockSkew.String()+" from the endorsing peer's clock")
+	}
+
+	return timestamp.Seconds, nil
+}
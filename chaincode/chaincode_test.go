@@ -0,0 +1,169 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package chaincode
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/joerust/mortgage-referrals/ledger"
+)
+
+var testLifecycle = Lifecycle{
+	IdField:     "referralId",
+	Order:       []string{"NEW", "CONTACTED", "CLOSED"},
+	Transitions: map[string][]string{"NEW": {"CONTACTED", "CLOSED"}, "CONTACTED": {"CLOSED"}, "CLOSED": {}},
+}
+
+func TestTxTime(t *testing.T) {
+	cases := []struct {
+		name         string
+		endorserTime int64
+		code         string
+	}{
+		{name: "peer clock agrees", endorserTime: 1700000000},
+		{name: "within the skew", endorserTime: 1700000000 - int64(MaxClockSkew.Seconds())},
+		{name: "timestamp ahead of the peer", endorserTime: 1700000000 - int64(MaxClockSkew.Seconds()) - 1, code: ErrCodeInvalidArgument},
+		{name: "timestamp behind the peer", endorserTime: 1700000000 + int64(MaxClockSkew.Seconds()) + 1, code: ErrCodeInvalidArgument},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			stub := ledger.NewMockStub()
+			stub.Time = 1700000000
+			stub.EndorserTime = c.endorserTime
+
+			timestamp, err := TxTime(stub)
+			if c.code != "" {
+				if err == nil || AsError(err).Code != c.code {
+					t.Fatalf("err = %v, want code %s", err, c.code)
+				}
+				return
+			}
+
+			if err != nil || timestamp != 1700000000 {
+				t.Fatalf("TxTime = %d, %v", timestamp, err)
+			}
+		})
+	}
+}
+
+func TestDecodeStrict(t *testing.T) {
+	cases := []struct {
+		name  string
+		value string
+		code  string
+	}{
+		{name: "known fields", value: `{"name":"Jane"}`},
+		{name: "unknown field", value: `{"name":"Jane","age":40}`, code: ErrCodeInvalidArgument},
+		{name: "trailing data", value: `{"name":"Jane"} {}`, code: ErrCodeInvalidArgument},
+		{name: "not JSON", value: `name`, code: ErrCodeInvalidArgument},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var into struct {
+				Name string `json:"name"`
+			}
+
+			err := DecodeStrict(c.value, &into)
+			if c.code == "" {
+				if err != nil || into.Name != "Jane" {
+					t.Fatalf("decoded %+v, %v", into, err)
+				}
+				return
+			}
+
+			if err == nil || AsError(err).Code != c.code {
+				t.Fatalf("err = %v, want code %s", err, c.code)
+			}
+		})
+	}
+}
+
+func TestLifecycleCheck(t *testing.T) {
+	if err := testLifecycle.Check("REF-1", "NEW", "CONTACTED"); err != nil {
+		t.Fatalf("NEW to CONTACTED: %v", err)
+	}
+
+	err := testLifecycle.Check("REF-1", "CLOSED", "NEW")
+	var transition *TransitionError
+	if !errors.As(err, &transition) || transition.From != "CLOSED" || transition.To != "NEW" {
+		t.Fatalf("CLOSED to NEW: err = %v, want a TransitionError", err)
+	}
+
+	var envelope struct {
+		Code    string `json:"code"`
+		Details struct {
+			ReferralId string   `json:"referralId"`
+			From       string   `json:"from"`
+			To         string   `json:"to"`
+			Allowed    []string `json:"allowed"`
+		} `json:"details"`
+	}
+	if err := json.Unmarshal([]byte(AsError(err).Error()), &envelope); err != nil {
+		t.Fatal(err)
+	}
+
+	if envelope.Code != ErrCodeInvalidTransition || envelope.Details.ReferralId != "REF-1" || envelope.Details.From != "CLOSED" || envelope.Details.Allowed == nil {
+		t.Fatalf("envelope %+v", envelope)
+	}
+
+	err = testLifecycle.Check("REF-1", "UNKNOWN", "NEW")
+	if !errors.As(err, &transition) {
+		t.Fatalf("from an unknown status: err = %v, want a TransitionError", err)
+	}
+}
+
+func TestLifecycleTable(t *testing.T) {
+	table := testLifecycle.Table()
+	if len(table) != 3 || table[0].Status != "NEW" || table[0].Terminal || !table[2].Terminal {
+		t.Fatalf("table %+v", table)
+	}
+
+	entry, ok := testLifecycle.Entry("CONTACTED")
+	if !ok || len(entry.Next) != 1 || entry.Next[0] != "CLOSED" {
+		t.Fatalf("CONTACTED entry %+v, %v", entry, ok)
+	}
+
+	if _, ok := testLifecycle.Entry("UNKNOWN"); ok {
+		t.Fatal("found an entry for an unknown status")
+	}
+}
+
+func TestAsError(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		code string
+	}{
+		{"envelope", NewError(ErrCodeNotFound, "Referral REF-1 does not exist"), ErrCodeNotFound},
+		{"coded error", &TransitionError{IdField: "referralId"}, ErrCodeInvalidTransition},
+		{"any other error", errors.New("boom"), ErrCodeInternal},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var envelope Error
+			if err := json.Unmarshal([]byte(AsError(c.err).Error()), &envelope); err != nil {
+				t.Fatal(err)
+			}
+
+			if envelope.Code != c.code || envelope.Message == "" {
+				t.Fatalf("envelope %+v, want code %s", envelope, c.code)
+			}
+		})
+	}
+}
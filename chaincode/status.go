@@ -0,0 +1,105 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package chaincode
+
+import (
+	"encoding/json"
+)
+
+// Lifecycle is the set of statuses a record moves through
+type Lifecycle struct {
+	// IdField names the record's id in the details of a TransitionError, such as referralId
+	IdField string
+	// Order lists the statuses in the order a record normally moves through them
+	Order []string
+	// Transitions maps each status to the statuses a record may move to next. Statuses with no entries
+	// are terminal.
+	Transitions map[string][]string
+}
+
+// StatusTransition describes the statuses reachable from a single status
+type StatusTransition struct {
+	Status   string   `json:"status"`
+	Next     []string `json:"next"`
+	Terminal bool     `json:"terminal"`
+}
+
+// TransitionError is returned when a record is asked to move to a status its lifecycle does not allow
+type TransitionError struct {
+	IdField string
+	Id      string
+	From    string
+	To      string
+	Allowed []string
+}
+
+func (e *TransitionError) Error() string {
+	return e.Envelope().Error()
+}
+
+// Envelope returns the error envelope, with the record's id under the lifecycle's id field
+func (e *TransitionError) Envelope() *Error {
+	return NewErrorDetails(ErrCodeInvalidTransition, "Illegal status transition", e)
+}
+
+// MarshalJSON writes the details with the id under the lifecycle's id field, such as
+// {"referralId":"REF-1","from":"NEW","to":"FUNDED","allowed":["CONTACTED","WITHDRAWN"]}
+func (e *TransitionError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		e.IdField: e.Id,
+		"from":    e.From,
+		"to":      e.To,
+		"allowed": e.Allowed,
+	})
+}
+
+// IsKnown reports whether status is part of the lifecycle
+func (l Lifecycle) IsKnown(status string) bool {
+	_, ok := l.Transitions[status]
+	return ok
+}
+
+// IsTerminal reports whether a record in this status can no longer move
+func (l Lifecycle) IsTerminal(status string) bool {
+	return len(l.Transitions[status]) == 0
+}
+
+// Check returns a TransitionError if the lifecycle does not allow moving from one status to the other
+func (l Lifecycle) Check(id string, from string, to string) error {
+	next := l.Transitions[from]
+	for i := range next {
+		if next[i] == to {
+			return nil
+		}
+	}
+
+	return &TransitionError{IdField: l.IdField, Id: id, From: from, To: to, Allowed: next}
+}
+
+// Table returns the transition table in lifecycle order
+func (l Lifecycle) Table() []StatusTransition {
+	table := make([]StatusTransition, 0, len(l.Order))
+	for _, status := range l.Order {
+		entry, _ := l.Entry(status)
+		table = append(table, entry)
+	}
+
+	return table
+}
+
+// Entry returns the transition table entry for a status, or false if the status is not part of the lifecycle
+func (l Lifecycle) Entry(status string) (StatusTransition, bool) {
+	next, ok := l.Transitions[status]
+	return StatusTransition{Status: status, Next: next, Terminal: len(next) == 0}, ok
+}
@@ -0,0 +1,245 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package decimal holds the fixed-point money and interest rate types shared by the referral and
+// mortgage chaincodes.
+package decimal
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// legacyCurrency is assumed for free-form amounts, which carry no currency code
+const legacyCurrency = "USD"
+
+// currencyMinorUnits is the number of decimal places used by a currency. Currencies not listed use 2.
+var currencyMinorUnits = map[string]int{
+	"BHD": 3,
+	"JPY": 0,
+	"KRW": 0,
+	"KWD": 3,
+}
+
+var currencyCodePattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// Money is an amount held as an integer number of the currency's minor units, cents for USD
+type Money struct {
+	MinorUnits int64  `json:"minorUnits"`
+	Currency   string `json:"currency"`
+}
+
+// BasisPoints is an interest rate in hundredths of a percent, 4.25% is 425
+type BasisPoints int64
+
+// minorUnitsFor returns the number of decimal places used by the currency
+func minorUnitsFor(currency string) int {
+	if units, ok := currencyMinorUnits[currency]; ok {
+		return units
+	}
+
+	return 2
+}
+
+// parseFixedPoint parses a plain decimal string into an integer scaled by 10^scale. Fractions with
+// more digits than scale are rejected unless round is set, in which case they are rounded half away from zero.
+func parseFixedPoint(value string, scale int, round bool) (int64, error) {
+	negative := false
+	digits := value
+	if strings.HasPrefix(digits, "-") || strings.HasPrefix(digits, "+") {
+		negative = digits[0] == '-'
+		digits = digits[1:]
+	}
+
+	whole, fraction := digits, ""
+	if i := strings.Index(digits, "."); i >= 0 {
+		whole, fraction = digits[:i], digits[i+1:]
+	}
+
+	if whole == "" && fraction == "" {
+		return 0, fmt.Errorf("%q is not a decimal number", value)
+	}
+	for _, part := range []string{whole, fraction} {
+		if strings.Trim(part, "0123456789") != "" {
+			return 0, fmt.Errorf("%q is not a decimal number", value)
+		}
+	}
+
+	roundUp := false
+	if len(fraction) > scale {
+		if !round {
+			return 0, fmt.Errorf("%q has more than %d decimal places", value, scale)
+		}
+		roundUp = fraction[scale] >= '5'
+		fraction = fraction[:scale]
+	}
+	fraction += strings.Repeat("0", scale-len(fraction))
+
+	var scaled int64
+	if whole+fraction != "" {
+		var err error
+		scaled, err = strconv.ParseInt(whole+fraction, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%q is out of range", value)
+		}
+	}
+
+	if roundUp {
+		if scaled == math.MaxInt64 {
+			return 0, fmt.Errorf("%q is out of range", value)
+		}
+		scaled++
+	}
+
+	if negative {
+		scaled = -scaled
+	}
+
+	return scaled, nil
+}
+
+// formatFixedPoint renders an integer scaled by 10^scale as a plain decimal string
+func formatFixedPoint(scaled int64, scale int) string {
+	sign := ""
+	magnitude := strconv.FormatUint(uint64(scaled), 10)
+	if scaled < 0 {
+		sign = "-"
+		magnitude = strconv.FormatUint(uint64(-(scaled+1))+1, 10)
+	}
+
+	if scale == 0 {
+		return sign + magnitude
+	}
+
+	if len(magnitude) <= scale {
+		magnitude = strings.Repeat("0", scale-len(magnitude)+1) + magnitude
+	}
+
+	return sign + magnitude[:len(magnitude)-scale] + "." + magnitude[len(magnitude)-scale:]
+}
+
+// ParseMoney parses a decimal amount such as "250000.00" in the given currency
+func ParseMoney(amount string, currency string) (Money, error) {
+	if !currencyCodePattern.MatchString(currency) {
+		return Money{}, fmt.Errorf("%q is not an ISO 4217 currency code", currency)
+	}
+
+	minorUnits, err := parseFixedPoint(amount, minorUnitsFor(currency), false)
+	if err != nil {
+		return Money{}, err
+	}
+
+	return Money{MinorUnits: minorUnits, Currency: currency}, nil
+}
+
+// String renders the amount with its currency, for example "250000.00 USD"
+func (m Money) String() string {
+	return formatFixedPoint(m.MinorUnits, minorUnitsFor(m.Currency)) + " " + m.Currency
+}
+
+// IsZero reports whether no amount has been set
+func (m Money) IsZero() bool {
+	return m == Money{}
+}
+
+// Validate checks the currency code and that the amount is not negative
+func (m Money) Validate() error {
+	if !currencyCodePattern.MatchString(m.Currency) {
+		return fmt.Errorf("%q is not an ISO 4217 currency code", m.Currency)
+	}
+
+	if m.MinorUnits < 0 {
+		return errors.New("amount must not be negative")
+	}
+
+	return nil
+}
+
+// Add returns the sum of two amounts in the same currency
+func (m Money) Add(other Money) (Money, error) {
+	if m.Currency != other.Currency {
+		return Money{}, fmt.Errorf("cannot add %s to %s", other.Currency, m.Currency)
+	}
+
+	sum := m.MinorUnits + other.MinorUnits
+	if (other.MinorUnits > 0 && sum < m.MinorUnits) || (other.MinorUnits < 0 && sum > m.MinorUnits) {
+		return Money{}, errors.New("amount overflows")
+	}
+
+	return Money{MinorUnits: sum, Currency: m.Currency}, nil
+}
+
+// Cmp compares two amounts in the same currency, returning -1, 0 or 1
+func (m Money) Cmp(other Money) (int, error) {
+	if m.Currency != other.Currency {
+		return 0, fmt.Errorf("cannot compare %s with %s", other.Currency, m.Currency)
+	}
+
+	if m.MinorUnits < other.MinorUnits {
+		return -1, nil
+	} else if m.MinorUnits > other.MinorUnits {
+		return 1, nil
+	}
+
+	return 0, nil
+}
+
+// ParseRate parses a percentage such as "4.25" or "4.25%" into basis points
+func ParseRate(rate string) (BasisPoints, error) {
+	basisPoints, err := parseFixedPoint(strings.TrimSuffix(strings.TrimSpace(rate), "%"), 2, false)
+	return BasisPoints(basisPoints), err
+}
+
+// String renders the rate as a percentage, for example "4.25%"
+func (r BasisPoints) String() string {
+	return formatFixedPoint(int64(r), 2) + "%"
+}
+
+// Validate checks the rate is between 0% and 100%
+func (r BasisPoints) Validate() error {
+	if r < 0 || r > 10000 {
+		return errors.New("rate must be between 0% and 100%")
+	}
+
+	return nil
+}
+
+// ParseLegacyMoney reads a free-form amount such as "$250,000" or "250000.00". Amounts were always dollars.
+func ParseLegacyMoney(amount string) (Money, error) {
+	amount = strings.TrimPrefix(strings.Replace(strings.TrimSpace(amount), ",", "", -1), "$")
+	if amount == "" {
+		return Money{}, nil
+	}
+
+	minorUnits, err := parseFixedPoint(amount, minorUnitsFor(legacyCurrency), true)
+	if err != nil {
+		return Money{}, err
+	}
+
+	return Money{MinorUnits: minorUnits, Currency: legacyCurrency}, nil
+}
+
+// ParseLegacyRate reads a free-form rate such as "4.125%". Rates finer than a basis point are rounded.
+func ParseLegacyRate(rate string) (BasisPoints, error) {
+	rate = strings.TrimSuffix(strings.TrimSpace(rate), "%")
+	if rate == "" {
+		return 0, nil
+	}
+
+	basisPoints, err := parseFixedPoint(rate, 2, true)
+	return BasisPoints(basisPoints), err
+}
@@ -0,0 +1,199 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package decimal
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseLegacyMoney(t *testing.T) {
+	cases := []struct {
+		amount string
+		want   int64
+		fails  bool
+	}{
+		{amount: "$250,000", want: 25000000},
+		{amount: " 250000.00 ", want: 25000000},
+		{amount: "", want: 0},
+		{amount: "0.005", want: 1},
+		{amount: "0.004", want: 0},
+		{amount: "19.995", want: 2000},
+		{amount: "-12.345", want: -1235},
+		{amount: "-0.5", want: -50},
+		{amount: ".75", want: 75},
+		{amount: "92233720368547758.07", want: math.MaxInt64},
+		{amount: "92233720368547758.08", fails: true},
+		{amount: "92233720368547758.075", fails: true},
+		{amount: "TBD", fails: true},
+		{amount: "1.2.3", fails: true},
+		{amount: "-", fails: true},
+		{amount: "$-", fails: true},
+	}
+
+	for _, c := range cases {
+		money, err := ParseLegacyMoney(c.amount)
+		if c.fails {
+			if err == nil {
+				t.Errorf("ParseLegacyMoney(%q) = %v, want an error", c.amount, money)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("ParseLegacyMoney(%q): %s", c.amount, err)
+			continue
+		}
+
+		if money.MinorUnits != c.want {
+			t.Errorf("ParseLegacyMoney(%q) = %d minor units, want %d", c.amount, money.MinorUnits, c.want)
+		}
+
+		if c.amount != "" && money.Currency != legacyCurrency {
+			t.Errorf("ParseLegacyMoney(%q) currency = %q, want %q", c.amount, money.Currency, legacyCurrency)
+		}
+	}
+}
+
+func TestParseLegacyRate(t *testing.T) {
+	cases := []struct {
+		rate  string
+		want  BasisPoints
+		fails bool
+	}{
+		{rate: "4.5%", want: 450},
+		{rate: " 4.25 ", want: 425},
+		{rate: "", want: 0},
+		{rate: "4.125%", want: 413},
+		{rate: "4.124%", want: 412},
+		{rate: "4.995", want: 500},
+		{rate: "-1.255%", want: -126},
+		{rate: "92233720368547758.07", want: math.MaxInt64},
+		{rate: "92233720368547758.075", fails: true},
+		{rate: "100000000000000000000", fails: true},
+		{rate: "TBD", fails: true},
+		{rate: "4,5%", fails: true},
+		{rate: "%", want: 0},
+	}
+
+	for _, c := range cases {
+		rate, err := ParseLegacyRate(c.rate)
+		if c.fails {
+			if err == nil {
+				t.Errorf("ParseLegacyRate(%q) = %d, want an error", c.rate, rate)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("ParseLegacyRate(%q): %s", c.rate, err)
+			continue
+		}
+
+		if rate != c.want {
+			t.Errorf("ParseLegacyRate(%q) = %d, want %d", c.rate, rate, c.want)
+		}
+	}
+}
+
+func TestParseMoney(t *testing.T) {
+	cases := []struct {
+		amount   string
+		currency string
+		want     int64
+		fails    bool
+	}{
+		{amount: "250000.00", currency: "USD", want: 25000000},
+		{amount: "1000", currency: "JPY", want: 1000},
+		{amount: "1.234", currency: "KWD", want: 1234},
+		{amount: "-3.50", currency: "EUR", want: -350},
+		{amount: "0.005", currency: "USD", fails: true},
+		{amount: "1.5", currency: "JPY", fails: true},
+		{amount: "10", currency: "usd", fails: true},
+		{amount: "10", currency: "", fails: true},
+	}
+
+	for _, c := range cases {
+		money, err := ParseMoney(c.amount, c.currency)
+		if c.fails {
+			if err == nil {
+				t.Errorf("ParseMoney(%q, %q) = %v, want an error", c.amount, c.currency, money)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("ParseMoney(%q, %q): %s", c.amount, c.currency, err)
+			continue
+		}
+
+		if money.MinorUnits != c.want || money.Currency != c.currency {
+			t.Errorf("ParseMoney(%q, %q) = %+v, want %d %s", c.amount, c.currency, money, c.want, c.currency)
+		}
+	}
+}
+
+func TestMoneyArithmetic(t *testing.T) {
+	dollars := Money{MinorUnits: 1000, Currency: "USD"}
+	euros := Money{MinorUnits: 1000, Currency: "EUR"}
+
+	if _, err := dollars.Add(euros); err == nil {
+		t.Error("adding EUR to USD succeeded")
+	}
+
+	if _, err := dollars.Cmp(euros); err == nil {
+		t.Error("comparing EUR with USD succeeded")
+	}
+
+	if _, err := (Money{MinorUnits: math.MaxInt64, Currency: "USD"}).Add(Money{MinorUnits: 1, Currency: "USD"}); err == nil {
+		t.Error("adding past the largest amount succeeded")
+	}
+
+	if _, err := (Money{MinorUnits: math.MinInt64, Currency: "USD"}).Add(Money{MinorUnits: -1, Currency: "USD"}); err == nil {
+		t.Error("adding past the smallest amount succeeded")
+	}
+
+	sum, err := dollars.Add(Money{MinorUnits: -250, Currency: "USD"})
+	if err != nil || sum.MinorUnits != 750 {
+		t.Errorf("sum = %v, %v, want 7.50 USD", sum, err)
+	}
+
+	if cmp, err := sum.Cmp(dollars); err != nil || cmp != -1 {
+		t.Errorf("Cmp = %d, %v, want -1", cmp, err)
+	}
+
+	if err := (Money{MinorUnits: -1, Currency: "USD"}).Validate(); err == nil {
+		t.Error("a negative amount validated")
+	}
+}
+
+func TestFormatting(t *testing.T) {
+	cases := []struct {
+		got  string
+		want string
+	}{
+		{Money{MinorUnits: 25000000, Currency: "USD"}.String(), "250000.00 USD"},
+		{Money{MinorUnits: -5, Currency: "USD"}.String(), "-0.05 USD"},
+		{Money{MinorUnits: 1000, Currency: "JPY"}.String(), "1000 JPY"},
+		{Money{MinorUnits: math.MinInt64, Currency: "USD"}.String(), "-92233720368547758.08 USD"},
+		{BasisPoints(425).String(), "4.25%"},
+		{BasisPoints(-7).String(), "-0.07%"},
+	}
+
+	for _, c := range cases {
+		if c.got != c.want {
+			t.Errorf("formatted %q, want %q", c.got, c.want)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package events holds the chaincode event payloads emitted by the referral and mortgage chaincodes,
+// shared with the services that consume them.
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// SchemaVersion is the version of ReferralEvent and MortgageEvent the chaincodes write. Fields are only ever added within a
+// version, so a consumer can decode any payload whose version is not newer than the one it was built with.
+const SchemaVersion = 1
+
+// Referral event types. The event type is also the name the event is emitted under, so consumers can
+// register for just the types they need.
+const (
+	ReferralCreated       = "REFERRAL_CREATED"
+	ReferralStatusChanged = "REFERRAL_STATUS_CHANGED"
+	ReferralUpdated       = "REFERRAL_UPDATED"
+	DepartmentAdded       = "REFERRAL_DEPARTMENT_ADDED"
+	DepartmentRemoved     = "REFERRAL_DEPARTMENT_REMOVED"
+	MortgageLinked        = "REFERRAL_MORTGAGE_LINKED"
+	ReferralArchived      = "REFERRAL_ARCHIVED"
+	ReferralRestored      = "REFERRAL_RESTORED"
+	ReferralPurged        = "REFERRAL_PURGED"
+)
+
+// Mortgage event types, emitted by the mortgage chaincode under their own names like the referral events
+const (
+	MortgageApplicationCreated = "MORTGAGE_APPLICATION_CREATED"
+	MortgageStatusChanged      = "MORTGAGE_STATUS_CHANGED"
+	MortgagePropertyAttached   = "MORTGAGE_PROPERTY_ATTACHED"
+	MortgageApplicantAdded     = "MORTGAGE_APPLICANT_ADDED"
+	MortgageIncomeAdded        = "MORTGAGE_INCOME_ADDED"
+	MortgageRateLocked         = "MORTGAGE_RATE_LOCKED"
+)
+
+// ReferralEvent is the payload of every referral chaincode event. It never carries the customer's
+// personal details, consumers that need them read the referral.
+type ReferralEvent struct {
+	SchemaVersion int      `json:"schemaVersion"`
+	EventType     string   `json:"eventType"`
+	ReferralId    string   `json:"referralId"`
+	OldStatus     string   `json:"oldStatus"`
+	NewStatus     string   `json:"newStatus"`
+	Departments   []string `json:"departments"`
+	Version       int64    `json:"version"`
+	TxId          string   `json:"txId"`
+	Timestamp     int64    `json:"timestamp"`
+}
+
+// Encode returns the event payload, stamped with the current schema version
+func (e ReferralEvent) Encode() ([]byte, error) {
+	e.SchemaVersion = SchemaVersion
+	return json.Marshal(e)
+}
+
+// Decode parses an event payload, rejecting payloads written with a newer schema than this package knows
+func Decode(payload []byte) (ReferralEvent, error) {
+	var event ReferralEvent
+	err := json.Unmarshal(payload, &event)
+	if err != nil {
+		return event, err
+	}
+
+	if event.SchemaVersion < 1 || event.SchemaVersion > SchemaVersion {
+		return event, fmt.Errorf("unsupported referral event schema version %d", event.SchemaVersion)
+	}
+
+	if event.EventType == "" || event.ReferralId == "" {
+		return event, errors.New("referral event is missing its eventType or referralId")
+	}
+
+	return event, nil
+}
+
+// MortgageEvent is the payload of every mortgage chaincode event. The mortgage chaincode updates the linked
+// referral by invoking the referral chaincode, and only the event of the chaincode a transaction was sent
+// to is recorded, so the event also carries the referral event for the change it made to the referral.
+// ReferralStatus is the status the application moved the referral to. Events written before Referral was
+// added only carry ReferralStatus.
+type MortgageEvent struct {
+	SchemaVersion  int            `json:"schemaVersion"`
+	EventType      string         `json:"eventType"`
+	MortgageNumber string         `json:"mortgageNumber"`
+	ReferralId     string         `json:"referralId"`
+	OldStatus      string         `json:"oldStatus"`
+	NewStatus      string         `json:"newStatus"`
+	ReferralStatus string         `json:"referralStatus,omitempty"`
+	Referral       *ReferralEvent `json:"referral,omitempty"`
+	TxId           string         `json:"txId"`
+	Timestamp      int64          `json:"timestamp"`
+}
+
+// Encode returns the event payload, stamped with the current schema version
+func (e MortgageEvent) Encode() ([]byte, error) {
+	e.SchemaVersion = SchemaVersion
+	return json.Marshal(e)
+}
+
+// DecodeMortgage parses a mortgage event payload, rejecting payloads written with a newer schema than this
+// package knows
+func DecodeMortgage(payload []byte) (MortgageEvent, error) {
+	var event MortgageEvent
+	err := json.Unmarshal(payload, &event)
+	if err != nil {
+		return event, err
+	}
+
+	if event.SchemaVersion < 1 || event.SchemaVersion > SchemaVersion {
+		return event, fmt.Errorf("unsupported mortgage event schema version %d", event.SchemaVersion)
+	}
+
+	if event.EventType == "" || event.MortgageNumber == "" {
+		return event, errors.New("mortgage event is missing its eventType or mortgageNumber")
+	}
+
+	if event.Referral != nil && (event.Referral.EventType == "" || event.Referral.ReferralId != event.ReferralId) {
+		return event, errors.New("mortgage event carries a referral event for another referral")
+	}
+
+	return event, nil
+}
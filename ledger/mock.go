@@ -0,0 +1,373 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// MockChaincodeName is the name the chaincode under test is deployed as on the mock ledger
+const MockChaincodeName = "mock"
+
+// MockChaincode answers the calls a chaincode under test makes to another chaincode
+type MockChaincode func(function string, args []string) ([]byte, error)
+
+// MockEvent is the event set by a committed transaction
+type MockEvent struct {
+	TxID    string
+	Name    string
+	Payload []byte
+}
+
+// pendingWrite is a write buffered until its transaction commits
+type pendingWrite struct {
+	value   []byte
+	deleted bool
+}
+
+// MockStub is an in-memory ledger for one chaincode. Functions run in a transaction through Invoke or
+// Query. Like the peer, a transaction only reads the committed state, never its own writes, and its writes
+// and event are only committed if the function succeeds. Queries cannot write, and a transaction cannot both
+// write state and run a paged range query.
+type MockStub struct {
+	// State is the committed world state
+	State map[string][]byte
+	// Events holds the event of every committed transaction that set one, in commit order
+	Events []MockEvent
+	// Attributes are the attributes of the caller's transaction certificate
+	Attributes map[string][]byte
+	// Certificate is the caller's transaction certificate
+	Certificate []byte
+	// Metadata is the metadata the caller attached to the transaction
+	Metadata []byte
+	// Chaincodes answers InvokeChaincode and QueryChaincode, by chaincode name
+	Chaincodes map[string]MockChaincode
+	// InvokedChaincode is the chaincode the caller's proposal invoked, another chaincode calling this one
+	// when it is set
+	InvokedChaincode string
+	// Time is the transaction timestamp in seconds
+	Time int64
+	// EndorserTime is the endorsing peer's clock in seconds, the transaction timestamp when it is 0
+	EndorserTime int64
+
+	txCount  int
+	txID     string
+	inTx     bool
+	readOnly bool
+	paged    bool
+	writes   map[string]pendingWrite
+	event    *MockEvent
+}
+
+// NewMockStub returns an empty ledger with a caller that has no attributes
+func NewMockStub() *MockStub {
+	return &MockStub{
+		State:      map[string][]byte{},
+		Attributes: map[string][]byte{},
+		Chaincodes: map[string]MockChaincode{},
+	}
+}
+
+// SetCaller replaces the caller's certificate attributes. The certificate is derived from them, so
+// callers with the same attributes have the same identity.
+func (s *MockStub) SetCaller(attributes map[string]string) {
+	s.Attributes = map[string][]byte{}
+	for name, value := range attributes {
+		s.Attributes[name] = []byte(value)
+	}
+
+	s.Certificate = []byte(fmt.Sprint(attributes))
+}
+
+// Invoke runs a function in a transaction, committing its writes and event if it succeeds
+func (s *MockStub) Invoke(function func(stub Stub) ([]byte, error)) ([]byte, error) {
+	return s.transact(false, function)
+}
+
+// Query runs a function in a read only transaction
+func (s *MockStub) Query(function func(stub Stub) ([]byte, error)) ([]byte, error) {
+	return s.transact(true, function)
+}
+
+// LastEvent returns the event of the last committed transaction that set one, or nil if there is none
+func (s *MockStub) LastEvent() *MockEvent {
+	if len(s.Events) == 0 {
+		return nil
+	}
+
+	return &s.Events[len(s.Events)-1]
+}
+
+func (s *MockStub) transact(readOnly bool, function func(stub Stub) ([]byte, error)) ([]byte, error) {
+	s.txCount++
+	s.txID = fmt.Sprintf("tx%d", s.txCount)
+	s.inTx = true
+	s.readOnly = readOnly
+	s.paged = false
+	s.writes = map[string]pendingWrite{}
+	s.event = nil
+
+	defer func() {
+		s.inTx = false
+		s.writes = nil
+		s.event = nil
+	}()
+
+	result, err := function(s)
+	if err != nil {
+		return nil, err
+	}
+
+	for key, write := range s.writes {
+		if write.deleted {
+			delete(s.State, key)
+		} else {
+			s.State[key] = write.value
+		}
+	}
+
+	if s.event != nil {
+		s.Events = append(s.Events, *s.event)
+	}
+
+	return result, nil
+}
+
+// checkWrite fails writes outside an invoke transaction
+func (s *MockStub) checkWrite() error {
+	if !s.inTx {
+		return errors.New("mock ledger: write outside a transaction")
+	}
+
+	if s.readOnly {
+		return errors.New("mock ledger: write in a query transaction")
+	}
+
+	return nil
+}
+
+// checkStateWrite fails state writes where checkWrite does, and after a paged range query
+func (s *MockStub) checkStateWrite() error {
+	if s.paged {
+		return errors.New("mock ledger: write in a transaction that ran a paged query")
+	}
+
+	return s.checkWrite()
+}
+
+func (s *MockStub) GetTxID() string {
+	return s.txID
+}
+
+func (s *MockStub) GetTxTimestamp() (*timestamppb.Timestamp, error) {
+	return &timestamppb.Timestamp{Seconds: s.Time}, nil
+}
+
+func (s *MockStub) GetEndorserTime() time.Time {
+	if s.EndorserTime == 0 {
+		return time.Unix(s.Time, 0)
+	}
+
+	return time.Unix(s.EndorserTime, 0)
+}
+
+func (s *MockStub) GetState(key string) ([]byte, error) {
+	return s.State[key], nil
+}
+
+func (s *MockStub) PutState(key string, value []byte) error {
+	err := s.checkStateWrite()
+	if err != nil {
+		return err
+	}
+
+	if key == "" {
+		return errors.New("mock ledger: key must not be empty")
+	}
+
+	s.writes[key] = pendingWrite{value: append([]byte{}, value...)}
+	return nil
+}
+
+func (s *MockStub) DelState(key string) error {
+	err := s.checkStateWrite()
+	if err != nil {
+		return err
+	}
+
+	s.writes[key] = pendingWrite{deleted: true}
+	return nil
+}
+
+// checkRange fails a range over composite keys unless it covers every key under a prefix. The peer only
+// range scans simple keys, and the shim adapter runs a scan of a whole prefix as a partial composite key
+// query, so no other range over composite keys can be run.
+func checkRange(startKey, endKey string) error {
+	composite := strings.HasPrefix(startKey, compositeKeyNamespace) || strings.HasPrefix(endKey, compositeKeyNamespace)
+	if composite && endKey != startKey+maxUnicodeRune {
+		return errors.New("mock ledger: composite keys can only be range scanned by prefix")
+	}
+
+	return nil
+}
+
+// RangeQueryState returns the committed keys from startKey up to but not including endKey, in key order
+func (s *MockStub) RangeQueryState(startKey, endKey string) (StateRangeQueryIterator, error) {
+	err := checkRange(startKey, endKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.rangeQuery(startKey, endKey, 0), nil
+}
+
+// RangeQueryStatePage returns up to pageSize of the committed keys from startKey up to but not including
+// endKey, starting at the bookmark if one is given. Like the peer, the bookmark of the next page is the key
+// it starts at, empty once the range is exhausted, and the transaction must not write before or after.
+func (s *MockStub) RangeQueryStatePage(startKey, endKey string, pageSize int32, bookmark string) (StateRangeQueryIterator, string, error) {
+	if len(s.writes) > 0 {
+		return nil, "", errors.New("mock ledger: paged query in a transaction that wrote")
+	}
+
+	if pageSize < 1 {
+		return nil, "", errors.New("mock ledger: page size must be positive")
+	}
+
+	err := checkRange(startKey, endKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	s.paged = true
+	if bookmark > startKey {
+		startKey = bookmark
+	}
+
+	iterator := s.rangeQuery(startKey, endKey, int(pageSize)+1)
+	if len(iterator.keys) <= int(pageSize) {
+		return iterator, "", nil
+	}
+
+	next := iterator.keys[pageSize]
+	iterator.keys = iterator.keys[:pageSize]
+	iterator.values = iterator.values[:pageSize]
+	return iterator, next, nil
+}
+
+// rangeQuery returns an iterator over the committed keys in the range, at most limit of them unless it is 0
+func (s *MockStub) rangeQuery(startKey, endKey string, limit int) *mockIterator {
+	keys := []string{}
+	for key := range s.State {
+		if key >= startKey && key < endKey {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+
+	iterator := &mockIterator{}
+	for _, key := range keys {
+		iterator.keys = append(iterator.keys, key)
+		iterator.values = append(iterator.values, s.State[key])
+	}
+
+	return iterator
+}
+
+func (s *MockStub) InvokeChaincode(chaincodeName string, function string, args []string) ([]byte, error) {
+	chaincode, ok := s.Chaincodes[chaincodeName]
+	if !ok {
+		return nil, errors.New("mock ledger: unknown chaincode " + chaincodeName)
+	}
+
+	return chaincode(function, args)
+}
+
+func (s *MockStub) QueryChaincode(chaincodeName string, function string, args []string) ([]byte, error) {
+	return s.InvokeChaincode(chaincodeName, function, args)
+}
+
+// GetInvokedChaincode returns InvokedChaincode, or the mock's own name when the caller invoked it directly
+func (s *MockStub) GetInvokedChaincode() (string, error) {
+	if s.InvokedChaincode == "" {
+		return MockChaincodeName, nil
+	}
+
+	return s.InvokedChaincode, nil
+}
+
+// SetEvent sets the transaction's event, replacing any event set earlier in the transaction
+func (s *MockStub) SetEvent(name string, payload []byte) error {
+	err := s.checkWrite()
+	if err != nil {
+		return err
+	}
+
+	if name == "" {
+		return errors.New("mock ledger: event name must not be empty")
+	}
+
+	s.event = &MockEvent{TxID: s.txID, Name: name, Payload: payload}
+	return nil
+}
+
+func (s *MockStub) ReadCertAttribute(attributeName string) ([]byte, error) {
+	value, ok := s.Attributes[attributeName]
+	if !ok {
+		return nil, errors.New("mock ledger: certificate has no attribute " + attributeName)
+	}
+
+	return value, nil
+}
+
+func (s *MockStub) GetCallerCertificate() ([]byte, error) {
+	return s.Certificate, nil
+}
+
+func (s *MockStub) GetCallerMetadata() ([]byte, error) {
+	return s.Metadata, nil
+}
+
+// mockIterator iterates over a snapshot of the keys a range query matched
+type mockIterator struct {
+	keys   []string
+	values [][]byte
+	next   int
+}
+
+func (i *mockIterator) HasNext() bool {
+	return i.next < len(i.keys)
+}
+
+func (i *mockIterator) Next() (string, []byte, error) {
+	if !i.HasNext() {
+		return "", nil, errors.New("mock ledger: iterator is exhausted")
+	}
+
+	i.next++
+	return i.keys[i.next-1], i.values[i.next-1], nil
+}
+
+func (i *mockIterator) Close() error {
+	return nil
+}
@@ -0,0 +1,341 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ledger
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// rangeKeys returns the keys a range query matches, in iteration order
+func rangeKeys(t *testing.T, stub Stub, startKey string, endKey string) []string {
+	iter, err := stub.RangeQueryState(startKey, endKey)
+	if err != nil {
+		t.Fatalf("RangeQueryState: %s", err)
+	}
+	defer iter.Close()
+
+	keys := []string{}
+	for iter.HasNext() {
+		key, _, err := iter.Next()
+		if err != nil {
+			t.Fatalf("Next: %s", err)
+		}
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+func TestMockCommitsSuccessfulInvoke(t *testing.T) {
+	stub := NewMockStub()
+
+	_, err := stub.Invoke(func(stub Stub) ([]byte, error) {
+		err := stub.PutState("a", []byte("1"))
+		if err != nil {
+			return nil, err
+		}
+		return nil, stub.SetEvent("CREATED", []byte("a"))
+	})
+	if err != nil {
+		t.Fatalf("Invoke: %s", err)
+	}
+
+	if string(stub.State["a"]) != "1" {
+		t.Errorf("State[a] = %q, want %q", stub.State["a"], "1")
+	}
+
+	event := stub.LastEvent()
+	if event == nil || event.Name != "CREATED" || event.TxID != "tx1" || string(event.Payload) != "a" {
+		t.Errorf("LastEvent() = %+v, want CREATED from tx1", event)
+	}
+}
+
+func TestMockRollsBackFailedInvoke(t *testing.T) {
+	stub := NewMockStub()
+	stub.State["a"] = []byte("1")
+
+	_, err := stub.Invoke(func(stub Stub) ([]byte, error) {
+		stub.PutState("a", []byte("2"))
+		stub.PutState("b", []byte("2"))
+		stub.DelState("a")
+		stub.SetEvent("CHANGED", nil)
+		return nil, errors.New("failed")
+	})
+	if err == nil {
+		t.Fatal("Invoke succeeded, want the function's error")
+	}
+
+	want := map[string][]byte{"a": []byte("1")}
+	if !reflect.DeepEqual(stub.State, want) {
+		t.Errorf("State = %q, want %q", stub.State, want)
+	}
+
+	if len(stub.Events) != 0 {
+		t.Errorf("Events = %+v, want none", stub.Events)
+	}
+}
+
+func TestMockReadsCommittedState(t *testing.T) {
+	stub := NewMockStub()
+	stub.State["a"] = []byte("1")
+	stub.State["b"] = []byte("1")
+
+	_, err := stub.Invoke(func(stub Stub) ([]byte, error) {
+		stub.PutState("a", []byte("2"))
+		stub.PutState("c", []byte("2"))
+		stub.DelState("b")
+
+		value, _ := stub.GetState("a")
+		if string(value) != "1" {
+			t.Errorf("GetState(a) = %q, want the committed value", value)
+		}
+
+		value, _ = stub.GetState("b")
+		if string(value) != "1" {
+			t.Errorf("GetState(b) = %q, want the committed value until the delete commits", value)
+		}
+
+		value, _ = stub.GetState("c")
+		if value != nil {
+			t.Errorf("GetState(c) = %q, want nil until the write commits", value)
+		}
+
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatalf("Invoke: %s", err)
+	}
+}
+
+func TestMockRangeQuery(t *testing.T) {
+	stub := NewMockStub()
+	for _, key := range []string{"k3", "k1", "k5", "j9", "l0"} {
+		stub.State[key] = []byte(key)
+	}
+
+	_, err := stub.Invoke(func(stub Stub) ([]byte, error) {
+		stub.PutState("k2", []byte("k2"))
+		stub.DelState("k3")
+
+		keys := rangeKeys(t, stub, "k", "l")
+		want := []string{"k1", "k3", "k5"}
+		if !reflect.DeepEqual(keys, want) {
+			t.Errorf("range k to l = %q, want the committed keys %q", keys, want)
+		}
+
+		keys = rangeKeys(t, stub, "k1", "k5")
+		want = []string{"k1", "k3"}
+		if !reflect.DeepEqual(keys, want) {
+			t.Errorf("range k1 to k5 = %q, want %q, the end key is excluded", keys, want)
+		}
+
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatalf("Invoke: %s", err)
+	}
+}
+
+func TestMockRangeQueryPages(t *testing.T) {
+	stub := NewMockStub()
+	for _, key := range []string{"k3", "k1", "k5", "j9", "l0"} {
+		stub.State[key] = []byte(key)
+	}
+
+	_, err := stub.Query(func(stub Stub) ([]byte, error) {
+		var pages [][]string
+		bookmark := ""
+		for {
+			iter, next, err := stub.RangeQueryStatePage("k", "l", 2, bookmark)
+			if err != nil {
+				t.Fatalf("RangeQueryStatePage: %s", err)
+			}
+
+			var keys []string
+			for iter.HasNext() {
+				key, _, _ := iter.Next()
+				keys = append(keys, key)
+			}
+			pages = append(pages, keys)
+
+			if next == "" {
+				break
+			}
+			bookmark = next
+		}
+
+		want := [][]string{{"k1", "k3"}, {"k5"}}
+		if !reflect.DeepEqual(pages, want) {
+			t.Errorf("pages = %q, want %q", pages, want)
+		}
+
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatalf("Query: %s", err)
+	}
+}
+
+func TestMockCompositeRangesArePrefixes(t *testing.T) {
+	stub := NewMockStub()
+	prefix := compositeKeyNamespace + "status" + compositeKeyNamespace
+	stub.State[prefix+"NEW"+compositeKeyNamespace+"R1"+compositeKeyNamespace] = []byte{0}
+
+	_, err := stub.Query(func(stub Stub) ([]byte, error) {
+		if keys := rangeKeys(t, stub, prefix, prefix+maxUnicodeRune); len(keys) != 1 {
+			t.Errorf("prefix scan = %q, want the one entry", keys)
+		}
+
+		ranges := [][2]string{
+			{prefix + "NEW" + compositeKeyNamespace, prefix + maxUnicodeRune},
+			{prefix, prefix + "O"},
+			{"a", prefix},
+		}
+		for _, r := range ranges {
+			if _, err := stub.RangeQueryState(r[0], r[1]); err == nil {
+				t.Errorf("range %q to %q succeeded, the peer only scans composite keys by prefix", r[0], r[1])
+			}
+
+			if _, _, err := stub.RangeQueryStatePage(r[0], r[1], 1, ""); err == nil {
+				t.Errorf("paged range %q to %q succeeded, the peer only scans composite keys by prefix", r[0], r[1])
+			}
+		}
+
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatalf("Query: %s", err)
+	}
+}
+
+func TestMockPagedQueriesCannotWrite(t *testing.T) {
+	stub := NewMockStub()
+
+	_, err := stub.Invoke(func(stub Stub) ([]byte, error) {
+		if _, _, err := stub.RangeQueryStatePage("a", "b", 1, ""); err != nil {
+			t.Fatalf("RangeQueryStatePage: %s", err)
+		}
+
+		if err := stub.PutState("a", []byte("1")); err == nil {
+			t.Error("PutState after a paged query succeeded")
+		}
+
+		return nil, stub.SetEvent("CHECKED", nil)
+	})
+	if err != nil {
+		t.Fatalf("Invoke: %s", err)
+	}
+
+	_, err = stub.Invoke(func(stub Stub) ([]byte, error) {
+		if err := stub.PutState("a", []byte("1")); err != nil {
+			t.Fatalf("PutState: %s", err)
+		}
+
+		if _, _, err := stub.RangeQueryStatePage("a", "b", 1, ""); err == nil {
+			t.Error("paged query after a write succeeded")
+		}
+
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatalf("Invoke: %s", err)
+	}
+}
+
+func TestMockWritesNeedAnInvoke(t *testing.T) {
+	stub := NewMockStub()
+
+	err := stub.PutState("a", []byte("1"))
+	if err == nil {
+		t.Error("PutState outside a transaction succeeded")
+	}
+
+	_, err = stub.Query(func(stub Stub) ([]byte, error) {
+		err := stub.PutState("a", []byte("1"))
+		if err == nil {
+			t.Error("PutState in a query succeeded")
+		}
+
+		err = stub.SetEvent("CREATED", nil)
+		if err == nil {
+			t.Error("SetEvent in a query succeeded")
+		}
+
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatalf("Query: %s", err)
+	}
+
+	if len(stub.State) != 0 || len(stub.Events) != 0 {
+		t.Errorf("State = %q, Events = %+v, want both empty", stub.State, stub.Events)
+	}
+}
+
+func TestMockLastEventWins(t *testing.T) {
+	stub := NewMockStub()
+
+	_, err := stub.Invoke(func(stub Stub) ([]byte, error) {
+		stub.SetEvent("FIRST", nil)
+		return nil, stub.SetEvent("SECOND", nil)
+	})
+	if err != nil {
+		t.Fatalf("Invoke: %s", err)
+	}
+
+	if len(stub.Events) != 1 || stub.Events[0].Name != "SECOND" {
+		t.Errorf("Events = %+v, want only SECOND", stub.Events)
+	}
+}
+
+func TestMockCaller(t *testing.T) {
+	stub := NewMockStub()
+	stub.SetCaller(map[string]string{"role": "admin"})
+
+	_, err := stub.Query(func(stub Stub) ([]byte, error) {
+		value, err := stub.ReadCertAttribute("role")
+		if err != nil || string(value) != "admin" {
+			t.Errorf("ReadCertAttribute(role) = %q, %v, want admin", value, err)
+		}
+
+		_, err = stub.ReadCertAttribute("department")
+		if err == nil {
+			t.Error("ReadCertAttribute(department) succeeded for a missing attribute")
+		}
+
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatalf("Query: %s", err)
+	}
+}
+
+func TestMockTransactionIds(t *testing.T) {
+	stub := NewMockStub()
+
+	var txIDs []string
+	for i := 0; i < 3; i++ {
+		stub.Query(func(stub Stub) ([]byte, error) {
+			txIDs = append(txIDs, stub.GetTxID())
+			return nil, nil
+		})
+	}
+
+	want := []string{"tx1", "tx2", "tx3"}
+	if !reflect.DeepEqual(txIDs, want) {
+		t.Errorf("transaction ids = %q, want %q", txIDs, want)
+	}
+}
@@ -0,0 +1,57 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ledger
+
+import (
+	"strconv"
+)
+
+// AllocateSequence advances the counter stored under key to the first value after it that inUse reports
+// free, stores the counter and returns the value. The peer does not show a transaction its own writes, so
+// the counter is read once, advanced in memory past the values already in use and written back once.
+// Every peer reads and writes the same counter in transaction order, so they all allocate the same value.
+func AllocateSequence(stub Stub, key string, inUse func(sequence int64) (bool, error)) (int64, error) {
+	valAsbytes, err := stub.GetState(key)
+	if err != nil {
+		return 0, err
+	}
+
+	var sequence int64
+	if valAsbytes != nil {
+		sequence, err = strconv.ParseInt(string(valAsbytes), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for {
+		sequence++
+
+		used, err := inUse(sequence)
+		if err != nil {
+			return 0, err
+		}
+
+		if !used {
+			break
+		}
+	}
+
+	err = stub.PutState(key, []byte(strconv.FormatInt(sequence, 10)))
+	if err != nil {
+		return 0, err
+	}
+
+	return sequence, nil
+}
@@ -0,0 +1,83 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ledger
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestAllocateSequenceSkipsValuesInUse(t *testing.T) {
+	stub := NewMockStub()
+	stub.State["seq"] = []byte("4")
+
+	var checked []int64
+	result, err := stub.Invoke(func(stub Stub) ([]byte, error) {
+		sequence, err := AllocateSequence(stub, "seq", func(sequence int64) (bool, error) {
+			checked = append(checked, sequence)
+			return sequence < 7, nil
+		})
+		return []byte{byte(sequence)}, err
+	})
+	if err != nil {
+		t.Fatalf("AllocateSequence: %s", err)
+	}
+
+	if result[0] != 7 || string(stub.State["seq"]) != "7" {
+		t.Errorf("allocated %d and stored %q, want 7", result[0], stub.State["seq"])
+	}
+
+	if want := []int64{5, 6, 7}; !reflect.DeepEqual(checked, want) {
+		t.Errorf("checked %v, want %v", checked, want)
+	}
+}
+
+func TestAllocateSequenceStartsAtOne(t *testing.T) {
+	stub := NewMockStub()
+
+	_, err := stub.Invoke(func(stub Stub) ([]byte, error) {
+		_, err := AllocateSequence(stub, "seq", func(sequence int64) (bool, error) { return false, nil })
+		return nil, err
+	})
+	if err != nil {
+		t.Fatalf("AllocateSequence: %s", err)
+	}
+
+	if string(stub.State["seq"]) != "1" {
+		t.Errorf("stored %q, want 1", stub.State["seq"])
+	}
+}
+
+func TestAllocateSequenceFailures(t *testing.T) {
+	stub := NewMockStub()
+	stub.State["bad"] = []byte("x")
+
+	_, err := stub.Invoke(func(stub Stub) ([]byte, error) {
+		_, err := AllocateSequence(stub, "bad", func(sequence int64) (bool, error) { return false, nil })
+		return nil, err
+	})
+	if err == nil {
+		t.Error("allocating from a counter that is not a number succeeded")
+	}
+
+	lookup := errors.New("lookup failed")
+	_, err = stub.Invoke(func(stub Stub) ([]byte, error) {
+		_, err := AllocateSequence(stub, "seq", func(sequence int64) (bool, error) { return false, lookup })
+		return nil, err
+	})
+	if err != lookup {
+		t.Errorf("err = %v, want the lookup's error", err)
+	}
+}
@@ -0,0 +1,242 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package ledger holds the stub interface the chaincodes are written against, with an adapter for the
+// peer's stub and an in-memory mock ledger for tests.
+package ledger
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-chaincode-go/pkg/cid"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// MetadataTransientKey is the transient data entry clients put the transaction metadata in. Transient
+// data reaches the chaincode without being written to the ledger.
+const MetadataTransientKey = "metadata"
+
+const (
+	compositeKeyNamespace = "\x00"
+	maxUnicodeRune        = "\U0010FFFF"
+)
+
+// StateRangeQueryIterator iterates over the keys and values returned by a range query
+type StateRangeQueryIterator interface {
+	HasNext() bool
+	Next() (string, []byte, error)
+	Close() error
+}
+
+// Stub is the part of the chaincode stub the chaincodes use
+type Stub interface {
+	GetTxID() string
+	GetTxTimestamp() (*timestamppb.Timestamp, error)
+	GetEndorserTime() time.Time
+
+	GetState(key string) ([]byte, error)
+	PutState(key string, value []byte) error
+	DelState(key string) error
+	RangeQueryState(startKey, endKey string) (StateRangeQueryIterator, error)
+	RangeQueryStatePage(startKey, endKey string, pageSize int32, bookmark string) (StateRangeQueryIterator, string, error)
+
+	InvokeChaincode(chaincodeName string, function string, args []string) ([]byte, error)
+	QueryChaincode(chaincodeName string, function string, args []string) ([]byte, error)
+	GetInvokedChaincode() (string, error)
+
+	SetEvent(name string, payload []byte) error
+
+	ReadCertAttribute(attributeName string) ([]byte, error)
+	GetCallerCertificate() ([]byte, error)
+	GetCallerMetadata() ([]byte, error)
+}
+
+// shimStub adapts the peer's stub to Stub
+type shimStub struct {
+	shim.ChaincodeStubInterface
+}
+
+// FromShim returns the Stub for the stub the peer passes to the chaincode's entry points
+func FromShim(stub shim.ChaincodeStubInterface) Stub {
+	return shimStub{stub}
+}
+
+// compositePrefix returns the object type and attributes of a scan of every key under a composite key
+// prefix. The peer only range scans simple keys, so such a scan is run as a partial composite key query.
+func (s shimStub) compositePrefix(startKey, endKey string) (string, []string, bool, error) {
+	if !strings.HasPrefix(startKey, compositeKeyNamespace) || endKey != startKey+maxUnicodeRune {
+		return "", nil, false, nil
+	}
+
+	objectType, attributes, err := s.SplitCompositeKey(startKey)
+	if err != nil {
+		return "", nil, false, err
+	}
+
+	return objectType, attributes, true, nil
+}
+
+// RangeQueryState returns the keys from startKey up to but not including endKey
+func (s shimStub) RangeQueryState(startKey, endKey string) (StateRangeQueryIterator, error) {
+	objectType, attributes, composite, err := s.compositePrefix(startKey, endKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var iterator shim.StateQueryIteratorInterface
+	if composite {
+		iterator, err = s.GetStateByPartialCompositeKey(objectType, attributes)
+	} else {
+		iterator, err = s.GetStateByRange(startKey, endKey)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return shimIterator{iterator}, nil
+}
+
+// RangeQueryStatePage returns up to pageSize of the keys from startKey up to but not including endKey,
+// resuming at the bookmark of the previous page if one is given. It also returns the bookmark of the next
+// page, empty once the range is exhausted. The peer refuses paged queries in transactions that write.
+func (s shimStub) RangeQueryStatePage(startKey, endKey string, pageSize int32, bookmark string) (StateRangeQueryIterator, string, error) {
+	objectType, attributes, composite, err := s.compositePrefix(startKey, endKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var iterator shim.StateQueryIteratorInterface
+	var metadata *pb.QueryResponseMetadata
+	if composite {
+		iterator, metadata, err = s.GetStateByPartialCompositeKeyWithPagination(objectType, attributes, pageSize, bookmark)
+	} else {
+		iterator, metadata, err = s.GetStateByRangeWithPagination(startKey, endKey, pageSize, bookmark)
+	}
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return shimIterator{iterator}, metadata.GetBookmark(), nil
+}
+
+// GetEndorserTime returns the endorsing peer's clock. The transaction timestamp is set by the client, so
+// this is what it can be checked against. Endorsing peers read their own clocks, so near a bound they can
+// disagree and the transaction then fails endorsement.
+func (s shimStub) GetEndorserTime() time.Time {
+	return time.Now()
+}
+
+// InvokeChaincode calls a function of another chaincode on the same channel
+func (s shimStub) InvokeChaincode(chaincodeName string, function string, args []string) ([]byte, error) {
+	callArgs := [][]byte{[]byte(function)}
+	for _, arg := range args {
+		callArgs = append(callArgs, []byte(arg))
+	}
+
+	response := s.ChaincodeStubInterface.InvokeChaincode(chaincodeName, callArgs, "")
+	if response.Status != shim.OK {
+		return nil, errors.New(response.Message)
+	}
+
+	return response.Payload, nil
+}
+
+// QueryChaincode calls a function of another chaincode. The peer no longer tells queries and invokes
+// apart, a query is an invoke that writes nothing.
+func (s shimStub) QueryChaincode(chaincodeName string, function string, args []string) ([]byte, error) {
+	return s.InvokeChaincode(chaincodeName, function, args)
+}
+
+// GetInvokedChaincode returns the name of the chaincode the client's proposal invoked. While another
+// chaincode is calling this one, that is the calling chaincode rather than this one.
+func (s shimStub) GetInvokedChaincode() (string, error) {
+	signedProposal, err := s.GetSignedProposal()
+	if err != nil {
+		return "", err
+	}
+
+	var proposal pb.Proposal
+	err = proto.Unmarshal(signedProposal.GetProposalBytes(), &proposal)
+	if err != nil {
+		return "", err
+	}
+
+	var payload pb.ChaincodeProposalPayload
+	err = proto.Unmarshal(proposal.GetPayload(), &payload)
+	if err != nil {
+		return "", err
+	}
+
+	var invocation pb.ChaincodeInvocationSpec
+	err = proto.Unmarshal(payload.GetInput(), &invocation)
+	if err != nil {
+		return "", err
+	}
+
+	name := invocation.GetChaincodeSpec().GetChaincodeId().GetName()
+	if name == "" {
+		return "", errors.New("proposal does not name the chaincode it invokes")
+	}
+
+	return name, nil
+}
+
+// ReadCertAttribute returns an attribute of the caller's certificate, failing if it does not carry it
+func (s shimStub) ReadCertAttribute(attributeName string) ([]byte, error) {
+	value, found, err := cid.GetAttributeValue(s.ChaincodeStubInterface, attributeName)
+	if err != nil {
+		return nil, err
+	}
+
+	if !found {
+		return nil, errors.New("certificate has no attribute " + attributeName)
+	}
+
+	return []byte(value), nil
+}
+
+// GetCallerCertificate returns the caller's serialized identity
+func (s shimStub) GetCallerCertificate() ([]byte, error) {
+	return s.GetCreator()
+}
+
+// GetCallerMetadata returns the transaction metadata the caller passed as transient data
+func (s shimStub) GetCallerMetadata() ([]byte, error) {
+	transient, err := s.GetTransient()
+	if err != nil {
+		return nil, err
+	}
+
+	return transient[MetadataTransientKey], nil
+}
+
+// shimIterator adapts the peer's query iterator to StateRangeQueryIterator
+type shimIterator struct {
+	shim.StateQueryIteratorInterface
+}
+
+func (i shimIterator) Next() (string, []byte, error) {
+	kv, err := i.StateQueryIteratorInterface.Next()
+	if err != nil {
+		return "", nil, err
+	}
+
+	return kv.Key, kv.Value, nil
+}
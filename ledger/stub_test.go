@@ -0,0 +1,216 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package ledger
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// fakeShim records the calls the adapter makes to the peer's stub. Methods it does not override panic.
+type fakeShim struct {
+	shim.ChaincodeStubInterface
+	calls     []string
+	transient map[string][]byte
+	response  pb.Response
+	invoked   [][]byte
+	proposal  *pb.SignedProposal
+}
+
+func (f *fakeShim) GetStateByRange(startKey, endKey string) (shim.StateQueryIteratorInterface, error) {
+	f.calls = append(f.calls, "range "+startKey+" "+endKey)
+	return &fakeIterator{keys: []string{startKey}}, nil
+}
+
+func (f *fakeShim) GetStateByPartialCompositeKey(objectType string, keys []string) (shim.StateQueryIteratorInterface, error) {
+	f.calls = append(f.calls, "partial "+objectType+" "+strings.Join(keys, ","))
+	return &fakeIterator{keys: append([]string{objectType}, keys...)}, nil
+}
+
+func (f *fakeShim) GetStateByRangeWithPagination(startKey, endKey string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	f.calls = append(f.calls, fmt.Sprintf("range page %s %s %d %s", startKey, endKey, pageSize, bookmark))
+	return &fakeIterator{keys: []string{startKey}}, &pb.QueryResponseMetadata{Bookmark: "next"}, nil
+}
+
+func (f *fakeShim) GetStateByPartialCompositeKeyWithPagination(objectType string, keys []string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	f.calls = append(f.calls, fmt.Sprintf("partial page %s %s %d %s", objectType, strings.Join(keys, ","), pageSize, bookmark))
+	return &fakeIterator{keys: append([]string{objectType}, keys...)}, &pb.QueryResponseMetadata{Bookmark: "next"}, nil
+}
+
+func (f *fakeShim) SplitCompositeKey(compositeKey string) (string, []string, error) {
+	var components []string
+	start := 1
+	for i := 1; i < len(compositeKey); i++ {
+		if compositeKey[i] == 0 {
+			components = append(components, compositeKey[start:i])
+			start = i + 1
+		}
+	}
+	return components[0], components[1:], nil
+}
+
+func (f *fakeShim) InvokeChaincode(chaincodeName string, args [][]byte, channel string) pb.Response {
+	f.invoked = args
+	return f.response
+}
+
+func (f *fakeShim) GetSignedProposal() (*pb.SignedProposal, error) {
+	return f.proposal, nil
+}
+
+func (f *fakeShim) GetTransient() (map[string][]byte, error) {
+	return f.transient, nil
+}
+
+type fakeIterator struct {
+	keys []string
+	next int
+}
+
+func (i *fakeIterator) HasNext() bool {
+	return i.next < len(i.keys)
+}
+
+func (i *fakeIterator) Next() (*queryresult.KV, error) {
+	i.next++
+	return &queryresult.KV{Key: i.keys[i.next-1], Value: []byte("v")}, nil
+}
+
+func (i *fakeIterator) Close() error {
+	return nil
+}
+
+func TestShimRangeQueryOfCompositePrefix(t *testing.T) {
+	peer := &fakeShim{}
+	stub := FromShim(peer)
+
+	prefix := "\x00status\x00NEW\x00"
+	iter, err := stub.RangeQueryState(prefix, prefix+maxUnicodeRune)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	for iter.HasNext() {
+		key, value, err := iter.Next()
+		if err != nil || string(value) != "v" {
+			t.Fatalf("Next() = %q, %q, %v", key, value, err)
+		}
+		keys = append(keys, key)
+	}
+
+	if !reflect.DeepEqual(peer.calls, []string{"partial status NEW"}) || !reflect.DeepEqual(keys, []string{"status", "NEW"}) {
+		t.Errorf("calls %q scanning %q, want a partial composite key query for status NEW", peer.calls, keys)
+	}
+}
+
+func TestShimRangeQueryOfSimpleKeys(t *testing.T) {
+	peer := &fakeShim{}
+	stub := FromShim(peer)
+
+	_, err := stub.RangeQueryState("a", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(peer.calls, []string{"range a b"}) {
+		t.Errorf("calls %q, want a range query", peer.calls)
+	}
+}
+
+func TestShimRangeQueryPages(t *testing.T) {
+	peer := &fakeShim{}
+	stub := FromShim(peer)
+
+	prefix := "\x00status\x00NEW\x00"
+	_, bookmark, err := stub.RangeQueryStatePage(prefix, prefix+maxUnicodeRune, 50, "b1")
+	if err != nil || bookmark != "next" {
+		t.Fatalf("RangeQueryStatePage() bookmark %q, %v", bookmark, err)
+	}
+
+	_, _, err = stub.RangeQueryStatePage("a", "b", 10, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"partial page status NEW 50 b1", "range page a b 10 "}
+	if !reflect.DeepEqual(peer.calls, want) {
+		t.Errorf("calls %q, want %q", peer.calls, want)
+	}
+}
+
+func TestShimInvokeChaincode(t *testing.T) {
+	peer := &fakeShim{response: pb.Response{Status: shim.OK, Payload: []byte("done")}}
+	stub := FromShim(peer)
+
+	result, err := stub.InvokeChaincode("referral", "read", []string{"REF-1"})
+	if err != nil || string(result) != "done" {
+		t.Fatalf("InvokeChaincode() = %q, %v", result, err)
+	}
+
+	if len(peer.invoked) != 2 || string(peer.invoked[0]) != "read" || string(peer.invoked[1]) != "REF-1" {
+		t.Errorf("invoked with %q, want the function then its arguments", peer.invoked)
+	}
+
+	peer.response = pb.Response{Status: 500, Message: `{"code":"NOT_FOUND"}`}
+	_, err = stub.QueryChaincode("referral", "read", []string{"REF-2"})
+	if err == nil || err.Error() != `{"code":"NOT_FOUND"}` {
+		t.Errorf("err = %v, want the called chaincode's message", err)
+	}
+}
+
+func TestShimCallerMetadata(t *testing.T) {
+	peer := &fakeShim{transient: map[string][]byte{MetadataTransientKey: []byte(`{"piiKey":"k"}`)}}
+
+	metadata, err := FromShim(peer).GetCallerMetadata()
+	if err != nil || string(metadata) != `{"piiKey":"k"}` {
+		t.Errorf("GetCallerMetadata() = %q, %v", metadata, err)
+	}
+}
+
+// signedProposal returns a proposal invoking the named chaincode
+func signedProposal(t *testing.T, chaincodeName string) *pb.SignedProposal {
+	marshal := func(message proto.Message) []byte {
+		valAsbytes, err := proto.Marshal(message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return valAsbytes
+	}
+
+	invocation := &pb.ChaincodeInvocationSpec{ChaincodeSpec: &pb.ChaincodeSpec{ChaincodeId: &pb.ChaincodeID{Name: chaincodeName}}}
+	payload := &pb.ChaincodeProposalPayload{Input: marshal(invocation)}
+	return &pb.SignedProposal{ProposalBytes: marshal(&pb.Proposal{Payload: marshal(payload)})}
+}
+
+func TestShimInvokedChaincode(t *testing.T) {
+	peer := &fakeShim{proposal: signedProposal(t, "mortgage")}
+
+	name, err := FromShim(peer).GetInvokedChaincode()
+	if err != nil || name != "mortgage" {
+		t.Errorf("GetInvokedChaincode() = %q, %v, want mortgage", name, err)
+	}
+
+	peer.proposal = signedProposal(t, "")
+	if _, err = FromShim(peer).GetInvokedChaincode(); err == nil {
+		t.Error("a proposal naming no chaincode was accepted")
+	}
+}
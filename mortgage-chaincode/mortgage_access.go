@@ -0,0 +1,80 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+
+	"github.com/joerust/mortgage-referrals/ledger"
+)
+
+// Caller roles, read from the "role" attribute of the transaction certificate. These match the referral chaincode.
+const (
+	RoleEmployee = "employee"
+	RoleMortgage = "mortgage"
+	RoleAdmin    = "admin"
+)
+
+const roleAttribute = "role"
+
+// anyRole lets every authenticated caller run a function
+var anyRole = []string{RoleEmployee, RoleMortgage, RoleAdmin}
+
+// functionRoles is the authorization policy, listing the roles allowed to run each Invoke and Query
+// function. Functions that are not listed cannot be run by anyone.
+var functionRoles = map[string][]string{
+	"init":                      {RoleAdmin},
+	"createMortgageApplication": {RoleMortgage, RoleAdmin},
+	"attachProperty":            {RoleMortgage, RoleAdmin},
+	"addApplicant":              {RoleMortgage, RoleAdmin},
+	"addIncome":                 {RoleMortgage, RoleAdmin},
+	"lockRate":                  {RoleMortgage, RoleAdmin},
+	"advanceUnderwriting":       {RoleMortgage, RoleAdmin},
+	"read":                      {RoleMortgage, RoleAdmin},
+	"searchByReferral":          {RoleMortgage, RoleAdmin},
+	"searchByStatus":            {RoleMortgage, RoleAdmin},
+	"getStatusTransitions":      anyRole,
+}
+
+// AccessError is returned when the caller is not allowed to do what they asked
+type AccessError struct {
+	Function string `json:"function"`
+	Role     string `json:"role"`
+	Reason   string `json:"reason"`
+}
+
+func (e *AccessError) Error() string {
+	return e.Envelope().Error()
+}
+
+func (e *AccessError) Envelope() *ChaincodeError {
+	return newErrorDetails(ErrCodeAccessDenied, "Access denied", e)
+}
+
+// authorize checks the policy allows the caller's role to run the function
+func (t *MortgageChaincode) authorize(stub ledger.Stub, function string) error {
+	role := ""
+	valAsbytes, err := stub.ReadCertAttribute(roleAttribute)
+	if err == nil {
+		role = strings.TrimSpace(string(valAsbytes))
+	}
+
+	for _, allowed := range functionRoles[function] {
+		if role == allowed {
+			return nil
+		}
+	}
+
+	return &AccessError{Function: function, Role: role, Reason: "role is not allowed to run this function"}
+}
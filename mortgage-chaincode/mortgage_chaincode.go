@@ -1,394 +1,686 @@
-/*
-Copyright IBM Corp 2016 All Rights Reserved.
-Licensed under the Apache License, Version 2.0 (the "License");
-you may not use this file except in compliance with the License.
-You may obtain a copy of the License at
-		 http://www.apache.org/licenses/LICENSE-2.0
-Unless required by applicable law or agreed to in writing, software
-distributed under the License is distributed on an "AS IS" BASIS,
-WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
-See the License for the specific language governing permissions and
-limitations under the License.
-*/
-
-package main
-
-import (
-	"errors"
-	"fmt"
-	"reflect"
-	"unsafe"
-	"strings"
-    "encoding/json"
-	"github.com/hyperledger/fabric/core/chaincode/shim"
-)
-
-type CustomerReferral struct {
-	ReferralId string `json:"referralId"`
-    CustomerName string `json:"customerName"`
-	ContactNumber string `json:"contactNumber"`
-	CustomerId string `json:"customerId"`
-	EmployeeId string `json:"employeeId"`
-	Departments []string `json:"departments"`
-    CreateDate int64 `json:"createDate"`
-	Status string `json:"status"`
-	Mortgage Mortgage `json:"mortgage"`
-}
-
-type Mortgage struct {
-	MortgageNumber string `json:"mortgageNumber"`
-    MortgageType string `json:"mortgageType"`
-	ReferralId string `json:"referralId"`
-	Rate string `json:"rate"`
-	Amount string `json:"amount"`
-}
-
-// ReferralChaincode implementation stores and updates referral information on the blockchain
-type ReferralChaincode struct {
-}
-
-func main() {
-	err := shim.Start(new(ReferralChaincode))
-	if err != nil {
-		fmt.Printf("Error starting Simple chaincode: %s", err)
-	}	
-}
-
-func BytesToString(b []byte) string {
-    bh := (*reflect.SliceHeader)(unsafe.Pointer(&b))
-    sh := reflect.StringHeader{bh.Data, bh.Len}
-    return *(*string)(unsafe.Pointer(&sh))
-}
-
-// Init resets all the things
-func (t *ReferralChaincode) Init(stub *shim.ChaincodeStub, function string, args []string) ([]byte, error) {
-	// There is no initialization to do
-	return nil, nil
-}
-
-// Invoke is our entry point to invoke a chaincode function
-func (t *ReferralChaincode) Invoke(stub *shim.ChaincodeStub, function string, args []string) ([]byte, error) {
-	fmt.Println("invoke is running " + function)
-
-	// Handle different functions
-	if function == "init" {
-		return t.Init(stub, "init", args)
-	} else if function == "createReferral" {
-		return t.createReferral(stub, args)
-	} else if function == "updateReferralStatus" {
-		return t.updateReferralStatus(stub, args)
-	}
-	fmt.Println("invoke did not find func: " + function)
-
-	return nil, errors.New("Received unknown function invocation")
-}
-
-// Query is our entry point for queries
-func (t *ReferralChaincode) Query(stub *shim.ChaincodeStub, function string, args []string) ([]byte, error) {
-	fmt.Println("query is running " + function)
-
-	// Handle different functions
-	if function == "read" { //read a variable
-		return t.read(stub, args)
-	} else if function == "searchByStatus" {
-		return t.searchByStatus(args[0], stub)
-	} else if function == "searchByDepartment" {
-		return t.searchByDepartment(args[0], stub)
-	}
-	fmt.Println("query did not find func: " + function)
-
-	return nil, errors.New("Received unknown function query")
-}
-
-// Adds the referral id to a ledger list item for the given department allowing for quick search of referrals in a given department
-func (t *ReferralChaincode) indexByDepartment(referralId string, department string, stub *shim.ChaincodeStub) (error) {
-	valAsbytes, err := stub.GetState(department)
-	if err != nil {
-		jsonResp := "{\"Error\":\"Failed to get state for " + department + "\"}"
-		return errors.New(jsonResp)
-	}
-	
-	if valAsbytes == nil {
-		err = stub.PutState(department, []byte(referralId))
-	} else {
-	    commaDelimitedStatuses := BytesToString(valAsbytes)
-		err = stub.PutState(department, []byte(commaDelimitedStatuses + "," + referralId))
-	}
-	
-	return err
-}
-
-func (t *ReferralChaincode) removeStatusReferralIndex(referralId string, status string, stub *shim.ChaincodeStub) (error) {
-	valAsbytes, err := stub.GetState(status)
-	if err != nil {
-		jsonResp := "{\"Error\":\"Failed to get state for " + status + "\"}"
-		return errors.New(jsonResp)
-	}
-	
-	if valAsbytes == nil {
-		return nil;
-	} else {
-		// Remove the referral from this status type, if it exists
-		commaDelimitedStatuses := BytesToString(valAsbytes)
-		referralIdsInCurrentStatus := strings.Split(commaDelimitedStatuses, ",")
-		updatedReferralIdList := ""
-		
-		appendComma := false
-		for i := range referralIdsInCurrentStatus {
-			if referralIdsInCurrentStatus[i] != referralId {
-			    if appendComma == false {
-					updatedReferralIdList += referralIdsInCurrentStatus[i]
-					appendComma = true
-				} else {
-					updatedReferralIdList = updatedReferralIdList + "," + referralIdsInCurrentStatus[i]
-				}
-			}
-		}
-		
-		err = stub.PutState(status, []byte(updatedReferralIdList))
-	}
-	
-	if err != nil {
-		jsonResp := "{\"Error\":\"Failed to update state for " + status + "\"}"
-		return errors.New(jsonResp)
-	}
-	
-	return nil
-}
-
-// Adds the referral id to a ledger list item for the given department allowing for quick search of referrals in a given department
-func (t *ReferralChaincode) indexByStatus(referralId string, status string, stub *shim.ChaincodeStub) (error) {
-	valAsbytes, err := stub.GetState(status)
-	if err != nil {
-		jsonResp := "{\"Error\":\"Failed to get state for " + status + "\"}"
-		return errors.New(jsonResp)
-	}
-	
-	if valAsbytes == nil {
-		err = stub.PutState(status, []byte(referralId))
-	} else {
-	    commaDelimitedStatuses := BytesToString(valAsbytes)
-		err = stub.PutState(status, []byte(commaDelimitedStatuses + "," + referralId))
-	}
-	
-	if err != nil {
-		jsonResp := "{\"Error\":\"Failed to update state for " + status + "\"}"
-		return errors.New(jsonResp)
-	}
-	
-	return nil
-}
-
-func unmarshallBytes(valAsBytes []byte) (error, CustomerReferral) {
-	var err error
-	var referral CustomerReferral
-
-	err = json.Unmarshal(valAsBytes, &referral)
-
-	fmt.Println("JSON Unmarshalled")	
-	if err != nil {
-		fmt.Println(err.Error())
-	}
-	
-	return err, referral
-}
-
-func (t *ReferralChaincode) marshallReferral(referral CustomerReferral) (error, []byte) {
-	fmt.Println("Marshalling JSON to bytes")
-	valAsbytes, err := json.Marshal(referral)
-	
-	if err != nil {
-		fmt.Println("Marshalling JSON to bytes failed")
-		return err, nil
-	}
-	
-	return nil, valAsbytes
-}
-
-func (t *ReferralChaincode) updateStatus(referral CustomerReferral, status string, stub *shim.ChaincodeStub) (error) {
-	fmt.Println("Setting status")
-	
-	err := t.removeStatusReferralIndex(referral.ReferralId, referral.Status, stub)
-	if err != nil {
-		return err
-	}
-	referral.Status = status
-	err = t.indexByStatus(referral.ReferralId, status, stub)
-	
-	return err
-}
-
-// updateReferral - invoke function to updateReferral key/value pair
-func (t *ReferralChaincode) updateReferralStatus(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
-	var key, value string
-	var err error
-	var referral CustomerReferral
-	var valAsbytes []byte
-	
-	fmt.Println("running updateReferral()")
-
-	if len(args) != 4 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 4 or more. name of the key and value to set")
-	}
-
-	key = args[0] // The referral id
-	value = args[1] // The new status
-	
-	// Look up the json blob that matches the current referral id
-	valAsbytes, err = stub.GetState(key)
-	
-	// Unmarshall said json blob into a referral object
-	err = json.Unmarshal(valAsbytes, &referral)
-	
-	// Save the current status so that it can be unindexed once we update the referral object
-	oldStatus := referral.Status;
-	
-	// Set the referral status to the new value
-	referral.Status = value;
-	
-	// Serialize the object to a JSON string to be stored in the ledger
-	valAsbytes, err = json.Marshal(referral)
-	
-	// Store the json string in the ledger
-	err = stub.PutState(key, valAsbytes) //write the variable into the chaincode state
-	
-	if err != nil {
-		return nil, err
-	}
-	
-	// Index things by the new status
-	err = t.indexByStatus(key, referral.Status, stub)
-	
-	if err != nil {
-		return []byte("Count not index the bytes by status from the value: " + value + " on the ledger"), err
-	}
-	
-	// Remove the indexing by the status before the update
-	err = t.removeStatusReferralIndex(key, oldStatus, stub)
-	
-	return nil, nil
-}
-
-// createReferral - invoke function to write key/value pair
-func (t *ReferralChaincode) createReferral(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
-
-	var key, value string
-	var err error
-	fmt.Println("running createReferral()")
-
-	if len(args) != 2 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 2 parameters, name of the key and value to set")
-	}
-
-	key = args[0] //rename for funsies
-	value = args[1]
-	
-	err = stub.PutState(key, []byte(value)) //write the variable into the chaincode state
-	if err != nil {
-		return nil, err
-	}
-	
-	var referral CustomerReferral
-
-	err = json.Unmarshal([] byte(value), &referral)
-
-	
-	// Deserialize the input string into a GO data structure to hold the referral
-	err = t.indexByStatus(key, referral.Status, stub)
-	
-	if err != nil {
-		return []byte("Count not index the bytes by status from the value: " + value + " on the ledger"), err
-	}
-	
-	// Create a ledger record that indexes the referral id by the created department
-	for i := range referral.Departments {
-		err = t.indexByDepartment(key, referral.Departments[i], stub)
-		if err != nil {
-			return []byte("Count not index the bytes by department from the value: " + value + " on the ledger"), err
-		}
-	}
-	
-	
-	return nil, nil
-}
-
-func (t *ReferralChaincode) processCommaDelimitedReferrals(delimitedReferrals string, stub *shim.ChaincodeStub) ([]byte, error) {
-	commaDelimitedReferrals := strings.Split(delimitedReferrals, ",")
-
-	referralResultSet := "["
-	
-	for i := range commaDelimitedReferrals {
-		valAsbytes, err := stub.GetState(commaDelimitedReferrals[i])
-		
-		if err != nil {
-			return nil, err
-		}
-		
-		if i == 0 {
-			referralResultSet = referralResultSet + BytesToString(valAsbytes)
-		} else {
-			referralResultSet = referralResultSet + "," + BytesToString(valAsbytes)
-		}
-	}
-	
-	referralResultSet += "]"
-	return []byte(referralResultSet), nil
-}
-
-func (t *ReferralChaincode) searchByDepartment(department string, stub *shim.ChaincodeStub) ([]byte, error) {
-	valAsbytes, err := stub.GetState(department)
-	
-	if err != nil {
-		jsonResp := "{\"Error\":\"Failed to get state for " + department + "\"}"
-		return nil, errors.New(jsonResp)
-	}
-	
-	valAsbytes, err = t.processCommaDelimitedReferrals(BytesToString(valAsbytes), stub)
-	
-	if(err != nil) {
-		return nil, err
-	}
-	
-	return valAsbytes, nil
-}
-
-func (t *ReferralChaincode) searchByStatus(status string, stub *shim.ChaincodeStub) ([]byte, error) {
-	valAsbytes, err := stub.GetState(status)
-	
-	if err != nil {
-		jsonResp := "{\"Error\":\"Failed to get state for " + status + "\"}"
-		return nil, errors.New(jsonResp)
-	}
-	
-	valAsbytes, err = t.processCommaDelimitedReferrals(BytesToString(valAsbytes), stub)
-	
-	if(err != nil) {
-		return nil, err
-	}
-	
-	return valAsbytes, nil
-}
-
-
-// read - query function to read key/value pair
-func (t *ReferralChaincode) read(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
-	var key, jsonResp string
-	var err error
-	
-	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting name of the key to query")
-	}
-
-	key = args[0]
-	valAsbytes, err := stub.GetState(key)
-	
-	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + key + "\"}"
-		return []byte(jsonResp), err
-	}
-	
-	if valAsbytes == nil {
-		return []byte("Did not find entry for key: " + key), nil
-	}
-	return valAsbytes, nil
-}
\ No newline at end of file
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+	"github.com/joerust/mortgage-referrals/chaincode"
+	"github.com/joerust/mortgage-referrals/decimal"
+	"github.com/joerust/mortgage-referrals/events"
+	"github.com/joerust/mortgage-referrals/ledger"
+)
+
+// maxRateLockDays bounds how long a rate can be locked for
+const maxRateLockDays = 180
+
+const secondsPerDay = 24 * 60 * 60
+
+// MortgageApplication is a mortgage being applied for on behalf of a referred customer
+type MortgageApplication struct {
+	MortgageNumber string              `json:"mortgageNumber"`
+	ReferralId     string              `json:"referralId"`
+	MortgageType   string              `json:"mortgageType"`
+	Status         string              `json:"status"`
+	Amount         decimal.Money       `json:"amount"`
+	Rate           decimal.BasisPoints `json:"rate"`
+	Property       *Property           `json:"property,omitempty"`
+	Applicants     []Applicant         `json:"applicants"`
+	RateLocks      []RateLock          `json:"rateLocks"`
+	Underwriting   []UnderwritingStep  `json:"underwriting"`
+}
+
+// Property is the home the mortgage is secured against
+type Property struct {
+	Address        string        `json:"address"`
+	City           string        `json:"city"`
+	Region         string        `json:"region"`
+	PostalCode     string        `json:"postalCode"`
+	PropertyType   string        `json:"propertyType"`
+	PurchasePrice  decimal.Money `json:"purchasePrice"`
+	AppraisedValue decimal.Money `json:"appraisedValue"`
+}
+
+// Applicant is a borrower on the application
+type Applicant struct {
+	ApplicantId string   `json:"applicantId"`
+	CustomerId  string   `json:"customerId"`
+	Name        string   `json:"name"`
+	Primary     bool     `json:"primary"`
+	Incomes     []Income `json:"incomes"`
+}
+
+// Income is a single source of an applicant's income
+type Income struct {
+	Source       string        `json:"source"`
+	Employer     string        `json:"employer"`
+	AnnualAmount decimal.Money `json:"annualAmount"`
+}
+
+// RateLock is a rate guaranteed to the applicants until it expires
+type RateLock struct {
+	Rate      decimal.BasisPoints `json:"rate"`
+	LockedAt  int64               `json:"lockedAt"`
+	ExpiresAt int64               `json:"expiresAt"`
+	TxId      string              `json:"txId"`
+}
+
+// UnderwritingStep records a single move of the application through the lifecycle
+type UnderwritingStep struct {
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Note      string `json:"note"`
+	Timestamp int64  `json:"timestamp"`
+	TxId      string `json:"txId"`
+}
+
+// applicationRequest is the JSON accepted by createMortgageApplication
+type applicationRequest struct {
+	ReferralId   string              `json:"referralId"`
+	MortgageType string              `json:"mortgageType"`
+	Amount       decimal.Money       `json:"amount"`
+	Rate         decimal.BasisPoints `json:"rate"`
+}
+
+// MortgageChaincode implementation stores mortgage applications and moves them through underwriting on the blockchain
+type MortgageChaincode struct {
+	// contract serves the typed transaction functions and the generated contract metadata
+	contract *contractapi.ContractChaincode
+}
+
+func main() {
+	chaincode, err := newMortgageChaincode()
+	if err != nil {
+		fmt.Printf("Error creating Mortgage chaincode: %s", err)
+		return
+	}
+
+	err = shim.Start(chaincode)
+	if err != nil {
+		fmt.Printf("Error starting Mortgage chaincode: %s", err)
+	}
+}
+
+// activeRateLock returns the most recent rate lock that has not expired at now, or nil
+func (a MortgageApplication) activeRateLock(now int64) *RateLock {
+	for i := len(a.RateLocks) - 1; i >= 0; i-- {
+		if a.RateLocks[i].ExpiresAt > now {
+			return &a.RateLocks[i]
+		}
+	}
+
+	return nil
+}
+
+// Init resets all the things. Expects the name of the deployed referral chaincode, which every
+// application must belong to, and an optional prefix for allocated mortgage numbers. The function name is ignored.
+func (t *MortgageChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	_, args := stub.GetFunctionAndParameters()
+
+	_, err := t.initialize(ledger.FromShim(stub), args)
+	if err != nil {
+		return shim.Error(asChaincodeError(err).Error())
+	}
+
+	return shim.Success(nil)
+}
+
+// initialize stores the referral chaincode name and mortgage number prefix
+func (t *MortgageChaincode) initialize(stub ledger.Stub, args []string) ([]byte, error) {
+	if len(args) < 1 || len(args) > 2 || args[0] == "" {
+		return nil, newError(ErrCodeInvalidArgument, "Incorrect number of arguments. Expecting the name of the referral chaincode and an optional mortgage number prefix")
+	}
+
+	prefix := defaultMortgageNumberPrefix
+	if len(args) == 2 {
+		prefix = args[1]
+	}
+
+	err := putMortgageNumberPrefix(prefix, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, putReferralChaincode(args[0], stub)
+}
+
+// Invoke is our entry point to invoke a chaincode function. The function names clients have always used
+// run with their string arguments, any other name is a typed transaction function of the contract.
+func (t *MortgageChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	function, args := stub.GetFunctionAndParameters()
+
+	if _, ok := functionRoles[function]; !ok {
+		return t.contract.Invoke(stub)
+	}
+
+	result, err := t.dispatch(ledger.FromShim(stub), function, args)
+	if err != nil {
+		return shim.Error(asChaincodeError(err).Error())
+	}
+
+	return shim.Success(result)
+}
+
+// dispatch runs a function by the name clients have always used, as a query if it was one
+func (t *MortgageChaincode) dispatch(stub ledger.Stub, function string, args []string) ([]byte, error) {
+	if queryFunctions[function] {
+		return t.query(stub, function, args)
+	}
+
+	return t.invoke(stub, function, args)
+}
+
+// invoke runs the named invoke function for an authorized caller
+func (t *MortgageChaincode) invoke(stub ledger.Stub, function string, args []string) ([]byte, error) {
+	// Every function is checked against the authorization policy before it runs
+	err := t.authorize(stub, function)
+	if err != nil {
+		return nil, err
+	}
+
+	// Handle different functions
+	if function == "init" {
+		return t.initialize(stub, args)
+	} else if function == "createMortgageApplication" {
+		return t.createMortgageApplication(stub, args)
+	} else if function == "attachProperty" {
+		return t.attachProperty(stub, args)
+	} else if function == "addApplicant" {
+		return t.addApplicant(stub, args)
+	} else if function == "addIncome" {
+		return t.addIncome(stub, args)
+	} else if function == "lockRate" {
+		return t.lockRate(stub, args)
+	} else if function == "advanceUnderwriting" {
+		return t.advanceUnderwriting(stub, args)
+	}
+	fmt.Println("invoke did not find func: " + function)
+
+	return nil, newError(ErrCodeUnknownFunction, "Received unknown function invocation")
+}
+
+// query runs the named query function for an authorized caller
+func (t *MortgageChaincode) query(stub ledger.Stub, function string, args []string) ([]byte, error) {
+	// Every function is checked against the authorization policy before it runs
+	err := t.authorize(stub, function)
+	if err != nil {
+		return nil, err
+	}
+
+	// Handle different functions
+	if function == "read" {
+		return t.read(stub, args)
+	} else if function == "searchByReferral" {
+		return t.searchByIndex(referralIndex, stub, args)
+	} else if function == "searchByStatus" {
+		return t.searchByIndex(statusIndex, stub, args)
+	} else if function == "getStatusTransitions" {
+		return t.getStatusTransitions(args)
+	}
+	fmt.Println("query did not find func: " + function)
+
+	return nil, newError(ErrCodeUnknownFunction, "Received unknown function query")
+}
+
+// getApplication loads the mortgage application stored under the given number
+func getApplication(mortgageNumber string, stub ledger.Stub) (MortgageApplication, error) {
+	var application MortgageApplication
+
+	valAsbytes, err := getMortgageBytes(mortgageNumber, stub)
+	if err != nil {
+		return application, err
+	}
+
+	if valAsbytes == nil {
+		return application, notFound(mortgageNumber)
+	}
+
+	err = json.Unmarshal(valAsbytes, &application)
+	if err != nil {
+		return application, newError(ErrCodeInternal, "Failed to unmarshal mortgage "+mortgageNumber)
+	}
+
+	return application, nil
+}
+
+// putApplication stores the mortgage application and returns the bytes written
+func putApplication(application MortgageApplication, stub ledger.Stub) ([]byte, error) {
+	valAsbytes, err := json.Marshal(application)
+	if err != nil {
+		return nil, err
+	}
+
+	err = putMortgageBytes(application.MortgageNumber, valAsbytes, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	return valAsbytes, nil
+}
+
+// updateApplication stores a change to an application's details and emits the event for it. The status
+// does not change, so the event's old and new status are both the application's status.
+func updateApplication(eventType string, application MortgageApplication, stub ledger.Stub) ([]byte, error) {
+	valAsbytes, err := putApplication(application, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = emitMortgageEvent(eventType, application.Status, application, nil, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	return valAsbytes, nil
+}
+
+// getEditableApplication loads an application whose details can still be changed
+func getEditableApplication(mortgageNumber string, stub ledger.Stub) (MortgageApplication, error) {
+	application, err := getApplication(mortgageNumber, stub)
+	if err != nil {
+		return application, err
+	}
+
+	if application.Status != StatusApplication {
+		return application, newError(ErrCodeFailedPrecondition, "Mortgage "+mortgageNumber+" is "+application.Status+" and can no longer be edited")
+	}
+
+	return application, nil
+}
+
+// createMortgageApplication - invoke function to open an application for a referral. Expects the
+// application JSON. Returns the mortgage number allocated by the chaincode along with the stored application.
+func (t *MortgageChaincode) createMortgageApplication(stub ledger.Stub, args []string) ([]byte, error) {
+
+	if len(args) != 1 {
+		return nil, newError(ErrCodeInvalidArgument, "Incorrect number of arguments. Expecting 1, the application JSON")
+	}
+
+	var request applicationRequest
+	err := chaincode.DecodeStrict(args[0], &request)
+	if err != nil {
+		return nil, err
+	}
+
+	if request.ReferralId == "" {
+		return nil, newError(ErrCodeInvalidArgument, "referralId is required")
+	}
+
+	if !request.Amount.IsZero() {
+		err = request.Amount.Validate()
+		if err != nil {
+			return nil, newError(ErrCodeInvalidArgument, "Invalid amount: "+err.Error())
+		}
+	}
+
+	err = request.Rate.Validate()
+	if err != nil {
+		return nil, newError(ErrCodeInvalidArgument, "Invalid rate: "+err.Error())
+	}
+
+	// Applications can only be opened for referrals the referral chaincode knows about
+	err = checkReferralExists(request.ReferralId, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	mortgageNumber, err := allocateMortgageNumber(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	application := MortgageApplication{
+		MortgageNumber: mortgageNumber,
+		ReferralId:     request.ReferralId,
+		MortgageType:   request.MortgageType,
+		Status:         StatusApplication,
+		Amount:         request.Amount,
+		Rate:           request.Rate,
+		Applicants:     []Applicant{},
+		RateLocks:      []RateLock{},
+		Underwriting:   []UnderwritingStep{},
+	}
+
+	valAsbytes, err := putApplication(application, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = putIndexEntry(statusIndex, application.Status, mortgageNumber, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = putIndexEntry(referralIndex, application.ReferralId, mortgageNumber, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	referralEvent, err := linkReferral(application, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = emitMortgageEvent(events.MortgageApplicationCreated, "", application, referralEvent, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(CreateApplicationResult{MortgageNumber: mortgageNumber, Application: valAsbytes})
+}
+
+// attachProperty - invoke function to set the property on an application. Expects the mortgage number and property JSON.
+func (t *MortgageChaincode) attachProperty(stub ledger.Stub, args []string) ([]byte, error) {
+
+	if len(args) != 2 {
+		return nil, newError(ErrCodeInvalidArgument, "Incorrect number of arguments. Expecting 2, the mortgage number and property JSON")
+	}
+
+	var property Property
+	err := chaincode.DecodeStrict(args[1], &property)
+	if err != nil {
+		return nil, err
+	}
+
+	if property.Address == "" || property.PostalCode == "" {
+		return nil, newError(ErrCodeInvalidArgument, "Property address and postalCode are required")
+	}
+
+	for _, value := range []decimal.Money{property.PurchasePrice, property.AppraisedValue} {
+		if value.IsZero() {
+			continue
+		}
+		err = value.Validate()
+		if err != nil {
+			return nil, newError(ErrCodeInvalidArgument, "Invalid property value: "+err.Error())
+		}
+	}
+
+	application, err := getEditableApplication(args[0], stub)
+	if err != nil {
+		return nil, err
+	}
+
+	application.Property = &property
+	return updateApplication(events.MortgagePropertyAttached, application, stub)
+}
+
+// addApplicant - invoke function to add a borrower to an application. Expects the mortgage number and applicant JSON.
+func (t *MortgageChaincode) addApplicant(stub ledger.Stub, args []string) ([]byte, error) {
+
+	if len(args) != 2 {
+		return nil, newError(ErrCodeInvalidArgument, "Incorrect number of arguments. Expecting 2, the mortgage number and applicant JSON")
+	}
+
+	var applicant Applicant
+	err := chaincode.DecodeStrict(args[1], &applicant)
+	if err != nil {
+		return nil, err
+	}
+
+	if applicant.ApplicantId == "" || applicant.Name == "" {
+		return nil, newError(ErrCodeInvalidArgument, "Applicant applicantId and name are required")
+	}
+
+	for i := range applicant.Incomes {
+		err = validateIncome(applicant.Incomes[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	application, err := getEditableApplication(args[0], stub)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range application.Applicants {
+		if application.Applicants[i].ApplicantId == applicant.ApplicantId {
+			return nil, newError(ErrCodeAlreadyExists, "Applicant "+applicant.ApplicantId+" is already on mortgage "+args[0])
+		}
+		if applicant.Primary && application.Applicants[i].Primary {
+			return nil, newError(ErrCodeAlreadyExists, "Mortgage "+args[0]+" already has a primary applicant")
+		}
+	}
+
+	if applicant.Incomes == nil {
+		applicant.Incomes = []Income{}
+	}
+
+	application.Applicants = append(application.Applicants, applicant)
+	return updateApplication(events.MortgageApplicantAdded, application, stub)
+}
+
+// validateIncome checks an income has a source and a positive annual amount
+func validateIncome(income Income) error {
+	if income.Source == "" {
+		return newError(ErrCodeInvalidArgument, "Income source is required")
+	}
+
+	err := income.AnnualAmount.Validate()
+	if err != nil || income.AnnualAmount.MinorUnits == 0 {
+		return newError(ErrCodeInvalidArgument, "Income annualAmount must be a positive amount")
+	}
+
+	return nil
+}
+
+// addIncome - invoke function to add an income to an applicant. Expects the mortgage number, applicant id and income JSON.
+func (t *MortgageChaincode) addIncome(stub ledger.Stub, args []string) ([]byte, error) {
+
+	if len(args) != 3 {
+		return nil, newError(ErrCodeInvalidArgument, "Incorrect number of arguments. Expecting 3, the mortgage number, applicant id and income JSON")
+	}
+
+	var income Income
+	err := chaincode.DecodeStrict(args[2], &income)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateIncome(income)
+	if err != nil {
+		return nil, err
+	}
+
+	application, err := getEditableApplication(args[0], stub)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range application.Applicants {
+		if application.Applicants[i].ApplicantId == args[1] {
+			application.Applicants[i].Incomes = append(application.Applicants[i].Incomes, income)
+			return updateApplication(events.MortgageIncomeAdded, application, stub)
+		}
+	}
+
+	return nil, newError(ErrCodeNotFound, "Applicant "+args[1]+" is not on mortgage "+args[0])
+}
+
+// lockRate - invoke function to lock a rate for the application. Expects the mortgage number, the rate
+// as a percentage such as "4.25" and the number of days the lock lasts.
+func (t *MortgageChaincode) lockRate(stub ledger.Stub, args []string) ([]byte, error) {
+
+	if len(args) != 3 {
+		return nil, newError(ErrCodeInvalidArgument, "Incorrect number of arguments. Expecting 3, the mortgage number, rate and lock days")
+	}
+
+	rate, err := decimal.ParseRate(args[1])
+	if err == nil {
+		err = rate.Validate()
+	}
+	if err != nil {
+		return nil, newError(ErrCodeInvalidArgument, "Invalid rate "+args[1])
+	}
+
+	lockDays, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || lockDays < 1 || lockDays > maxRateLockDays {
+		return nil, newError(ErrCodeInvalidArgument, "Lock days must be between 1 and "+strconv.Itoa(maxRateLockDays))
+	}
+
+	application, err := getApplication(args[0], stub)
+	if err != nil {
+		return nil, err
+	}
+
+	if statusLifecycle.IsTerminal(application.Status) {
+		return nil, newError(ErrCodeFailedPrecondition, "Mortgage "+args[0]+" is "+application.Status+" and its rate can no longer be locked")
+	}
+
+	now, err := chaincode.TxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	application.RateLocks = append(application.RateLocks, RateLock{
+		Rate:      rate,
+		LockedAt:  now,
+		ExpiresAt: now + lockDays*secondsPerDay,
+		TxId:      stub.GetTxID(),
+	})
+
+	return updateApplication(events.MortgageRateLocked, application, stub)
+}
+
+// advanceUnderwriting - invoke function to move an application to its next status. Expects the mortgage
+// number, the new status and an optional note.
+func (t *MortgageChaincode) advanceUnderwriting(stub ledger.Stub, args []string) ([]byte, error) {
+
+	if len(args) != 2 && len(args) != 3 {
+		return nil, newError(ErrCodeInvalidArgument, "Incorrect number of arguments. Expecting the mortgage number, new status and an optional note")
+	}
+
+	mortgageNumber := args[0]
+	status := args[1]
+	note := ""
+	if len(args) == 3 {
+		note = args[2]
+	}
+
+	application, err := getApplication(mortgageNumber, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = statusLifecycle.Check(mortgageNumber, application.Status, status)
+	if err != nil {
+		return nil, err
+	}
+
+	now, err := chaincode.TxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkStatusRequirements(application, status, now)
+	if err != nil {
+		return nil, err
+	}
+
+	oldStatus := application.Status
+	application.Status = status
+	application.Underwriting = append(application.Underwriting, UnderwritingStep{
+		From:      oldStatus,
+		To:        status,
+		Note:      note,
+		Timestamp: now,
+		TxId:      stub.GetTxID(),
+	})
+
+	valAsbytes, err := putApplication(application, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = delIndexEntry(statusIndex, oldStatus, mortgageNumber, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = putIndexEntry(statusIndex, status, mortgageNumber, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	referralEvent, err := followReferralStatus(application, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = emitMortgageEvent(events.MortgageStatusChanged, oldStatus, application, referralEvent, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	return valAsbytes, nil
+}
+
+// searchByIndex - query function returning the applications indexed under a single value as a JSON array
+func (t *MortgageChaincode) searchByIndex(indexName string, stub ledger.Stub, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, newError(ErrCodeInvalidArgument, "Incorrect number of arguments. Expecting the "+indexName+" to search for")
+	}
+
+	mortgageNumbers, err := getIndexedMortgageNumbers(indexName, args[0], stub)
+	if err != nil {
+		return nil, err
+	}
+
+	var resultSet bytes.Buffer
+	resultSet.WriteString("[")
+	for i := range mortgageNumbers {
+		valAsbytes, err := getMortgageBytes(mortgageNumbers[i], stub)
+		if err != nil {
+			return nil, err
+		}
+
+		// Skip index entries left behind for applications that no longer exist
+		if valAsbytes == nil {
+			continue
+		}
+
+		if resultSet.Len() > 1 {
+			resultSet.WriteString(",")
+		}
+		resultSet.Write(valAsbytes)
+	}
+	resultSet.WriteString("]")
+
+	return resultSet.Bytes(), nil
+}
+
+// read - query function to read a mortgage application
+func (t *MortgageChaincode) read(stub ledger.Stub, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, newError(ErrCodeInvalidArgument, "Incorrect number of arguments. Expecting the mortgage number to query")
+	}
+
+	valAsbytes, err := getMortgageBytes(args[0], stub)
+	if err != nil {
+		return nil, err
+	}
+
+	if valAsbytes == nil {
+		return nil, notFound(args[0])
+	}
+
+	return valAsbytes, nil
+}
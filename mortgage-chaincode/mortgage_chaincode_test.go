@@ -0,0 +1,323 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/joerust/mortgage-referrals/chaincode"
+	"github.com/joerust/mortgage-referrals/events"
+	"github.com/joerust/mortgage-referrals/ledger"
+)
+
+const testReferralId = "REF-0000000001"
+
+// deniedReferralId is a referral the fake referral chaincode refuses to let the caller read
+const deniedReferralId = "REF-0000000002"
+
+// referralCall is a call the mortgage chaincode made to the referral chaincode
+type referralCall struct {
+	function string
+	args     []string
+}
+
+// mortgageHarness runs the mortgage chaincode against an in-memory ledger and a fake referral chaincode
+type mortgageHarness struct {
+	t     *testing.T
+	cc    *MortgageChaincode
+	stub  *ledger.MockStub
+	calls []referralCall
+}
+
+func newMortgageHarness(t *testing.T) *mortgageHarness {
+	h := &mortgageHarness{t: t, cc: new(MortgageChaincode), stub: ledger.NewMockStub()}
+	h.stub.Time = 1500000000
+
+	h.stub.Chaincodes["referral"] = func(function string, args []string) ([]byte, error) {
+		h.calls = append(h.calls, referralCall{function, args})
+		switch function {
+		case "read":
+			if args[0] == deniedReferralId {
+				return nil, errors.New(`{"code":"ACCESS_DENIED","message":"Access denied"}`)
+			}
+			if args[0] != testReferralId {
+				return nil, errors.New("not found")
+			}
+			return []byte(`{"referralId":"` + args[0] + `","status":"OPEN"}`), nil
+		case "linkMortgage":
+			return events.ReferralEvent{EventType: events.MortgageLinked, ReferralId: args[0], OldStatus: "OPEN", NewStatus: "OPEN", Version: 2}.Encode()
+		case "followMortgageStatus":
+			return events.ReferralEvent{EventType: events.ReferralStatusChanged, ReferralId: args[0], OldStatus: "OPEN", NewStatus: args[2], Version: 3}.Encode()
+		}
+		return nil, errors.New("unknown function " + function)
+	}
+
+	h.stub.SetCaller(map[string]string{roleAttribute: RoleAdmin})
+	_, err := h.stub.Invoke(func(stub ledger.Stub) ([]byte, error) {
+		return h.cc.initialize(stub, []string{"referral"})
+	})
+	if err != nil {
+		t.Fatalf("init: %s", err)
+	}
+
+	h.stub.SetCaller(map[string]string{roleAttribute: RoleMortgage})
+	return h
+}
+
+func (h *mortgageHarness) invoke(function string, args ...string) ([]byte, error) {
+	return h.stub.Invoke(func(stub ledger.Stub) ([]byte, error) {
+		return h.cc.invoke(stub, function, args)
+	})
+}
+
+func (h *mortgageHarness) mustInvoke(function string, args ...string) []byte {
+	valAsbytes, err := h.invoke(function, args...)
+	if err != nil {
+		h.t.Fatalf("%s: %s", function, err)
+	}
+	return valAsbytes
+}
+
+// createApplication opens an application for the test referral and returns its mortgage number
+func (h *mortgageHarness) createApplication() string {
+	var result CreateApplicationResult
+	valAsbytes := h.mustInvoke("createMortgageApplication", `{"referralId":"`+testReferralId+`","mortgageType":"FIXED","rate":425}`)
+	err := json.Unmarshal(valAsbytes, &result)
+	if err != nil {
+		h.t.Fatalf("createMortgageApplication result: %s", err)
+	}
+	return result.MortgageNumber
+}
+
+func (h *mortgageHarness) lastEvent() events.MortgageEvent {
+	event := h.stub.LastEvent()
+	if event == nil {
+		h.t.Fatal("no event was committed")
+	}
+
+	decoded, err := events.DecodeMortgage(event.Payload)
+	if err != nil {
+		h.t.Fatalf("event payload: %s", err)
+	}
+	return decoded
+}
+
+// checkCode fails the test unless err is an error envelope with the code
+func checkCode(t *testing.T, err error, code string) {
+	t.Helper()
+
+	if err == nil {
+		t.Fatalf("succeeded, want %s", code)
+	}
+
+	var envelope ChaincodeError
+	if json.Unmarshal([]byte(err.Error()), &envelope) != nil || envelope.Code != code {
+		t.Fatalf("err = %v, want code %s", err, code)
+	}
+}
+
+func TestCreateMortgageApplication(t *testing.T) {
+	h := newMortgageHarness(t)
+
+	mortgageNumber := h.createApplication()
+	if !strings.HasPrefix(mortgageNumber, defaultMortgageNumberPrefix+"-") {
+		t.Errorf("mortgage number = %q, want the default prefix", mortgageNumber)
+	}
+
+	if len(h.calls) != 2 || h.calls[0].function != "read" || h.calls[1].function != "linkMortgage" {
+		t.Fatalf("referral calls = %+v, want read then linkMortgage", h.calls)
+	}
+
+	var linked referralMortgage
+	err := json.Unmarshal([]byte(h.calls[1].args[1]), &linked)
+	if err != nil || linked.MortgageNumber != mortgageNumber || linked.Rate != 425 || linked.SchemaVersion != referralMortgageSchemaVersion {
+		t.Errorf("linked mortgage = %s, want %s at 4.25%% and schema version %d", h.calls[1].args[1], mortgageNumber, referralMortgageSchemaVersion)
+	}
+
+	event := h.lastEvent()
+	if event.EventType != events.MortgageApplicationCreated || event.MortgageNumber != mortgageNumber || event.NewStatus != StatusApplication {
+		t.Errorf("event = %+v, want %s for %s", event, events.MortgageApplicationCreated, mortgageNumber)
+	}
+
+	if event.Referral == nil || event.Referral.EventType != events.MortgageLinked || event.Referral.Version != 2 || event.ReferralStatus != "" {
+		t.Errorf("referral event = %+v, want the referral chaincode's %s event", event.Referral, events.MortgageLinked)
+	}
+}
+
+func TestCreateMortgageApplicationUnknownReferral(t *testing.T) {
+	h := newMortgageHarness(t)
+
+	_, err := h.invoke("createMortgageApplication", `{"referralId":"REF-0000000099"}`)
+	checkCode(t, err, ErrCodeNotFound)
+	if !strings.Contains(err.Error(), "does not exist") {
+		t.Fatalf("err = %v, want the referral not to exist", err)
+	}
+
+	if len(h.stub.Events) != 0 {
+		t.Errorf("events = %+v, want none for a failed create", h.stub.Events)
+	}
+}
+
+func TestMortgageErrorCodes(t *testing.T) {
+	h := newMortgageHarness(t)
+	mortgageNumber := h.createApplication()
+
+	cases := []struct {
+		name     string
+		function string
+		args     []string
+		code     string
+	}{
+		{"unknown mortgage", "addApplicant", []string{"MTG-0000000099", `{"applicantId":"A1","name":"Jane Doe"}`}, ErrCodeNotFound},
+		{"malformed JSON", "attachProperty", []string{mortgageNumber, `{"address":`}, ErrCodeInvalidArgument},
+		{"invalid rate", "createMortgageApplication", []string{`{"referralId":"` + testReferralId + `","rate":10001}`}, ErrCodeInvalidArgument},
+		{"referral the caller may not read", "createMortgageApplication", []string{`{"referralId":"` + deniedReferralId + `"}`}, ErrCodeAccessDenied},
+		{"applicant not on the mortgage", "addIncome", []string{mortgageNumber, "A9", `{"source":"SALARY","annualAmount":{"minorUnits":100,"currency":"USD"}}`}, ErrCodeNotFound},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := h.invoke(c.function, c.args...)
+			checkCode(t, err, c.code)
+		})
+	}
+}
+
+func TestAdvanceUnderwriting(t *testing.T) {
+	h := newMortgageHarness(t)
+	mortgageNumber := h.createApplication()
+	h.calls = nil
+
+	_, err := h.invoke("advanceUnderwriting", mortgageNumber, StatusSubmitted)
+	checkCode(t, err, ErrCodeFailedPrecondition)
+	if !strings.Contains(err.Error(), "not ready") {
+		t.Fatalf("submitting an empty application: err = %v, want missing requirements", err)
+	}
+
+	h.mustInvoke("advanceUnderwriting", mortgageNumber, StatusWithdrawn, "customer withdrew")
+
+	if len(h.calls) != 1 || h.calls[0].function != "followMortgageStatus" {
+		t.Fatalf("referral calls = %+v, want followMortgageStatus", h.calls)
+	}
+	if h.calls[0].args[2] != referralStatusFollows[StatusWithdrawn] {
+		t.Errorf("referral moved to %q, want %q", h.calls[0].args[2], referralStatusFollows[StatusWithdrawn])
+	}
+
+	event := h.lastEvent()
+	if event.OldStatus != StatusApplication || event.NewStatus != StatusWithdrawn || event.ReferralStatus != referralStatusFollows[StatusWithdrawn] {
+		t.Errorf("event = %+v, want APPLICATION to WITHDRAWN following the referral", event)
+	}
+
+	if event.Referral == nil || event.Referral.EventType != events.ReferralStatusChanged || event.Referral.NewStatus != referralStatusFollows[StatusWithdrawn] {
+		t.Errorf("referral event = %+v, want the referral chaincode's %s event", event.Referral, events.ReferralStatusChanged)
+	}
+
+	_, err = h.invoke("advanceUnderwriting", mortgageNumber, StatusSubmitted)
+	var transition *chaincode.TransitionError
+	if !errors.As(err, &transition) || transition.From != StatusWithdrawn {
+		t.Errorf("leaving a terminal status: err = %v, want a TransitionError", err)
+	}
+	checkCode(t, err, ErrCodeInvalidTransition)
+}
+
+func TestApplicationChangeEvents(t *testing.T) {
+	h := newMortgageHarness(t)
+	mortgageNumber := h.createApplication()
+	h.stub.Time += 60
+
+	cases := []struct {
+		function  string
+		args      []string
+		eventType string
+	}{
+		{"attachProperty", []string{mortgageNumber, `{"address":"1 Main St","postalCode":"12345"}`}, events.MortgagePropertyAttached},
+		{"addApplicant", []string{mortgageNumber, `{"applicantId":"A1","name":"Jane Doe"}`}, events.MortgageApplicantAdded},
+		{"addIncome", []string{mortgageNumber, "A1", `{"source":"SALARY","annualAmount":{"minorUnits":100,"currency":"USD"}}`}, events.MortgageIncomeAdded},
+		{"lockRate", []string{mortgageNumber, "4.25", "30"}, events.MortgageRateLocked},
+	}
+	for _, c := range cases {
+		h.mustInvoke(c.function, c.args...)
+
+		event := h.lastEvent()
+		if event.EventType != c.eventType || event.MortgageNumber != mortgageNumber || event.OldStatus != StatusApplication || event.NewStatus != StatusApplication {
+			t.Errorf("%s: event = %+v, want %s for %s", c.function, event, c.eventType, mortgageNumber)
+		}
+
+		if event.Timestamp != h.stub.Time || event.Referral != nil || event.ReferralStatus != "" {
+			t.Errorf("%s: event = %+v, want the transaction time and no referral change", c.function, event)
+		}
+	}
+}
+
+func TestBackdatedTransaction(t *testing.T) {
+	h := newMortgageHarness(t)
+	mortgageNumber := h.createApplication()
+
+	h.stub.EndorserTime = h.stub.Time + 3600
+	_, err := h.invoke("advanceUnderwriting", mortgageNumber, StatusWithdrawn)
+	checkCode(t, err, ErrCodeInvalidArgument)
+	if !strings.Contains(err.Error(), "endorsing peer's clock") {
+		t.Fatalf("err = %v, want the timestamp to be rejected", err)
+	}
+}
+
+func TestMortgageAuthorization(t *testing.T) {
+	h := newMortgageHarness(t)
+
+	h.stub.SetCaller(map[string]string{roleAttribute: RoleEmployee})
+	_, err := h.invoke("createMortgageApplication", `{"referralId":"`+testReferralId+`"}`)
+	var access *AccessError
+	if !errors.As(err, &access) || access.Role != RoleEmployee {
+		t.Errorf("employee creating an application: err = %v, want an AccessError", err)
+	}
+	checkCode(t, err, ErrCodeAccessDenied)
+
+	_, err = h.stub.Query(func(stub ledger.Stub) ([]byte, error) {
+		return h.cc.query(stub, "getStatusTransitions", nil)
+	})
+	if err != nil {
+		t.Errorf("employee reading the transitions: %s", err)
+	}
+}
+
+func TestMortgageContractCoversEveryFunction(t *testing.T) {
+	contract := reflect.TypeOf(&MortgageContract{})
+
+	var evaluate []string
+	for function := range functionRoles {
+		if function == "init" {
+			continue
+		}
+
+		typedName := strings.ToUpper(function[:1]) + function[1:]
+		if _, ok := contract.MethodByName(typedName); !ok {
+			t.Errorf("%s has no typed transaction function %s", function, typedName)
+		}
+
+		if queryFunctions[function] {
+			evaluate = append(evaluate, typedName)
+		}
+	}
+
+	got := (&MortgageContract{}).GetEvaluateTransactions()
+	sort.Strings(got)
+	sort.Strings(evaluate)
+	if !reflect.DeepEqual(got, evaluate) {
+		t.Errorf("evaluate transactions %v, want %v", got, evaluate)
+	}
+}
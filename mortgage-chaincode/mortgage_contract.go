@@ -0,0 +1,147 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/hyperledger/fabric-contract-api-go/metadata"
+	"github.com/joerust/mortgage-referrals/chaincode"
+	"github.com/joerust/mortgage-referrals/ledger"
+)
+
+// mortgageContractName is the name the contract's transaction functions can be qualified with
+const mortgageContractName = "mortgage"
+
+// queryFunctions are the functions clients have always run as queries
+var queryFunctions = map[string]bool{
+	"read":                 true,
+	"searchByReferral":     true,
+	"searchByStatus":       true,
+	"getStatusTransitions": true,
+}
+
+// MortgageContract exposes every mortgage function as a typed transaction function, named after the
+// function clients have always called with its first letter capitalized. The contract API generates the
+// contract metadata from these signatures. Each one runs the function it is named after, so the
+// authorization policy and validation are the same whichever name is called. Applications and their
+// parts are passed and returned as the same JSON as before.
+type MortgageContract struct {
+	contractapi.Contract
+	chaincode *MortgageChaincode
+}
+
+// newMortgageChaincode returns the chaincode along with the contract serving its typed functions
+func newMortgageChaincode() (*MortgageChaincode, error) {
+	t := new(MortgageChaincode)
+
+	contract := &MortgageContract{chaincode: t}
+	contract.Name = mortgageContractName
+	contract.Info = metadata.InfoMetadata{
+		Title:       "Mortgage applications",
+		Description: "Opens mortgage applications for referred customers and moves them through underwriting",
+		Version:     "2.0.0",
+	}
+
+	chaincode, err := contractapi.NewChaincode(contract)
+	if err != nil {
+		return nil, err
+	}
+
+	t.contract = chaincode
+	return t, nil
+}
+
+// GetEvaluateTransactions marks the query functions as evaluate only in the contract metadata
+func (c *MortgageContract) GetEvaluateTransactions() []string {
+	return []string{"Read", "SearchByReferral", "SearchByStatus", "GetStatusTransitions"}
+}
+
+// call runs the named function for the transaction, returning its result as it has always been returned
+func (c *MortgageContract) call(ctx contractapi.TransactionContextInterface, function string, args ...string) (string, error) {
+	result, err := c.chaincode.dispatch(ledger.FromShim(ctx.GetStub()), function, args)
+	if err != nil {
+		return "", asChaincodeError(err)
+	}
+
+	return string(result), nil
+}
+
+// CreateMortgageApplication opens an application for a referral, see createMortgageApplication
+func (c *MortgageContract) CreateMortgageApplication(ctx contractapi.TransactionContextInterface, applicationJSON string) (string, error) {
+	return c.call(ctx, "createMortgageApplication", applicationJSON)
+}
+
+// AttachProperty sets the property on an application, see attachProperty
+func (c *MortgageContract) AttachProperty(ctx contractapi.TransactionContextInterface, mortgageNumber string, propertyJSON string) (string, error) {
+	return c.call(ctx, "attachProperty", mortgageNumber, propertyJSON)
+}
+
+// AddApplicant adds a borrower to an application, see addApplicant
+func (c *MortgageContract) AddApplicant(ctx contractapi.TransactionContextInterface, mortgageNumber string, applicantJSON string) (string, error) {
+	return c.call(ctx, "addApplicant", mortgageNumber, applicantJSON)
+}
+
+// AddIncome adds an income to an applicant, see addIncome
+func (c *MortgageContract) AddIncome(ctx contractapi.TransactionContextInterface, mortgageNumber string, applicantId string, incomeJSON string) (string, error) {
+	return c.call(ctx, "addIncome", mortgageNumber, applicantId, incomeJSON)
+}
+
+// LockRate locks a rate, given as a percentage such as "4.25", for a number of days, see lockRate
+func (c *MortgageContract) LockRate(ctx contractapi.TransactionContextInterface, mortgageNumber string, rate string, lockDays int) (string, error) {
+	return c.call(ctx, "lockRate", mortgageNumber, rate, strconv.Itoa(lockDays))
+}
+
+// AdvanceUnderwriting moves an application to its next status, see advanceUnderwriting. The note may be empty.
+func (c *MortgageContract) AdvanceUnderwriting(ctx contractapi.TransactionContextInterface, mortgageNumber string, status string, note string) (string, error) {
+	return c.call(ctx, "advanceUnderwriting", mortgageNumber, status, note)
+}
+
+// Read returns an application, see read
+func (c *MortgageContract) Read(ctx contractapi.TransactionContextInterface, mortgageNumber string) (string, error) {
+	return c.call(ctx, "read", mortgageNumber)
+}
+
+// SearchByReferral returns the applications opened for a referral as a JSON array, see searchByReferral
+func (c *MortgageContract) SearchByReferral(ctx contractapi.TransactionContextInterface, referralId string) (string, error) {
+	return c.call(ctx, "searchByReferral", referralId)
+}
+
+// SearchByStatus returns the applications in a status as a JSON array, see searchByStatus
+func (c *MortgageContract) SearchByStatus(ctx contractapi.TransactionContextInterface, status string) (string, error) {
+	return c.call(ctx, "searchByStatus", status)
+}
+
+// GetStatusTransitions returns the allowed transition table, or only the entry for a status if one is given
+func (c *MortgageContract) GetStatusTransitions(ctx contractapi.TransactionContextInterface, status string) ([]chaincode.StatusTransition, error) {
+	var args []string
+	if status != "" {
+		args = append(args, status)
+	}
+
+	result, err := c.call(ctx, "getStatusTransitions", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var table []chaincode.StatusTransition
+	err = json.Unmarshal([]byte(result), &table)
+	if err != nil {
+		return nil, newError(ErrCodeInternal, "Failed to decode the status transitions")
+	}
+
+	return table, nil
+}
@@ -0,0 +1,85 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/joerust/mortgage-referrals/chaincode"
+)
+
+// Error codes returned in the error envelope. They are the codes the referral chaincode uses, so clients
+// handle both chaincodes' errors alike. Clients should branch on the code, the message is for people and
+// may change.
+const (
+	ErrCodeInvalidArgument    = chaincode.ErrCodeInvalidArgument
+	ErrCodeNotFound           = chaincode.ErrCodeNotFound
+	ErrCodeAlreadyExists      = chaincode.ErrCodeAlreadyExists
+	ErrCodeAccessDenied       = chaincode.ErrCodeAccessDenied
+	ErrCodeInvalidTransition  = chaincode.ErrCodeInvalidTransition
+	ErrCodeFailedPrecondition = chaincode.ErrCodeFailedPrecondition
+	ErrCodeUnknownFunction    = chaincode.ErrCodeUnknownFunction
+	ErrCodeLedger             = chaincode.ErrCodeLedger
+	ErrCodeInternal           = chaincode.ErrCodeInternal
+)
+
+// ChaincodeError is the error envelope every Invoke and Query function fails with
+type ChaincodeError = chaincode.Error
+
+// newError returns an error envelope without details
+func newError(code string, message string) *ChaincodeError {
+	return chaincode.NewError(code, message)
+}
+
+// newErrorDetails returns an error envelope carrying details about what went wrong
+func newErrorDetails(code string, message string, details interface{}) *ChaincodeError {
+	return chaincode.NewErrorDetails(code, message, details)
+}
+
+// notFound returns the error for a mortgage application that does not exist
+func notFound(mortgageNumber string) *ChaincodeError {
+	return newErrorDetails(ErrCodeNotFound, "Mortgage "+mortgageNumber+" does not exist", map[string]string{"mortgageNumber": mortgageNumber})
+}
+
+// referralNotFound returns the error for a referral that does not exist
+func referralNotFound(referralId string) *ChaincodeError {
+	return newErrorDetails(ErrCodeNotFound, "Referral "+referralId+" does not exist", map[string]string{"referralId": referralId})
+}
+
+// decodeCalledError returns the envelope the referral chaincode failed with, or nil if the call failed
+// some other way, such as the peer being unable to run it
+func decodeCalledError(err error) *ChaincodeError {
+	var called ChaincodeError
+	if json.Unmarshal([]byte(err.Error()), &called) != nil || called.Code == "" {
+		return nil
+	}
+
+	return &called
+}
+
+// calledChaincodeError passes on the envelope the referral chaincode failed with, so its code reaches
+// the client. Other failures of the call are internal errors.
+func calledChaincodeError(err error) *ChaincodeError {
+	called := decodeCalledError(err)
+	if called == nil {
+		return newError(ErrCodeInternal, "The referral chaincode call failed: "+err.Error())
+	}
+
+	return called
+}
+
+// asChaincodeError converts any error into the envelope
+func asChaincodeError(err error) *ChaincodeError {
+	return chaincode.AsError(err)
+}
@@ -0,0 +1,57 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"github.com/joerust/mortgage-referrals/chaincode"
+	"github.com/joerust/mortgage-referrals/events"
+	"github.com/joerust/mortgage-referrals/ledger"
+)
+
+// emitMortgageEvent sets the chaincode event for a change to an application. A transaction carries a
+// single event, so each function emits one, after its writes and the referral chaincode calls succeeded.
+// The referral event for the change made to the linked referral, if any, is carried along with it.
+func emitMortgageEvent(eventType string, oldStatus string, application MortgageApplication, referral *events.ReferralEvent, stub ledger.Stub) error {
+	timestamp, err := chaincode.TxTime(stub)
+	if err != nil {
+		return err
+	}
+
+	referralStatus := ""
+	if referral != nil && referral.EventType == events.ReferralStatusChanged {
+		referralStatus = referral.NewStatus
+	}
+
+	payload, err := events.MortgageEvent{
+		EventType:      eventType,
+		MortgageNumber: application.MortgageNumber,
+		ReferralId:     application.ReferralId,
+		OldStatus:      oldStatus,
+		NewStatus:      application.Status,
+		ReferralStatus: referralStatus,
+		Referral:       referral,
+		TxId:           stub.GetTxID(),
+		Timestamp:      timestamp,
+	}.Encode()
+	if err != nil {
+		return err
+	}
+
+	err = stub.SetEvent(eventType, payload)
+	if err != nil {
+		return newError(ErrCodeLedger, "Failed to set "+eventType+" event for "+application.MortgageNumber)
+	}
+
+	return nil
+}
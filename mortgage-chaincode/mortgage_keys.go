@@ -0,0 +1,171 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/joerust/mortgage-referrals/ledger"
+)
+
+// Key namespaces. Every ledger key the chaincode writes is a composite key whose first
+// component is one of these, so records of one type can never overwrite another.
+const (
+	mortgageNamespace = "mortgage"
+	configNamespace   = "config"
+	sequenceNamespace = "sequence"
+	statusIndex       = "status"
+	referralIndex     = "referral"
+)
+
+const (
+	compositeKeySeparator = "\x00"
+	maxUnicodeRune        = "\U0010FFFF"
+)
+
+// indexEntryValue is stored against every index key, the key itself carries all of the information
+var indexEntryValue = []byte{0x00}
+
+// createCompositeKey joins the namespace and attributes into a single ledger key
+func createCompositeKey(namespace string, attributes ...string) (string, error) {
+	if namespace == "" {
+		return "", newError(ErrCodeInternal, "Key namespace must not be empty")
+	}
+
+	key := compositeKeySeparator + namespace + compositeKeySeparator
+	for _, attribute := range attributes {
+		if strings.Contains(attribute, compositeKeySeparator) {
+			return "", fmt.Errorf("Key attribute %q must not contain a null character", attribute)
+		}
+		key += attribute + compositeKeySeparator
+	}
+
+	return key, nil
+}
+
+// splitCompositeKey returns the namespace and attributes a composite key was built from
+func splitCompositeKey(key string) (string, []string, error) {
+	if !strings.HasPrefix(key, compositeKeySeparator) || !strings.HasSuffix(key, compositeKeySeparator) || len(key) < 2 {
+		return "", nil, fmt.Errorf("Key %q is not a composite key", key)
+	}
+
+	components := strings.Split(key[1:len(key)-1], compositeKeySeparator)
+	return components[0], components[1:], nil
+}
+
+// mortgageKey returns the ledger key a mortgage application is stored under
+func mortgageKey(mortgageNumber string) (string, error) {
+	if mortgageNumber == "" {
+		return "", newError(ErrCodeInvalidArgument, "Mortgage number must not be empty")
+	}
+
+	key, err := createCompositeKey(mortgageNamespace, mortgageNumber)
+	if err != nil {
+		return "", newError(ErrCodeInvalidArgument, "Key "+mortgageNumber+" is outside the mortgage namespace")
+	}
+
+	return key, nil
+}
+
+// getMortgageBytes reads the raw mortgage application for the given number, returning nil if it does not exist
+func getMortgageBytes(mortgageNumber string, stub ledger.Stub) ([]byte, error) {
+	key, err := mortgageKey(mortgageNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	valAsbytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Failed to get state for "+mortgageNumber)
+	}
+
+	return valAsbytes, nil
+}
+
+// putMortgageBytes writes the raw mortgage application for the given number
+func putMortgageBytes(mortgageNumber string, valAsbytes []byte, stub ledger.Stub) error {
+	key, err := mortgageKey(mortgageNumber)
+	if err != nil {
+		return err
+	}
+
+	err = stub.PutState(key, valAsbytes)
+	if err != nil {
+		return newError(ErrCodeLedger, "Failed to update state for "+mortgageNumber)
+	}
+
+	return nil
+}
+
+// getIndexedMortgageNumbers range scans the entries of an index for a single value and returns the mortgage numbers found
+func getIndexedMortgageNumbers(indexName string, value string, stub ledger.Stub) ([]string, error) {
+	prefix, err := createCompositeKey(indexName, value)
+	if err != nil {
+		return nil, err
+	}
+
+	keysIter, err := stub.RangeQueryState(prefix, prefix+maxUnicodeRune)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Failed to scan "+indexName+" index for "+value)
+	}
+	defer keysIter.Close()
+
+	var mortgageNumbers []string
+	for keysIter.HasNext() {
+		key, _, err := keysIter.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		_, attributes, err := splitCompositeKey(key)
+		if err != nil || len(attributes) != 2 {
+			fmt.Println("Skipping malformed index key " + key)
+			continue
+		}
+		mortgageNumbers = append(mortgageNumbers, attributes[1])
+	}
+
+	return mortgageNumbers, nil
+}
+
+// putIndexEntry records that mortgageNumber is indexed under value in the named index
+func putIndexEntry(indexName string, value string, mortgageNumber string, stub ledger.Stub) error {
+	key, err := createCompositeKey(indexName, value, mortgageNumber)
+	if err != nil {
+		return err
+	}
+
+	err = stub.PutState(key, indexEntryValue)
+	if err != nil {
+		return newError(ErrCodeLedger, "Failed to update "+indexName+" index for "+value)
+	}
+
+	return nil
+}
+
+// delIndexEntry removes mortgageNumber from value in the named index
+func delIndexEntry(indexName string, value string, mortgageNumber string, stub ledger.Stub) error {
+	key, err := createCompositeKey(indexName, value, mortgageNumber)
+	if err != nil {
+		return err
+	}
+
+	err = stub.DelState(key)
+	if err != nil {
+		return newError(ErrCodeLedger, "Failed to update "+indexName+" index for "+value)
+	}
+
+	return nil
+}
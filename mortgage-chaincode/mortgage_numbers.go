@@ -0,0 +1,113 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	"github.com/joerust/mortgage-referrals/ledger"
+)
+
+// mortgageNumberPrefixKey is where Init stores the prefix of allocated mortgage numbers
+const mortgageNumberPrefixKey = "mortgageNumberPrefix"
+
+// defaultMortgageNumberPrefix starts every mortgage number when Init was not given a prefix
+const defaultMortgageNumberPrefix = "MTG"
+
+// mortgageSequenceName is the counter mortgage numbers are allocated from
+const mortgageSequenceName = "mortgage"
+
+// mortgageNumberWidth zero pads the counter in allocated numbers so they sort in the order they were created
+const mortgageNumberWidth = 10
+
+var mortgageNumberPrefixPattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]{0,15}$`)
+
+// CreateApplicationResult is the response to createMortgageApplication
+type CreateApplicationResult struct {
+	MortgageNumber string          `json:"mortgageNumber"`
+	Application    json.RawMessage `json:"application"`
+}
+
+// getMortgageNumberPrefix returns the prefix set by Init, or the default if there is none
+func getMortgageNumberPrefix(stub ledger.Stub) (string, error) {
+	key, err := createCompositeKey(configNamespace, mortgageNumberPrefixKey)
+	if err != nil {
+		return "", err
+	}
+
+	valAsbytes, err := stub.GetState(key)
+	if err != nil {
+		return "", newError(ErrCodeLedger, "Failed to get state for config")
+	}
+
+	if valAsbytes == nil {
+		return defaultMortgageNumberPrefix, nil
+	}
+
+	return string(valAsbytes), nil
+}
+
+// putMortgageNumberPrefix stores the prefix of allocated mortgage numbers
+func putMortgageNumberPrefix(prefix string, stub ledger.Stub) error {
+	if !mortgageNumberPrefixPattern.MatchString(prefix) {
+		return newError(ErrCodeInvalidArgument, "Mortgage number prefix must be a letter followed by up to 15 letters or digits")
+	}
+
+	key, err := createCompositeKey(configNamespace, mortgageNumberPrefixKey)
+	if err != nil {
+		return err
+	}
+
+	err = stub.PutState(key, []byte(prefix))
+	if err != nil {
+		return newError(ErrCodeLedger, "Failed to update state for config")
+	}
+
+	return nil
+}
+
+// allocateMortgageNumber returns the next unused mortgage number, the configured prefix followed by the
+// counter. Numbers taken by applications created before the chaincode allocated them are skipped.
+func allocateMortgageNumber(stub ledger.Stub) (string, error) {
+	prefix, err := getMortgageNumberPrefix(stub)
+	if err != nil {
+		return "", err
+	}
+
+	key, err := createCompositeKey(sequenceNamespace, mortgageSequenceName)
+	if err != nil {
+		return "", err
+	}
+
+	format := func(sequence int64) string {
+		return fmt.Sprintf("%s-%0*d", prefix, mortgageNumberWidth, sequence)
+	}
+
+	lookupFailed := false
+	sequence, err := ledger.AllocateSequence(stub, key, func(sequence int64) (bool, error) {
+		existing, err := getMortgageBytes(format(sequence), stub)
+		lookupFailed = err != nil
+		return existing != nil, err
+	})
+	if err != nil {
+		if lookupFailed {
+			return "", err
+		}
+		return "", newError(ErrCodeLedger, "Failed to allocate a mortgage number from the "+mortgageSequenceName+" sequence")
+	}
+
+	return format(sequence), nil
+}
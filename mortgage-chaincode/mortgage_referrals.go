@@ -0,0 +1,173 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/joerust/mortgage-referrals/decimal"
+	"github.com/joerust/mortgage-referrals/events"
+	"github.com/joerust/mortgage-referrals/ledger"
+)
+
+// referralChaincodeKey is where Init stores the name of the deployed referral chaincode
+const referralChaincodeKey = "referralChaincode"
+
+// referralMortgageSchemaVersion is the referral chaincode's mortgage schema version the summary is written in
+const referralMortgageSchemaVersion = 2
+
+// referralStatusFollows maps the mortgage statuses the referral follows to the referral status they move it to
+var referralStatusFollows = map[string]string{
+	StatusFunded:    "FUNDED",
+	StatusWithdrawn: "WITHDRAWN",
+}
+
+// referralMortgage is the summary of an application stored on the linked referral
+type referralMortgage struct {
+	MortgageNumber string              `json:"mortgageNumber"`
+	MortgageType   string              `json:"mortgageType"`
+	ReferralId     string              `json:"referralId"`
+	Rate           decimal.BasisPoints `json:"rate"`
+	Amount         decimal.Money       `json:"amount"`
+	SchemaVersion  int                 `json:"schemaVersion"`
+}
+
+// referralSummary holds the referral fields the mortgage chaincode checks
+type referralSummary struct {
+	ReferralId string `json:"referralId"`
+	Status     string `json:"status"`
+}
+
+// getReferralChaincode returns the name of the referral chaincode set by Init
+func getReferralChaincode(stub ledger.Stub) (string, error) {
+	key, err := createCompositeKey(configNamespace, referralChaincodeKey)
+	if err != nil {
+		return "", err
+	}
+
+	valAsbytes, err := stub.GetState(key)
+	if err != nil {
+		return "", newError(ErrCodeLedger, "Failed to get state for config")
+	}
+
+	if valAsbytes == nil {
+		return "", newError(ErrCodeFailedPrecondition, "The referral chaincode name has not been set by Init")
+	}
+
+	return string(valAsbytes), nil
+}
+
+// putReferralChaincode stores the name of the referral chaincode
+func putReferralChaincode(name string, stub ledger.Stub) error {
+	key, err := createCompositeKey(configNamespace, referralChaincodeKey)
+	if err != nil {
+		return err
+	}
+
+	err = stub.PutState(key, []byte(name))
+	if err != nil {
+		return newError(ErrCodeLedger, "Failed to update state for config")
+	}
+
+	return nil
+}
+
+// checkReferralExists asks the referral chaincode for the referral, returning an error unless it exists
+func checkReferralExists(referralId string, stub ledger.Stub) error {
+	referralChaincode, err := getReferralChaincode(stub)
+	if err != nil {
+		return err
+	}
+
+	valAsbytes, err := stub.QueryChaincode(referralChaincode, "read", []string{referralId})
+	if err != nil {
+		// Only a refusal with another code, such as the caller not being allowed to read it, is passed on
+		called := decodeCalledError(err)
+		if called != nil && called.Code != ErrCodeNotFound {
+			return called
+		}
+		return referralNotFound(referralId)
+	}
+
+	var referral referralSummary
+	err = json.Unmarshal(valAsbytes, &referral)
+	if err != nil || referral.ReferralId != referralId {
+		return referralNotFound(referralId)
+	}
+
+	return nil
+}
+
+// linkReferral stores the application's mortgage number on its referral, returning the referral event
+// for the change
+func linkReferral(application MortgageApplication, stub ledger.Stub) (*events.ReferralEvent, error) {
+	referralChaincode, err := getReferralChaincode(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	valAsbytes, err := json.Marshal(referralMortgage{
+		MortgageNumber: application.MortgageNumber,
+		MortgageType:   application.MortgageType,
+		ReferralId:     application.ReferralId,
+		Rate:           application.Rate,
+		Amount:         application.Amount,
+		SchemaVersion:  referralMortgageSchemaVersion,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := stub.InvokeChaincode(referralChaincode, "linkMortgage", []string{application.ReferralId, string(valAsbytes)})
+	if err != nil {
+		return nil, calledChaincodeError(err)
+	}
+
+	return decodeReferralEvent(payload)
+}
+
+// followReferralStatus moves the linked referral along when the application reaches a status it follows,
+// returning the referral event for the change or nil if the referral did not move
+func followReferralStatus(application MortgageApplication, stub ledger.Stub) (*events.ReferralEvent, error) {
+	referralStatus, ok := referralStatusFollows[application.Status]
+	if !ok {
+		return nil, nil
+	}
+
+	referralChaincode, err := getReferralChaincode(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := stub.InvokeChaincode(referralChaincode, "followMortgageStatus", []string{application.ReferralId, application.MortgageNumber, referralStatus})
+	if err != nil {
+		return nil, calledChaincodeError(err)
+	}
+
+	return decodeReferralEvent(payload)
+}
+
+// decodeReferralEvent reads the referral event the referral chaincode returned, if it returned one
+func decodeReferralEvent(payload []byte) (*events.ReferralEvent, error) {
+	if len(payload) == 0 {
+		return nil, nil
+	}
+
+	event, err := events.Decode(payload)
+	if err != nil {
+		return nil, newError(ErrCodeInternal, "The referral chaincode returned an unreadable referral event")
+	}
+
+	return &event, nil
+}
@@ -0,0 +1,116 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/joerust/mortgage-referrals/chaincode"
+)
+
+// Mortgage application statuses
+const (
+	StatusApplication           = "APPLICATION"
+	StatusSubmitted             = "SUBMITTED"
+	StatusUnderwriting          = "UNDERWRITING"
+	StatusConditionallyApproved = "CONDITIONALLY_APPROVED"
+	StatusApproved              = "APPROVED"
+	StatusDeclined              = "DECLINED"
+	StatusFunded                = "FUNDED"
+	StatusWithdrawn             = "WITHDRAWN"
+)
+
+// statusOrder lists the statuses in the order an application normally moves through them
+var statusOrder = []string{
+	StatusApplication,
+	StatusSubmitted,
+	StatusUnderwriting,
+	StatusConditionallyApproved,
+	StatusApproved,
+	StatusDeclined,
+	StatusFunded,
+	StatusWithdrawn,
+}
+
+// statusTransitions maps each status to the statuses an application may move to next.
+// Statuses with no entries are terminal.
+var statusTransitions = map[string][]string{
+	StatusApplication:           {StatusSubmitted, StatusWithdrawn},
+	StatusSubmitted:             {StatusUnderwriting, StatusWithdrawn},
+	StatusUnderwriting:          {StatusConditionallyApproved, StatusApproved, StatusDeclined, StatusWithdrawn},
+	StatusConditionallyApproved: {StatusApproved, StatusDeclined, StatusWithdrawn},
+	StatusApproved:              {StatusFunded, StatusWithdrawn},
+	StatusDeclined:              {},
+	StatusFunded:                {},
+	StatusWithdrawn:             {},
+}
+
+// statusLifecycle checks application status changes against statusTransitions
+var statusLifecycle = chaincode.Lifecycle{IdField: "mortgageNumber", Order: statusOrder, Transitions: statusTransitions}
+
+// checkStatusRequirements returns an error if the application is missing something the target status needs
+func checkStatusRequirements(application MortgageApplication, status string, now int64) error {
+	var missing []string
+
+	switch status {
+	case StatusSubmitted:
+		if application.Amount.IsZero() {
+			missing = append(missing, "amount")
+		}
+		if application.Property == nil {
+			missing = append(missing, "property")
+		}
+		if len(application.Applicants) == 0 {
+			missing = append(missing, "applicants")
+		}
+		for i := range application.Applicants {
+			if len(application.Applicants[i].Incomes) == 0 {
+				missing = append(missing, "income for applicant "+application.Applicants[i].ApplicantId)
+			}
+		}
+	case StatusApproved, StatusFunded:
+		lock := application.activeRateLock(now)
+		if lock == nil {
+			missing = append(missing, "active rate lock")
+		}
+	}
+
+	if len(missing) == 0 {
+		return nil
+	}
+
+	return newErrorDetails(ErrCodeFailedPrecondition, "Application is not ready for "+status, struct {
+		MortgageNumber string   `json:"mortgageNumber"`
+		Status         string   `json:"status"`
+		Missing        []string `json:"missing"`
+	}{application.MortgageNumber, status, missing})
+}
+
+// getStatusTransitions - query function returning the allowed transition table, or the entry for a single status
+func (t *MortgageChaincode) getStatusTransitions(args []string) ([]byte, error) {
+	if len(args) > 1 {
+		return nil, newError(ErrCodeInvalidArgument, "Incorrect number of arguments. Expecting at most 1, the status to look up")
+	}
+
+	table := statusLifecycle.Table()
+	if len(args) == 1 {
+		entry, ok := statusLifecycle.Entry(args[0])
+		if !ok {
+			return nil, newError(ErrCodeInvalidArgument, "Unknown status "+args[0])
+		}
+		table = []chaincode.StatusTransition{entry}
+	}
+
+	return json.Marshal(table)
+}
@@ -0,0 +1,219 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultLimit and maxLimit bound the page size of referral listings
+const (
+	defaultLimit = 100
+	maxLimit     = 1000
+)
+
+// apiError is the body of an error response, in the same shape as the chaincode's error envelope
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// API serves read only queries against the read model, to callers authenticated by their client certificate
+type API struct {
+	store *Store
+}
+
+// NewAPI returns the query API for a store
+func NewAPI(store *Store) *API {
+	return &API{store: store}
+}
+
+// Handler returns the HTTP handler for the API's routes
+//
+//	GET /referrals?status=&department=&includeArchived=&limit=&offset=
+//	GET /referrals/{referralId}
+//	GET /reports/status?department=
+//	GET /checkpoint
+func (a *API) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/referrals", authenticated(a.listReferrals))
+	mux.HandleFunc("/referrals/", authenticated(a.getReferral))
+	mux.HandleFunc("/reports/status", authenticated(a.statusReport))
+	mux.HandleFunc("/checkpoint", authenticated(a.checkpoint))
+	return mux
+}
+
+// listReferrals returns a page of the referrals matching the query parameters that the caller may read
+func (a *API) listReferrals(w http.ResponseWriter, r *http.Request, caller Caller) {
+	if !allowGet(w, r) {
+		return
+	}
+
+	query := r.URL.Query()
+	departments, ok := caller.visibleDepartments(query.Get("department"))
+	if !ok {
+		writeError(w, http.StatusForbidden, "ACCESS_DENIED", "Only the referrals of the caller's departments can be listed")
+		return
+	}
+
+	filter := ReferralFilter{
+		Status:      query.Get("status"),
+		Departments: departments,
+		Limit:       defaultLimit,
+	}
+
+	var err error
+	if value := query.Get("includeArchived"); value != "" {
+		filter.IncludeArchived, err = strconv.ParseBool(value)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", "includeArchived must be true or false")
+			return
+		}
+	}
+
+	if value := query.Get("limit"); value != "" {
+		filter.Limit, err = strconv.Atoi(value)
+		if err != nil || filter.Limit < 1 || filter.Limit > maxLimit {
+			writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", "limit must be between 1 and "+strconv.Itoa(maxLimit))
+			return
+		}
+	}
+
+	if value := query.Get("offset"); value != "" {
+		filter.Offset, err = strconv.Atoi(value)
+		if err != nil || filter.Offset < 0 {
+			writeError(w, http.StatusBadRequest, "INVALID_ARGUMENT", "offset must be a non-negative integer")
+			return
+		}
+	}
+
+	referrals, err := a.store.ListReferrals(filter)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	writeJSON(w, referrals)
+}
+
+// getReferral returns a single referral with its status history, if the caller may read it
+func (a *API) getReferral(w http.ResponseWriter, r *http.Request, caller Caller) {
+	if !allowGet(w, r) {
+		return
+	}
+
+	referralId := strings.TrimPrefix(r.URL.Path, "/referrals/")
+	if referralId == "" || strings.Contains(referralId, "/") {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "Unknown path "+r.URL.Path)
+		return
+	}
+
+	referral, err := a.store.GetReferral(referralId)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	if referral == nil {
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "Referral "+referralId+" does not exist")
+		return
+	}
+
+	if !caller.seesAll() && !caller.inDepartment(referral.Departments) {
+		writeError(w, http.StatusForbidden, "ACCESS_DENIED", "Only the referral's departments can read it")
+		return
+	}
+
+	writeJSON(w, referral)
+}
+
+// statusReport returns the number of referrals in each status, counting those the caller may read
+func (a *API) statusReport(w http.ResponseWriter, r *http.Request, caller Caller) {
+	if !allowGet(w, r) {
+		return
+	}
+
+	departments, ok := caller.visibleDepartments(r.URL.Query().Get("department"))
+	if !ok {
+		writeError(w, http.StatusForbidden, "ACCESS_DENIED", "Only the referrals of the caller's departments can be counted")
+		return
+	}
+
+	counts, err := a.store.CountByStatus(departments)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	writeJSON(w, counts)
+}
+
+// checkpoint returns the last block projected, so callers can tell how far behind the chain the model is,
+// and the number of events skipped as dead letters
+func (a *API) checkpoint(w http.ResponseWriter, r *http.Request, caller Caller) {
+	if !allowGet(w, r) {
+		return
+	}
+
+	blockNumber, err := a.store.Checkpoint()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	deadLetters, err := a.store.CountDeadLetters()
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	writeJSON(w, map[string]int64{"blockNumber": blockNumber, "deadLetters": deadLetters})
+}
+
+// allowGet rejects any method but GET, the read model is only changed by the projector
+func allowGet(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method == http.MethodGet {
+		return true
+	}
+
+	w.Header().Set("Allow", http.MethodGet)
+	writeError(w, http.StatusMethodNotAllowed, "INVALID_ARGUMENT", "Only GET is supported")
+	return false
+}
+
+// writeJSON writes a successful JSON response
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		log.Println("Failed to write response:", err)
+	}
+}
+
+// writeError writes an error response
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(apiError{Code: code, Message: message})
+}
+
+// writeInternalError logs a store failure and reports it without its details
+func writeInternalError(w http.ResponseWriter, err error) {
+	log.Println("Query failed:", err)
+	writeError(w, http.StatusInternalServerError, "INTERNAL", "Query failed")
+}
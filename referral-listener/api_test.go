@@ -0,0 +1,186 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hyperledger/fabric-chaincode-go/pkg/attrmgr"
+	"github.com/joerust/mortgage-referrals/events"
+)
+
+// apiHarness serves the query API over a read model holding a referral in each of two departments
+type apiHarness struct {
+	t       *testing.T
+	store   *Store
+	handler http.Handler
+}
+
+func newAPIHarness(t *testing.T) *apiHarness {
+	store := openTestStore(t)
+	source := &fakeSource{blocks: []Block{
+		{Number: 0, ChaincodeEvents: []ChaincodeEvent{
+			referralEvent(t, events.ReferralCreated, "REF-1", "NEW", 1, "MORTGAGES"),
+			referralEvent(t, events.ReferralCreated, "REF-2", "NEW", 1, "SAVINGS"),
+		}},
+	}}
+	follow(t, NewProjector(source, store, testReferralChaincode, testMortgageChaincode))
+
+	return &apiHarness{t: t, store: store, handler: NewAPI(store).Handler()}
+}
+
+// clientCertificate returns a client certificate carrying Fabric CA attributes
+func clientCertificate(t *testing.T, attributes map[string]string) *x509.Certificate {
+	t.Helper()
+
+	certificate := &x509.Certificate{Subject: pkix.Name{CommonName: "user1"}}
+	err := attrmgr.New().AddAttributesToCert(&attrmgr.Attributes{Attrs: attributes}, certificate)
+	if err != nil {
+		t.Fatalf("add attributes: %s", err)
+	}
+
+	return certificate
+}
+
+// get sends a GET request as the holder of the certificate, or without one if it is nil
+func (h *apiHarness) get(certificate *x509.Certificate, path string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodGet, path, nil)
+	if certificate != nil {
+		request.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{certificate}}}
+	}
+
+	response := httptest.NewRecorder()
+	h.handler.ServeHTTP(response, request)
+	return response
+}
+
+func decodeResponse(t *testing.T, response *httptest.ResponseRecorder, into interface{}) {
+	t.Helper()
+
+	err := json.Unmarshal(response.Body.Bytes(), into)
+	if err != nil {
+		t.Fatalf("decode %s: %s", response.Body, err)
+	}
+}
+
+func TestAPIAccess(t *testing.T) {
+	h := newAPIHarness(t)
+
+	admin := clientCertificate(t, map[string]string{roleAttribute: RoleAdmin})
+	mortgages := clientCertificate(t, map[string]string{roleAttribute: RoleEmployee, departmentsAttribute: "MORTGAGES"})
+	noDepartments := clientCertificate(t, map[string]string{roleAttribute: RoleEmployee})
+	unknownRole := clientCertificate(t, map[string]string{roleAttribute: "auditor"})
+
+	cases := []struct {
+		name        string
+		certificate *x509.Certificate
+		path        string
+		status      int
+		code        string
+		referrals   []string
+	}{
+		{name: "no client certificate", path: "/referrals", status: http.StatusUnauthorized, code: "UNAUTHENTICATED"},
+		{name: "unknown role", certificate: unknownRole, path: "/referrals", status: http.StatusForbidden, code: "ACCESS_DENIED"},
+		{name: "admin lists every referral", certificate: admin, path: "/referrals", status: http.StatusOK, referrals: []string{"REF-1", "REF-2"}},
+		{name: "admin lists another department", certificate: admin, path: "/referrals?department=SAVINGS", status: http.StatusOK, referrals: []string{"REF-2"}},
+		{name: "employee lists their departments", certificate: mortgages, path: "/referrals", status: http.StatusOK, referrals: []string{"REF-1"}},
+		{name: "employee lists another department", certificate: mortgages, path: "/referrals?department=SAVINGS", status: http.StatusForbidden, code: "ACCESS_DENIED"},
+		{name: "employee without departments", certificate: noDepartments, path: "/referrals", status: http.StatusOK, referrals: []string{}},
+		{name: "employee reads their referral", certificate: mortgages, path: "/referrals/REF-1", status: http.StatusOK},
+		{name: "employee reads another department's referral", certificate: mortgages, path: "/referrals/REF-2", status: http.StatusForbidden, code: "ACCESS_DENIED"},
+		{name: "unknown referral", certificate: admin, path: "/referrals/REF-9", status: http.StatusNotFound, code: "NOT_FOUND"},
+		{name: "employee reports another department", certificate: mortgages, path: "/reports/status?department=SAVINGS", status: http.StatusForbidden, code: "ACCESS_DENIED"},
+		{name: "checkpoint needs a certificate", path: "/checkpoint", status: http.StatusUnauthorized, code: "UNAUTHENTICATED"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			response := h.get(c.certificate, c.path)
+			if response.Code != c.status {
+				t.Fatalf("status = %d %s, want %d", response.Code, response.Body, c.status)
+			}
+
+			if c.code != "" {
+				var body apiError
+				decodeResponse(t, response, &body)
+				if body.Code != c.code {
+					t.Errorf("code = %s, want %s", body.Code, c.code)
+				}
+			}
+
+			if c.referrals != nil {
+				var referrals []ReferralView
+				decodeResponse(t, response, &referrals)
+				ids := []string{}
+				for _, referral := range referrals {
+					ids = append(ids, referral.ReferralId)
+				}
+				if !sameStrings(ids, c.referrals) {
+					t.Errorf("referrals = %v, want %v", ids, c.referrals)
+				}
+			}
+		})
+	}
+}
+
+func TestAPIStatusReport(t *testing.T) {
+	h := newAPIHarness(t)
+
+	cases := []struct {
+		name       string
+		attributes map[string]string
+		want       int64
+	}{
+		{"admin counts every referral", map[string]string{roleAttribute: RoleAdmin}, 2},
+		{"mortgage service counts every referral", map[string]string{roleAttribute: RoleMortgage}, 2},
+		{"employee counts their departments", map[string]string{roleAttribute: RoleEmployee, departmentsAttribute: "SAVINGS, MORTGAGES"}, 2},
+		{"employee in one department", map[string]string{roleAttribute: RoleEmployee, departmentsAttribute: "SAVINGS"}, 1},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			response := h.get(clientCertificate(t, c.attributes), "/reports/status")
+			if response.Code != http.StatusOK {
+				t.Fatalf("status = %d %s", response.Code, response.Body)
+			}
+
+			var counts []StatusCount
+			decodeResponse(t, response, &counts)
+			if len(counts) != 1 || counts[0].Status != "NEW" || counts[0].Count != c.want {
+				t.Errorf("counts = %+v, want %d NEW", counts, c.want)
+			}
+		})
+	}
+}
+
+func TestAPICheckpoint(t *testing.T) {
+	h := newAPIHarness(t)
+
+	response := h.get(clientCertificate(t, map[string]string{roleAttribute: RoleEmployee}), "/checkpoint")
+	if response.Code != http.StatusOK {
+		t.Fatalf("status = %d %s", response.Code, response.Body)
+	}
+
+	var checkpoint map[string]int64
+	decodeResponse(t, response, &checkpoint)
+	if checkpoint["blockNumber"] != 0 || checkpoint["deadLetters"] != 0 {
+		t.Errorf("checkpoint = %v, want block 0 without dead letters", checkpoint)
+	}
+}
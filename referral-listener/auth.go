@@ -0,0 +1,120 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/pkg/attrmgr"
+)
+
+// Caller roles, read from the "role" attribute of the client certificate as the chaincodes read them
+const (
+	RoleEmployee = "employee"
+	RoleMortgage = "mortgage"
+	RoleAdmin    = "admin"
+)
+
+// Client certificate attributes describing the caller
+const (
+	roleAttribute        = "role"
+	departmentsAttribute = "departments"
+)
+
+// Caller is the client behind an API request. Clients authenticate with a TLS client certificate issued
+// by the Fabric CA, carrying the same attributes the chaincodes authorize transactions with.
+type Caller struct {
+	Role        string
+	Departments []string
+}
+
+// seesAll reports whether the caller may read every referral. Employees only read the referrals routed
+// to their departments.
+func (c Caller) seesAll() bool {
+	return c.Role == RoleAdmin || c.Role == RoleMortgage
+}
+
+// inDepartment reports whether the caller belongs to any of the departments
+func (c Caller) inDepartment(departments []string) bool {
+	for i := range c.Departments {
+		for j := range departments {
+			if c.Departments[i] == departments[j] {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// visibleDepartments returns the departments the caller may read referrals of, nil meaning all of them.
+// A department asked for must be one of the caller's, ok is false if it is not.
+func (c Caller) visibleDepartments(department string) (departments []string, ok bool) {
+	if department != "" {
+		if !c.seesAll() && !c.inDepartment([]string{department}) {
+			return nil, false
+		}
+		return []string{department}, true
+	}
+
+	if c.seesAll() {
+		return nil, true
+	}
+
+	return c.Departments, true
+}
+
+// getCaller reads the caller from the client certificate the TLS handshake verified, failing if the
+// request has none
+func getCaller(r *http.Request) (Caller, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return Caller{}, false
+	}
+
+	attributes, err := attrmgr.New().GetAttributesFromCert(r.TLS.VerifiedChains[0][0])
+	if err != nil {
+		return Caller{}, false
+	}
+
+	caller := Caller{Departments: []string{}}
+	caller.Role, _, _ = attributes.Value(roleAttribute)
+
+	value, _, _ := attributes.Value(departmentsAttribute)
+	for _, department := range strings.Split(value, ",") {
+		if department = strings.TrimSpace(department); department != "" {
+			caller.Departments = append(caller.Departments, department)
+		}
+	}
+
+	return caller, true
+}
+
+// authenticated wraps a handler so it only runs for a caller with a verified certificate and a known role
+func authenticated(handler func(w http.ResponseWriter, r *http.Request, caller Caller)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, ok := getCaller(r)
+		if !ok {
+			writeError(w, http.StatusUnauthorized, "UNAUTHENTICATED", "A client certificate issued by the Fabric CA is required")
+			return
+		}
+
+		if caller.Role != RoleEmployee && caller.Role != RoleMortgage && caller.Role != RoleAdmin {
+			writeError(w, http.StatusForbidden, "ACCESS_DENIED", "Role "+caller.Role+" may not use the query API")
+			return
+		}
+
+		handler(w, r, caller)
+	}
+}
@@ -0,0 +1,102 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-protos-go/msp"
+)
+
+// Identity is the client identity the listener signs its Deliver requests with. The channel's readers
+// policy decides whether the peer streams blocks to it.
+type Identity struct {
+	mspId       string
+	certificate []byte
+	key         *ecdsa.PrivateKey
+}
+
+// LoadIdentity reads a PEM certificate and its ECDSA private key, as issued by the Fabric CA
+func LoadIdentity(mspId string, certPath string, keyPath string) (*Identity, error) {
+	certificate, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if block, _ := pem.Decode(certificate); block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New(certPath + " does not hold a PEM certificate")
+	}
+
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := parsePrivateKey(keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", keyPath, err)
+	}
+
+	return &Identity{mspId: mspId, certificate: certificate, key: key}, nil
+}
+
+// parsePrivateKey reads an ECDSA private key in PKCS#8, as the Fabric CA writes it, or SEC 1 form
+func parsePrivateKey(keyPEM []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("no PEM private key found")
+	}
+
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		ecdsaKey, ok := key.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("private key is not an ECDSA key")
+		}
+		return ecdsaKey, nil
+	}
+
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+// serialize returns the identity as the creator of a signed message
+func (i *Identity) serialize() ([]byte, error) {
+	return proto.Marshal(&msp.SerializedIdentity{Mspid: i.mspId, IdBytes: i.certificate})
+}
+
+// sign returns the identity's signature of a message. Fabric only accepts ECDSA signatures in their
+// low-S form, so a signature with a high S is replaced by its equivalent.
+func (i *Identity) sign(message []byte) ([]byte, error) {
+	digest := sha256.Sum256(message)
+	r, s, err := ecdsa.Sign(rand.Reader, i.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	order := i.key.Params().N
+	if s.Cmp(new(big.Int).Rsh(order, 1)) > 0 {
+		s.Sub(order, s)
+	}
+
+	return asn1.Marshal(struct{ R, S *big.Int }{r, s})
+}
@@ -0,0 +1,296 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/orderer"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// ChaincodeEvent is the event a valid transaction in a block set
+type ChaincodeEvent struct {
+	ChaincodeID string
+	TxID        string
+	EventName   string
+	Payload     []byte
+}
+
+// Block holds the parts of a block the listener reads, the events of its valid transactions in the
+// order they were committed
+type Block struct {
+	Number          uint64
+	ChaincodeEvents []ChaincodeEvent
+}
+
+// BlockStream delivers blocks in order, waiting for the next block once it reaches the end of the chain
+type BlockStream interface {
+	Recv() (Block, error)
+}
+
+// BlockSource opens block streams. A stream can start at any block, so the listener resumes from its
+// checkpoint after a restart or a lost connection.
+type BlockSource interface {
+	Blocks(ctx context.Context, start uint64) (BlockStream, error)
+}
+
+// DeliverClient streams blocks from a peer's Deliver service, the service the Gateway's chaincode event
+// stream is built on. The Gateway streams the events of a single chaincode, while the listener needs the
+// events of both chaincodes in the order they were committed, so it reads whole blocks.
+type DeliverClient struct {
+	conn     *grpc.ClientConn
+	channel  string
+	identity *Identity
+}
+
+// NewDeliverClient returns a client for the Deliver service of the peer at the given address, e.g.
+// localhost:7051, reading the blocks of a channel. A nil tlsConfig connects without TLS.
+func NewDeliverClient(peerAddress string, tlsConfig *tls.Config, channel string, identity *Identity) (*DeliverClient, error) {
+	transport := insecure.NewCredentials()
+	if tlsConfig != nil {
+		transport = credentials.NewTLS(tlsConfig)
+	}
+
+	conn, err := grpc.Dial(peerAddress, grpc.WithTransportCredentials(transport))
+	if err != nil {
+		return nil, err
+	}
+
+	return &DeliverClient{conn: conn, channel: channel, identity: identity}, nil
+}
+
+// Close closes the connection to the peer
+func (c *DeliverClient) Close() error {
+	return c.conn.Close()
+}
+
+// Blocks opens a stream of the channel's blocks from start onwards, which runs until ctx is done
+func (c *DeliverClient) Blocks(ctx context.Context, start uint64) (BlockStream, error) {
+	envelope, err := c.seekEnvelope(start)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := pb.NewDeliverClient(c.conn).Deliver(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = stream.Send(envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	err = stream.CloseSend()
+	if err != nil {
+		return nil, err
+	}
+
+	return deliverStream{stream}, nil
+}
+
+// seekEnvelope returns the signed request for every block from start onwards, waiting for blocks that
+// have not been committed yet
+func (c *DeliverClient) seekEnvelope(start uint64) (*common.Envelope, error) {
+	seekInfo, err := proto.Marshal(&orderer.SeekInfo{
+		Start:    &orderer.SeekPosition{Type: &orderer.SeekPosition_Specified{Specified: &orderer.SeekSpecified{Number: start}}},
+		Stop:     &orderer.SeekPosition{Type: &orderer.SeekPosition_Specified{Specified: &orderer.SeekSpecified{Number: math.MaxUint64}}},
+		Behavior: orderer.SeekInfo_BLOCK_UNTIL_READY,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	creator, err := c.identity.serialize()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, 24)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	// The transaction id of a signed request is the hash of its nonce and creator
+	txId := sha256.Sum256(append(append([]byte{}, nonce...), creator...))
+
+	channelHeader, err := proto.Marshal(&common.ChannelHeader{
+		Type:      int32(common.HeaderType_DELIVER_SEEK_INFO),
+		ChannelId: c.channel,
+		TxId:      hex.EncodeToString(txId[:]),
+		Timestamp: timestamppb.Now(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	signatureHeader, err := proto.Marshal(&common.SignatureHeader{Creator: creator, Nonce: nonce})
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := proto.Marshal(&common.Payload{
+		Header: &common.Header{ChannelHeader: channelHeader, SignatureHeader: signatureHeader},
+		Data:   seekInfo,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := c.identity.sign(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return &common.Envelope{Payload: payload, Signature: signature}, nil
+}
+
+// deliverStream reads the blocks of a Deliver stream
+type deliverStream struct {
+	stream pb.Deliver_DeliverClient
+}
+
+// Recv returns the next block. The peer only sends a status to end the stream, for example when the
+// identity may not read the channel.
+func (s deliverStream) Recv() (Block, error) {
+	response, err := s.stream.Recv()
+	if err != nil {
+		return Block{}, err
+	}
+
+	switch response := response.Type.(type) {
+	case *pb.DeliverResponse_Block:
+		return parseBlock(response.Block), nil
+	case *pb.DeliverResponse_Status:
+		return Block{}, fmt.Errorf("peer ended the block stream with status %s", response.Status)
+	}
+
+	return Block{}, errors.New("peer sent an unexpected Deliver response")
+}
+
+// parseBlock reads the chaincode events of a block. Invalid transactions are recorded in the block too,
+// with their events, so they are skipped using the block's transaction filter. A transaction that cannot
+// be read is logged and skipped, it would fail the same way every time the block was read.
+func parseBlock(block *common.Block) Block {
+	parsed := Block{Number: block.GetHeader().GetNumber()}
+
+	var filter []byte
+	if metadata := block.GetMetadata().GetMetadata(); len(metadata) > int(common.BlockMetadataIndex_TRANSACTIONS_FILTER) {
+		filter = metadata[common.BlockMetadataIndex_TRANSACTIONS_FILTER]
+	}
+
+	for i, envelope := range block.GetData().GetData() {
+		if i >= len(filter) || pb.TxValidationCode(filter[i]) != pb.TxValidationCode_VALID {
+			continue
+		}
+
+		event, err := transactionEvent(envelope)
+		if err != nil {
+			log.Printf("Skipping unreadable transaction %d in block %d: %v", i, parsed.Number, err)
+			continue
+		}
+
+		if event != nil {
+			parsed.ChaincodeEvents = append(parsed.ChaincodeEvents, *event)
+		}
+	}
+
+	return parsed
+}
+
+// transactionEvent returns the chaincode event a transaction set, or nil if it is not a chaincode
+// transaction or set no event. Only the event of the chaincode the transaction was sent to is recorded.
+func transactionEvent(envelopeBytes []byte) (*ChaincodeEvent, error) {
+	var envelope common.Envelope
+	err := proto.Unmarshal(envelopeBytes, &envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	var payload common.Payload
+	err = proto.Unmarshal(envelope.Payload, &payload)
+	if err != nil {
+		return nil, err
+	}
+
+	var channelHeader common.ChannelHeader
+	err = proto.Unmarshal(payload.GetHeader().GetChannelHeader(), &channelHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	if channelHeader.Type != int32(common.HeaderType_ENDORSER_TRANSACTION) {
+		return nil, nil
+	}
+
+	var transaction pb.Transaction
+	err = proto.Unmarshal(payload.Data, &transaction)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(transaction.Actions) == 0 {
+		return nil, errors.New("transaction has no actions")
+	}
+
+	var actionPayload pb.ChaincodeActionPayload
+	err = proto.Unmarshal(transaction.Actions[0].Payload, &actionPayload)
+	if err != nil {
+		return nil, err
+	}
+
+	var responsePayload pb.ProposalResponsePayload
+	err = proto.Unmarshal(actionPayload.GetAction().GetProposalResponsePayload(), &responsePayload)
+	if err != nil {
+		return nil, err
+	}
+
+	var action pb.ChaincodeAction
+	err = proto.Unmarshal(responsePayload.Extension, &action)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(action.Events) == 0 {
+		return nil, nil
+	}
+
+	var event pb.ChaincodeEvent
+	err = proto.Unmarshal(action.Events, &event)
+	if err != nil {
+		return nil, err
+	}
+
+	if event.EventName == "" {
+		return nil, nil
+	}
+
+	return &ChaincodeEvent{ChaincodeID: event.ChaincodeId, TxID: event.TxId, EventName: event.EventName, Payload: event.Payload}, nil
+}
@@ -0,0 +1,178 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"math/big"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/msp"
+	"github.com/hyperledger/fabric-protos-go/orderer"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+// envelopeOf wraps transaction data in a signed envelope with a channel header of the given type
+func envelopeOf(t *testing.T, headerType common.HeaderType, data []byte) []byte {
+	t.Helper()
+
+	channelHeader := mustMarshal(t, &common.ChannelHeader{Type: int32(headerType), ChannelId: "mychannel"})
+	payload := mustMarshal(t, &common.Payload{Header: &common.Header{ChannelHeader: channelHeader}, Data: data})
+	return mustMarshal(t, &common.Envelope{Payload: payload})
+}
+
+// endorserTransaction returns a chaincode transaction that set the event, or no event if it is nil
+func endorserTransaction(t *testing.T, event *pb.ChaincodeEvent) []byte {
+	t.Helper()
+
+	var events []byte
+	if event != nil {
+		events = mustMarshal(t, event)
+	}
+
+	extension := mustMarshal(t, &pb.ChaincodeAction{Events: events})
+	responsePayload := mustMarshal(t, &pb.ProposalResponsePayload{Extension: extension})
+	actionPayload := mustMarshal(t, &pb.ChaincodeActionPayload{Action: &pb.ChaincodeEndorsedAction{ProposalResponsePayload: responsePayload}})
+	transaction := mustMarshal(t, &pb.Transaction{Actions: []*pb.TransactionAction{{Payload: actionPayload}}})
+
+	return envelopeOf(t, common.HeaderType_ENDORSER_TRANSACTION, transaction)
+}
+
+func mustMarshal(t *testing.T, message proto.Message) []byte {
+	t.Helper()
+
+	valAsbytes, err := proto.Marshal(message)
+	if err != nil {
+		t.Fatalf("marshal: %s", err)
+	}
+
+	return valAsbytes
+}
+
+func unmarshal(t *testing.T, valAsbytes []byte, into proto.Message) {
+	t.Helper()
+
+	err := proto.Unmarshal(valAsbytes, into)
+	if err != nil {
+		t.Fatalf("unmarshal %T: %s", into, err)
+	}
+}
+
+func TestParseBlock(t *testing.T) {
+	event := func(txId string) *pb.ChaincodeEvent {
+		return &pb.ChaincodeEvent{ChaincodeId: testReferralChaincode, TxId: txId, EventName: "REFERRAL_CREATED", Payload: []byte(`{}`)}
+	}
+
+	transactions := []struct {
+		envelope []byte
+		code     pb.TxValidationCode
+	}{
+		{endorserTransaction(t, event("tx-valid")), pb.TxValidationCode_VALID},
+		{endorserTransaction(t, event("tx-invalid")), pb.TxValidationCode_MVCC_READ_CONFLICT},
+		{endorserTransaction(t, nil), pb.TxValidationCode_VALID},
+		{endorserTransaction(t, &pb.ChaincodeEvent{ChaincodeId: testReferralChaincode, TxId: "tx-unnamed"}), pb.TxValidationCode_VALID},
+		{envelopeOf(t, common.HeaderType_CONFIG, nil), pb.TxValidationCode_VALID},
+		{[]byte("not a transaction"), pb.TxValidationCode_VALID},
+		{endorserTransaction(t, event("tx-after")), pb.TxValidationCode_VALID},
+		// A transaction past the end of the filter has not been validated
+		{endorserTransaction(t, event("tx-unfiltered")), pb.TxValidationCode_VALID},
+	}
+
+	block := &common.Block{
+		Header:   &common.BlockHeader{Number: 7},
+		Data:     &common.BlockData{},
+		Metadata: &common.BlockMetadata{Metadata: make([][]byte, len(common.BlockMetadataIndex_name))},
+	}
+	filter := []byte{}
+	for i, transaction := range transactions {
+		block.Data.Data = append(block.Data.Data, transaction.envelope)
+		if i < len(transactions)-1 {
+			filter = append(filter, byte(transaction.code))
+		}
+	}
+	block.Metadata.Metadata[common.BlockMetadataIndex_TRANSACTIONS_FILTER] = filter
+
+	parsed := parseBlock(block)
+	if parsed.Number != 7 {
+		t.Errorf("block number = %d, want 7", parsed.Number)
+	}
+
+	var txIds []string
+	for _, event := range parsed.ChaincodeEvents {
+		txIds = append(txIds, event.TxID)
+	}
+	if !sameStrings(txIds, []string{"tx-valid", "tx-after"}) {
+		t.Fatalf("events of %v, want only the valid transactions that set a named event", txIds)
+	}
+
+	if got := parsed.ChaincodeEvents[0]; got.ChaincodeID != testReferralChaincode || got.EventName != "REFERRAL_CREATED" || string(got.Payload) != `{}` {
+		t.Errorf("event = %+v", got)
+	}
+}
+
+func TestSeekEnvelope(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &DeliverClient{channel: "mychannel", identity: &Identity{mspId: "Org1MSP", certificate: []byte("certificate"), key: key}}
+	envelope, err := client.seekEnvelope(42)
+	if err != nil {
+		t.Fatalf("seek envelope: %s", err)
+	}
+
+	var signature struct{ R, S *big.Int }
+	_, err = asn1.Unmarshal(envelope.Signature, &signature)
+	if err != nil {
+		t.Fatalf("signature: %s", err)
+	}
+
+	digest := sha256.Sum256(envelope.Payload)
+	if !ecdsa.Verify(&key.PublicKey, digest[:], signature.R, signature.S) {
+		t.Error("signature does not verify against the identity's key")
+	}
+	if signature.S.Cmp(new(big.Int).Rsh(key.Params().N, 1)) > 0 {
+		t.Error("signature is not in its low-S form")
+	}
+
+	var payload common.Payload
+	unmarshal(t, envelope.Payload, &payload)
+	var channelHeader common.ChannelHeader
+	unmarshal(t, payload.GetHeader().GetChannelHeader(), &channelHeader)
+	var signatureHeader common.SignatureHeader
+	unmarshal(t, payload.GetHeader().GetSignatureHeader(), &signatureHeader)
+	var creator msp.SerializedIdentity
+	unmarshal(t, signatureHeader.GetCreator(), &creator)
+	var seekInfo orderer.SeekInfo
+	unmarshal(t, payload.GetData(), &seekInfo)
+
+	if channelHeader.Type != int32(common.HeaderType_DELIVER_SEEK_INFO) || channelHeader.ChannelId != "mychannel" || channelHeader.TxId == "" {
+		t.Errorf("channel header = %+v", &channelHeader)
+	}
+
+	if creator.Mspid != "Org1MSP" || string(creator.IdBytes) != "certificate" {
+		t.Errorf("creator = %+v", &creator)
+	}
+
+	if seekInfo.GetStart().GetSpecified().GetNumber() != 42 || seekInfo.Behavior != orderer.SeekInfo_BLOCK_UNTIL_READY {
+		t.Errorf("seek info = %+v, want every block from 42, waiting for new ones", &seekInfo)
+	}
+}
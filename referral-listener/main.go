@@ -0,0 +1,142 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// The referral listener projects the referral and mortgage chaincode events into a SQLite read model
+// and serves reporting queries from it, so they do not have to go through the chaincodes' Query functions.
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func main() {
+	peerAddress := flag.String("peer", "localhost:7051", "address of the peer to stream blocks from")
+	channel := flag.String("channel", "", "channel the chaincodes are deployed on")
+	mspId := flag.String("msp-id", "", "MSP id of the identity the listener reads blocks as")
+	certPath := flag.String("cert", "", "PEM certificate of the identity the listener reads blocks as")
+	keyPath := flag.String("key", "", "PEM private key of the identity the listener reads blocks as")
+	tlsCAPath := flag.String("tls-ca", "", "PEM certificate of the CA that issued the peer's TLS certificate, TLS is not used without it")
+	tlsServerName := flag.String("tls-server-name", "", "host name to verify the peer's TLS certificate against, if it is not the host in -peer")
+	referralChaincode := flag.String("referral-chaincode", "", "name the referral chaincode was deployed under")
+	mortgageChaincode := flag.String("mortgage-chaincode", "", "name the mortgage chaincode was deployed under")
+	dbPath := flag.String("db", "referrals.db", "path of the SQLite read model")
+	listen := flag.String("listen", ":8080", "address the query API listens on")
+	apiCertPath := flag.String("api-cert", "", "PEM certificate the query API serves TLS with")
+	apiKeyPath := flag.String("api-key", "", "PEM private key of the query API's certificate")
+	clientCAPath := flag.String("client-ca", "", "PEM certificate of the Fabric CA that issues the query API's client certificates")
+	retryInterval := flag.Duration("retry", 5*time.Second, "how long to wait before reconnecting when the block stream fails")
+	flag.Parse()
+
+	if *referralChaincode == "" || *mortgageChaincode == "" {
+		log.Fatal("-referral-chaincode and -mortgage-chaincode are required")
+	}
+
+	if *channel == "" || *mspId == "" || *certPath == "" || *keyPath == "" {
+		log.Fatal("-channel, -msp-id, -cert and -key are required")
+	}
+
+	if *apiCertPath == "" || *apiKeyPath == "" || *clientCAPath == "" {
+		log.Fatal("-api-cert, -api-key and -client-ca are required")
+	}
+
+	clientCAs, err := loadCertPool(*clientCAPath)
+	if err != nil {
+		log.Fatal("Failed to read client CA certificate: ", err)
+	}
+
+	identity, err := LoadIdentity(*mspId, *certPath, *keyPath)
+	if err != nil {
+		log.Fatal("Failed to load identity: ", err)
+	}
+
+	var tlsConfig *tls.Config
+	if *tlsCAPath != "" {
+		roots, err := loadCertPool(*tlsCAPath)
+		if err != nil {
+			log.Fatal("Failed to read TLS CA certificate: ", err)
+		}
+		tlsConfig = &tls.Config{RootCAs: roots, ServerName: *tlsServerName, MinVersion: tls.VersionTLS12}
+	}
+
+	peer, err := NewDeliverClient(*peerAddress, tlsConfig, *channel, identity)
+	if err != nil {
+		log.Fatal("Failed to connect to the peer: ", err)
+	}
+	defer peer.Close()
+
+	store, err := OpenStore(*dbPath)
+	if err != nil {
+		log.Fatal("Failed to open read model: ", err)
+	}
+	defer store.Close()
+
+	checkpoint, err := store.Checkpoint()
+	if err != nil {
+		log.Fatal("Failed to read checkpoint: ", err)
+	}
+	log.Printf("Resuming after block %d", checkpoint)
+
+	projector := NewProjector(peer, store, *referralChaincode, *mortgageChaincode)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		projector.Run(*retryInterval, stop)
+		close(done)
+	}()
+
+	// Callers authenticate with a client certificate, which the API reads their role and departments from
+	server := &http.Server{
+		Addr:      *listen,
+		Handler:   NewAPI(store).Handler(),
+		TLSConfig: &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs, MinVersion: tls.VersionTLS12},
+	}
+	go func() {
+		err := server.ListenAndServeTLS(*apiCertPath, *apiKeyPath)
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatal("Query API failed: ", err)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+
+	// Let the projector finish the block it is on, its checkpoint is committed with the block
+	close(stop)
+	<-done
+	server.Close()
+}
+
+// loadCertPool reads the PEM certificates in a file into a pool
+func loadCertPool(path string) (*x509.CertPool, error) {
+	valAsbytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(valAsbytes) {
+		return nil, errors.New("no certificates found in " + path)
+	}
+
+	return pool, nil
+}
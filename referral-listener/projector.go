@@ -0,0 +1,277 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/joerust/mortgage-referrals/events"
+)
+
+// Projector applies the referral and mortgage chaincode events recorded on the chain to the read model
+type Projector struct {
+	source            BlockSource
+	store             *Store
+	referralChaincode string
+	mortgageChaincode string
+}
+
+// NewProjector returns a projector for the events of the named chaincodes. The names are the ones the
+// chaincodes were deployed under, as they appear in their events.
+func NewProjector(source BlockSource, store *Store, referralChaincode string, mortgageChaincode string) *Projector {
+	return &Projector{
+		source:            source,
+		store:             store,
+		referralChaincode: referralChaincode,
+		mortgageChaincode: mortgageChaincode,
+	}
+}
+
+// Run projects blocks as they are committed until stop is closed. When the stream fails the failure is
+// logged and the stream is opened again after retryInterval, from the last checkpoint.
+func (p *Projector) Run(retryInterval time.Duration, stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for {
+		err := p.Follow(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Println("Failed to project blocks:", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// Follow projects every block after the checkpoint, then each block as it is committed, until ctx is done
+// or a block fails
+func (p *Projector) Follow(ctx context.Context) error {
+	checkpoint, err := p.store.Checkpoint()
+	if err != nil {
+		return err
+	}
+
+	next := uint64(checkpoint + 1)
+	stream, err := p.source.Blocks(ctx, next)
+	if err != nil {
+		return err
+	}
+
+	for {
+		block, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+
+		if block.Number != next {
+			return fmt.Errorf("peer sent block %d, expected block %d", block.Number, next)
+		}
+
+		err = p.applyBlock(block)
+		if err != nil {
+			return fmt.Errorf("block %d: %v", block.Number, err)
+		}
+		next++
+	}
+}
+
+// applyBlock projects the events of a block and moves the checkpoint past it in one database transaction
+func (p *Projector) applyBlock(block Block) error {
+	tx, err := p.store.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, event := range block.ChaincodeEvents {
+		switch event.ChaincodeID {
+		case p.referralChaincode:
+			err = p.applyReferralEvent(tx, block.Number, event)
+		case p.mortgageChaincode:
+			err = p.applyMortgageEvent(tx, block.Number, event)
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("event %s of transaction %s: %v", event.EventName, event.TxID, err)
+		}
+	}
+
+	err = setCheckpoint(tx, block.Number)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// skipEvent records an event the projector cannot read as a dead letter and moves on. The event would fail
+// the same way every time the block is retried, so stopping on it would stop the read model for good.
+func skipEvent(tx *sql.Tx, blockNumber uint64, chaincodeEvent ChaincodeEvent, reason error) error {
+	log.Printf("Skipping event %s of transaction %s in block %d: %v", chaincodeEvent.EventName, chaincodeEvent.TxID, blockNumber, reason)
+	return insertDeadLetter(tx, blockNumber, chaincodeEvent, reason.Error())
+}
+
+// applyReferralEvent projects a referral chaincode event
+func (p *Projector) applyReferralEvent(tx *sql.Tx, blockNumber uint64, chaincodeEvent ChaincodeEvent) error {
+	event, err := events.Decode(chaincodeEvent.Payload)
+	if err != nil {
+		return skipEvent(tx, blockNumber, chaincodeEvent, err)
+	}
+
+	return applyReferralChange(tx, blockNumber, event)
+}
+
+// applyReferralChange projects a referral event. Every event carries the referral's status, departments
+// and version after the change, so the referral row is replaced rather than patched.
+func applyReferralChange(tx *sql.Tx, blockNumber uint64, event events.ReferralEvent) error {
+	if event.EventType == events.ReferralPurged {
+		return deleteReferral(tx, event.ReferralId)
+	}
+
+	existing, err := getReferralRow(tx, event.ReferralId)
+	if err != nil {
+		return err
+	}
+
+	// The version only increases, an event at or below the stored version has already been applied
+	if existing != nil && event.Version <= existing.Version {
+		return nil
+	}
+
+	archived := existing != nil && existing.Archived
+	switch event.EventType {
+	case events.ReferralArchived:
+		archived = true
+	case events.ReferralRestored:
+		archived = false
+	}
+
+	oldStatus := ""
+	if existing != nil {
+		oldStatus = existing.Status
+	}
+
+	// Referrals created before the chaincode emitted events are first seen on a later change, they are
+	// dated from that change
+	_, err = tx.Exec(`INSERT INTO referrals (referral_id, status, version, archived, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (referral_id) DO UPDATE SET status = excluded.status, version = excluded.version,
+			archived = excluded.archived, updated_at = excluded.updated_at`,
+		event.ReferralId, event.NewStatus, event.Version, archived, event.Timestamp, event.Timestamp)
+	if err != nil {
+		return err
+	}
+
+	err = replaceDepartments(tx, event.ReferralId, event.Departments)
+	if err != nil {
+		return err
+	}
+
+	if event.NewStatus != oldStatus {
+		return insertStatusChange(tx, event.ReferralId, oldStatus, event.NewStatus, event.TxId, event.Timestamp, blockNumber)
+	}
+
+	return nil
+}
+
+// applyMortgageEvent projects a mortgage chaincode event. The referral chaincode's own event is not
+// recorded when the mortgage chaincode changes a referral, so the mortgage event carries it. Events
+// written before it did only carry the referral's new status, its version is left for the referral's
+// next event to correct.
+func (p *Projector) applyMortgageEvent(tx *sql.Tx, blockNumber uint64, chaincodeEvent ChaincodeEvent) error {
+	event, err := events.DecodeMortgage(chaincodeEvent.Payload)
+	if err != nil {
+		return skipEvent(tx, blockNumber, chaincodeEvent, err)
+	}
+
+	_, err = tx.Exec(`INSERT INTO mortgages (mortgage_number, referral_id, status, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (mortgage_number) DO UPDATE SET status = excluded.status, updated_at = excluded.updated_at`,
+		event.MortgageNumber, event.ReferralId, event.NewStatus, event.Timestamp)
+	if err != nil {
+		return err
+	}
+
+	if event.Referral != nil {
+		return applyReferralChange(tx, blockNumber, *event.Referral)
+	}
+
+	if event.ReferralStatus == "" {
+		return nil
+	}
+
+	existing, err := getReferralRow(tx, event.ReferralId)
+	if err != nil || existing == nil || existing.Status == event.ReferralStatus {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE referrals SET status = ?, updated_at = ? WHERE referral_id = ?", event.ReferralStatus, event.Timestamp, event.ReferralId)
+	if err != nil {
+		return err
+	}
+
+	return insertStatusChange(tx, event.ReferralId, existing.Status, event.ReferralStatus, event.TxId, event.Timestamp, blockNumber)
+}
+
+// replaceDepartments sets the departments a referral is routed to
+func replaceDepartments(tx *sql.Tx, referralId string, departments []string) error {
+	_, err := tx.Exec("DELETE FROM referral_departments WHERE referral_id = ?", referralId)
+	if err != nil {
+		return err
+	}
+
+	for _, department := range departments {
+		_, err = tx.Exec("INSERT OR IGNORE INTO referral_departments (referral_id, department) VALUES (?, ?)", referralId, department)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// insertStatusChange records a status change of a referral
+func insertStatusChange(tx *sql.Tx, referralId string, oldStatus string, newStatus string, txId string, changedAt int64, blockNumber uint64) error {
+	_, err := tx.Exec("INSERT INTO status_changes (referral_id, old_status, new_status, tx_id, changed_at, block_number) VALUES (?, ?, ?, ?, ?, ?)",
+		referralId, oldStatus, newStatus, txId, changedAt, blockNumber)
+	return err
+}
+
+// deleteReferral removes a purged referral and its history. Its mortgage applications are not purged on
+// the ledger, so they are kept.
+func deleteReferral(tx *sql.Tx, referralId string) error {
+	for _, table := range []string{"referrals", "referral_departments", "status_changes"} {
+		_, err := tx.Exec("DELETE FROM "+table+" WHERE referral_id = ?", referralId)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,259 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/joerust/mortgage-referrals/events"
+)
+
+const (
+	testReferralChaincode = "referrals"
+	testMortgageChaincode = "mortgages"
+)
+
+// fakeSource delivers a fixed chain of blocks, ending each stream with io.EOF once it has sent them all
+type fakeSource struct {
+	blocks []Block
+	starts []uint64
+}
+
+func (s *fakeSource) Blocks(ctx context.Context, start uint64) (BlockStream, error) {
+	s.starts = append(s.starts, start)
+
+	var remaining []Block
+	for _, block := range s.blocks {
+		if block.Number >= start {
+			remaining = append(remaining, block)
+		}
+	}
+
+	return &fakeStream{blocks: remaining}, nil
+}
+
+type fakeStream struct {
+	blocks []Block
+}
+
+func (s *fakeStream) Recv() (Block, error) {
+	if len(s.blocks) == 0 {
+		return Block{}, io.EOF
+	}
+
+	block := s.blocks[0]
+	s.blocks = s.blocks[1:]
+	return block, nil
+}
+
+// openTestStore opens an empty read model in the test's temporary directory
+func openTestStore(t *testing.T) *Store {
+	t.Helper()
+
+	store, err := OpenStore(filepath.Join(t.TempDir(), "referrals.db"))
+	if err != nil {
+		t.Fatalf("open store: %s", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	return store
+}
+
+// referralEvent returns a referral chaincode event moving a referral to a status at a version
+func referralEvent(t *testing.T, eventType string, referralId string, status string, version int64, departments ...string) ChaincodeEvent {
+	t.Helper()
+
+	payload, err := events.ReferralEvent{
+		EventType:   eventType,
+		ReferralId:  referralId,
+		NewStatus:   status,
+		Departments: departments,
+		Version:     version,
+		TxId:        "tx-" + referralId,
+		Timestamp:   1500000000 + version,
+	}.Encode()
+	if err != nil {
+		t.Fatalf("encode event: %s", err)
+	}
+
+	return ChaincodeEvent{ChaincodeID: testReferralChaincode, TxID: "tx-" + referralId, EventName: eventType, Payload: payload}
+}
+
+// follow projects every block of the source, failing the test unless the stream ends with io.EOF
+func follow(t *testing.T, projector *Projector) {
+	t.Helper()
+
+	err := projector.Follow(context.Background())
+	if !errors.Is(err, io.EOF) {
+		t.Fatalf("follow: %v", err)
+	}
+}
+
+func checkCheckpoint(t *testing.T, store *Store, want int64) {
+	t.Helper()
+
+	checkpoint, err := store.Checkpoint()
+	if err != nil || checkpoint != want {
+		t.Fatalf("checkpoint = %d, %v, want %d", checkpoint, err, want)
+	}
+}
+
+func mustGetReferral(t *testing.T, store *Store, referralId string) ReferralView {
+	t.Helper()
+
+	referral, err := store.GetReferral(referralId)
+	if err != nil || referral == nil {
+		t.Fatalf("referral %s: %v, %v", referralId, referral, err)
+	}
+
+	return *referral
+}
+
+func TestProjectorFollowsBlocks(t *testing.T) {
+	store := openTestStore(t)
+
+	mortgagePayload, _ := events.MortgageEvent{
+		EventType:      events.MortgageApplicationCreated,
+		MortgageNumber: "MTG-0000000001",
+		ReferralId:     "REF-1",
+		NewStatus:      "APPLICATION",
+		Referral:       &events.ReferralEvent{EventType: events.MortgageLinked, ReferralId: "REF-1", NewStatus: "OPEN", Departments: []string{"MORTGAGES"}, Version: 3},
+	}.Encode()
+
+	source := &fakeSource{blocks: []Block{
+		{Number: 0},
+		{Number: 1, ChaincodeEvents: []ChaincodeEvent{referralEvent(t, events.ReferralCreated, "REF-1", "NEW", 1, "MORTGAGES")}},
+		{Number: 2, ChaincodeEvents: []ChaincodeEvent{
+			referralEvent(t, events.ReferralStatusChanged, "REF-1", "OPEN", 2, "MORTGAGES"),
+			{ChaincodeID: testMortgageChaincode, TxID: "tx-mortgage", EventName: events.MortgageApplicationCreated, Payload: mortgagePayload},
+		}},
+	}}
+	projector := NewProjector(source, store, testReferralChaincode, testMortgageChaincode)
+
+	follow(t, projector)
+	checkCheckpoint(t, store, 2)
+
+	referral := mustGetReferral(t, store, "REF-1")
+	if referral.Status != "OPEN" || referral.Version != 3 || !sameStrings(referral.MortgageNumbers, []string{"MTG-0000000001"}) {
+		t.Errorf("referral = %+v, want OPEN at version 3 linked to its mortgage", referral)
+	}
+
+	if len(referral.StatusHistory) != 2 || referral.StatusHistory[1].OldStatus != "NEW" || referral.StatusHistory[1].NewStatus != "OPEN" {
+		t.Errorf("status history = %+v, want created then NEW to OPEN", referral.StatusHistory)
+	}
+
+	// The next stream starts after the checkpoint
+	follow(t, projector)
+	if len(source.starts) != 2 || source.starts[0] != 0 || source.starts[1] != 3 {
+		t.Errorf("streams started at %v, want 0 then 3", source.starts)
+	}
+}
+
+func TestProjectorIgnoresAppliedVersions(t *testing.T) {
+	store := openTestStore(t)
+	source := &fakeSource{blocks: []Block{
+		{Number: 0, ChaincodeEvents: []ChaincodeEvent{referralEvent(t, events.ReferralStatusChanged, "REF-1", "OPEN", 2, "MORTGAGES")}},
+		{Number: 1, ChaincodeEvents: []ChaincodeEvent{referralEvent(t, events.ReferralCreated, "REF-1", "NEW", 1, "MORTGAGES")}},
+	}}
+
+	follow(t, NewProjector(source, store, testReferralChaincode, testMortgageChaincode))
+
+	if referral := mustGetReferral(t, store, "REF-1"); referral.Status != "OPEN" || referral.Version != 2 {
+		t.Errorf("referral = %+v, want the later version kept", referral)
+	}
+}
+
+func TestProjectorIgnoresOtherChaincodes(t *testing.T) {
+	store := openTestStore(t)
+	event := referralEvent(t, events.ReferralCreated, "REF-1", "NEW", 1, "MORTGAGES")
+	event.ChaincodeID = "another"
+	source := &fakeSource{blocks: []Block{{Number: 0, ChaincodeEvents: []ChaincodeEvent{event}}}}
+
+	follow(t, NewProjector(source, store, testReferralChaincode, testMortgageChaincode))
+	checkCheckpoint(t, store, 0)
+
+	if referral, err := store.GetReferral("REF-1"); referral != nil || err != nil {
+		t.Errorf("referral = %+v, %v, want the other chaincode's event ignored", referral, err)
+	}
+}
+
+func TestProjectorSkipsUnreadableEvents(t *testing.T) {
+	store := openTestStore(t)
+	source := &fakeSource{blocks: []Block{
+		{Number: 0, ChaincodeEvents: []ChaincodeEvent{
+			{ChaincodeID: testReferralChaincode, TxID: "tx-bad", EventName: events.ReferralCreated, Payload: []byte("not json")},
+			{ChaincodeID: testMortgageChaincode, TxID: "tx-newer", EventName: events.MortgageStatusChanged, Payload: []byte(`{"schemaVersion":99,"eventType":"MORTGAGE_STATUS_CHANGED","mortgageNumber":"MTG-1"}`)},
+			referralEvent(t, events.ReferralCreated, "REF-1", "NEW", 1, "MORTGAGES"),
+		}},
+	}}
+
+	follow(t, NewProjector(source, store, testReferralChaincode, testMortgageChaincode))
+	checkCheckpoint(t, store, 0)
+	mustGetReferral(t, store, "REF-1")
+
+	count, err := store.CountDeadLetters()
+	if err != nil || count != 2 {
+		t.Fatalf("dead letters = %d, %v, want both unreadable events", count, err)
+	}
+
+	var txId, reason string
+	err = store.db.QueryRow("SELECT tx_id, reason FROM dead_letters WHERE chaincode_id = ?", testMortgageChaincode).Scan(&txId, &reason)
+	if err != nil || txId != "tx-newer" || reason == "" {
+		t.Errorf("dead letter = %q, %q, %v, want the mortgage event with its reason", txId, reason, err)
+	}
+}
+
+func TestProjectorStopsAtMissingBlock(t *testing.T) {
+	store := openTestStore(t)
+	source := &fakeSource{blocks: []Block{
+		{Number: 0},
+		{Number: 2, ChaincodeEvents: []ChaincodeEvent{referralEvent(t, events.ReferralCreated, "REF-1", "NEW", 1, "MORTGAGES")}},
+	}}
+
+	err := NewProjector(source, store, testReferralChaincode, testMortgageChaincode).Follow(context.Background())
+	if err == nil || errors.Is(err, io.EOF) {
+		t.Fatalf("follow: %v, want the missing block reported", err)
+	}
+	checkCheckpoint(t, store, 0)
+}
+
+func TestProjectorRunStops(t *testing.T) {
+	store := openTestStore(t)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		NewProjector(&fakeSource{}, store, testReferralChaincode, testMortgageChaincode).Run(0, stop)
+		close(done)
+	}()
+
+	close(stop)
+	<-done
+}
+
+func sameStrings(got []string, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,376 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"database/sql"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// schema creates the read model. The tables only hold what the chaincode events carry, the customer's
+// personal details stay on the ledger.
+const schema = `
+CREATE TABLE IF NOT EXISTS checkpoint (
+	id           INTEGER PRIMARY KEY CHECK (id = 1),
+	block_number INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS referrals (
+	referral_id TEXT PRIMARY KEY,
+	status      TEXT NOT NULL,
+	version     INTEGER NOT NULL,
+	archived    INTEGER NOT NULL DEFAULT 0,
+	created_at  INTEGER NOT NULL,
+	updated_at  INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS referrals_status ON referrals (status);
+
+CREATE TABLE IF NOT EXISTS referral_departments (
+	referral_id TEXT NOT NULL,
+	department  TEXT NOT NULL,
+	PRIMARY KEY (referral_id, department)
+);
+
+CREATE INDEX IF NOT EXISTS referral_departments_department ON referral_departments (department);
+
+CREATE TABLE IF NOT EXISTS status_changes (
+	referral_id  TEXT NOT NULL,
+	old_status   TEXT NOT NULL,
+	new_status   TEXT NOT NULL,
+	tx_id        TEXT NOT NULL,
+	changed_at   INTEGER NOT NULL,
+	block_number INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS status_changes_referral ON status_changes (referral_id);
+
+CREATE TABLE IF NOT EXISTS mortgages (
+	mortgage_number TEXT PRIMARY KEY,
+	referral_id     TEXT NOT NULL,
+	status          TEXT NOT NULL,
+	updated_at      INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS mortgages_referral ON mortgages (referral_id);
+
+CREATE TABLE IF NOT EXISTS dead_letters (
+	block_number INTEGER NOT NULL,
+	tx_id        TEXT NOT NULL,
+	chaincode_id TEXT NOT NULL,
+	event_name   TEXT NOT NULL,
+	payload      BLOB NOT NULL,
+	reason       TEXT NOT NULL
+);
+`
+
+// noCheckpoint is the checkpoint of a store that has not processed any block
+const noCheckpoint = -1
+
+// Store is the SQLite read model
+type Store struct {
+	db *sql.DB
+}
+
+// OpenStore opens the SQLite database at the given path, creating the schema if needed
+func OpenStore(path string) (*Store, error) {
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite allows a single writer, one connection keeps the projector and the API from contending for it
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(schema)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Store{db: db}, nil
+}
+
+// Close closes the database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Checkpoint returns the number of the last block processed, or noCheckpoint if there is none
+func (s *Store) Checkpoint() (int64, error) {
+	var blockNumber int64
+	err := s.db.QueryRow("SELECT block_number FROM checkpoint WHERE id = 1").Scan(&blockNumber)
+	if err == sql.ErrNoRows {
+		return noCheckpoint, nil
+	}
+
+	return blockNumber, err
+}
+
+// setCheckpoint records the last block processed as part of the transaction that applied it, so a
+// block is either projected and checkpointed or neither
+func setCheckpoint(tx *sql.Tx, blockNumber uint64) error {
+	_, err := tx.Exec(`INSERT INTO checkpoint (id, block_number) VALUES (1, ?)
+		ON CONFLICT (id) DO UPDATE SET block_number = excluded.block_number`, blockNumber)
+	return err
+}
+
+// insertDeadLetter keeps an event the projector could not read, with the reason, so it can be looked at
+// and replayed once the listener understands it
+func insertDeadLetter(tx *sql.Tx, blockNumber uint64, event ChaincodeEvent, reason string) error {
+	_, err := tx.Exec("INSERT INTO dead_letters (block_number, tx_id, chaincode_id, event_name, payload, reason) VALUES (?, ?, ?, ?, ?, ?)",
+		blockNumber, event.TxID, event.ChaincodeID, event.EventName, event.Payload, reason)
+	return err
+}
+
+// CountDeadLetters returns the number of events the projector skipped
+func (s *Store) CountDeadLetters() (int64, error) {
+	var count int64
+	err := s.db.QueryRow("SELECT COUNT(*) FROM dead_letters").Scan(&count)
+	return count, err
+}
+
+// referralRow is the stored state of a referral the projector compares events against
+type referralRow struct {
+	Status   string
+	Version  int64
+	Archived bool
+}
+
+// getReferralRow returns the stored referral, or nil if the read model has not seen it
+func getReferralRow(tx *sql.Tx, referralId string) (*referralRow, error) {
+	var row referralRow
+	err := tx.QueryRow("SELECT status, version, archived FROM referrals WHERE referral_id = ?", referralId).
+		Scan(&row.Status, &row.Version, &row.Archived)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &row, nil
+}
+
+// ReferralView is a referral as the query API returns it
+type ReferralView struct {
+	ReferralId      string         `json:"referralId"`
+	Status          string         `json:"status"`
+	Departments     []string       `json:"departments"`
+	Version         int64          `json:"version"`
+	Archived        bool           `json:"archived"`
+	CreatedAt       int64          `json:"createdAt"`
+	UpdatedAt       int64          `json:"updatedAt"`
+	MortgageNumbers []string       `json:"mortgageNumbers"`
+	StatusHistory   []StatusChange `json:"statusHistory,omitempty"`
+}
+
+// StatusChange is one status change of a referral
+type StatusChange struct {
+	OldStatus string `json:"oldStatus"`
+	NewStatus string `json:"newStatus"`
+	TxId      string `json:"txId"`
+	ChangedAt int64  `json:"changedAt"`
+}
+
+// ReferralFilter selects the referrals ListReferrals returns. Empty fields match everything, except
+// Departments, which matches everything only when it is nil.
+type ReferralFilter struct {
+	Status          string
+	Departments     []string
+	IncludeArchived bool
+	Limit           int
+	Offset          int
+}
+
+// ListReferrals returns the referrals matching the filter, oldest first
+func (s *Store) ListReferrals(filter ReferralFilter) ([]ReferralView, error) {
+	var conditions []string
+	var args []interface{}
+
+	if filter.Status != "" {
+		conditions = append(conditions, "r.status = ?")
+		args = append(args, filter.Status)
+	}
+
+	if filter.Departments != nil {
+		condition, departmentArgs := inDepartments(filter.Departments)
+		conditions = append(conditions, condition)
+		args = append(args, departmentArgs...)
+	}
+
+	if !filter.IncludeArchived {
+		conditions = append(conditions, "r.archived = 0")
+	}
+
+	query := "SELECT r.referral_id, r.status, r.version, r.archived, r.created_at, r.updated_at FROM referrals r"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY r.created_at, r.referral_id LIMIT ? OFFSET ?"
+	args = append(args, filter.Limit, filter.Offset)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	referrals := []ReferralView{}
+	for rows.Next() {
+		var referral ReferralView
+		err = rows.Scan(&referral.ReferralId, &referral.Status, &referral.Version, &referral.Archived, &referral.CreatedAt, &referral.UpdatedAt)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		referrals = append(referrals, referral)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	for i := range referrals {
+		err = s.loadRelations(&referrals[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return referrals, nil
+}
+
+// inDepartments returns the condition matching referrals routed to any of the departments, and its arguments.
+// No departments matches no referrals.
+func inDepartments(departments []string) (string, []interface{}) {
+	if len(departments) == 0 {
+		return "0", nil
+	}
+
+	args := make([]interface{}, len(departments))
+	for i := range departments {
+		args[i] = departments[i]
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(departments)), ", ")
+	return "EXISTS (SELECT 1 FROM referral_departments d WHERE d.referral_id = r.referral_id AND d.department IN (" + placeholders + "))", args
+}
+
+// GetReferral returns a referral with its status history, or nil if the read model has not seen it
+func (s *Store) GetReferral(referralId string) (*ReferralView, error) {
+	var referral ReferralView
+	err := s.db.QueryRow("SELECT referral_id, status, version, archived, created_at, updated_at FROM referrals WHERE referral_id = ?", referralId).
+		Scan(&referral.ReferralId, &referral.Status, &referral.Version, &referral.Archived, &referral.CreatedAt, &referral.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.loadRelations(&referral)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query("SELECT old_status, new_status, tx_id, changed_at FROM status_changes WHERE referral_id = ? ORDER BY rowid", referralId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	referral.StatusHistory = []StatusChange{}
+	for rows.Next() {
+		var change StatusChange
+		err = rows.Scan(&change.OldStatus, &change.NewStatus, &change.TxId, &change.ChangedAt)
+		if err != nil {
+			return nil, err
+		}
+		referral.StatusHistory = append(referral.StatusHistory, change)
+	}
+
+	return &referral, rows.Err()
+}
+
+// loadRelations fills in the departments and mortgage numbers of a referral
+func (s *Store) loadRelations(referral *ReferralView) error {
+	var err error
+	referral.Departments, err = s.queryStrings("SELECT department FROM referral_departments WHERE referral_id = ? ORDER BY department", referral.ReferralId)
+	if err != nil {
+		return err
+	}
+
+	referral.MortgageNumbers, err = s.queryStrings("SELECT mortgage_number FROM mortgages WHERE referral_id = ? ORDER BY mortgage_number", referral.ReferralId)
+	return err
+}
+
+// queryStrings returns the single string column of a query's rows
+func (s *Store) queryStrings(query string, args ...interface{}) ([]string, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	values := []string{}
+	for rows.Next() {
+		var value string
+		err = rows.Scan(&value)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+
+	return values, rows.Err()
+}
+
+// StatusCount is the number of referrals in a status
+type StatusCount struct {
+	Status string `json:"status"`
+	Count  int64  `json:"count"`
+}
+
+// CountByStatus returns the number of unarchived referrals in each status. Only referrals routed to one
+// of the departments are counted, unless departments is nil.
+func (s *Store) CountByStatus(departments []string) ([]StatusCount, error) {
+	query := "SELECT r.status, COUNT(*) FROM referrals r WHERE r.archived = 0"
+	var args []interface{}
+	if departments != nil {
+		condition, departmentArgs := inDepartments(departments)
+		query += " AND " + condition
+		args = departmentArgs
+	}
+	query += " GROUP BY r.status ORDER BY r.status"
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []StatusCount{}
+	for rows.Next() {
+		var count StatusCount
+		err = rows.Scan(&count.Status, &count.Count)
+		if err != nil {
+			return nil, err
+		}
+		counts = append(counts, count)
+	}
+
+	return counts, rows.Err()
+}
@@ -0,0 +1,216 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+
+	"github.com/joerust/mortgage-referrals/ledger"
+)
+
+// Caller roles, read from the "role" attribute of the transaction certificate
+const (
+	RoleEmployee = "employee"
+	RoleMortgage = "mortgage"
+	RoleAdmin    = "admin"
+)
+
+// Transaction certificate attributes describing the caller
+const (
+	roleAttribute        = "role"
+	employeeIdAttribute  = "employeeId"
+	departmentsAttribute = "departments"
+	piiAttribute         = "pii"
+)
+
+// anyRole lets every authenticated caller run a function
+var anyRole = []string{RoleEmployee, RoleMortgage, RoleAdmin}
+
+// functionRoles is the authorization policy, listing the roles allowed to run each Invoke and Query
+// function. Functions that are not listed cannot be run by anyone.
+var functionRoles = map[string][]string{
+	"init":                 {RoleAdmin},
+	"createReferral":       {RoleEmployee, RoleAdmin},
+	"updateReferralStatus": {RoleEmployee, RoleAdmin},
+	"updateReferral":       {RoleEmployee, RoleAdmin},
+	"addDepartment":        {RoleEmployee, RoleAdmin},
+	"removeDepartment":     {RoleEmployee, RoleAdmin},
+	"archiveReferral":      {RoleEmployee, RoleAdmin},
+	"restoreReferral":      {RoleAdmin},
+	"purgeReferral":        {RoleAdmin},
+	"migrateIndexes":       {RoleAdmin},
+	"migrateReferralKeys":  {RoleAdmin},
+	"migrateContactIndex":  {RoleAdmin},
+	"purgeLegacyTokens":    {RoleAdmin},
+	"sealLegacyPII":        {RoleAdmin},
+	"rebuildIndexes":       {RoleAdmin},
+	"linkMortgage":         {RoleMortgage, RoleAdmin},
+	"followMortgageStatus": {RoleMortgage, RoleAdmin},
+	"read":                 anyRole,
+	"searchByStatus":       anyRole,
+	"searchByDepartment":   anyRole,
+	"searchByEmployee":     anyRole,
+	"searchByCustomer":     anyRole,
+	"getStatusTransitions": anyRole,
+	"getReferralHistory":   anyRole,
+	"queryReferrals":       anyRole,
+	"checkIndexes":         {RoleAdmin},
+}
+
+// Caller is the identity behind the current transaction
+type Caller struct {
+	Id          string   `json:"id"`
+	Role        string   `json:"role"`
+	EmployeeId  string   `json:"employeeId"`
+	Departments []string `json:"departments"`
+	PII         bool     `json:"pii"`
+}
+
+// AccessError is returned when the caller is not allowed to do what they asked
+type AccessError struct {
+	Function string `json:"function"`
+	Role     string `json:"role"`
+	Reason   string `json:"reason"`
+}
+
+func (e *AccessError) Error() string {
+	return e.Envelope().Error()
+}
+
+func (e *AccessError) Envelope() *ChaincodeError {
+	return newErrorDetails(ErrCodeAccessDenied, "Access denied", e)
+}
+
+// readAttribute returns a certificate attribute, or an empty string if the certificate does not carry it
+func readAttribute(name string, stub ledger.Stub) string {
+	valAsbytes, err := stub.ReadCertAttribute(name)
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(valAsbytes))
+}
+
+// getCaller builds the caller identity from the transaction certificate and its attributes
+func getCaller(stub ledger.Stub) Caller {
+	caller := Caller{
+		Role:        readAttribute(roleAttribute, stub),
+		EmployeeId:  readAttribute(employeeIdAttribute, stub),
+		Departments: []string{},
+		PII:         readAttribute(piiAttribute, stub) == "true",
+	}
+
+	for _, department := range strings.Split(readAttribute(departmentsAttribute, stub), ",") {
+		if department = strings.TrimSpace(department); department != "" {
+			caller.Departments = append(caller.Departments, department)
+		}
+	}
+
+	certificate, err := stub.GetCallerCertificate()
+	if err == nil && len(certificate) > 0 {
+		hash := sha256.Sum256(certificate)
+		caller.Id = hex.EncodeToString(hash[:])
+	}
+
+	return caller
+}
+
+// authorize looks up the caller and checks the policy allows their role to run the function
+func (t *ReferralChaincode) authorize(stub ledger.Stub, function string) (Caller, error) {
+	caller := getCaller(stub)
+
+	for _, role := range functionRoles[function] {
+		if caller.Role == role {
+			return caller, nil
+		}
+	}
+
+	return caller, &AccessError{Function: function, Role: caller.Role, Reason: "role is not allowed to run this function"}
+}
+
+// isAdmin reports whether the caller bypasses the per-referral checks
+func (c Caller) isAdmin() bool {
+	return c.Role == RoleAdmin
+}
+
+// inDepartment reports whether the caller belongs to any of the departments
+func (c Caller) inDepartment(departments []string) bool {
+	for i := range c.Departments {
+		for j := range departments {
+			if c.Departments[i] == departments[j] {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// authorizeCreate checks employees only create referrals under their own employee id
+func (c Caller) authorizeCreate(referral CustomerReferral) error {
+	if c.isAdmin() || (c.EmployeeId != "" && c.EmployeeId == referral.EmployeeId) {
+		return nil
+	}
+
+	return &AccessError{Function: "createReferral", Role: c.Role, Reason: "referrals can only be created under the caller's own employeeId"}
+}
+
+// authorizeChange checks the caller belongs to one of the departments the referral is routed to
+func (c Caller) authorizeChange(function string, referral CustomerReferral) error {
+	if c.isAdmin() || c.inDepartment(referral.Departments) {
+		return nil
+	}
+
+	return &AccessError{Function: function, Role: c.Role, Reason: "only the referral's departments can change it"}
+}
+
+// canReadPII reports whether the caller may see the customer's personal details on the referral. The
+// caller needs the pii attribute and has to be an admin or belong to one of the referral's departments.
+func (c Caller) canReadPII(referral CustomerReferral) bool {
+	return c.PII && (c.isAdmin() || c.inDepartment(referral.Departments))
+}
+
+// redactReferral returns the stored referral bytes as the caller may see them, with the customer's
+// personal details decrypted for callers who may read them and masked for everyone else
+func (c Caller) redactReferral(valAsbytes []byte, stub ledger.Stub) ([]byte, error) {
+	var referral CustomerReferral
+	err := json.Unmarshal(valAsbytes, &referral)
+	if err != nil {
+		return nil, err
+	}
+
+	if !c.canReadPII(referral) {
+		key, err := getPIIKey(stub)
+		if err != nil {
+			return nil, err
+		}
+
+		maskReferralPII(&referral, key)
+		return json.Marshal(referral)
+	}
+
+	if !isSealed(referral.CustomerName) && !isSealed(referral.ContactNumber) {
+		return valAsbytes, nil
+	}
+
+	err = openReferralPII(&referral, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(referral)
+}
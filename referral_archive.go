@@ -0,0 +1,410 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/joerust/mortgage-referrals/events"
+	"github.com/joerust/mortgage-referrals/ledger"
+)
+
+// indexReferral adds the referral to every index createReferral populates
+func (t *ReferralChaincode) indexReferral(referralId string, referral CustomerReferral, referredAt int64, stub ledger.Stub) error {
+	err := t.indexByStatus(referralId, referral.Status, stub)
+	if err != nil {
+		return err
+	}
+
+	for i := range referral.Departments {
+		err = t.indexByDepartment(referralId, referral.Departments[i], stub)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = t.indexByEmployee(referralId, referral.EmployeeId, stub)
+	if err != nil {
+		return err
+	}
+
+	return t.indexByCustomer(referralId, referral, referredAt, stub)
+}
+
+// unindexReferral removes the referral from every index createReferral populates
+func (t *ReferralChaincode) unindexReferral(referralId string, referral CustomerReferral, stub ledger.Stub) error {
+	err := t.removeStatusReferralIndex(referralId, referral.Status, stub)
+	if err != nil {
+		return err
+	}
+
+	for i := range referral.Departments {
+		err = t.removeDepartmentReferralIndex(referralId, referral.Departments[i], stub)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = t.removeEmployeeReferralIndex(referralId, referral.EmployeeId, stub)
+	if err != nil {
+		return err
+	}
+
+	return t.removeCustomerReferralIndex(referralId, referral, stub)
+}
+
+// isArchived reports whether the stored referral bytes are for an archived referral
+func isArchived(valAsbytes []byte) (bool, error) {
+	var referral CustomerReferral
+	err := json.Unmarshal(valAsbytes, &referral)
+	if err != nil {
+		return false, err
+	}
+
+	return referral.Archived, nil
+}
+
+// checkNotArchived rejects changes to an archived referral, it has to be restored first
+func checkNotArchived(referralId string, referral CustomerReferral) error {
+	if referral.Archived {
+		return newError(ErrCodeFailedPrecondition, "Referral "+referralId+" is archived and must be restored before it can be changed")
+	}
+
+	return nil
+}
+
+// parseArchiveArgs reads the referral id and optional reason code of an archive, restore or purge
+func parseArchiveArgs(args []string, fallback string) (string, string, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return "", "", newError(ErrCodeInvalidArgument, "Incorrect number of arguments. Expecting the referral id and an optional reason code")
+	}
+
+	reasonCode := ""
+	if len(args) == 2 {
+		reasonCode = args[1]
+	}
+
+	reasonCode, err := checkReasonCode(reasonCode, fallback)
+	if err != nil {
+		return "", "", err
+	}
+
+	return args[0], reasonCode, nil
+}
+
+// setArchived flips the archived flag on a referral, writing the record and its audit entry
+func setArchived(key string, referral CustomerReferral, archived bool, action string, reasonCode string, stub ledger.Stub) ([]byte, error) {
+	oldAsbytes, err := json.Marshal(referral)
+	if err != nil {
+		return nil, err
+	}
+
+	referral.Archived = archived
+	err = touchReferral(&referral, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	valAsbytes, err := json.Marshal(referral)
+	if err != nil {
+		return nil, err
+	}
+
+	err = putReferralBytes(key, valAsbytes, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = appendAuditEntry(key, oldAsbytes, valAsbytes, action, reasonCode, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	eventType := events.ReferralRestored
+	if archived {
+		eventType = events.ReferralArchived
+	}
+
+	err = emitReferralEvent(eventType, referral.Status, referral, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	return valAsbytes, nil
+}
+
+// archiveReferral - invoke function hiding a referral from every search. Expects the referral id and an
+// optional reason code. The record is kept and can still be read by admins until it is restored or purged.
+func (t *ReferralChaincode) archiveReferral(stub ledger.Stub, caller Caller, args []string) ([]byte, error) {
+
+	key, reasonCode, err := parseArchiveArgs(args, ReasonArchived)
+	if err != nil {
+		return nil, err
+	}
+
+	referral, err := getReferral(key, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = caller.authorizeChange("archiveReferral", referral)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkNotArchived(key, referral)
+	if err != nil {
+		return nil, err
+	}
+
+	valAsbytes, err := setArchived(key, referral, true, "archiveReferral", reasonCode, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.unindexReferral(key, referral, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	return valAsbytes, nil
+}
+
+// restoreReferral - invoke function returning an archived referral to the searches. Expects the referral
+// id and an optional reason code.
+func (t *ReferralChaincode) restoreReferral(stub ledger.Stub, caller Caller, args []string) ([]byte, error) {
+
+	key, reasonCode, err := parseArchiveArgs(args, ReasonRestored)
+	if err != nil {
+		return nil, err
+	}
+
+	referral, err := getReferral(key, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	if !referral.Archived {
+		return nil, newError(ErrCodeFailedPrecondition, "Referral "+key+" is not archived")
+	}
+
+	valAsbytes, err := setArchived(key, referral, false, "restoreReferral", reasonCode, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	// The customer indexes record when the referral was made, which is its create date
+	err = t.indexReferral(key, referral, referral.CreateDate, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	return valAsbytes, nil
+}
+
+// purgeReferral - invoke function permanently deleting a referral for a data retention request. Expects
+// the referral id and an optional reason code. The record, every index entry and any stored idempotent
+// result are deleted, and the customer's personal details are blanked in the audit trail. The audit
+// trail itself is kept and records the purge.
+func (t *ReferralChaincode) purgeReferral(stub ledger.Stub, caller Caller, args []string) ([]byte, error) {
+
+	key, reasonCode, err := parseArchiveArgs(args, ReasonPurged)
+	if err != nil {
+		return nil, err
+	}
+
+	referral, err := getReferral(key, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.unindexReferral(key, referral, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	recordKey, err := referralKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	err = stub.DelState(recordKey)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Failed to delete state for "+key)
+	}
+
+	err = purgeIdempotentResults(key, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = redactAuditTrail(key, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = appendAuditEntry(key, nil, []byte("{}"), "purgeReferral", reasonCode, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = emitReferralEvent(events.ReferralPurged, referral.Status, referral, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// purgeIdempotentResults deletes the stored createReferral results for a referral, they hold a full copy
+// of it. The tokens are found through the referral's idempotency index.
+func purgeIdempotentResults(referralId string, stub ledger.Stub) error {
+	prefix, err := createCompositeKey(idempotencyIndex, referralId)
+	if err != nil {
+		return err
+	}
+
+	keysIter, err := stub.RangeQueryState(prefix, prefix+maxUnicodeRune)
+	if err != nil {
+		return newError(ErrCodeLedger, "Failed to scan idempotency index for "+referralId)
+	}
+	defer keysIter.Close()
+
+	var purged []string
+	for keysIter.HasNext() {
+		indexKey, _, err := keysIter.Next()
+		if err != nil {
+			return err
+		}
+
+		_, attributes, err := splitCompositeKey(indexKey)
+		if err != nil || len(attributes) != 3 {
+			continue
+		}
+
+		key, err := idempotencyKey(attributes[1], attributes[2])
+		if err != nil {
+			return err
+		}
+		purged = append(purged, key, indexKey)
+	}
+
+	for _, key := range purged {
+		err = stub.DelState(key)
+		if err != nil {
+			return newError(ErrCodeLedger, "Failed to delete idempotency record for "+referralId)
+		}
+	}
+
+	return nil
+}
+
+// purgeLegacyTokens - invoke function deleting the idempotency records stored before tokens were scoped
+// to their caller. They can no longer be returned but hold a full copy of their referral, which
+// purgeReferral cannot find without scanning them all. Takes no arguments and deletes up to
+// maxRebuildBatchSize records a call, returning how many it deleted and whether any are left.
+func (t *ReferralChaincode) purgeLegacyTokens(stub ledger.Stub, args []string) ([]byte, error) {
+
+	if len(args) != 0 {
+		return nil, newError(ErrCodeInvalidArgument, "Incorrect number of arguments. Expecting none")
+	}
+
+	prefix, err := createCompositeKey(legacyIdempotency)
+	if err != nil {
+		return nil, err
+	}
+
+	keysIter, err := stub.RangeQueryState(prefix, prefix+maxUnicodeRune)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Failed to scan legacy idempotency records")
+	}
+	defer keysIter.Close()
+
+	var purged []string
+	for keysIter.HasNext() && len(purged) < maxRebuildBatchSize {
+		key, _, err := keysIter.Next()
+		if err != nil {
+			return nil, err
+		}
+		purged = append(purged, key)
+	}
+	remaining := keysIter.HasNext()
+
+	for _, key := range purged {
+		err = stub.DelState(key)
+		if err != nil {
+			return nil, newError(ErrCodeLedger, "Failed to delete legacy idempotency record")
+		}
+	}
+
+	return json.Marshal(PurgeResult{Purged: len(purged), Remaining: remaining})
+}
+
+// PurgeResult reports a batch deleted by purgeLegacyTokens
+type PurgeResult struct {
+	Purged    int  `json:"purged"`
+	Remaining bool `json:"remaining"`
+}
+
+// redactAuditTrail blanks the customer's personal details in every audit entry of a referral
+func redactAuditTrail(referralId string, stub ledger.Stub) error {
+	prefix, err := createCompositeKey(auditNamespace, referralId)
+	if err != nil {
+		return err
+	}
+
+	keysIter, err := stub.RangeQueryState(prefix, prefix+maxUnicodeRune)
+	if err != nil {
+		return newError(ErrCodeLedger, "Failed to scan audit trail for "+referralId)
+	}
+	defer keysIter.Close()
+
+	var keys []string
+	var redacted [][]byte
+	for keysIter.HasNext() {
+		key, valAsbytes, err := keysIter.Next()
+		if err != nil {
+			return err
+		}
+
+		var entry AuditEntry
+		err = json.Unmarshal(valAsbytes, &entry)
+		if err != nil {
+			return err
+		}
+
+		for i := range entry.Changes {
+			if piiFields[entry.Changes[i].Field] {
+				entry.Changes[i].Old = nil
+				entry.Changes[i].New = nil
+			}
+		}
+
+		valAsbytes, err = json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+		redacted = append(redacted, valAsbytes)
+	}
+
+	for i := range keys {
+		err = stub.PutState(keys[i], redacted[i])
+		if err != nil {
+			return newError(ErrCodeLedger, "Failed to redact audit trail for "+referralId)
+		}
+	}
+
+	return nil
+}
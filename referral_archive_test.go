@@ -0,0 +1,309 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/joerust/mortgage-referrals/events"
+)
+
+// searchIndexes lists every index a seeded referral is found under
+func searchIndexes() []struct{ name, value string } {
+	return []struct{ name, value string }{
+		{statusIndex, StatusNew},
+		{departmentIndex, "MORTGAGES"},
+		{employeeIndex, "E1"},
+		{customerIndex, "C1"},
+		{contactIndex, contactIndexValue("+15551234567", testPIIKey)},
+	}
+}
+
+func TestArchiveReferral(t *testing.T) {
+	runInvokeCases(t, "archiveReferral", []invokeCase{
+		{
+			name: "hides the referral from every index",
+			args: []string{testReferralId},
+			check: func(t *testing.T, h *harness, result []byte) {
+				if referral := h.stored(testReferralId); !referral.Archived || referral.Version != 2 {
+					t.Fatalf("stored %+v", referral)
+				}
+
+				for _, index := range searchIndexes() {
+					if got := h.indexed(index.name, index.value); len(got) != 0 {
+						t.Errorf("%s index still holds %v", index.name, got)
+					}
+				}
+
+				checkEvent(t, h, events.ReferralArchived, 2)
+			},
+		},
+		{
+			name: "is only readable by admins",
+			args: []string{testReferralId},
+			check: func(t *testing.T, h *harness, result []byte) {
+				_, err := h.as(mortgagesEmployee).query("read", testReferralId)
+				checkCode(t, err, ErrCodeNotFound)
+
+				if referral := h.read(adminCaller, testReferralId); !referral.Archived {
+					t.Fatalf("admin read %+v", referral)
+				}
+			},
+		},
+		{
+			name:  "needs no pii key",
+			setup: func(h *harness) { h.stub.Metadata = nil },
+			args:  []string{testReferralId},
+			check: func(t *testing.T, h *harness, result []byte) {
+				if got := h.indexed(contactIndex, contactIndexValue("+15551234567", testPIIKey)); len(got) != 0 {
+					t.Errorf("contact index still holds %v", got)
+				}
+			},
+		},
+		{name: "already archived", setup: func(h *harness) { h.mustInvoke(adminCaller, "archiveReferral", testReferralId) }, args: []string{testReferralId}, code: ErrCodeFailedPrecondition},
+		{name: "another department", caller: savingsEmployee, args: []string{testReferralId}, code: ErrCodeAccessDenied},
+		{name: "mortgage service", caller: mortgageService, args: []string{testReferralId}, code: ErrCodeAccessDenied},
+		{name: "unknown referral", args: []string{"REF-0000000099"}, code: ErrCodeNotFound},
+		{name: "invalid reason code", args: []string{testReferralId, "tidy up"}, code: ErrCodeInvalidArgument},
+		{name: "no arguments", code: ErrCodeInvalidArgument},
+	})
+}
+
+func TestRestoreReferral(t *testing.T) {
+	archive := func(h *harness) { h.mustInvoke(adminCaller, "archiveReferral", testReferralId) }
+
+	runInvokeCases(t, "restoreReferral", []invokeCase{
+		{
+			name:   "returns the referral to every index",
+			setup:  func(h *harness) { h.stub.Time += 60; archive(h) },
+			caller: adminCaller,
+			args:   []string{testReferralId, "RETURNED"},
+			check: func(t *testing.T, h *harness, result []byte) {
+				if referral := h.stored(testReferralId); referral.Archived || referral.Version != 3 {
+					t.Fatalf("stored %+v", referral)
+				}
+
+				for _, index := range searchIndexes() {
+					if got := h.indexed(index.name, index.value); !sameStrings(got, []string{testReferralId}) {
+						t.Errorf("%s index holds %v", index.name, got)
+					}
+				}
+
+				// Duplicate detection still dates the referral from when it was made
+				entries := h.indexEntries(customerIndex, "C1")
+				if len(entries) != 1 || string(entries[0].Value) != "1500000000" {
+					t.Fatalf("customer index entries %+v", entries)
+				}
+
+				checkEvent(t, h, events.ReferralRestored, 3)
+			},
+		},
+		{
+			name:   "needs no pii key",
+			setup:  func(h *harness) { archive(h); h.stub.Metadata = nil },
+			caller: adminCaller,
+			args:   []string{testReferralId},
+			check: func(t *testing.T, h *harness, result []byte) {
+				if got := h.indexed(contactIndex, contactIndexValue("+15551234567", testPIIKey)); !sameStrings(got, []string{testReferralId}) {
+					t.Errorf("contact index holds %v", got)
+				}
+			},
+		},
+		{name: "not archived", caller: adminCaller, args: []string{testReferralId}, code: ErrCodeFailedPrecondition},
+		{name: "employee", setup: archive, args: []string{testReferralId}, code: ErrCodeAccessDenied},
+		{name: "unknown referral", caller: adminCaller, args: []string{"REF-0000000099"}, code: ErrCodeNotFound},
+	})
+}
+
+func TestPurgeReferral(t *testing.T) {
+	runInvokeCases(t, "purgeReferral", []invokeCase{
+		{
+			name: "deletes the referral and its index entries",
+			setup: func(h *harness) {
+				h.mustInvoke(mortgagesEmployee, "createReferral", `{"customerName":"John Doe","contactNumber":"+15559876543","customerId":"C1","employeeId":"E1","departments":["MORTGAGES"],"status":"NEW"}`, "token-1")
+			},
+			caller: adminCaller,
+			args:   []string{testReferralId},
+			check: func(t *testing.T, h *harness, result []byte) {
+				if h.exists(testReferralId) {
+					t.Fatal("referral is still on the ledger")
+				}
+
+				// The other referral of the customer is left alone
+				if got := h.indexed(customerIndex, "C1"); !sameStrings(got, []string{"REF-0000000002"}) {
+					t.Fatalf("customer index holds %v", got)
+				}
+
+				for _, index := range searchIndexes()[:3] {
+					if got := h.indexed(index.name, index.value); !sameStrings(got, []string{"REF-0000000002"}) {
+						t.Errorf("%s index holds %v", index.name, got)
+					}
+				}
+
+				_, err := h.as(adminCaller).query("read", testReferralId)
+				checkCode(t, err, ErrCodeNotFound)
+
+				checkEvent(t, h, events.ReferralPurged, 1)
+			},
+		},
+		{
+			name: "deletes the stored idempotent result",
+			setup: func(h *harness) {
+				h.mustInvoke(mortgagesEmployee, "createReferral", testReferralJSON, "token-1")
+			},
+			caller: adminCaller,
+			args:   []string{"REF-0000000002"},
+			check: func(t *testing.T, h *harness, result []byte) {
+				records, _ := createCompositeKey(idempotencyNamespace)
+				index, _ := createCompositeKey(idempotencyIndex)
+				for key := range h.stub.State {
+					if strings.HasPrefix(key, records) || strings.HasPrefix(key, index) {
+						t.Fatalf("idempotency key %q was left behind", key)
+					}
+				}
+			},
+		},
+		{
+			name: "blanks personal details in the audit trail",
+			setup: func(h *harness) {
+				h.mustInvoke(mortgagesEmployee, "updateReferral", testReferralId, `{"customerName":"Janet Doe"}`, "1")
+			},
+			caller: adminCaller,
+			args:   []string{testReferralId},
+			check: func(t *testing.T, h *harness, result []byte) {
+				prefix, _ := createCompositeKey(auditNamespace, testReferralId)
+				entries := 0
+				for key, valAsbytes := range h.stub.State {
+					if !strings.HasPrefix(key, prefix) {
+						continue
+					}
+					entries++
+
+					var entry AuditEntry
+					decodeJSON(t, valAsbytes, &entry)
+					for _, change := range entry.Changes {
+						if piiFields[change.Field] && (string(change.Old) != "null" || string(change.New) != "null") {
+							t.Errorf("entry %d still records %s: %s -> %s", entry.Sequence, change.Field, change.Old, change.New)
+						}
+					}
+				}
+
+				if entries != 3 {
+					t.Fatalf("audit trail has %d entries, want the create, update and purge", entries)
+				}
+			},
+		},
+		{
+			name:   "archived referral",
+			setup:  func(h *harness) { h.mustInvoke(adminCaller, "archiveReferral", testReferralId) },
+			caller: adminCaller,
+			args:   []string{testReferralId},
+			check: func(t *testing.T, h *harness, result []byte) {
+				if h.exists(testReferralId) {
+					t.Fatal("referral is still on the ledger")
+				}
+			},
+		},
+		{name: "employee", args: []string{testReferralId}, code: ErrCodeAccessDenied},
+		{name: "unknown referral", caller: adminCaller, args: []string{"REF-0000000099"}, code: ErrCodeNotFound},
+		{
+			name:   "without a pii key",
+			setup:  func(h *harness) { h.stub.Metadata = nil },
+			caller: adminCaller,
+			args:   []string{testReferralId},
+			check: func(t *testing.T, h *harness, result []byte) {
+				if h.exists(testReferralId) {
+					t.Error("referral is still on the ledger")
+				}
+
+				for _, index := range searchIndexes() {
+					if got := h.indexed(index.name, index.value); len(got) != 0 {
+						t.Errorf("%s index still holds %v", index.name, got)
+					}
+				}
+			},
+		},
+		{
+			name: "legacy contact index without a pii key",
+			setup: func(h *harness) {
+				h.unkeyContactIndex(testReferralId, "+15551234567")
+				h.stub.Metadata = nil
+			},
+			caller: adminCaller,
+			args:   []string{testReferralId},
+			code:   ErrCodeInvalidArgument,
+		},
+	})
+}
+
+func TestPurgeLegacyTokens(t *testing.T) {
+	legacy := func(count int) func(h *harness) {
+		return func(h *harness) {
+			for i := 0; i < count; i++ {
+				key, _ := createCompositeKey(legacyIdempotency, fmt.Sprintf("token-%d", i))
+				h.stub.State[key] = []byte(`{"referralId":"REF-0000000001","requestHash":"h","result":"e30="}`)
+			}
+		}
+	}
+
+	countLegacy := func(h *harness) int {
+		prefix, _ := createCompositeKey(legacyIdempotency)
+		count := 0
+		for key := range h.stub.State {
+			if strings.HasPrefix(key, prefix) {
+				count++
+			}
+		}
+		return count
+	}
+
+	runInvokeCases(t, "purgeLegacyTokens", []invokeCase{
+		{
+			name:   "deletes the unscoped records a batch at a time",
+			setup:  legacy(maxRebuildBatchSize + 1),
+			caller: adminCaller,
+			check: func(t *testing.T, h *harness, result []byte) {
+				var purged PurgeResult
+				decodeJSON(t, result, &purged)
+				if purged.Purged != maxRebuildBatchSize || !purged.Remaining || countLegacy(h) != 1 {
+					t.Fatalf("purged %+v leaving %d records", purged, countLegacy(h))
+				}
+
+				decodeJSON(t, h.mustInvoke(adminCaller, "purgeLegacyTokens"), &purged)
+				if purged.Purged != 1 || purged.Remaining || countLegacy(h) != 0 {
+					t.Fatalf("purged %+v leaving %d records", purged, countLegacy(h))
+				}
+			},
+		},
+		{
+			name:   "keeps the records scoped to their caller",
+			setup:  func(h *harness) { h.mustInvoke(mortgagesEmployee, "createReferral", testReferralJSON, "token-1") },
+			caller: adminCaller,
+			check: func(t *testing.T, h *harness, result []byte) {
+				if string(result) != `{"purged":0,"remaining":false}` {
+					t.Fatalf("purged %s", result)
+				}
+
+				retry := h.mustInvoke(mortgagesEmployee, "createReferral", testReferralJSON, "token-1")
+				if h.exists("REF-0000000003") {
+					t.Fatalf("retry after the purge created another referral: %s", retry)
+				}
+			},
+		},
+		{name: "arguments", caller: adminCaller, args: []string{"token-1"}, code: ErrCodeInvalidArgument},
+		{name: "employee", code: ErrCodeAccessDenied},
+	})
+}
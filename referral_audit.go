@@ -0,0 +1,270 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/joerust/mortgage-referrals/chaincode"
+	"github.com/joerust/mortgage-referrals/ledger"
+)
+
+// Reason codes recorded when the caller does not supply one
+const (
+	ReasonCreated           = "CREATED"
+	ReasonStatusChanged     = "STATUS_CHANGED"
+	ReasonMortgageLinked    = "MORTGAGE_LINKED"
+	ReasonMortgageProgress  = "MORTGAGE_PROGRESS"
+	ReasonDepartmentAdded   = "DEPARTMENT_ADDED"
+	ReasonDepartmentRemoved = "DEPARTMENT_REMOVED"
+	ReasonReferralUpdated   = "REFERRAL_UPDATED"
+	ReasonArchived          = "ARCHIVED"
+	ReasonRestored          = "RESTORED"
+	ReasonPurged            = "PURGED"
+)
+
+// auditSequenceWidth zero pads sequence numbers so audit keys sort in the order they were written
+const auditSequenceWidth = 10
+
+var reasonCodePattern = regexp.MustCompile(`^[A-Z][A-Z0-9_]{0,31}$`)
+
+// piiFields are the referral fields whose audit values are hidden from callers who may not see them
+var piiFields = map[string]bool{
+	customerNameField:  true,
+	contactNumberField: true,
+	contactHashField:   true,
+}
+
+// FieldChange is the old and new JSON value of a single referral field
+type FieldChange struct {
+	Field string          `json:"field"`
+	Old   json.RawMessage `json:"old"`
+	New   json.RawMessage `json:"new"`
+}
+
+// AuditEntry records a single change to a referral
+type AuditEntry struct {
+	ReferralId string        `json:"referralId"`
+	Sequence   int64         `json:"sequence"`
+	Action     string        `json:"action"`
+	ReasonCode string        `json:"reasonCode"`
+	Actor      string        `json:"actor"`
+	ActorRole  string        `json:"actorRole"`
+	EmployeeId string        `json:"employeeId"`
+	TxId       string        `json:"txId"`
+	Timestamp  int64         `json:"timestamp"`
+	Changes    []FieldChange `json:"changes"`
+}
+
+// checkReasonCode validates a caller supplied reason code, returning the fallback if none was given
+func checkReasonCode(reasonCode string, fallback string) (string, error) {
+	if reasonCode == "" {
+		return fallback, nil
+	}
+
+	if !reasonCodePattern.MatchString(reasonCode) {
+		return "", newError(ErrCodeInvalidArgument, "Reason code "+reasonCode+" must be upper case letters, digits and underscores")
+	}
+
+	return reasonCode, nil
+}
+
+// diffReferrals lists the top level fields that differ between two stored referrals. A nil old referral
+// reports every field of the new one.
+func diffReferrals(oldBytes []byte, newBytes []byte) ([]FieldChange, error) {
+	oldFields := make(map[string]json.RawMessage)
+	newFields := make(map[string]json.RawMessage)
+
+	if oldBytes != nil {
+		err := json.Unmarshal(oldBytes, &oldFields)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := json.Unmarshal(newBytes, &newFields)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields []string
+	for field := range newFields {
+		fields = append(fields, field)
+	}
+	for field := range oldFields {
+		if _, ok := newFields[field]; !ok {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+
+	changes := []FieldChange{}
+	for _, field := range fields {
+		if bytes.Equal(oldFields[field], newFields[field]) {
+			continue
+		}
+		changes = append(changes, FieldChange{Field: field, Old: oldFields[field], New: newFields[field]})
+	}
+
+	return changes, nil
+}
+
+// nextAuditSequence allocates the next sequence number in a referral's audit trail
+func nextAuditSequence(referralId string, stub ledger.Stub) (int64, error) {
+	key, err := createCompositeKey(auditSequenceNamespace, referralId)
+	if err != nil {
+		return 0, err
+	}
+
+	valAsbytes, err := stub.GetState(key)
+	if err != nil {
+		return 0, newError(ErrCodeLedger, "Failed to get audit sequence for "+referralId)
+	}
+
+	var sequence int64
+	if valAsbytes != nil {
+		sequence, err = strconv.ParseInt(string(valAsbytes), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+	}
+	sequence++
+
+	err = stub.PutState(key, []byte(strconv.FormatInt(sequence, 10)))
+	if err != nil {
+		return 0, newError(ErrCodeLedger, "Failed to update audit sequence for "+referralId)
+	}
+
+	return sequence, nil
+}
+
+// appendAuditEntry records the change from oldBytes to newBytes in the referral's audit trail. Entries are
+// only ever added, the one exception being purgeReferral blanking the customer's personal details in them.
+func appendAuditEntry(referralId string, oldBytes []byte, newBytes []byte, action string, reasonCode string, stub ledger.Stub) error {
+	changes, err := diffReferrals(oldBytes, newBytes)
+	if err != nil {
+		return err
+	}
+
+	timestamp, err := chaincode.TxTime(stub)
+	if err != nil {
+		return err
+	}
+
+	sequence, err := nextAuditSequence(referralId, stub)
+	if err != nil {
+		return err
+	}
+
+	caller := getCaller(stub)
+	entry := AuditEntry{
+		ReferralId: referralId,
+		Sequence:   sequence,
+		Action:     action,
+		ReasonCode: reasonCode,
+		Actor:      caller.Id,
+		ActorRole:  caller.Role,
+		EmployeeId: caller.EmployeeId,
+		TxId:       stub.GetTxID(),
+		Timestamp:  timestamp,
+		Changes:    changes,
+	}
+
+	valAsbytes, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	key, err := createCompositeKey(auditNamespace, referralId, fmt.Sprintf("%0*d", auditSequenceWidth, sequence))
+	if err != nil {
+		return err
+	}
+
+	err = stub.PutState(key, valAsbytes)
+	if err != nil {
+		return newError(ErrCodeLedger, "Failed to write audit entry for "+referralId)
+	}
+
+	return nil
+}
+
+// getReferralHistory - query function returning a referral's audit trail, oldest entry first
+func (t *ReferralChaincode) getReferralHistory(stub ledger.Stub, caller Caller, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, newError(ErrCodeInvalidArgument, "Incorrect number of arguments. Expecting the referral id")
+	}
+
+	referralId := args[0]
+	referral, err := getReferral(referralId, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix, err := createCompositeKey(auditNamespace, referralId)
+	if err != nil {
+		return nil, err
+	}
+
+	keysIter, err := stub.RangeQueryState(prefix, prefix+maxUnicodeRune)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Failed to scan audit trail for "+referralId)
+	}
+	defer keysIter.Close()
+
+	showPII := caller.canReadPII(referral)
+	history := []AuditEntry{}
+	for keysIter.HasNext() {
+		_, valAsbytes, err := keysIter.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		var entry AuditEntry
+		err = json.Unmarshal(valAsbytes, &entry)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range entry.Changes {
+			change := &entry.Changes[i]
+			if !piiFields[change.Field] {
+				continue
+			}
+
+			if !showPII {
+				change.Old = nil
+				change.New = nil
+				continue
+			}
+
+			change.Old, err = openAuditValue(referralId, change.Field, change.Old, stub)
+			if err != nil {
+				return nil, err
+			}
+
+			change.New, err = openAuditValue(referralId, change.Field, change.New, stub)
+			if err != nil {
+				return nil, err
+			}
+		}
+		history = append(history, entry)
+	}
+
+	return json.Marshal(history)
+}
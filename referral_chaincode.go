@@ -14,381 +14,563 @@ limitations under the License.
 package main
 
 import (
-	"errors"
 	"fmt"
-	"reflect"
-	"unsafe"
-	"strings"
     "encoding/json"
-	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+	"github.com/joerust/mortgage-referrals/chaincode"
+	"github.com/joerust/mortgage-referrals/decimal"
+	"github.com/joerust/mortgage-referrals/events"
+	"github.com/joerust/mortgage-referrals/ledger"
 )
 
 type CustomerReferral struct {
 	ReferralId string `json:"referralId"`
     CustomerName string `json:"customerName"`
 	ContactNumber string `json:"contactNumber"`
+	ContactHash string `json:"contactHash,omitempty"`
 	CustomerId string `json:"customerId"`
 	EmployeeId string `json:"employeeId"`
 	Departments []string `json:"departments"`
     CreateDate int64 `json:"createDate"`
 	Status string `json:"status"`
 	Mortgage Mortgage `json:"mortgage"`
+	PossibleDuplicateOf []string `json:"possibleDuplicateOf,omitempty"`
+	UpdatedDate int64 `json:"updatedDate"`
+	StatusEnteredAt map[string]int64 `json:"statusEnteredAt,omitempty"`
+	Version int64 `json:"version"`
+	Archived bool `json:"archived,omitempty"`
 }
 
 type Mortgage struct {
 	MortgageNumber string `json:"mortgageNumber"`
     MortgageType string `json:"mortgageType"`
 	ReferralId string `json:"referralId"`
-	Rate string `json:"rate"`
-	Amount string `json:"amount"`
+	Rate decimal.BasisPoints `json:"rate"`
+	Amount decimal.Money `json:"amount"`
+	LegacyRate string `json:"legacyRate,omitempty"`
+	LegacyAmount string `json:"legacyAmount,omitempty"`
 }
 
 // ReferralChaincode implementation stores and updates referral information on the blockchain
 type ReferralChaincode struct {
+	// contract serves the typed transaction functions and the generated contract metadata
+	contract *contractapi.ContractChaincode
 }
 
 func main() {
-	err := shim.Start(new(ReferralChaincode))
+	chaincode, err := newReferralChaincode()
+	if err != nil {
+		fmt.Printf("Error creating Simple chaincode: %s", err)
+		return
+	}
+	
+	err = shim.Start(chaincode)
 	if err != nil {
 		fmt.Printf("Error starting Simple chaincode: %s", err)
 	}	
 }
 
-func BytesToString(b []byte) string {
-    bh := (*reflect.SliceHeader)(unsafe.Pointer(&b))
-    sh := reflect.StringHeader{bh.Data, bh.Len}
-    return *(*string)(unsafe.Pointer(&sh))
+// Init resets all the things. The optional argument is the window, in seconds, within which a repeat
+// referral of the same customer is flagged as a possible duplicate. The function name is ignored.
+func (t *ReferralChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	_, args := stub.GetFunctionAndParameters()
+	
+	_, err := t.initialize(ledger.FromShim(stub), args)
+	if err != nil {
+		return shim.Error(asChaincodeError(err).Error())
+	}
+	
+	return shim.Success(nil)
 }
 
-// Init resets all the things
-func (t *ReferralChaincode) Init(stub *shim.ChaincodeStub, function string, args []string) ([]byte, error) {
-	// There is no initialization to do
-	return nil, nil
+// initialize stores the chaincode configuration, keeping the fingerprint of the piiKey already in use
+func (t *ReferralChaincode) initialize(stub ledger.Stub, args []string) ([]byte, error) {
+	config, err := parseConfigArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	
+	stored, err := getConfig(stub)
+	if err != nil {
+		return nil, err
+	}
+	config.PIIKeyFingerprint = stored.PIIKeyFingerprint
+	
+	return nil, putConfig(config, stub)
+}
+
+// Invoke is our entry point to invoke a chaincode function. The function names clients have always used
+// run with their string arguments, any other name is a typed transaction function of the contract. Every
+// error is returned as a ChaincodeError envelope.
+func (t *ReferralChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	function, args := stub.GetFunctionAndParameters()
+
+	if _, ok := functionRoles[function]; !ok {
+		return t.contract.Invoke(stub)
+	}
+
+	result, err := t.dispatch(ledger.FromShim(stub), function, args)
+	if err != nil {
+		return shim.Error(asChaincodeError(err).Error())
+	}
+	
+	return shim.Success(result)
 }
 
-// Invoke is our entry point to invoke a chaincode function
-func (t *ReferralChaincode) Invoke(stub *shim.ChaincodeStub, function string, args []string) ([]byte, error) {
-	fmt.Println("invoke is running " + function)
+// dispatch runs a function by the name clients have always used, as a query if it was one
+func (t *ReferralChaincode) dispatch(stub ledger.Stub, function string, args []string) ([]byte, error) {
+	if queryFunctions[function] {
+		return t.query(stub, function, args)
+	}
+	
+	return t.invoke(stub, function, args)
+}
+
+// invoke runs the named invoke function for an authorized caller
+func (t *ReferralChaincode) invoke(stub ledger.Stub, function string, args []string) ([]byte, error) {
+	// Every function is checked against the authorization policy before it runs
+	caller, err := t.authorize(stub, function)
+	if err != nil {
+		return nil, err
+	}
 
 	// Handle different functions
 	if function == "init" {
-		return t.Init(stub, "init", args)
+		return t.initialize(stub, args)
 	} else if function == "createReferral" {
-		return t.createReferral(stub, args)
+		return t.createReferral(stub, caller, args)
 	} else if function == "updateReferralStatus" {
-		return t.updateReferralStatus(stub, args)
+		return t.updateReferralStatus(stub, caller, args)
+	} else if function == "updateReferral" {
+		return t.updateReferral(stub, caller, args)
+	} else if function == "addDepartment" {
+		return t.addDepartment(stub, caller, args)
+	} else if function == "removeDepartment" {
+		return t.removeDepartment(stub, caller, args)
+	} else if function == "archiveReferral" {
+		return t.archiveReferral(stub, caller, args)
+	} else if function == "restoreReferral" {
+		return t.restoreReferral(stub, caller, args)
+	} else if function == "purgeReferral" {
+		return t.purgeReferral(stub, caller, args)
+	} else if function == "migrateIndexes" {
+		return t.migrateIndexes(stub, args)
+	} else if function == "migrateReferralKeys" {
+		return t.migrateReferralKeys(stub, args)
+	} else if function == "migrateContactIndex" {
+		return t.migrateContactIndex(stub, args)
+	} else if function == "purgeLegacyTokens" {
+		return t.purgeLegacyTokens(stub, args)
+	} else if function == "sealLegacyPII" {
+		return t.sealLegacyPII(stub, args)
+	} else if function == "rebuildIndexes" {
+		return t.rebuildIndexes(stub, args)
+	} else if function == "linkMortgage" {
+		return t.linkMortgage(stub, args)
+	} else if function == "followMortgageStatus" {
+		return t.followMortgageStatus(stub, args)
 	}
 	fmt.Println("invoke did not find func: " + function)
 
-	return nil, errors.New("Received unknown function invocation")
+	return nil, newErrorDetails(ErrCodeUnknownFunction, "Received unknown function invocation", map[string]string{"function": function})
 }
 
-// Query is our entry point for queries
-func (t *ReferralChaincode) Query(stub *shim.ChaincodeStub, function string, args []string) ([]byte, error) {
-	fmt.Println("query is running " + function)
+// query runs the named query function for an authorized caller
+func (t *ReferralChaincode) query(stub ledger.Stub, function string, args []string) ([]byte, error) {
+	// Every function is checked against the authorization policy before it runs
+	caller, err := t.authorize(stub, function)
+	if err != nil {
+		return nil, err
+	}
 
 	// Handle different functions
 	if function == "read" { //read a variable
-		return t.read(stub, args)
+		return t.read(stub, caller, args)
 	} else if function == "searchByStatus" {
-		return t.searchByStatus(args[0], stub)
+		return t.searchByStatus(args, caller, stub)
 	} else if function == "searchByDepartment" {
-		return t.searchByDepartment(args[0], stub)
+		return t.searchByDepartment(args, caller, stub)
+	} else if function == "searchByEmployee" {
+		return t.searchByEmployee(args, caller, stub)
+	} else if function == "searchByCustomer" {
+		return t.searchByCustomer(args, caller, stub)
+	} else if function == "getStatusTransitions" {
+		return t.getStatusTransitions(args)
+	} else if function == "getReferralHistory" {
+		return t.getReferralHistory(stub, caller, args)
+	} else if function == "queryReferrals" {
+		return t.queryReferrals(stub, caller, args)
+	} else if function == "checkIndexes" {
+		return t.checkIndexes(stub, args)
 	}
 	fmt.Println("query did not find func: " + function)
 
-	return nil, errors.New("Received unknown function query")
+	return nil, newErrorDetails(ErrCodeUnknownFunction, "Received unknown function query", map[string]string{"function": function})
 }
 
-// Adds the referral id to a ledger list item for the given department allowing for quick search of referrals in a given department
-func (t *ReferralChaincode) indexByDepartment(referralId string, department string, stub *shim.ChaincodeStub) (error) {
-	valAsbytes, err := stub.GetState(department)
-	if err != nil {
-		jsonResp := "{\"Error\":\"Failed to get state for " + department + "\"}"
-		return errors.New(jsonResp)
-	}
-	
-	if valAsbytes == nil {
-		err = stub.PutState(department, []byte(referralId))
-	} else {
-	    commaDelimitedStatuses := BytesToString(valAsbytes)
-		err = stub.PutState(department, []byte(commaDelimitedStatuses + "," + referralId))
-	}
-	
-	return err
+// Adds the referral id to the department index allowing for quick search of referrals in a given department
+func (t *ReferralChaincode) indexByDepartment(referralId string, department string, stub ledger.Stub) (error) {
+	return putIndexEntry(departmentIndex, department, referralId, stub)
 }
 
-func (t *ReferralChaincode) removeStatusReferralIndex(referralId string, status string, stub *shim.ChaincodeStub) (error) {
-	valAsbytes, err := stub.GetState(status)
-	if err != nil {
-		jsonResp := "{\"Error\":\"Failed to get state for " + status + "\"}"
-		return errors.New(jsonResp)
-	}
-	
-	if valAsbytes == nil {
-		return nil;
-	} else {
-		// Remove the referral from this status type, if it exists
-		commaDelimitedStatuses := BytesToString(valAsbytes)
-		referralIdsInCurrentStatus := strings.Split(commaDelimitedStatuses, ",")
-		updatedReferralIdList := ""
-		
-		appendComma := false
-		for i := range referralIdsInCurrentStatus {
-			if referralIdsInCurrentStatus[i] != referralId {
-			    if appendComma == false {
-					updatedReferralIdList += referralIdsInCurrentStatus[i]
-					appendComma = true
-				} else {
-					updatedReferralIdList = updatedReferralIdList + "," + referralIdsInCurrentStatus[i]
-				}
-			}
-		}
-		
-		err = stub.PutState(status, []byte(updatedReferralIdList))
-	}
-	
-	if err != nil {
-		jsonResp := "{\"Error\":\"Failed to update state for " + status + "\"}"
-		return errors.New(jsonResp)
-	}
-	
-	return nil
+// Removes the referral id from the department index for the given department, if it exists
+func (t *ReferralChaincode) removeDepartmentReferralIndex(referralId string, department string, stub ledger.Stub) (error) {
+	return delIndexEntry(departmentIndex, department, referralId, stub)
 }
 
-// Adds the referral id to a ledger list item for the given department allowing for quick search of referrals in a given department
-func (t *ReferralChaincode) indexByStatus(referralId string, status string, stub *shim.ChaincodeStub) (error) {
-	valAsbytes, err := stub.GetState(status)
-	if err != nil {
-		jsonResp := "{\"Error\":\"Failed to get state for " + status + "\"}"
-		return errors.New(jsonResp)
-	}
-	
-	if valAsbytes == nil {
-		err = stub.PutState(status, []byte(referralId))
-	} else {
-	    commaDelimitedStatuses := BytesToString(valAsbytes)
-		err = stub.PutState(status, []byte(commaDelimitedStatuses + "," + referralId))
-	}
-	
-	if err != nil {
-		jsonResp := "{\"Error\":\"Failed to update state for " + status + "\"}"
-		return errors.New(jsonResp)
-	}
-	
-	return nil
+// Removes the referral id from the status index for the given status, if it exists
+func (t *ReferralChaincode) removeStatusReferralIndex(referralId string, status string, stub ledger.Stub) (error) {
+	return delIndexEntry(statusIndex, status, referralId, stub)
 }
 
-func unmarshallBytes(valAsBytes []byte) (error, CustomerReferral) {
-	var err error
-	var referral CustomerReferral
-
-	err = json.Unmarshal(valAsBytes, &referral)
-
-	fmt.Println("JSON Unmarshalled")	
-	if err != nil {
-		fmt.Println(err.Error())
-	}
-	
-	return err, referral
+// Adds the referral id to the status index allowing for quick search of referrals in a given status
+func (t *ReferralChaincode) indexByStatus(referralId string, status string, stub ledger.Stub) (error) {
+	return putIndexEntry(statusIndex, status, referralId, stub)
 }
 
-func (t *ReferralChaincode) marshallReferral(referral CustomerReferral) (error, []byte) {
-	fmt.Println("Marshalling JSON to bytes")
-	valAsbytes, err := json.Marshal(referral)
-	
-	if err != nil {
-		fmt.Println("Marshalling JSON to bytes failed")
-		return err, nil
-	}
-	
-	return nil, valAsbytes
+// Adds the referral id to the employee index allowing for quick search of the referrals an employee made
+func (t *ReferralChaincode) indexByEmployee(referralId string, employeeId string, stub ledger.Stub) (error) {
+	return putIndexEntry(employeeIndex, employeeId, referralId, stub)
 }
 
-func (t *ReferralChaincode) updateStatus(referral CustomerReferral, status string, stub *shim.ChaincodeStub) (error) {
-	fmt.Println("Setting status")
-	
-	err := t.removeStatusReferralIndex(referral.ReferralId, referral.Status, stub)
-	if err != nil {
-		return err
-	}
-	referral.Status = status
-	err = t.indexByStatus(referral.ReferralId, status, stub)
-	
-	return err
+// Removes the referral id from the employee index for the given employee, if it exists
+func (t *ReferralChaincode) removeEmployeeReferralIndex(referralId string, employeeId string, stub ledger.Stub) (error) {
+	return delIndexEntry(employeeIndex, employeeId, referralId, stub)
 }
 
-// updateReferral - invoke function to updateReferral key/value pair
-func (t *ReferralChaincode) updateReferralStatus(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+// updateReferralStatus - invoke function to move a referral to a new status, with an optional reason code
+func (t *ReferralChaincode) updateReferralStatus(stub ledger.Stub, caller Caller, args []string) ([]byte, error) {
 	var key, value string
 	var err error
 	var referral CustomerReferral
 	var valAsbytes []byte
-	
-	fmt.Println("running updateReferral()")
 
-	if len(args) != 2 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 2. name of the key and value to set")
+	if len(args) != 2 && len(args) != 3 {
+		return nil, newError(ErrCodeInvalidArgument, "Incorrect number of arguments. Expecting the referral id, the new status and an optional reason code")
 	}
 
 	key = args[0] // The referral id
 	value = args[1] // The new status
 	
+	reasonCode := ""
+	if len(args) == 3 {
+		reasonCode = args[2]
+	}
+	
+	reasonCode, err = checkReasonCode(reasonCode, ReasonStatusChanged)
+	if err != nil {
+		return nil, err
+	}
+	
 	// Look up the json blob that matches the current referral id
-	valAsbytes, err = stub.GetState(key)
+	valAsbytes, err = getReferralBytes(key, stub)
+	if err != nil {
+		return nil, err
+	}
+	
+	if valAsbytes == nil {
+		return nil, notFound(key)
+	}
 	
 	// Unmarshall said json blob into a referral object
 	err = json.Unmarshal(valAsbytes, &referral)
+	if err != nil {
+		return nil, newError(ErrCodeInternal, "Failed to unmarshal referral " + key)
+	}
 	
 	// Save the current status so that it can be unindexed once we update the referral object
 	oldStatus := referral.Status;
 	
+	// Only the departments the referral is routed to can move it along
+	err = caller.authorizeChange("updateReferralStatus", referral)
+	if err != nil {
+		return nil, err
+	}
+	
+	err = checkNotArchived(key, referral)
+	if err != nil {
+		return nil, err
+	}
+	
+	// Reject moves the referral lifecycle does not allow
+	err = statusLifecycle.Check(key, oldStatus, value)
+	if err != nil {
+		return nil, err
+	}
+	
 	// Set the referral status to the new value
 	referral.Status = value;
 	
+	err = touchReferral(&referral, stub)
+	if err != nil {
+		return nil, err
+	}
+	enterStatus(&referral, value, referral.UpdatedDate)
+	
 	// Serialize the object to a JSON string to be stored in the ledger
+	oldAsbytes := valAsbytes
 	valAsbytes, err = json.Marshal(referral)
+	if err != nil {
+		return nil, err
+	}
 	
 	// Store the json string in the ledger
-	err = stub.PutState(key, valAsbytes) //write the variable into the chaincode state
+	err = putReferralBytes(key, valAsbytes, stub) //write the variable into the chaincode state
 	
 	if err != nil {
 		return nil, err
 	}
 	
+	err = appendAuditEntry(key, oldAsbytes, valAsbytes, "updateReferralStatus", reasonCode, stub)
+	if err != nil {
+		return nil, err
+	}
+	
+	err = emitReferralEvent(events.ReferralStatusChanged, oldStatus, referral, stub)
+	if err != nil {
+		return nil, err
+	}
+	
 	// Index things by the new status
 	err = t.indexByStatus(key, referral.Status, stub)
 	
 	if err != nil {
-		return []byte("Count not index the bytes by status from the value: " + value + " on the ledger"), err
+		return nil, err
 	}
 	
 	// Remove the indexing by the status before the update
 	err = t.removeStatusReferralIndex(key, oldStatus, stub)
+	if err != nil {
+		return nil, err
+	}
 	
 	return nil, nil
 }
 
-// createReferral - invoke function to write key/value pair
-func (t *ReferralChaincode) createReferral(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
+// createReferral - invoke function to store a new referral under an id allocated by the chaincode. Expects
+// the referral JSON without a referralId and an optional client idempotency token, retrying with the same
+// token and arguments returns the original result. Returns the allocated id along with the stored referral.
+func (t *ReferralChaincode) createReferral(stub ledger.Stub, caller Caller, args []string) ([]byte, error) {
 
-	var key, value string
-	var err error
-	fmt.Println("running createReferral()")
+	var key, value, token string
+
+	if len(args) != 1 && len(args) != 2 {
+		return nil, newError(ErrCodeInvalidArgument, "Incorrect number of arguments. Expecting the referral JSON and an optional idempotency token")
+	}
 
-	if len(args) != 2 {
-		return nil, errors.New("Incorrect number of arguments. Expecting 2 parameters, name of the key and value to set")
+	// Clients from before ids were allocated pass the id they chose ahead of the JSON
+	if len(args) == 2 && jsonType([]byte(args[0])) != '{' && jsonType([]byte(args[1])) == '{' {
+		return nil, newError(ErrCodeInvalidArgument, "createReferral no longer takes a referral id, the chaincode allocates one and returns it. Expecting the referral JSON and an optional idempotency token")
 	}
 
-	key = args[0] //rename for funsies
-	value = args[1]
+	value = args[0]
+	if len(args) == 2 {
+		token = args[1]
+	}
 	
-	err = stub.PutState(key, []byte(value)) //write the variable into the chaincode state
+	// Deserialize the input string into a GO data structure to hold the referral
+	referral, err := decodeReferral([]byte(value))
 	if err != nil {
 		return nil, err
 	}
 	
-	var referral CustomerReferral
-
-	err = json.Unmarshal([] byte(value), &referral)
-
+	err = caller.authorizeCreate(referral)
+	if err != nil {
+		return nil, err
+	}
 	
-	// Deserialize the input string into a GO data structure to hold the referral
-	err = t.indexByStatus(key, referral.Status, stub)
+	// A retry of a create that already succeeded gets the original result back
+	requestHash := hashRequest(value)
+	if token != "" {
+		result, err := getIdempotentResult(caller, token, requestHash, stub)
+		if err != nil || result != nil {
+			return result, err
+		}
+	}
+	
+	// The id is allocated by the chaincode and every referral starts its lifecycle in the initial status,
+	// the later statuses are only reached through updateReferralStatus
+	createErr := &ValidationError{}
+	if referral.ReferralId != "" {
+		createErr.add("referralId", ViolationReadOnly, "referralId is allocated by the chaincode and must be left out")
+	}
 	
+	if referral.Status != "" && referral.Status != initialStatus {
+		createErr.add("status", ViolationInitialStatus, "a referral must be created with status "+initialStatus)
+	}
+	
+	if len(createErr.Violations) > 0 {
+		return nil, createErr
+	}
+	
+	key, err = allocateReferralId(stub)
 	if err != nil {
-		return []byte("Count not index the bytes by status from the value: " + value + " on the ledger"), err
+		return nil, err
 	}
 	
-	// Create a ledger record that indexes the referral id by the created department
-	for i := range referral.Departments {
-		err = t.indexByDepartment(key, referral.Departments[i], stub)
-		if err != nil {
-			return []byte("Count not index the bytes by department from the value: " + value + " on the ledger"), err
-		}
+	referral.ReferralId = key
+	if referral.Mortgage != (Mortgage{}) && referral.Mortgage.ReferralId == "" {
+		referral.Mortgage.ReferralId = key
 	}
 	
+	// Nothing is written unless the referral passes validation
+	err = validateReferral(referral)
+	if err != nil {
+		return nil, err
+	}
 	
-	return nil, nil
-}
-
-func (t *ReferralChaincode) processCommaDelimitedReferrals(delimitedReferrals string, stub *shim.ChaincodeStub) ([]byte, error) {
-	commaDelimitedReferrals := strings.Split(delimitedReferrals, ",")
-
-	referralResultSet := "["
+	// The contact hash is owned by the chaincode, it is what the contact number is indexed under
+	err = setContactHash(&referral, stub)
+	if err != nil {
+		return nil, err
+	}
 	
-	for i := range commaDelimitedReferrals {
-		valAsbytes, err := stub.GetState(commaDelimitedReferrals[i])
-		
-		if err != nil {
-			return nil, err
-		}
-		
-		if i == 0 {
-			referralResultSet = referralResultSet + BytesToString(valAsbytes)
-		} else {
-			referralResultSet = referralResultSet + "," + BytesToString(valAsbytes)
-		}
+	// Flag earlier referrals of the same customer, the duplicate list is owned by the chaincode
+	referredAt, err := chaincode.TxTime(stub)
+	if err != nil {
+		return nil, err
 	}
 	
-	referralResultSet += "]"
-	return []byte(referralResultSet), nil
-}
-
-func (t *ReferralChaincode) searchByDepartment(department string, stub *shim.ChaincodeStub) ([]byte, error) {
-	valAsbytes, err := stub.GetState(department)
+	referral.PossibleDuplicateOf, err = findDuplicateCustomers(referral, referredAt, stub)
+	if err != nil {
+		return nil, err
+	}
 	
+	// Dates, the version and the archived flag are owned by the chaincode, any client values are ignored
+	referral.CreateDate = referredAt
+	referral.UpdatedDate = referredAt
+	referral.StatusEnteredAt = map[string]int64{referral.Status: referredAt}
+	referral.Version = 1
+	referral.Archived = false
+	
+	// Customer details are only ever stored encrypted
+	err = sealReferralPII(&referral, stub)
 	if err != nil {
-		jsonResp := "{\"Error\":\"Failed to get state for " + department + "\"}"
-		return nil, errors.New(jsonResp)
+		return nil, err
 	}
 	
-	valAsbytes, err = t.processCommaDelimitedReferrals(BytesToString(valAsbytes), stub)
+	valAsbytes, err := json.Marshal(referral)
+	if err != nil {
+		return nil, err
+	}
 	
-	if(err != nil) {
+	err = putReferralBytes(key, valAsbytes, stub) //write the variable into the chaincode state
+	if err != nil {
 		return nil, err
 	}
 	
-	return valAsbytes, nil
-}
-
-func (t *ReferralChaincode) searchByStatus(status string, stub *shim.ChaincodeStub) ([]byte, error) {
-	valAsbytes, err := stub.GetState(status)
+	err = appendAuditEntry(key, nil, valAsbytes, "createReferral", ReasonCreated, stub)
+	if err != nil {
+		return nil, err
+	}
 	
+	err = emitReferralEvent(events.ReferralCreated, "", referral, stub)
 	if err != nil {
-		jsonResp := "{\"Error\":\"Failed to get state for " + status + "\"}"
-		return nil, errors.New(jsonResp)
+		return nil, err
 	}
 	
-	valAsbytes, err = t.processCommaDelimitedReferrals(BytesToString(valAsbytes), stub)
+	// Index the referral by everything it can be searched on
+	err = t.indexReferral(key, referral, referredAt, stub)
+	if err != nil {
+		return nil, err
+	}
 	
-	if(err != nil) {
+	result, err := json.Marshal(CreateReferralResult{ReferralId: key, Referral: valAsbytes})
+	if err != nil {
 		return nil, err
 	}
 	
-	return valAsbytes, nil
+	if token != "" {
+		err = putIdempotentResult(caller, token, requestHash, key, result, stub)
+		if err != nil {
+			return nil, err
+		}
+	}
+	
+	return result, nil
+}
+
+// Looks up each indexed referral id and returns the stored referrals, redacted for the caller
+func (t *ReferralChaincode) processIndexedReferrals(referralIds []string, caller Caller, stub ledger.Stub) ([]json.RawMessage, error) {
+	referralResultSet := []json.RawMessage{}
+	
+	for i := range referralIds {
+		valAsbytes, err := getReferralBytes(referralIds[i], stub)
+		
+		if err != nil {
+			return nil, err
+		}
+		
+		// Skip index entries left behind for referrals that no longer exist
+		if valAsbytes == nil {
+			continue
+		}
+		
+		valAsbytes, err = caller.redactReferral(valAsbytes, stub)
+		if err != nil {
+			return nil, err
+		}
+		
+		referralResultSet = append(referralResultSet, valAsbytes)
+	}
+	
+	return referralResultSet, nil
+}
+
+// searchByDepartment - query function returning a page of the referrals routed to a department
+func (t *ReferralChaincode) searchByDepartment(args []string, caller Caller, stub ledger.Stub) ([]byte, error) {
+	return t.searchIndex(departmentIndex, caller, args, stub)
 }
 
+// searchByStatus - query function returning a page of the referrals in a status
+func (t *ReferralChaincode) searchByStatus(args []string, caller Caller, stub ledger.Stub) ([]byte, error) {
+	return t.searchIndex(statusIndex, caller, args, stub)
+}
+
+// searchByEmployee - query function returning a page of the referrals made by an employee
+func (t *ReferralChaincode) searchByEmployee(args []string, caller Caller, stub ledger.Stub) ([]byte, error) {
+	return t.searchIndex(employeeIndex, caller, args, stub)
+}
+
+// searchByCustomer - query function returning a page of a customer's referral history
+func (t *ReferralChaincode) searchByCustomer(args []string, caller Caller, stub ledger.Stub) ([]byte, error) {
+	return t.searchIndex(customerIndex, caller, args, stub)
+}
 
 // read - query function to read key/value pair
-func (t *ReferralChaincode) read(stub *shim.ChaincodeStub, args []string) ([]byte, error) {
-	var key, jsonResp string
+func (t *ReferralChaincode) read(stub ledger.Stub, caller Caller, args []string) ([]byte, error) {
+	var key string
 	var err error
 	
 	if len(args) != 1 {
-		return nil, errors.New("Incorrect number of arguments. Expecting name of the key to query")
+		return nil, newError(ErrCodeInvalidArgument, "Incorrect number of arguments. Expecting name of the key to query")
 	}
 
 	key = args[0]
-	valAsbytes, err := stub.GetState(key)
+	
+	// Only keys inside the referral namespace can be read
+	valAsbytes, err := getReferralBytes(key, stub)
 	
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + key + "\"}"
-		return []byte(jsonResp), err
+		return nil, err
 	}
 	
 	if valAsbytes == nil {
-		return []byte("Did not find entry for key: " + key), nil
+		return nil, notFound(key)
 	}
-	return valAsbytes, nil
+	
+	// Archived referrals are only shown to admins
+	archived, err := isArchived(valAsbytes)
+	if err != nil {
+		return nil, err
+	}
+	
+	if archived && !caller.isAdmin() {
+		return nil, notFound(key)
+	}
+	
+	// Customer details are only returned to the referral's departments
+	return caller.redactReferral(valAsbytes, stub)
 }
\ No newline at end of file
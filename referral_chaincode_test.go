@@ -0,0 +1,758 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/joerust/mortgage-referrals/chaincode"
+	"github.com/joerust/mortgage-referrals/events"
+	"github.com/joerust/mortgage-referrals/ledger"
+)
+
+// testMortgageJSON links the test referral to a mortgage
+const testMortgageJSON = `{"schemaVersion":2,"mortgageNumber":"MTG-0000000001","mortgageType":"FIXED","referralId":"REF-0000000001","rate":450,"amount":{"minorUnits":25000000,"currency":"USD"}}`
+
+func TestInit(t *testing.T) {
+	runInvokeCases(t, "init", []invokeCase{
+		{
+			name:   "defaults",
+			caller: adminCaller,
+			check: func(t *testing.T, h *harness, result []byte) {
+				// The fingerprint of the piiKey the seeded referral was sealed with is kept
+				want := defaultConfig()
+				want.PIIKeyFingerprint = piiKeyFingerprint(testPIIKey)
+				if config := h.config(); config != want {
+					t.Fatalf("config %+v, want the defaults", config)
+				}
+			},
+		},
+		{
+			name:   "window and prefix",
+			caller: adminCaller,
+			args:   []string{"60", "LEAD"},
+			check: func(t *testing.T, h *harness, result []byte) {
+				if config := h.config(); config.DuplicateWindowSeconds != 60 || config.ReferralIdPrefix != "LEAD" {
+					t.Fatalf("config %+v, want a 60 second window and the LEAD prefix", config)
+				}
+
+				// The counter carries on under the new prefix
+				if referralId := h.createReferral(testReferralJSON); referralId != "LEAD-0000000002" {
+					t.Fatalf("allocated %s, want LEAD-0000000002", referralId)
+				}
+			},
+		},
+		{
+			name:   "prefix only",
+			caller: adminCaller,
+			args:   []string{"", "LEAD"},
+			check: func(t *testing.T, h *harness, result []byte) {
+				if config := h.config(); config.DuplicateWindowSeconds != defaultDuplicateWindowSeconds || config.ReferralIdPrefix != "LEAD" {
+					t.Fatalf("config %+v, want the default window and the LEAD prefix", config)
+				}
+			},
+		},
+		{name: "negative window", caller: adminCaller, args: []string{"-1"}, code: ErrCodeInvalidArgument},
+		{name: "window not a number", caller: adminCaller, args: []string{"month"}, code: ErrCodeInvalidArgument},
+		{name: "prefix starting with a digit", caller: adminCaller, args: []string{"60", "1REF"}, code: ErrCodeInvalidArgument},
+		{name: "prefix with a separator", caller: adminCaller, args: []string{"60", "REF-"}, code: ErrCodeInvalidArgument},
+		{
+			name:   "mortgage chaincode",
+			caller: adminCaller,
+			args:   []string{"", "", "mortgage-cc"},
+			check: func(t *testing.T, h *harness, result []byte) {
+				if config := h.config(); config.MortgageChaincode != "mortgage-cc" || config.ReferralIdPrefix != defaultReferralIdPrefix {
+					t.Fatalf("config %+v, want the mortgage-cc chaincode and the default prefix", config)
+				}
+			},
+		},
+		{name: "mortgage chaincode name with a space", caller: adminCaller, args: []string{"", "", "mortgage cc"}, code: ErrCodeInvalidArgument},
+		{name: "too many arguments", caller: adminCaller, args: []string{"60", "REF", "mortgage", "x"}, code: ErrCodeInvalidArgument},
+		{name: "employee", caller: mortgagesEmployee, code: ErrCodeAccessDenied},
+	})
+}
+
+// config returns the committed chaincode settings
+func (h *harness) config() ChaincodeConfig {
+	h.t.Helper()
+
+	var config ChaincodeConfig
+	_, err := h.stub.Query(func(stub ledger.Stub) ([]byte, error) {
+		var err error
+		config, err = getConfig(stub)
+		return nil, err
+	})
+	if err != nil {
+		h.t.Fatal(err)
+	}
+
+	return config
+}
+
+func TestCreateReferral(t *testing.T) {
+	const secondReferralId = "REF-0000000002"
+
+	runInvokeCases(t, "createReferral", []invokeCase{
+		{
+			name: "stores the referral under an allocated id",
+			args: []string{testReferralJSON},
+			check: func(t *testing.T, h *harness, result []byte) {
+				var created CreateReferralResult
+				decodeJSON(t, result, &created)
+				if created.ReferralId != secondReferralId {
+					t.Fatalf("allocated %s, want %s", created.ReferralId, secondReferralId)
+				}
+
+				referral := h.stored(secondReferralId)
+				if referral.ReferralId != secondReferralId || referral.Version != 1 || referral.CreateDate != testTime || referral.UpdatedDate != testTime {
+					t.Fatalf("stored %+v", referral)
+				}
+
+				if referral.StatusEnteredAt[StatusNew] != testTime {
+					t.Fatalf("entered NEW at %v, want %d", referral.StatusEnteredAt, testTime)
+				}
+
+				if !isSealed(referral.CustomerName) || !isSealed(referral.ContactNumber) {
+					t.Fatalf("customer details are stored in the clear: %+v", referral)
+				}
+
+				// The envelope holds nothing but the ciphertext, not even a mask
+				if !strings.HasPrefix(referral.ContactNumber, piiEnvelopePrefix) || strings.Count(referral.ContactNumber, ":") != 2 {
+					t.Fatalf("contact number stored as %s", referral.ContactNumber)
+				}
+
+				checkEvent(t, h, events.ReferralCreated, 1)
+			},
+		},
+		{
+			name: "indexes the referral",
+			args: []string{testReferralJSON},
+			check: func(t *testing.T, h *harness, result []byte) {
+				want := []string{testReferralId, secondReferralId}
+				for _, index := range []struct{ name, value string }{
+					{statusIndex, StatusNew},
+					{departmentIndex, "MORTGAGES"},
+					{employeeIndex, "E1"},
+					{customerIndex, "C1"},
+					{contactIndex, contactIndexValue("+1 555 123 4567", testPIIKey)},
+				} {
+					if got := h.indexed(index.name, index.value); !sameStrings(got, want) {
+						t.Errorf("%s index for %s holds %v, want %v", index.name, index.value, got, want)
+					}
+				}
+			},
+		},
+		{
+			name: "flags an earlier referral of the same customer",
+			args: []string{testReferralJSON},
+			check: func(t *testing.T, h *harness, result []byte) {
+				if got := h.stored(secondReferralId).PossibleDuplicateOf; !sameStrings(got, []string{testReferralId}) {
+					t.Fatalf("possible duplicates %v, want the seeded referral", got)
+				}
+			},
+		},
+		{
+			name: "flags an earlier referral with the same contact number",
+			args: []string{`{"customerName":"J Doe","contactNumber":"+1 (555) 123-4567","customerId":"C2","employeeId":"E1","departments":["MORTGAGES"],"status":"NEW"}`},
+			check: func(t *testing.T, h *harness, result []byte) {
+				if got := h.stored(secondReferralId).PossibleDuplicateOf; !sameStrings(got, []string{testReferralId}) {
+					t.Fatalf("possible duplicates %v, want the seeded referral", got)
+				}
+			},
+		},
+		{
+			name:  "ignores referrals outside the duplicate window",
+			setup: func(h *harness) { h.stub.Time += defaultDuplicateWindowSeconds + 1 },
+			args:  []string{testReferralJSON},
+			check: func(t *testing.T, h *harness, result []byte) {
+				if got := h.stored(secondReferralId).PossibleDuplicateOf; len(got) != 0 {
+					t.Fatalf("possible duplicates %v, want none", got)
+				}
+			},
+		},
+		{
+			name: "skips ids already taken",
+			setup: func(h *harness) {
+				h.stub.State[mustReferralKey(secondReferralId)] = []byte(`{"referralId":"REF-0000000002"}`)
+			},
+			args: []string{testReferralJSON},
+			check: func(t *testing.T, h *harness, result []byte) {
+				var created CreateReferralResult
+				decodeJSON(t, result, &created)
+				if created.ReferralId != "REF-0000000003" {
+					t.Fatalf("allocated %s, want REF-0000000003", created.ReferralId)
+				}
+			},
+		},
+		{
+			name: "fills in the mortgage's referral id",
+			args: []string{`{"customerName":"Jane Doe","contactNumber":"+15551234567","customerId":"C1","employeeId":"E1","departments":["MORTGAGES"],"status":"NEW","mortgage":{"schemaVersion":2,"mortgageType":"FIXED","rate":450}}`},
+			check: func(t *testing.T, h *harness, result []byte) {
+				if mortgage := h.stored(secondReferralId).Mortgage; mortgage.ReferralId != secondReferralId || mortgage.Rate != 450 {
+					t.Fatalf("mortgage %+v", mortgage)
+				}
+			},
+		},
+		{
+			name:   "admin creates for any employee",
+			caller: adminCaller,
+			args:   []string{`{"customerName":"Jane Doe","contactNumber":"+15551234567","customerId":"C1","employeeId":"E9","departments":["SAVINGS"],"status":"NEW"}`},
+		},
+		{name: "client supplied id", args: []string{`{"referralId":"MINE","customerName":"Jane Doe","contactNumber":"+15551234567","customerId":"C1","employeeId":"E1","departments":["MORTGAGES"],"status":"NEW"}`}, code: ErrCodeValidation},
+		{name: "malformed JSON", args: []string{`{"customerName":`}, code: ErrCodeValidation},
+		{name: "unknown field", args: []string{`{"customerName":"Jane Doe","nickname":"JD"}`}, code: ErrCodeValidation},
+		{name: "missing fields", caller: adminCaller, args: []string{`{"status":"NEW"}`}, code: ErrCodeValidation},
+		{name: "unknown status", args: []string{`{"customerName":"Jane Doe","contactNumber":"+15551234567","customerId":"C1","employeeId":"E1","departments":["MORTGAGES"],"status":"LOST"}`}, code: ErrCodeValidation},
+		{name: "created past the initial status", args: []string{`{"customerName":"Jane Doe","contactNumber":"+15551234567","customerId":"C1","employeeId":"E1","departments":["MORTGAGES"],"status":"FUNDED"}`}, code: ErrCodeValidation},
+		{name: "bad contact number", args: []string{`{"customerName":"Jane Doe","contactNumber":"call me","customerId":"C1","employeeId":"E1","departments":["MORTGAGES"],"status":"NEW"}`}, code: ErrCodeValidation},
+		{name: "another employee's referral", args: []string{`{"customerName":"Jane Doe","contactNumber":"+15551234567","customerId":"C1","employeeId":"E2","departments":["MORTGAGES"],"status":"NEW"}`}, code: ErrCodeAccessDenied},
+		{name: "mortgage service", caller: mortgageService, args: []string{testReferralJSON}, code: ErrCodeAccessDenied},
+		{name: "without a pii key", setup: func(h *harness) { h.stub.Metadata = nil }, args: []string{testReferralJSON}, code: ErrCodeInvalidArgument},
+		{name: "malformed metadata", setup: func(h *harness) { h.stub.Metadata = []byte("key") }, args: []string{testReferralJSON}, code: ErrCodeInvalidArgument},
+		{
+			name:  "timestamp within the clock skew",
+			setup: func(h *harness) { h.stub.EndorserTime = testTime - int64(chaincode.MaxClockSkew.Seconds()) },
+			args:  []string{testReferralJSON},
+			check: func(t *testing.T, h *harness, result []byte) {
+				if referral := h.stored(secondReferralId); referral.CreateDate != testTime {
+					t.Fatalf("created at %d, want the transaction timestamp %d", referral.CreateDate, testTime)
+				}
+			},
+		},
+		{name: "backdated timestamp", setup: func(h *harness) { h.stub.EndorserTime = testTime + 3600 }, args: []string{testReferralJSON}, code: ErrCodeInvalidArgument},
+		{name: "timestamp in the future", setup: func(h *harness) { h.stub.EndorserTime = testTime - 3600 }, args: []string{testReferralJSON}, code: ErrCodeInvalidArgument},
+		{name: "short pii key", setup: func(h *harness) { h.stub.Metadata = piiMetadata([]byte("short")) }, args: []string{testReferralJSON}, code: ErrCodeInvalidArgument},
+		{name: "pii key other than the one in use", setup: func(h *harness) { h.stub.Metadata = piiMetadata([]byte("fedcba9876543210fedcba9876543210")) }, args: []string{testReferralJSON}, code: ErrCodeInvalidArgument},
+		{name: "legacy id and JSON", args: []string{"REF-1", testReferralJSON}, code: ErrCodeInvalidArgument},
+		{name: "no arguments", code: ErrCodeInvalidArgument},
+		{name: "too many arguments", args: []string{testReferralJSON, "token", "x"}, code: ErrCodeInvalidArgument},
+	})
+}
+
+func TestCreateReferralIdempotency(t *testing.T) {
+	h := newHarness(t)
+
+	first := h.mustInvoke(mortgagesEmployee, "createReferral", testReferralJSON, "token-1")
+	retry := h.mustInvoke(mortgagesEmployee, "createReferral", testReferralJSON, "token-1")
+	if string(first) != string(retry) {
+		t.Fatalf("retry returned %s, want %s", retry, first)
+	}
+
+	if h.exists("REF-0000000002") {
+		t.Fatal("retry created a second referral")
+	}
+
+	_, err := h.invoke("createReferral", `{"customerName":"John Doe","contactNumber":"+15559876543","customerId":"C2","employeeId":"E1","departments":["MORTGAGES"],"status":"NEW"}`, "token-1")
+	checkCode(t, err, ErrCodeAlreadyExists)
+
+	// Tokens are the caller's own, another caller can neither read the result nor block the token
+	_, err = h.as(savingsEmployee).invoke("createReferral", testReferralJSON, "token-1")
+	checkCode(t, err, ErrCodeAccessDenied)
+
+	var other CreateReferralResult
+	decodeJSON(t, h.mustInvoke(adminCaller, "createReferral", testReferralJSON, "token-1"), &other)
+	if other.ReferralId != "REF-0000000002" {
+		t.Fatalf("admin's create with the same token was allocated %s, want REF-0000000002", other.ReferralId)
+	}
+}
+
+// mustReferralKey returns the ledger key of a referral
+func mustReferralKey(referralId string) string {
+	key, err := referralKey(referralId)
+	if err != nil {
+		panic(err)
+	}
+
+	return key
+}
+
+func TestUpdateReferralStatus(t *testing.T) {
+	runInvokeCases(t, "updateReferralStatus", []invokeCase{
+		{
+			name: "moves the referral and its status index",
+			setup: func(h *harness) {
+				h.stub.Time += 60
+			},
+			args: []string{testReferralId, StatusContacted},
+			check: func(t *testing.T, h *harness, result []byte) {
+				referral := h.stored(testReferralId)
+				if referral.Status != StatusContacted || referral.Version != 2 || referral.UpdatedDate != testTime+60 {
+					t.Fatalf("stored %+v", referral)
+				}
+
+				if referral.StatusEnteredAt[StatusNew] != testTime || referral.StatusEnteredAt[StatusContacted] != testTime+60 {
+					t.Fatalf("status entry times %v", referral.StatusEnteredAt)
+				}
+
+				if got := h.indexed(statusIndex, StatusNew); len(got) != 0 {
+					t.Fatalf("NEW index still holds %v", got)
+				}
+				if got := h.indexed(statusIndex, StatusContacted); !sameStrings(got, []string{testReferralId}) {
+					t.Fatalf("CONTACTED index holds %v", got)
+				}
+
+				if event := checkEvent(t, h, events.ReferralStatusChanged, 2); event.OldStatus != StatusNew || event.NewStatus != StatusContacted {
+					t.Fatalf("event %+v", event)
+				}
+			},
+		},
+		{
+			name: "records the reason code",
+			args: []string{testReferralId, StatusWithdrawn, "CUSTOMER_DECLINED"},
+			check: func(t *testing.T, h *harness, result []byte) {
+				history := h.history(adminCaller, testReferralId)
+				if last := history[len(history)-1]; last.ReasonCode != "CUSTOMER_DECLINED" || last.Action != "updateReferralStatus" {
+					t.Fatalf("audit entry %+v", last)
+				}
+			},
+		},
+		{name: "invalid reason code", args: []string{testReferralId, StatusContacted, "no reason"}, code: ErrCodeInvalidArgument},
+		{name: "skipping a status", args: []string{testReferralId, StatusFunded}, code: ErrCodeInvalidTransition},
+		{name: "unknown status", args: []string{testReferralId, "LOST"}, code: ErrCodeInvalidTransition},
+		{name: "unknown referral", args: []string{"REF-0000000099", StatusContacted}, code: ErrCodeNotFound},
+		{name: "key outside the namespace", args: []string{"bad\x00key", StatusContacted}, code: ErrCodeInvalidArgument},
+		{name: "another department", caller: savingsEmployee, args: []string{testReferralId, StatusContacted}, code: ErrCodeAccessDenied},
+		{name: "mortgage service", caller: mortgageService, args: []string{testReferralId, StatusContacted}, code: ErrCodeAccessDenied},
+		{
+			name:  "archived referral",
+			setup: func(h *harness) { h.mustInvoke(adminCaller, "archiveReferral", testReferralId) },
+			args:  []string{testReferralId, StatusContacted},
+			code:  ErrCodeFailedPrecondition,
+		},
+		{name: "missing status", args: []string{testReferralId}, code: ErrCodeInvalidArgument},
+	})
+}
+
+func TestUpdateReferral(t *testing.T) {
+	runInvokeCases(t, "updateReferral", []invokeCase{
+		{
+			name: "patches the customer name",
+			args: []string{testReferralId, `{"customerName":"Janet Doe"}`, "1"},
+			check: func(t *testing.T, h *harness, result []byte) {
+				referral := h.stored(testReferralId)
+				if referral.Version != 2 || !isSealed(referral.CustomerName) {
+					t.Fatalf("stored %+v", referral)
+				}
+
+				if read := h.read(mortgagesEmployee, testReferralId); read.CustomerName != "Janet Doe" || read.ContactNumber != "+15551234567" {
+					t.Fatalf("read back %+v", read)
+				}
+
+				checkEvent(t, h, events.ReferralUpdated, 2)
+			},
+		},
+		{
+			name: "moves the contact number index",
+			args: []string{testReferralId, `{"contactNumber":"+15550000000"}`, "1"},
+			check: func(t *testing.T, h *harness, result []byte) {
+				if got := h.indexed(contactIndex, contactIndexValue("+15551234567", testPIIKey)); len(got) != 0 {
+					t.Fatalf("old contact number still indexed for %v", got)
+				}
+
+				entries := h.indexEntries(contactIndex, contactIndexValue("+15550000000", testPIIKey))
+				if len(entries) != 1 || entries[0].ReferralId != testReferralId || string(entries[0].Value) != strconv.Itoa(testTime) {
+					t.Fatalf("new contact number entries %+v", entries)
+				}
+			},
+		},
+		{
+			name: "reformatting the contact number keeps its index entry",
+			args: []string{testReferralId, `{"contactNumber":"+1 555 123 4567"}`, "1"},
+			check: func(t *testing.T, h *harness, result []byte) {
+				if got := h.indexed(contactIndex, contactIndexValue("+15551234567", testPIIKey)); !sameStrings(got, []string{testReferralId}) {
+					t.Fatalf("contact index holds %v", got)
+				}
+			},
+		},
+		{
+			name: "patches an unlinked mortgage",
+			args: []string{testReferralId, `{"mortgage":{"schemaVersion":2,"mortgageType":"VARIABLE","referralId":"REF-0000000001","rate":375}}`, "1"},
+			check: func(t *testing.T, h *harness, result []byte) {
+				if mortgage := h.stored(testReferralId).Mortgage; mortgage.MortgageType != "VARIABLE" || mortgage.Rate != 375 {
+					t.Fatalf("mortgage %+v", mortgage)
+				}
+			},
+		},
+		{name: "stale version", args: []string{testReferralId, `{"customerName":"Janet Doe"}`, "0"}, code: ErrCodeVersionConflict},
+		{name: "version not a number", args: []string{testReferralId, `{"customerName":"Janet Doe"}`, "one"}, code: ErrCodeInvalidArgument},
+		{name: "empty patch", args: []string{testReferralId, `{}`, "1"}, code: ErrCodeInvalidArgument},
+		{name: "read only field", args: []string{testReferralId, `{"status":"FUNDED"}`, "1"}, code: ErrCodeInvalidArgument},
+		{name: "invalid contact number", args: []string{testReferralId, `{"contactNumber":"555"}`, "1"}, code: ErrCodeValidation},
+		{name: "blank customer name", args: []string{testReferralId, `{"customerName":" "}`, "1"}, code: ErrCodeValidation},
+		{
+			name:  "changing a linked mortgage number",
+			setup: func(h *harness) { h.mustInvoke(mortgageService, "linkMortgage", testReferralId, testMortgageJSON) },
+			args:  []string{testReferralId, `{"mortgage":{"mortgageNumber":"MTG-0000000002","referralId":"REF-0000000001"}}`, "2"},
+			code:  ErrCodeFailedPrecondition,
+		},
+		{
+			name:  "changing the rate of a linked mortgage",
+			setup: func(h *harness) { h.mustInvoke(mortgageService, "linkMortgage", testReferralId, testMortgageJSON) },
+			args:  []string{testReferralId, `{"mortgage":{"schemaVersion":2,"mortgageNumber":"MTG-0000000001","mortgageType":"FIXED","referralId":"REF-0000000001","rate":100,"amount":{"minorUnits":25000000,"currency":"USD"}}}`, "2"},
+			code:  ErrCodeFailedPrecondition,
+		},
+		{name: "without a pii key", setup: func(h *harness) { h.stub.Metadata = nil }, args: []string{testReferralId, `{"customerName":"Janet Doe"}`, "1"}, code: ErrCodeInvalidArgument},
+		{name: "wrong pii key", setup: func(h *harness) { h.stub.Metadata = piiMetadata([]byte("fedcba9876543210fedcba9876543210")) }, args: []string{testReferralId, `{"customerName":"Janet Doe"}`, "1"}, code: ErrCodeInvalidArgument},
+		{name: "another department", caller: savingsEmployee, args: []string{testReferralId, `{"customerName":"Janet Doe"}`, "1"}, code: ErrCodeAccessDenied},
+		{name: "unknown referral", args: []string{"REF-0000000099", `{"customerName":"Janet Doe"}`, "1"}, code: ErrCodeNotFound},
+		{name: "missing version", args: []string{testReferralId, `{"customerName":"Janet Doe"}`}, code: ErrCodeInvalidArgument},
+	})
+}
+
+func TestAddDepartment(t *testing.T) {
+	runInvokeCases(t, "addDepartment", []invokeCase{
+		{
+			name: "routes the referral to the department",
+			args: []string{testReferralId, " SAVINGS "},
+			check: func(t *testing.T, h *harness, result []byte) {
+				if referral := h.stored(testReferralId); !sameStrings(referral.Departments, []string{"MORTGAGES", "SAVINGS"}) || referral.Version != 2 {
+					t.Fatalf("stored %+v", referral)
+				}
+
+				if got := h.indexed(departmentIndex, "SAVINGS"); !sameStrings(got, []string{testReferralId}) {
+					t.Fatalf("SAVINGS index holds %v", got)
+				}
+
+				checkEvent(t, h, events.DepartmentAdded, 2)
+			},
+		},
+		{name: "already routed", args: []string{testReferralId, "MORTGAGES"}, code: ErrCodeAlreadyExists},
+		{name: "blank department", args: []string{testReferralId, " "}, code: ErrCodeInvalidArgument},
+		{name: "invalid reason code", args: []string{testReferralId, "SAVINGS", "because"}, code: ErrCodeInvalidArgument},
+		{name: "another department", caller: savingsEmployee, args: []string{testReferralId, "SAVINGS"}, code: ErrCodeAccessDenied},
+		{name: "unknown referral", args: []string{"REF-0000000099", "SAVINGS"}, code: ErrCodeNotFound},
+		{
+			name:  "archived referral",
+			setup: func(h *harness) { h.mustInvoke(adminCaller, "archiveReferral", testReferralId) },
+			args:  []string{testReferralId, "SAVINGS"},
+			code:  ErrCodeFailedPrecondition,
+		},
+		{name: "missing department", args: []string{testReferralId}, code: ErrCodeInvalidArgument},
+	})
+}
+
+func TestRemoveDepartment(t *testing.T) {
+	addSavings := func(h *harness) { h.mustInvoke(mortgagesEmployee, "addDepartment", testReferralId, "SAVINGS") }
+
+	runInvokeCases(t, "removeDepartment", []invokeCase{
+		{
+			name:  "takes the department off the referral",
+			setup: addSavings,
+			args:  []string{testReferralId, "MORTGAGES", "TRANSFERRED"},
+			check: func(t *testing.T, h *harness, result []byte) {
+				if referral := h.stored(testReferralId); !sameStrings(referral.Departments, []string{"SAVINGS"}) || referral.Version != 3 {
+					t.Fatalf("stored %+v", referral)
+				}
+
+				if got := h.indexed(departmentIndex, "MORTGAGES"); len(got) != 0 {
+					t.Fatalf("MORTGAGES index still holds %v", got)
+				}
+
+				checkEvent(t, h, events.DepartmentRemoved, 3)
+			},
+		},
+		{name: "last department", args: []string{testReferralId, "MORTGAGES"}, code: ErrCodeFailedPrecondition},
+		{name: "not routed", setup: addSavings, args: []string{testReferralId, "LOANS"}, code: ErrCodeFailedPrecondition},
+		{name: "another department", setup: addSavings, caller: map[string]string{roleAttribute: RoleEmployee, departmentsAttribute: "LOANS"}, args: []string{testReferralId, "SAVINGS"}, code: ErrCodeAccessDenied},
+		{name: "unknown referral", args: []string{"REF-0000000099", "MORTGAGES"}, code: ErrCodeNotFound},
+		{name: "too many arguments", args: []string{testReferralId, "MORTGAGES", "MOVED", "x"}, code: ErrCodeInvalidArgument},
+	})
+}
+
+func TestLinkMortgage(t *testing.T) {
+	runInvokeCases(t, "linkMortgage", []invokeCase{
+		{
+			name:   "stores the mortgage on the referral",
+			caller: mortgageService,
+			args:   []string{testReferralId, testMortgageJSON},
+			check: func(t *testing.T, h *harness, result []byte) {
+				referral := h.stored(testReferralId)
+				if referral.Mortgage.MortgageNumber != "MTG-0000000001" || referral.Mortgage.Amount.MinorUnits != 25000000 || referral.Version != 2 {
+					t.Fatalf("stored %+v", referral)
+				}
+
+				checkReturnedEvent(t, h, result, events.MortgageLinked, 2)
+			},
+		},
+		{
+			name:   "relinking the same mortgage",
+			setup:  func(h *harness) { h.mustInvoke(mortgageService, "linkMortgage", testReferralId, testMortgageJSON) },
+			caller: mortgageService,
+			args:   []string{testReferralId, testMortgageJSON},
+		},
+		{
+			name:   "reads version 1 mortgages",
+			caller: mortgageService,
+			args:   []string{testReferralId, `{"mortgageNumber":"MTG-0000000001","referralId":"REF-0000000001","rate":"4.5%","amount":"$250,000"}`},
+			check: func(t *testing.T, h *harness, result []byte) {
+				if mortgage := h.stored(testReferralId).Mortgage; mortgage.Rate != 450 || mortgage.Amount.MinorUnits != 25000000 {
+					t.Fatalf("mortgage %+v", mortgage)
+				}
+			},
+		},
+		{
+			name:   "reads numbers without a schema version",
+			caller: mortgageService,
+			args:   []string{testReferralId, `{"mortgageNumber":"MTG-0000000001","referralId":"REF-0000000001","rate":450,"amount":{"minorUnits":25000000,"currency":"USD"}}`},
+			check: func(t *testing.T, h *harness, result []byte) {
+				if mortgage := h.stored(testReferralId).Mortgage; mortgage.Rate != 450 || mortgage.Amount.MinorUnits != 25000000 {
+					t.Fatalf("mortgage %+v", mortgage)
+				}
+			},
+		},
+		{
+			name:   "flags legacy values that cannot be parsed",
+			caller: mortgageService,
+			args:   []string{testReferralId, `{"mortgageNumber":"MTG-0000000001","referralId":"REF-0000000001","rate":"TBD","amount":"about 250k"}`},
+			check: func(t *testing.T, h *harness, result []byte) {
+				mortgage := h.stored(testReferralId).Mortgage
+				if mortgage.Rate != 0 || !mortgage.Amount.IsZero() || mortgage.LegacyRate != "TBD" || mortgage.LegacyAmount != "about 250k" {
+					t.Fatalf("mortgage %+v", mortgage)
+				}
+			},
+		},
+		{name: "rate of the wrong type", caller: mortgageService, args: []string{testReferralId, `{"mortgageNumber":"MTG-0000000001","referralId":"REF-0000000001","rate":true}`}, code: ErrCodeInvalidArgument},
+		{
+			name:   "another mortgage",
+			setup:  func(h *harness) { h.mustInvoke(mortgageService, "linkMortgage", testReferralId, testMortgageJSON) },
+			caller: mortgageService,
+			args:   []string{testReferralId, `{"mortgageNumber":"MTG-0000000002","referralId":"REF-0000000001"}`},
+			code:   ErrCodeAlreadyExists,
+		},
+		{name: "another referral's mortgage", caller: mortgageService, args: []string{testReferralId, `{"mortgageNumber":"MTG-0000000001","referralId":"REF-0000000002"}`}, code: ErrCodeInvalidArgument},
+		{name: "no mortgage number", caller: mortgageService, args: []string{testReferralId, `{"referralId":"REF-0000000001"}`}, code: ErrCodeInvalidArgument},
+		{name: "newer schema", caller: mortgageService, args: []string{testReferralId, `{"schemaVersion":3,"mortgageNumber":"MTG-0000000001","referralId":"REF-0000000001"}`}, code: ErrCodeInvalidArgument},
+		{
+			name: "terminal referral",
+			setup: func(h *harness) {
+				h.mustInvoke(mortgagesEmployee, "updateReferralStatus", testReferralId, StatusWithdrawn)
+			},
+			caller: mortgageService,
+			args:   []string{testReferralId, testMortgageJSON},
+			code:   ErrCodeFailedPrecondition,
+		},
+		{
+			name:   "archived referral",
+			setup:  func(h *harness) { h.mustInvoke(adminCaller, "archiveReferral", testReferralId) },
+			caller: mortgageService,
+			args:   []string{testReferralId, testMortgageJSON},
+			code:   ErrCodeFailedPrecondition,
+		},
+		{name: "unknown referral", caller: mortgageService, args: []string{"REF-0000000002", `{"mortgageNumber":"MTG-0000000001","referralId":"REF-0000000002"}`}, code: ErrCodeNotFound},
+		{name: "employee", args: []string{testReferralId, testMortgageJSON}, code: ErrCodeAccessDenied},
+		{name: "missing mortgage", caller: mortgageService, args: []string{testReferralId}, code: ErrCodeInvalidArgument},
+		{
+			name:   "called directly",
+			setup:  func(h *harness) { h.stub.InvokedChaincode = ledger.MockChaincodeName },
+			caller: mortgageService,
+			args:   []string{testReferralId, testMortgageJSON},
+			code:   ErrCodeAccessDenied,
+		},
+		{
+			name:   "called by another chaincode",
+			setup:  func(h *harness) { h.stub.InvokedChaincode = "other" },
+			caller: mortgageService,
+			args:   []string{testReferralId, testMortgageJSON},
+			code:   ErrCodeAccessDenied,
+		},
+		{
+			name:   "mortgage chaincode not set by init",
+			setup:  func(h *harness) { h.mustInvoke(adminCaller, "init") },
+			caller: mortgageService,
+			args:   []string{testReferralId, testMortgageJSON},
+			code:   ErrCodeFailedPrecondition,
+		},
+	})
+}
+
+func TestFollowMortgageStatus(t *testing.T) {
+	link := func(h *harness) { h.mustInvoke(mortgageService, "linkMortgage", testReferralId, testMortgageJSON) }
+
+	runInvokeCases(t, "followMortgageStatus", []invokeCase{
+		{
+			name:   "walks the referral through the statuses in between",
+			setup:  link,
+			caller: mortgageService,
+			args:   []string{testReferralId, "MTG-0000000001", StatusFunded},
+			check: func(t *testing.T, h *harness, result []byte) {
+				referral := h.stored(testReferralId)
+				if referral.Status != StatusFunded || referral.Version != 3 {
+					t.Fatalf("stored %+v", referral)
+				}
+
+				for _, status := range []string{StatusContacted, StatusApplication, StatusUnderwriting, StatusApproved, StatusFunded} {
+					if _, ok := referral.StatusEnteredAt[status]; !ok {
+						t.Errorf("no entry time for %s", status)
+					}
+				}
+
+				if got := h.indexed(statusIndex, StatusFunded); !sameStrings(got, []string{testReferralId}) {
+					t.Fatalf("FUNDED index holds %v", got)
+				}
+				if got := h.indexed(statusIndex, StatusNew); len(got) != 0 {
+					t.Fatalf("NEW index still holds %v", got)
+				}
+
+				if event := checkReturnedEvent(t, h, result, events.ReferralStatusChanged, 3); event.OldStatus != StatusNew {
+					t.Fatalf("event %+v", event)
+				}
+			},
+		},
+		{
+			name:   "already in the status",
+			setup:  link,
+			caller: mortgageService,
+			args:   []string{testReferralId, "MTG-0000000001", StatusNew},
+			check: func(t *testing.T, h *harness, result []byte) {
+				if referral := h.stored(testReferralId); referral.Version != 2 {
+					t.Fatalf("stored %+v, want it unchanged", referral)
+				}
+			},
+		},
+		{
+			name: "no way there",
+			setup: func(h *harness) {
+				link(h)
+				h.mustInvoke(mortgagesEmployee, "updateReferralStatus", testReferralId, StatusWithdrawn)
+			},
+			caller: mortgageService,
+			args:   []string{testReferralId, "MTG-0000000001", StatusFunded},
+			code:   ErrCodeInvalidTransition,
+		},
+		{name: "not linked", caller: mortgageService, args: []string{testReferralId, "MTG-0000000001", StatusFunded}, code: ErrCodeFailedPrecondition},
+		{name: "another mortgage", setup: link, caller: mortgageService, args: []string{testReferralId, "MTG-0000000002", StatusFunded}, code: ErrCodeFailedPrecondition},
+		{name: "unknown referral", caller: mortgageService, args: []string{"REF-0000000099", "MTG-0000000001", StatusFunded}, code: ErrCodeNotFound},
+		{name: "employee", setup: link, args: []string{testReferralId, "MTG-0000000001", StatusFunded}, code: ErrCodeAccessDenied},
+		{name: "missing status", caller: mortgageService, args: []string{testReferralId, "MTG-0000000001"}, code: ErrCodeInvalidArgument},
+		{
+			name:   "called directly",
+			setup:  func(h *harness) { link(h); h.stub.InvokedChaincode = ledger.MockChaincodeName },
+			caller: mortgageService,
+			args:   []string{testReferralId, "MTG-0000000001", StatusFunded},
+			code:   ErrCodeAccessDenied,
+		},
+	})
+}
+
+func TestAuthorization(t *testing.T) {
+	cases := []struct {
+		name     string
+		caller   map[string]string
+		function string
+		query    bool
+	}{
+		{"unknown invoke function", adminCaller, "deleteEverything", false},
+		{"unknown query function", adminCaller, "dumpState", true},
+		{"invoke without a role", noRole, "createReferral", false},
+		{"query without a role", noRole, "read", true},
+		{"unknown role", map[string]string{roleAttribute: "auditor"}, "read", true},
+		{"admin function as an employee", mortgagesEmployee, "purgeReferral", false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h := newHarness(t).as(c.caller)
+
+			run := h.invoke
+			if c.query {
+				run = h.query
+			}
+
+			_, err := run(c.function, testReferralId)
+			checkCode(t, err, ErrCodeAccessDenied)
+
+			var details struct {
+				Details AccessError `json:"details"`
+			}
+			decodeJSON(t, []byte(err.Error()), &details)
+			if details.Details.Function != c.function || details.Details.Role != c.caller[roleAttribute] {
+				t.Fatalf("access error %+v", details.Details)
+			}
+		})
+	}
+}
+
+func TestErrorEnvelope(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		code string
+	}{
+		{"chaincode error", notFound("REF-1"), ErrCodeNotFound},
+		{"validation error", &ValidationError{}, ErrCodeValidation},
+		{"transition error", &chaincode.TransitionError{}, ErrCodeInvalidTransition},
+		{"version error", &VersionError{}, ErrCodeVersionConflict},
+		{"access error", &AccessError{}, ErrCodeAccessDenied},
+		{"any other error", strconv.ErrSyntax, ErrCodeInternal},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var envelope ChaincodeError
+			decodeJSON(t, []byte(asChaincodeError(c.err).Error()), &envelope)
+			if envelope.Code != c.code || envelope.Message == "" {
+				t.Fatalf("envelope %+v, want code %s", envelope, c.code)
+			}
+		})
+	}
+}
+
+// read returns a referral as the caller reads it
+func (h *harness) read(caller map[string]string, referralId string) CustomerReferral {
+	h.t.Helper()
+
+	h.as(caller)
+	result, err := h.query("read", referralId)
+	if err != nil {
+		h.t.Fatalf("read %s failed: %v", referralId, err)
+	}
+
+	var referral CustomerReferral
+	decodeJSON(h.t, result, &referral)
+	return referral
+}
+
+// history returns a referral's audit trail as the caller sees it
+func (h *harness) history(caller map[string]string, referralId string) []AuditEntry {
+	h.t.Helper()
+
+	h.as(caller)
+	result, err := h.query("getReferralHistory", referralId)
+	if err != nil {
+		h.t.Fatalf("getReferralHistory %s failed: %v", referralId, err)
+	}
+
+	var history []AuditEntry
+	decodeJSON(h.t, result, &history)
+	return history
+}
+
+// indexEntries returns the committed entries of an index for a value
+func (h *harness) indexEntries(indexName string, value string) []indexEntry {
+	h.t.Helper()
+
+	var entries []indexEntry
+	_, err := h.stub.Query(func(stub ledger.Stub) ([]byte, error) {
+		var err error
+		entries, err = getIndexEntries(indexName, value, stub)
+		return nil, err
+	})
+	if err != nil {
+		h.t.Fatal(err)
+	}
+
+	return entries
+}
@@ -0,0 +1,124 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+
+	"github.com/joerust/mortgage-referrals/ledger"
+)
+
+// defaultDuplicateWindowSeconds is how far back createReferral looks for earlier referrals of the same customer
+const defaultDuplicateWindowSeconds = 30 * 24 * 60 * 60
+
+// defaultReferralIdPrefix starts every referral id createReferral allocates
+const defaultReferralIdPrefix = "REF"
+
+var referralIdPrefixPattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]{0,15}$`)
+
+// chaincodeNamePattern matches the names Fabric accepts for a chaincode
+var chaincodeNamePattern = regexp.MustCompile(`^[A-Za-z0-9]+([-_][A-Za-z0-9]+)*$`)
+
+// ChaincodeConfig holds the settings passed to Init
+type ChaincodeConfig struct {
+	DuplicateWindowSeconds int64  `json:"duplicateWindowSeconds"`
+	ReferralIdPrefix       string `json:"referralIdPrefix"`
+	MortgageChaincode      string `json:"mortgageChaincode,omitempty"`
+	// PIIKeyFingerprint identifies the piiKey the customer details are sealed with, see piiKeyFingerprint
+	PIIKeyFingerprint string `json:"piiKeyFingerprint,omitempty"`
+}
+
+// defaultConfig returns the settings used when Init was not given them
+func defaultConfig() ChaincodeConfig {
+	return ChaincodeConfig{DuplicateWindowSeconds: defaultDuplicateWindowSeconds, ReferralIdPrefix: defaultReferralIdPrefix}
+}
+
+// getConfig reads the chaincode settings from the ledger, falling back to the defaults
+func getConfig(stub ledger.Stub) (ChaincodeConfig, error) {
+	config := defaultConfig()
+
+	key, err := createCompositeKey(configNamespace)
+	if err != nil {
+		return config, err
+	}
+
+	valAsbytes, err := stub.GetState(key)
+	if err != nil {
+		return config, newError(ErrCodeLedger, "Failed to get state for config")
+	}
+
+	if valAsbytes == nil {
+		return config, nil
+	}
+
+	err = json.Unmarshal(valAsbytes, &config)
+	return config, err
+}
+
+// putConfig stores the chaincode settings on the ledger
+func putConfig(config ChaincodeConfig, stub ledger.Stub) error {
+	key, err := createCompositeKey(configNamespace)
+	if err != nil {
+		return err
+	}
+
+	valAsbytes, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	err = stub.PutState(key, valAsbytes)
+	if err != nil {
+		return newError(ErrCodeLedger, "Failed to update state for config")
+	}
+
+	return nil
+}
+
+// parseConfigArgs builds the settings from the Init arguments. The optional first argument is the
+// duplicate customer window in seconds, the optional second one the referral id prefix and the optional
+// third one the name of the mortgage chaincode allowed to link and move referrals.
+func parseConfigArgs(args []string) (ChaincodeConfig, error) {
+	config := defaultConfig()
+
+	if len(args) > 3 {
+		return config, newError(ErrCodeInvalidArgument, "Incorrect number of arguments. Expecting at most 3, the duplicate window in seconds, the referral id prefix and the mortgage chaincode name")
+	}
+
+	if len(args) > 0 && args[0] != "" {
+		window, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil || window < 0 {
+			return config, newError(ErrCodeInvalidArgument, "Duplicate window must be a non-negative number of seconds")
+		}
+		config.DuplicateWindowSeconds = window
+	}
+
+	if len(args) > 1 && args[1] != "" {
+		if !referralIdPrefixPattern.MatchString(args[1]) {
+			return config, newError(ErrCodeInvalidArgument, "Referral id prefix must be a letter followed by up to 15 letters or digits")
+		}
+		config.ReferralIdPrefix = args[1]
+	}
+
+	if len(args) > 2 {
+		if !chaincodeNamePattern.MatchString(args[2]) {
+			return config, newError(ErrCodeInvalidArgument, "Mortgage chaincode name "+args[2]+" is not a valid chaincode name")
+		}
+		config.MortgageChaincode = args[2]
+	}
+
+	return config, nil
+}
@@ -0,0 +1,637 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/joerust/mortgage-referrals/ledger"
+)
+
+// Batch sizes for checkIndexes and rebuildIndexes
+const (
+	defaultRebuildBatchSize = 50
+	maxRebuildBatchSize     = 200
+)
+
+// rebuildTokenIndex ties checkIndexes and rebuildIndexes continuation tokens to a consistency pass
+const rebuildTokenIndex = "rebuild"
+
+// The phases of a consistency pass. The referral records are walked first, checking each referral has the
+// entries its record calls for, then the index entries, checking each is called for by its referral.
+const (
+	referralPhase = "referrals"
+	entryPhase    = "entries"
+)
+
+// referralIndexes are the indexes built from the referral records, in the order they are checked
+var referralIndexes = []string{statusIndex, departmentIndex, employeeIndex, customerIndex, contactIndex}
+
+// entriesPerReferral scales the batch size to the number of entries a batch of the entry phase reads, about
+// as many as a batch of the referral phase checks
+var entriesPerReferral = len(referralIndexes)
+
+// singleEntryIndexes hold at most one entry per referral, a referral can only be in one department index per department
+var singleEntryIndexes = map[string]bool{
+	statusIndex:   true,
+	employeeIndex: true,
+	customerIndex: true,
+	contactIndex:  true,
+}
+
+// IndexEntryRef identifies a single index entry
+type IndexEntryRef struct {
+	Index      string `json:"index"`
+	Value      string `json:"value"`
+	ReferralId string `json:"referralId"`
+}
+
+// IndexDuplicate is a referral filed under more than one value of an index that holds one entry per referral
+type IndexDuplicate struct {
+	Index      string   `json:"index"`
+	ReferralId string   `json:"referralId"`
+	Values     []string `json:"values"`
+}
+
+// IndexReport lists the ways the indexes disagree with the referral records in one batch of a consistency
+// pass. An orphaned entry is one the record does not call for, because the referral does not exist, is
+// archived or has a different value. The stale entry behind a duplicate is also reported as orphaned.
+// Unreadable records are listed and their index entries are left alone. A referral still indexed under
+// the legacy contact number hash is only checked with the piiKey, without it a warning is listed instead.
+type IndexReport struct {
+	ReferralsScanned int              `json:"referralsScanned"`
+	EntriesScanned   int              `json:"entriesScanned"`
+	Orphaned         []IndexEntryRef  `json:"orphaned"`
+	Missing          []IndexEntryRef  `json:"missing"`
+	Duplicates       []IndexDuplicate `json:"duplicates"`
+	Unreadable       []string         `json:"unreadable"`
+	Warnings         []string         `json:"warnings"`
+	Consistent       bool             `json:"consistent"`
+	NextToken        string           `json:"nextToken"`
+}
+
+// RebuildResult is the result of a single rebuildIndexes batch
+type RebuildResult struct {
+	ReferralsScanned int             `json:"referralsScanned"`
+	EntriesScanned   int             `json:"entriesScanned"`
+	Removed          []IndexEntryRef `json:"removed"`
+	Added            []IndexEntryRef `json:"added"`
+	Unreadable       []string        `json:"unreadable"`
+	Warnings         []string        `json:"warnings"`
+	NextToken        string          `json:"nextToken"`
+}
+
+// referralBatch is a run of referral records in id order, the ids after After. Last is the final id of
+// the batch when more referrals follow it, and empty when the batch runs to the end, and Bookmark is where a
+// paged read of the batch after it resumes.
+type referralBatch struct {
+	After      string
+	Last       string
+	Bookmark   string
+	Referrals  map[string]CustomerReferral
+	Unreadable map[string]bool
+}
+
+// keyPage is a run of the keys under a composite key prefix. More is set when keys follow it, and Bookmark
+// is where a paged read of them resumes.
+type keyPage struct {
+	Keys     []string
+	Values   [][]byte
+	More     bool
+	Bookmark string
+}
+
+// readKeyPage reads up to limit of the keys under a composite key prefix that follow afterKey. The peer only
+// range scans a composite key prefix from its start, so a query resumes with a paged read at the bookmark.
+// An invoke cannot run paged queries, and a token from one carries no bookmark, so those read the prefix
+// from its start and skip the keys up to afterKey.
+func readKeyPage(prefix string, afterKey string, bookmark string, limit int, paged bool, stub ledger.Stub) (keyPage, error) {
+	var page keyPage
+
+	if paged && (afterKey == "" || bookmark != "") {
+		keysIter, next, err := stub.RangeQueryStatePage(prefix, prefix+maxUnicodeRune, int32(limit), bookmark)
+		if err != nil {
+			return page, err
+		}
+		defer keysIter.Close()
+
+		for keysIter.HasNext() {
+			key, valAsbytes, err := keysIter.Next()
+			if err != nil {
+				return page, err
+			}
+			page.Keys = append(page.Keys, key)
+			page.Values = append(page.Values, valAsbytes)
+		}
+
+		page.More = next != ""
+		page.Bookmark = next
+		return page, nil
+	}
+
+	keysIter, err := stub.RangeQueryState(prefix, prefix+maxUnicodeRune)
+	if err != nil {
+		return page, err
+	}
+	defer keysIter.Close()
+
+	for keysIter.HasNext() {
+		key, valAsbytes, err := keysIter.Next()
+		if err != nil {
+			return page, err
+		}
+
+		if key <= afterKey {
+			continue
+		}
+
+		if len(page.Keys) == limit {
+			page.More = true
+			break
+		}
+		page.Keys = append(page.Keys, key)
+		page.Values = append(page.Values, valAsbytes)
+	}
+
+	return page, nil
+}
+
+// loadReferralBatch reads up to batchSize referral records after the given id, resuming at the bookmark
+// when it is read as a page
+func loadReferralBatch(after string, bookmark string, batchSize int, paged bool, stub ledger.Stub) (referralBatch, error) {
+	batch := referralBatch{After: after, Referrals: map[string]CustomerReferral{}, Unreadable: map[string]bool{}}
+
+	prefix, err := createCompositeKey(referralNamespace)
+	if err != nil {
+		return batch, err
+	}
+
+	afterKey := ""
+	if after != "" {
+		afterKey, err = referralKey(after)
+		if err != nil {
+			return batch, err
+		}
+	}
+
+	page, err := readKeyPage(prefix, afterKey, bookmark, batchSize, paged, stub)
+	if err != nil {
+		return batch, newError(ErrCodeLedger, "Failed to scan referrals")
+	}
+
+	last := ""
+	for i, key := range page.Keys {
+		_, attributes, err := splitCompositeKey(key)
+		if err != nil || len(attributes) != 1 {
+			fmt.Println("Skipping malformed referral key " + key)
+			continue
+		}
+
+		referralId := attributes[0]
+		last = referralId
+
+		var referral CustomerReferral
+		err = json.Unmarshal(page.Values[i], &referral)
+		if err != nil {
+			batch.Unreadable[referralId] = true
+			continue
+		}
+		batch.Referrals[referralId] = referral
+	}
+
+	// The batch ends at the last id read, unless the scan ran out first
+	if page.More {
+		batch.Last = last
+		batch.Bookmark = page.Bookmark
+	}
+
+	return batch, nil
+}
+
+// legacyContactWarning is the warning for a referral whose contact number index entry could not be checked
+func legacyContactWarning(referralId string) string {
+	return "The contact number index of " + referralId + " was not checked, it is indexed under the legacy hash, which needs the piiKey"
+}
+
+// checkableContactValue returns the value the referral should be filed under in the contact number index,
+// or an empty string if it is still indexed under the legacy hash of a sealed number and the transaction
+// carries no piiKey to open it
+func checkableContactValue(referral CustomerReferral, stub ledger.Stub) (string, error) {
+	if referral.ContactHash == "" && isSealed(referral.ContactNumber) {
+		key, err := getPIIKey(stub)
+		if err != nil || key == nil {
+			return "", err
+		}
+	}
+
+	return storedContactIndexValue(referral, stub)
+}
+
+// indexValues returns the values a referral should be filed under in an index. The contact number index
+// value is empty when it cannot be worked out, see checkableContactValue.
+func indexValues(indexName string, referral CustomerReferral, stub ledger.Stub) ([]string, error) {
+	switch indexName {
+	case statusIndex:
+		return []string{referral.Status}, nil
+	case departmentIndex:
+		return referral.Departments, nil
+	case employeeIndex:
+		return []string{referral.EmployeeId}, nil
+	case customerIndex:
+		return []string{referral.CustomerId}, nil
+	}
+
+	contactValue, err := checkableContactValue(referral, stub)
+	return []string{contactValue}, err
+}
+
+// expectedIndexEntries returns the entries the indexes should hold for an unarchived referral. The contact
+// number index is left out, with a warning, when its value cannot be worked out without the piiKey.
+func expectedIndexEntries(referralId string, referral CustomerReferral, stub ledger.Stub) ([]IndexEntryRef, string, error) {
+	var expected []IndexEntryRef
+	warning := ""
+	for _, indexName := range referralIndexes {
+		values, err := indexValues(indexName, referral, stub)
+		if err != nil {
+			return nil, "", err
+		}
+
+		for _, value := range values {
+			if indexName == contactIndex && value == "" {
+				warning = legacyContactWarning(referralId)
+				continue
+			}
+			expected = append(expected, IndexEntryRef{indexName, value, referralId})
+		}
+	}
+
+	return expected, warning, nil
+}
+
+// checkReferralBatch reports the entries the referrals of a batch call for that the indexes do not hold,
+// reading each expected entry by its key
+func checkReferralBatch(batch referralBatch, report *IndexReport, stub ledger.Stub) error {
+	referralIds := make([]string, 0, len(batch.Referrals))
+	for referralId := range batch.Referrals {
+		referralIds = append(referralIds, referralId)
+	}
+	sort.Strings(referralIds)
+
+	for _, referralId := range referralIds {
+		referral := batch.Referrals[referralId]
+		if referral.Archived {
+			continue
+		}
+
+		expected, warning, err := expectedIndexEntries(referralId, referral, stub)
+		if err != nil {
+			return err
+		}
+
+		if warning != "" {
+			report.Warnings = append(report.Warnings, warning)
+		}
+
+		for _, entry := range expected {
+			found, err := hasIndexEntry(entry.Index, entry.Value, entry.ReferralId, stub)
+			if err != nil {
+				return err
+			}
+
+			if !found {
+				report.Missing = append(report.Missing, entry)
+			}
+		}
+	}
+
+	for referralId := range batch.Unreadable {
+		report.Unreadable = append(report.Unreadable, referralId)
+	}
+	sort.Strings(report.Unreadable)
+
+	return nil
+}
+
+// entryReferral is a referral read while checking index entries. Entries of a referral that does not exist
+// are orphaned, and entries of an unreadable one are left alone.
+type entryReferral struct {
+	referral CustomerReferral
+	exists   bool
+	readable bool
+}
+
+// entryChecker checks index entries against their referral records, reading each referral once
+type entryChecker struct {
+	stub      ledger.Stub
+	report    *IndexReport
+	referrals map[string]entryReferral
+}
+
+// getReferral returns the record of the referral an entry is filed for
+func (c *entryChecker) getReferral(referralId string) (entryReferral, error) {
+	if cached, ok := c.referrals[referralId]; ok {
+		return cached, nil
+	}
+
+	var read entryReferral
+	valAsbytes, err := getReferralBytes(referralId, c.stub)
+	if err != nil {
+		return read, err
+	}
+
+	if valAsbytes != nil {
+		read.exists = true
+		read.readable = json.Unmarshal(valAsbytes, &read.referral) == nil
+	}
+
+	c.referrals[referralId] = read
+	return read, nil
+}
+
+// check reports an entry as orphaned when its referral does not call for it, and as a duplicate too when
+// the referral is also filed under the value it does call for
+func (c *entryChecker) check(entry IndexEntryRef) error {
+	read, err := c.getReferral(entry.ReferralId)
+	if err != nil || (read.exists && !read.readable) {
+		return err
+	}
+
+	if !read.exists || read.referral.Archived {
+		c.report.Orphaned = append(c.report.Orphaned, entry)
+		return nil
+	}
+
+	values, err := indexValues(entry.Index, read.referral, c.stub)
+	if err != nil {
+		return err
+	}
+
+	for _, value := range values {
+		if value == entry.Value {
+			return nil
+		}
+	}
+
+	// The referral phase already warned that its contact number index could not be checked
+	if entry.Index == contactIndex && values[0] == "" {
+		return nil
+	}
+
+	c.report.Orphaned = append(c.report.Orphaned, entry)
+
+	if !singleEntryIndexes[entry.Index] {
+		return nil
+	}
+
+	found, err := hasIndexEntry(entry.Index, values[0], entry.ReferralId, c.stub)
+	if err != nil || !found {
+		return err
+	}
+
+	duplicate := []string{entry.Value, values[0]}
+	sort.Strings(duplicate)
+	c.report.Duplicates = append(c.report.Duplicates, IndexDuplicate{entry.Index, entry.ReferralId, duplicate})
+	return nil
+}
+
+// entryPosition is where the entry phase of a consistency pass resumes, after the key of the named index
+type entryPosition struct {
+	Index    string
+	After    string
+	Bookmark string
+}
+
+// checkEntryBatch checks up to limit index entries, starting after the given position and carrying on into
+// the indexes after it. Returns the position to resume from, with an empty index name once every index has
+// been checked.
+func checkEntryBatch(from entryPosition, limit int, paged bool, report *IndexReport, stub ledger.Stub) (entryPosition, error) {
+	checker := &entryChecker{stub: stub, report: report, referrals: map[string]entryReferral{}}
+
+	position := 0
+	for position < len(referralIndexes) && referralIndexes[position] != from.Index {
+		position++
+	}
+
+	for ; position < len(referralIndexes); position++ {
+		indexName := referralIndexes[position]
+		if report.EntriesScanned == limit {
+			return entryPosition{Index: indexName}, nil
+		}
+
+		prefix, err := createCompositeKey(indexName)
+		if err != nil {
+			return entryPosition{}, err
+		}
+
+		page, err := readKeyPage(prefix, from.After, from.Bookmark, limit-report.EntriesScanned, paged, stub)
+		if err != nil {
+			return entryPosition{}, newError(ErrCodeLedger, "Failed to scan "+indexName+" index")
+		}
+
+		for _, key := range page.Keys {
+			report.EntriesScanned++
+
+			_, attributes, err := splitCompositeKey(key)
+			if err != nil || len(attributes) != 2 {
+				fmt.Println("Skipping malformed index key " + key)
+				continue
+			}
+
+			err = checker.check(IndexEntryRef{indexName, attributes[0], attributes[1]})
+			if err != nil {
+				return entryPosition{}, err
+			}
+		}
+
+		// The batch ends at the last entry read when more of the index follow it
+		if page.More {
+			return entryPosition{Index: indexName, After: page.Keys[len(page.Keys)-1], Bookmark: page.Bookmark}, nil
+		}
+		from = entryPosition{}
+	}
+
+	return entryPosition{}, nil
+}
+
+// parseConsistencyArgs reads the optional batch size and continuation token of checkIndexes and
+// rebuildIndexes. A pass without a token starts with the first batch of referrals.
+func parseConsistencyArgs(args []string) (int, pageToken, error) {
+	if len(args) > 2 {
+		return 0, pageToken{}, newError(ErrCodeInvalidArgument, "Incorrect number of arguments. Expecting an optional batch size and an optional continuation token")
+	}
+
+	batchSize := defaultRebuildBatchSize
+	if len(args) > 0 && args[0] != "" {
+		size, err := strconv.Atoi(args[0])
+		if err != nil || size < 1 || size > maxRebuildBatchSize {
+			return 0, pageToken{}, newError(ErrCodeInvalidArgument, "Batch size must be between 1 and "+strconv.Itoa(maxRebuildBatchSize))
+		}
+		batchSize = size
+	}
+
+	if len(args) < 2 || args[1] == "" {
+		return batchSize, pageToken{Index: rebuildTokenIndex, Value: referralPhase}, nil
+	}
+
+	token, err := decodePageToken(args[1], rebuildTokenIndex, referralPhase)
+	if err == nil {
+		if token.After == "" {
+			return 0, pageToken{}, invalidPageToken()
+		}
+		return batchSize, token, nil
+	}
+
+	// An entry phase token resumes within one of the indexes, never anywhere else in the key space
+	token, err = decodePageToken(args[1], rebuildTokenIndex, entryPhase)
+	if err != nil {
+		return 0, pageToken{}, err
+	}
+
+	prefix, err := createCompositeKey(token.Driver)
+	if err != nil || !isReferralIndex(token.Driver) || (token.After != "" && !strings.HasPrefix(token.After, prefix)) {
+		return 0, pageToken{}, invalidPageToken()
+	}
+
+	return batchSize, token, nil
+}
+
+// isReferralIndex reports whether the name is one of the indexes built from the referral records
+func isReferralIndex(indexName string) bool {
+	for i := range referralIndexes {
+		if referralIndexes[i] == indexName {
+			return true
+		}
+	}
+
+	return false
+}
+
+// runConsistencyBatch checks the batch of the pass the token points at. Queries read the batch as a page,
+// see readKeyPage. Returns the report, with the token for the next batch, and the referrals a referral phase
+// batch read.
+func runConsistencyBatch(batchSize int, token pageToken, paged bool, stub ledger.Stub) (IndexReport, referralBatch, error) {
+	report := IndexReport{
+		Orphaned:   []IndexEntryRef{},
+		Missing:    []IndexEntryRef{},
+		Duplicates: []IndexDuplicate{},
+		Unreadable: []string{},
+		Warnings:   []string{},
+	}
+
+	var batch referralBatch
+	if token.Value == referralPhase {
+		var err error
+		batch, err = loadReferralBatch(token.After, token.Bookmark, batchSize, paged, stub)
+		if err != nil {
+			return report, batch, err
+		}
+		report.ReferralsScanned = len(batch.Referrals) + len(batch.Unreadable)
+
+		err = checkReferralBatch(batch, &report, stub)
+		if err != nil {
+			return report, batch, err
+		}
+
+		next := pageToken{Index: rebuildTokenIndex, Value: entryPhase, Driver: referralIndexes[0]}
+		if batch.Last != "" {
+			next = pageToken{Index: rebuildTokenIndex, Value: referralPhase, After: batch.Last, Bookmark: batch.Bookmark}
+		}
+		report.NextToken = encodePageToken(next)
+	} else {
+		from := entryPosition{Index: token.Driver, After: token.After, Bookmark: token.Bookmark}
+		next, err := checkEntryBatch(from, batchSize*entriesPerReferral, paged, &report, stub)
+		if err != nil {
+			return report, batch, err
+		}
+
+		if next.Index != "" {
+			report.NextToken = encodePageToken(pageToken{Index: rebuildTokenIndex, Value: entryPhase, Driver: next.Index, After: next.After, Bookmark: next.Bookmark})
+		}
+	}
+
+	report.Consistent = len(report.Orphaned) == 0 && len(report.Missing) == 0 && len(report.Duplicates) == 0
+	return report, batch, nil
+}
+
+// checkIndexes - query function reporting the index entries that are orphaned, missing or duplicated, a
+// batch at a time. Expects an optional batch size and an optional continuation token from the previous
+// batch. A pass first checks the referral records in id order, reading the entries each one calls for,
+// then the index entries, reading the referral each one is filed for. Returns the report of the batch
+// with a token for the next one until the pass is complete. A piiKey is needed to check the contact
+// number index of referrals still indexed under the legacy hash.
+func (t *ReferralChaincode) checkIndexes(stub ledger.Stub, args []string) ([]byte, error) {
+
+	batchSize, token, err := parseConsistencyArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	report, _, err := runConsistencyBatch(batchSize, token, true, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(report)
+}
+
+// rebuildIndexes - invoke function bringing the indexes back in line with the referral records, a batch at
+// a time. Expects an optional batch size and an optional continuation token from the previous batch. Each
+// call checks the next batch of the pass as checkIndexes does, adds the missing entries and removes the
+// orphaned ones, and returns a token for the batch after it until the pass is complete.
+func (t *ReferralChaincode) rebuildIndexes(stub ledger.Stub, args []string) ([]byte, error) {
+
+	batchSize, token, err := parseConsistencyArgs(args)
+	if err != nil {
+		return nil, err
+	}
+
+	report, batch, err := runConsistencyBatch(batchSize, token, false, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range report.Orphaned {
+		err = delIndexEntry(entry.Index, entry.Value, entry.ReferralId, stub)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, entry := range report.Missing {
+		// The customer indexes record when the referral was made, which is its create date
+		entryValue := indexEntryValue
+		if entry.Index == customerIndex || entry.Index == contactIndex {
+			entryValue = []byte(strconv.FormatInt(batch.Referrals[entry.ReferralId].CreateDate, 10))
+		}
+
+		err = putIndexEntryValue(entry.Index, entry.Value, entry.ReferralId, entryValue, stub)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return json.Marshal(RebuildResult{
+		ReferralsScanned: report.ReferralsScanned,
+		EntriesScanned:   report.EntriesScanned,
+		Removed:          report.Orphaned,
+		Added:            report.Missing,
+		Unreadable:       report.Unreadable,
+		Warnings:         report.Warnings,
+		NextToken:        report.NextToken,
+	})
+}
@@ -0,0 +1,423 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// delEntry deletes a committed index entry
+func delEntry(h *harness, indexName string, value string, referralId string) {
+	key, _ := createCompositeKey(indexName, value, referralId)
+	delete(h.stub.State, key)
+}
+
+// passReport runs the rest of the consistency pass the first batch's report starts as the admin, and
+// merges the reports of its batches
+func passReport(t *testing.T, h *harness, first []byte) IndexReport {
+	t.Helper()
+
+	var report IndexReport
+	decodeJSON(t, first, &report)
+	for batches := 1; report.NextToken != ""; batches++ {
+		if batches > 20 {
+			t.Fatal("consistency pass did not finish")
+		}
+
+		h.as(adminCaller)
+		result, err := h.query("checkIndexes", "", report.NextToken)
+		checkCode(t, err, "")
+
+		var batch IndexReport
+		decodeJSON(t, result, &batch)
+		report.ReferralsScanned += batch.ReferralsScanned
+		report.EntriesScanned += batch.EntriesScanned
+		report.Orphaned = append(report.Orphaned, batch.Orphaned...)
+		report.Missing = append(report.Missing, batch.Missing...)
+		report.Duplicates = append(report.Duplicates, batch.Duplicates...)
+		report.Unreadable = append(report.Unreadable, batch.Unreadable...)
+		report.Warnings = append(report.Warnings, batch.Warnings...)
+		report.Consistent = report.Consistent && batch.Consistent
+		report.NextToken = batch.NextToken
+	}
+
+	return report
+}
+
+// checkReport runs a whole consistency pass as the admin
+func checkReport(t *testing.T, h *harness) IndexReport {
+	t.Helper()
+
+	h.as(adminCaller)
+	result, err := h.query("checkIndexes")
+	checkCode(t, err, "")
+
+	return passReport(t, h, result)
+}
+
+// finishRebuild runs the rest of the rebuild the first batch's result starts as the admin, and merges the
+// results of its batches
+func finishRebuild(t *testing.T, h *harness, first []byte) RebuildResult {
+	t.Helper()
+
+	var rebuilt RebuildResult
+	decodeJSON(t, first, &rebuilt)
+	for batches := 1; rebuilt.NextToken != ""; batches++ {
+		if batches > 20 {
+			t.Fatal("rebuild did not finish")
+		}
+
+		var batch RebuildResult
+		decodeJSON(t, h.mustInvoke(adminCaller, "rebuildIndexes", "", rebuilt.NextToken), &batch)
+		rebuilt.ReferralsScanned += batch.ReferralsScanned
+		rebuilt.EntriesScanned += batch.EntriesScanned
+		rebuilt.Removed = append(rebuilt.Removed, batch.Removed...)
+		rebuilt.Added = append(rebuilt.Added, batch.Added...)
+		rebuilt.Unreadable = append(rebuilt.Unreadable, batch.Unreadable...)
+		rebuilt.Warnings = append(rebuilt.Warnings, batch.Warnings...)
+		rebuilt.NextToken = batch.NextToken
+	}
+
+	return rebuilt
+}
+
+func TestCheckIndexes(t *testing.T) {
+	stale := IndexEntryRef{statusIndex, StatusContacted, testReferralId}
+
+	runQueryCases(t, "checkIndexes", []invokeCase{
+		{
+			name:   "indexes built by the chaincode are consistent",
+			caller: adminCaller,
+			check: func(t *testing.T, h *harness, result []byte) {
+				report := passReport(t, h, result)
+				if !report.Consistent || report.ReferralsScanned != 1 || report.EntriesScanned != 5 {
+					t.Fatalf("report %+v", report)
+				}
+			},
+		},
+		{
+			name:   "status entry left behind is orphaned and duplicated",
+			setup:  func(h *harness) { putStatusEntries(h, StatusContacted, testReferralId) },
+			caller: adminCaller,
+			check: func(t *testing.T, h *harness, result []byte) {
+				report := passReport(t, h, result)
+				if report.Consistent || !reflect.DeepEqual(report.Orphaned, []IndexEntryRef{stale}) {
+					t.Fatalf("orphaned %+v", report.Orphaned)
+				}
+
+				want := []IndexDuplicate{{statusIndex, testReferralId, []string{StatusContacted, StatusNew}}}
+				if !reflect.DeepEqual(report.Duplicates, want) {
+					t.Fatalf("duplicates %+v, want %+v", report.Duplicates, want)
+				}
+			},
+		},
+		{
+			name:   "entry for a referral that does not exist is orphaned",
+			setup:  func(h *harness) { putStatusEntries(h, StatusNew, "REF-GONE") },
+			caller: adminCaller,
+			check: func(t *testing.T, h *harness, result []byte) {
+				report := passReport(t, h, result)
+				want := []IndexEntryRef{{statusIndex, StatusNew, "REF-GONE"}}
+				if !reflect.DeepEqual(report.Orphaned, want) || len(report.Duplicates) != 0 {
+					t.Fatalf("report %+v", report)
+				}
+			},
+		},
+		{
+			name:   "department entry that was never written is missing",
+			setup:  func(h *harness) { delEntry(h, departmentIndex, "MORTGAGES", testReferralId) },
+			caller: adminCaller,
+			check: func(t *testing.T, h *harness, result []byte) {
+				report := passReport(t, h, result)
+				want := []IndexEntryRef{{departmentIndex, "MORTGAGES", testReferralId}}
+				if !reflect.DeepEqual(report.Missing, want) || len(report.Orphaned) != 0 {
+					t.Fatalf("report %+v", report)
+				}
+			},
+		},
+		{
+			name: "archived referral should not be indexed",
+			setup: func(h *harness) {
+				h.mustInvoke(adminCaller, "archiveReferral", testReferralId)
+				putStatusEntries(h, StatusNew, testReferralId)
+			},
+			caller: adminCaller,
+			check: func(t *testing.T, h *harness, result []byte) {
+				report := passReport(t, h, result)
+				want := []IndexEntryRef{{statusIndex, StatusNew, testReferralId}}
+				if !reflect.DeepEqual(report.Orphaned, want) || len(report.Missing) != 0 {
+					t.Fatalf("report %+v", report)
+				}
+			},
+		},
+		{
+			name: "unreadable record is listed and its entries left alone",
+			setup: func(h *harness) {
+				key, _ := referralKey("REF-BAD")
+				h.stub.State[key] = []byte("not json")
+				putStatusEntries(h, StatusNew, "REF-BAD")
+			},
+			caller: adminCaller,
+			check: func(t *testing.T, h *harness, result []byte) {
+				report := passReport(t, h, result)
+				if !report.Consistent || !sameStrings(report.Unreadable, []string{"REF-BAD"}) || report.ReferralsScanned != 2 {
+					t.Fatalf("report %+v", report)
+				}
+			},
+		},
+		{
+			name: "legacy contact number index is skipped without the piiKey",
+			setup: func(h *harness) {
+				h.unkeyContactIndex(testReferralId, "+15551234567")
+				h.stub.Metadata = nil
+			},
+			caller: adminCaller,
+			check: func(t *testing.T, h *harness, result []byte) {
+				report := passReport(t, h, result)
+				if !report.Consistent || !sameStrings(report.Warnings, []string{legacyContactWarning(testReferralId)}) {
+					t.Fatalf("report %+v", report)
+				}
+			},
+		},
+		{
+			name: "legacy contact number index is checked with the piiKey",
+			setup: func(h *harness) {
+				h.unkeyContactIndex(testReferralId, "+15551234567")
+				delEntry(h, contactIndex, legacyContactIndexValue("+15551234567"), testReferralId)
+			},
+			caller: adminCaller,
+			check: func(t *testing.T, h *harness, result []byte) {
+				report := passReport(t, h, result)
+				want := []IndexEntryRef{{contactIndex, legacyContactIndexValue("+15551234567"), testReferralId}}
+				if !reflect.DeepEqual(report.Missing, want) || len(report.Warnings) != 0 {
+					t.Fatalf("report %+v", report)
+				}
+			},
+		},
+		{
+			name:   "batches are bounded",
+			setup:  seedMore,
+			caller: adminCaller,
+			args:   []string{"1"},
+			check: func(t *testing.T, h *harness, result []byte) {
+				var report IndexReport
+				decodeJSON(t, result, &report)
+				if report.ReferralsScanned != 1 || report.EntriesScanned != 0 || report.NextToken == "" {
+					t.Fatalf("first batch %+v, want one referral", report)
+				}
+			},
+		},
+		{
+			name:   "arguments are rejected",
+			caller: adminCaller,
+			args:   []string{"status"},
+			code:   ErrCodeInvalidArgument,
+		},
+		{
+			name:   "entry phase token outside the indexes is rejected",
+			caller: adminCaller,
+			args:   []string{"", encodePageToken(pageToken{Index: rebuildTokenIndex, Value: entryPhase, Driver: statusIndex, After: testReferralId})},
+			code:   ErrCodeInvalidArgument,
+		},
+		{
+			name: "employees cannot check the indexes",
+			code: ErrCodeAccessDenied,
+		},
+	})
+}
+
+func TestRebuildIndexes(t *testing.T) {
+	runInvokeCases(t, "rebuildIndexes", []invokeCase{
+		{
+			name: "removes orphaned entries and adds missing ones",
+			setup: func(h *harness) {
+				putStatusEntries(h, StatusContacted, testReferralId)
+				putStatusEntries(h, StatusNew, "REF-GONE")
+				delEntry(h, departmentIndex, "MORTGAGES", testReferralId)
+			},
+			caller: adminCaller,
+			check: func(t *testing.T, h *harness, result []byte) {
+				rebuilt := finishRebuild(t, h, result)
+				if len(rebuilt.Removed) != 2 || len(rebuilt.Added) != 1 {
+					t.Fatalf("rebuilt %+v", rebuilt)
+				}
+
+				if report := checkReport(t, h); !report.Consistent {
+					t.Fatalf("indexes still inconsistent: %+v", report)
+				}
+			},
+		},
+		{
+			name: "restored customer entries keep the time the referral was made",
+			setup: func(h *harness) {
+				delEntry(h, customerIndex, "C1", testReferralId)
+				delEntry(h, contactIndex, contactIndexValue("+15551234567", testPIIKey), testReferralId)
+			},
+			caller: adminCaller,
+			check: func(t *testing.T, h *harness, result []byte) {
+				want := strconv.FormatInt(h.stored(testReferralId).CreateDate, 10)
+				for _, indexName := range []string{customerIndex, contactIndex} {
+					value := "C1"
+					if indexName == contactIndex {
+						value = contactIndexValue("+15551234567", testPIIKey)
+					}
+					key, _ := createCompositeKey(indexName, value, testReferralId)
+					if got := string(h.stub.State[key]); got != want {
+						t.Fatalf("%s entry holds %q, want %q", indexName, got, want)
+					}
+				}
+			},
+		},
+		{
+			name: "legacy contact number entry is left alone without the piiKey",
+			setup: func(h *harness) {
+				h.unkeyContactIndex(testReferralId, "+15551234567")
+				h.stub.Metadata = nil
+			},
+			caller: adminCaller,
+			check: func(t *testing.T, h *harness, result []byte) {
+				rebuilt := finishRebuild(t, h, result)
+				if len(rebuilt.Removed) != 0 || len(rebuilt.Added) != 0 || len(rebuilt.Warnings) != 1 {
+					t.Fatalf("rebuilt %+v", rebuilt)
+				}
+
+				if !sameStrings(h.indexed(contactIndex, legacyContactIndexValue("+15551234567")), []string{testReferralId}) {
+					t.Fatal("legacy contact number entry was removed")
+				}
+			},
+		},
+		{
+			name:   "batch size must be in range",
+			caller: adminCaller,
+			args:   []string{strconv.Itoa(maxRebuildBatchSize + 1)},
+			code:   ErrCodeInvalidArgument,
+		},
+		{
+			name:   "token from a search is rejected",
+			caller: adminCaller,
+			args:   []string{"1", encodePageToken(pageToken{Index: statusIndex, Value: StatusNew, After: testReferralId})},
+			code:   ErrCodeInvalidArgument,
+		},
+		{
+			name: "employees cannot rebuild the indexes",
+			code: ErrCodeAccessDenied,
+		},
+	})
+}
+
+func TestRebuildIndexesInBatches(t *testing.T) {
+	h := newHarness(t)
+	h.seed()
+	seedMore(h)
+
+	referralIds := []string{"REF-0000000001", "REF-0000000002", "REF-0000000003", "REF-0000000004"}
+	for _, referralId := range referralIds {
+		putStatusEntries(h, StatusContacted, referralId)
+	}
+	// An orphan after the last referral is found with the other index entries
+	putStatusEntries(h, StatusNew, "REF-9999999999")
+
+	var batches []RebuildResult
+	token := ""
+	for {
+		var rebuilt RebuildResult
+		decodeJSON(t, h.mustInvoke(adminCaller, "rebuildIndexes", "2", token), &rebuilt)
+		batches = append(batches, rebuilt)
+
+		if rebuilt.NextToken == "" {
+			break
+		}
+		if len(batches) > 20 {
+			t.Fatal("rebuild did not finish")
+		}
+		token = rebuilt.NextToken
+	}
+
+	// The referral records are checked first, and hold no orphans
+	for i := 0; i < 2; i++ {
+		if batches[i].ReferralsScanned != 2 || batches[i].EntriesScanned != 0 || len(batches[i].Removed) != 0 {
+			t.Fatalf("batch %d %+v, want two referrals checked", i, batches[i])
+		}
+	}
+
+	var removed []IndexEntryRef
+	for i, batch := range batches[2:] {
+		if batch.ReferralsScanned != 0 || batch.EntriesScanned > 2*entriesPerReferral {
+			t.Fatalf("batch %d %+v, want at most %d entries checked", i+2, batch, 2*entriesPerReferral)
+		}
+		removed = append(removed, batch.Removed...)
+	}
+
+	want := []IndexEntryRef{{statusIndex, StatusContacted, referralIds[0]}, {statusIndex, StatusContacted, referralIds[1]}, {statusIndex, StatusContacted, referralIds[2]}, {statusIndex, StatusContacted, referralIds[3]}, {statusIndex, StatusNew, "REF-9999999999"}}
+	if !reflect.DeepEqual(removed, want) {
+		t.Fatalf("removed %+v, want %+v", removed, want)
+	}
+
+	if report := checkReport(t, h); !report.Consistent {
+		t.Fatalf("indexes still inconsistent: %+v", report)
+	}
+}
+
+func TestCheckIndexesInBatches(t *testing.T) {
+	h := newHarness(t)
+	h.seed()
+	seedMore(h)
+	putStatusEntries(h, StatusContacted, "REF-0000000003")
+	putStatusEntries(h, StatusNew, "REF-9999999999")
+
+	entries := 0
+	for _, indexName := range referralIndexes {
+		prefix, _ := createCompositeKey(indexName)
+		for key := range h.stub.State {
+			if strings.HasPrefix(key, prefix) {
+				entries++
+			}
+		}
+	}
+
+	var referralsScanned, entriesScanned int
+	var orphaned []IndexEntryRef
+	token := ""
+	for batches := 1; ; batches++ {
+		if batches > 20 {
+			t.Fatal("consistency pass did not finish")
+		}
+
+		h.as(adminCaller)
+		result, err := h.query("checkIndexes", "1", token)
+		checkCode(t, err, "")
+
+		var report IndexReport
+		decodeJSON(t, result, &report)
+		if report.ReferralsScanned > 1 || report.EntriesScanned > entriesPerReferral {
+			t.Fatalf("batch %d %+v, want one referral or %d entries at most", batches, report, entriesPerReferral)
+		}
+		referralsScanned += report.ReferralsScanned
+		entriesScanned += report.EntriesScanned
+		orphaned = append(orphaned, report.Orphaned...)
+
+		if report.NextToken == "" {
+			break
+		}
+		token = report.NextToken
+	}
+
+	want := []IndexEntryRef{{statusIndex, StatusContacted, "REF-0000000003"}, {statusIndex, StatusNew, "REF-9999999999"}}
+	if referralsScanned != 4 || entriesScanned != entries || !reflect.DeepEqual(orphaned, want) {
+		t.Fatalf("checked %d referrals and %d of %d entries, orphaned %+v, want %+v", referralsScanned, entriesScanned, entries, orphaned, want)
+	}
+}
@@ -0,0 +1,273 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/hyperledger/fabric-contract-api-go/metadata"
+	"github.com/joerust/mortgage-referrals/chaincode"
+	"github.com/joerust/mortgage-referrals/ledger"
+)
+
+// referralContractName is the name the contract's transaction functions can be qualified with
+const referralContractName = "referral"
+
+// queryFunctions are the functions clients have always run as queries
+var queryFunctions = map[string]bool{
+	"read":                 true,
+	"searchByStatus":       true,
+	"searchByDepartment":   true,
+	"searchByEmployee":     true,
+	"searchByCustomer":     true,
+	"getStatusTransitions": true,
+	"getReferralHistory":   true,
+	"queryReferrals":       true,
+	"checkIndexes":         true,
+}
+
+// ReferralContract exposes every referral function as a typed transaction function, named after the
+// function clients have always called with its first letter capitalized. The contract API generates the
+// contract metadata from these signatures. Each one runs the function it is named after, so the
+// authorization policy, validation and error envelope are the same whichever name is called. Referral
+// documents are passed and returned as the same JSON as before, which keeps their versioned formats
+// under the chaincode's control.
+type ReferralContract struct {
+	contractapi.Contract
+	chaincode *ReferralChaincode
+}
+
+// newReferralChaincode returns the chaincode along with the contract serving its typed functions
+func newReferralChaincode() (*ReferralChaincode, error) {
+	t := new(ReferralChaincode)
+
+	contract := &ReferralContract{chaincode: t}
+	contract.Name = referralContractName
+	contract.Info = metadata.InfoMetadata{
+		Title:       "Customer referrals",
+		Description: "Records customer referrals between departments and follows them through the mortgage lifecycle",
+		Version:     "2.0.0",
+	}
+
+	chaincode, err := contractapi.NewChaincode(contract)
+	if err != nil {
+		return nil, err
+	}
+
+	t.contract = chaincode
+	return t, nil
+}
+
+// GetEvaluateTransactions marks the query functions as evaluate only in the contract metadata
+func (c *ReferralContract) GetEvaluateTransactions() []string {
+	return []string{
+		"Read",
+		"SearchByStatus",
+		"SearchByDepartment",
+		"SearchByEmployee",
+		"SearchByCustomer",
+		"GetStatusTransitions",
+		"GetReferralHistory",
+		"QueryReferrals",
+		"CheckIndexes",
+	}
+}
+
+// call runs the named function for the transaction, returning its result as it has always been returned
+func (c *ReferralContract) call(ctx contractapi.TransactionContextInterface, function string, args ...string) (string, error) {
+	result, err := c.chaincode.dispatch(ledger.FromShim(ctx.GetStub()), function, args)
+	if err != nil {
+		return "", asChaincodeError(err)
+	}
+
+	return string(result), nil
+}
+
+// callInto runs the named function for the transaction, decoding its result
+func (c *ReferralContract) callInto(ctx contractapi.TransactionContextInterface, into interface{}, function string, args ...string) error {
+	result, err := c.call(ctx, function, args...)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal([]byte(result), into)
+	if err != nil {
+		return newError(ErrCodeInternal, "Failed to decode the result of "+function)
+	}
+
+	return nil
+}
+
+// pageArgs returns the size and continuation token arguments of a paged function, a size of 0 meaning the default
+func pageArgs(pageSize int, continuationToken string) []string {
+	size := ""
+	if pageSize != 0 {
+		size = strconv.Itoa(pageSize)
+	}
+
+	return []string{size, continuationToken}
+}
+
+// CreateReferral stores a new referral, see createReferral. The idempotency token may be empty.
+func (c *ReferralContract) CreateReferral(ctx contractapi.TransactionContextInterface, referralJSON string, idempotencyToken string) (string, error) {
+	return c.call(ctx, "createReferral", referralJSON, idempotencyToken)
+}
+
+// UpdateReferralStatus moves a referral to a new status, see updateReferralStatus. The reason code may be empty.
+func (c *ReferralContract) UpdateReferralStatus(ctx contractapi.TransactionContextInterface, referralId string, status string, reasonCode string) error {
+	_, err := c.call(ctx, "updateReferralStatus", referralId, status, reasonCode)
+	return err
+}
+
+// UpdateReferral applies a JSON patch to a referral, see updateReferral. The reason code may be empty.
+func (c *ReferralContract) UpdateReferral(ctx contractapi.TransactionContextInterface, referralId string, patchJSON string, expectedVersion int64, reasonCode string) (string, error) {
+	return c.call(ctx, "updateReferral", referralId, patchJSON, strconv.FormatInt(expectedVersion, 10), reasonCode)
+}
+
+// AddDepartment routes a referral to another department, see addDepartment. The reason code may be empty.
+func (c *ReferralContract) AddDepartment(ctx contractapi.TransactionContextInterface, referralId string, department string, reasonCode string) (string, error) {
+	return c.call(ctx, "addDepartment", referralId, department, reasonCode)
+}
+
+// RemoveDepartment takes a department off a referral, see removeDepartment. The reason code may be empty.
+func (c *ReferralContract) RemoveDepartment(ctx contractapi.TransactionContextInterface, referralId string, department string, reasonCode string) (string, error) {
+	return c.call(ctx, "removeDepartment", referralId, department, reasonCode)
+}
+
+// ArchiveReferral hides a referral from every search, see archiveReferral. The reason code may be empty.
+func (c *ReferralContract) ArchiveReferral(ctx contractapi.TransactionContextInterface, referralId string, reasonCode string) (string, error) {
+	return c.call(ctx, "archiveReferral", referralId, reasonCode)
+}
+
+// RestoreReferral returns an archived referral to the searches, see restoreReferral. The reason code may be empty.
+func (c *ReferralContract) RestoreReferral(ctx contractapi.TransactionContextInterface, referralId string, reasonCode string) (string, error) {
+	return c.call(ctx, "restoreReferral", referralId, reasonCode)
+}
+
+// PurgeReferral permanently deletes a referral, see purgeReferral. The reason code may be empty.
+func (c *ReferralContract) PurgeReferral(ctx contractapi.TransactionContextInterface, referralId string, reasonCode string) error {
+	_, err := c.call(ctx, "purgeReferral", referralId, reasonCode)
+	return err
+}
+
+// LinkMortgage stores a mortgage on its referral, see linkMortgage
+func (c *ReferralContract) LinkMortgage(ctx contractapi.TransactionContextInterface, referralId string, mortgageJSON string) (string, error) {
+	return c.call(ctx, "linkMortgage", referralId, mortgageJSON)
+}
+
+// FollowMortgageStatus moves a referral along with its mortgage, see followMortgageStatus
+func (c *ReferralContract) FollowMortgageStatus(ctx contractapi.TransactionContextInterface, referralId string, mortgageNumber string, status string) (string, error) {
+	return c.call(ctx, "followMortgageStatus", referralId, mortgageNumber, status)
+}
+
+// MigrateIndexes converts legacy index values into composite key entries, see migrateIndexes
+func (c *ReferralContract) MigrateIndexes(ctx contractapi.TransactionContextInterface, indexName string, legacyKeys []string) (string, error) {
+	return c.call(ctx, "migrateIndexes", append([]string{indexName}, legacyKeys...)...)
+}
+
+// MigrateReferralKeys moves referrals stored under their bare id into the referral namespace, see migrateReferralKeys
+func (c *ReferralContract) MigrateReferralKeys(ctx contractapi.TransactionContextInterface, referralIds []string) ([]string, error) {
+	migrated := []string{}
+	err := c.callInto(ctx, &migrated, "migrateReferralKeys", referralIds...)
+	return migrated, err
+}
+
+// MigrateContactIndex moves referrals from the legacy contact number index to the keyed one, see migrateContactIndex
+func (c *ReferralContract) MigrateContactIndex(ctx contractapi.TransactionContextInterface, referralIds []string) ([]string, error) {
+	migrated := []string{}
+	err := c.callInto(ctx, &migrated, "migrateContactIndex", referralIds...)
+	return migrated, err
+}
+
+// PurgeLegacyTokens deletes a batch of the idempotency records stored before tokens were scoped
+// to their caller, see purgeLegacyTokens
+func (c *ReferralContract) PurgeLegacyTokens(ctx contractapi.TransactionContextInterface) (*PurgeResult, error) {
+	result := new(PurgeResult)
+	err := c.callInto(ctx, result, "purgeLegacyTokens")
+	return result, err
+}
+
+// SealLegacyPII encrypts the personal details of referrals stored in plaintext or in the legacy envelope,
+// see sealLegacyPII
+func (c *ReferralContract) SealLegacyPII(ctx contractapi.TransactionContextInterface, referralIds []string) ([]string, error) {
+	sealed := []string{}
+	err := c.callInto(ctx, &sealed, "sealLegacyPII", referralIds...)
+	return sealed, err
+}
+
+// RebuildIndexes repairs the indexes in the next batch of a consistency pass, see rebuildIndexes. A batch
+// size of 0 means the default and the token is empty for the first batch.
+func (c *ReferralContract) RebuildIndexes(ctx contractapi.TransactionContextInterface, batchSize int, continuationToken string) (*RebuildResult, error) {
+	result := new(RebuildResult)
+	err := c.callInto(ctx, result, "rebuildIndexes", pageArgs(batchSize, continuationToken)...)
+	return result, err
+}
+
+// Read returns a referral, see read
+func (c *ReferralContract) Read(ctx contractapi.TransactionContextInterface, referralId string) (string, error) {
+	return c.call(ctx, "read", referralId)
+}
+
+// SearchByStatus returns a page of the referrals in a status, see searchByStatus
+func (c *ReferralContract) SearchByStatus(ctx contractapi.TransactionContextInterface, status string, pageSize int, continuationToken string) (string, error) {
+	return c.call(ctx, "searchByStatus", append([]string{status}, pageArgs(pageSize, continuationToken)...)...)
+}
+
+// SearchByDepartment returns a page of the referrals routed to a department, see searchByDepartment
+func (c *ReferralContract) SearchByDepartment(ctx contractapi.TransactionContextInterface, department string, pageSize int, continuationToken string) (string, error) {
+	return c.call(ctx, "searchByDepartment", append([]string{department}, pageArgs(pageSize, continuationToken)...)...)
+}
+
+// SearchByEmployee returns a page of the referrals made by an employee, see searchByEmployee
+func (c *ReferralContract) SearchByEmployee(ctx contractapi.TransactionContextInterface, employeeId string, pageSize int, continuationToken string) (string, error) {
+	return c.call(ctx, "searchByEmployee", append([]string{employeeId}, pageArgs(pageSize, continuationToken)...)...)
+}
+
+// SearchByCustomer returns a page of a customer's referral history, see searchByCustomer
+func (c *ReferralContract) SearchByCustomer(ctx contractapi.TransactionContextInterface, customerId string, pageSize int, continuationToken string) (string, error) {
+	return c.call(ctx, "searchByCustomer", append([]string{customerId}, pageArgs(pageSize, continuationToken)...)...)
+}
+
+// GetStatusTransitions returns the allowed transition table, or only the entry for a status if one is given
+func (c *ReferralContract) GetStatusTransitions(ctx contractapi.TransactionContextInterface, status string) ([]chaincode.StatusTransition, error) {
+	var args []string
+	if status != "" {
+		args = append(args, status)
+	}
+
+	var table []chaincode.StatusTransition
+	err := c.callInto(ctx, &table, "getStatusTransitions", args...)
+	return table, err
+}
+
+// GetReferralHistory returns a referral's audit trail, see getReferralHistory
+func (c *ReferralContract) GetReferralHistory(ctx contractapi.TransactionContextInterface, referralId string) (string, error) {
+	return c.call(ctx, "getReferralHistory", referralId)
+}
+
+// QueryReferrals returns a page of the referrals matching a filter, see queryReferrals
+func (c *ReferralContract) QueryReferrals(ctx contractapi.TransactionContextInterface, filterJSON string, pageSize int, continuationToken string) (string, error) {
+	return c.call(ctx, "queryReferrals", append([]string{filterJSON}, pageArgs(pageSize, continuationToken)...)...)
+}
+
+// CheckIndexes reports the index entries that disagree with the referral records in the next batch of a
+// consistency pass, see checkIndexes. A batch size of 0 means the default and the token is empty for the
+// first batch.
+func (c *ReferralContract) CheckIndexes(ctx contractapi.TransactionContextInterface, batchSize int, continuationToken string) (*IndexReport, error) {
+	report := new(IndexReport)
+	err := c.callInto(ctx, report, "checkIndexes", pageArgs(batchSize, continuationToken)...)
+	return report, err
+}
@@ -0,0 +1,80 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/joerust/mortgage-referrals/ledger"
+)
+
+// typedName is the name of the typed transaction function for a function
+func typedName(function string) string {
+	return strings.ToUpper(function[:1]) + function[1:]
+}
+
+func TestReferralContractCoversEveryFunction(t *testing.T) {
+	contract := reflect.TypeOf(&ReferralContract{})
+
+	var evaluate []string
+	for function := range functionRoles {
+		if function == "init" {
+			continue
+		}
+
+		if _, ok := contract.MethodByName(typedName(function)); !ok {
+			t.Errorf("%s has no typed transaction function %s", function, typedName(function))
+		}
+
+		if queryFunctions[function] {
+			evaluate = append(evaluate, typedName(function))
+		}
+	}
+
+	for function := range queryFunctions {
+		if _, ok := functionRoles[function]; !ok {
+			t.Errorf("query function %s is not in the authorization policy", function)
+		}
+	}
+
+	got := (&ReferralContract{}).GetEvaluateTransactions()
+	sort.Strings(got)
+	sort.Strings(evaluate)
+	if !reflect.DeepEqual(got, evaluate) {
+		t.Errorf("evaluate transactions %v, want %v", got, evaluate)
+	}
+}
+
+func TestDispatch(t *testing.T) {
+	h := newHarness(t)
+	h.seed()
+
+	// read is only known to the query dispatcher and updateReferralStatus to the invoke one
+	_, err := h.stub.Query(func(stub ledger.Stub) ([]byte, error) {
+		return h.cc.dispatch(stub, "read", []string{testReferralId})
+	})
+	checkCode(t, err, "")
+
+	_, err = h.stub.Invoke(func(stub ledger.Stub) ([]byte, error) {
+		return h.cc.dispatch(stub, "updateReferralStatus", []string{testReferralId, StatusContacted, ""})
+	})
+	checkCode(t, err, "")
+
+	if got := h.stored(testReferralId).Status; got != StatusContacted {
+		t.Fatalf("status %s, want %s", got, StatusContacted)
+	}
+}
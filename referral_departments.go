@@ -0,0 +1,193 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/joerust/mortgage-referrals/events"
+	"github.com/joerust/mortgage-referrals/ledger"
+)
+
+// parseDepartmentArgs reads the referral id, department and optional reason code of a department change
+func parseDepartmentArgs(args []string, fallback string) (string, string, string, error) {
+	if len(args) != 2 && len(args) != 3 {
+		return "", "", "", newError(ErrCodeInvalidArgument, "Incorrect number of arguments. Expecting the referral id, the department and an optional reason code")
+	}
+
+	department := strings.TrimSpace(args[1])
+	if department == "" {
+		return "", "", "", newError(ErrCodeInvalidArgument, "Department must not be empty")
+	}
+
+	reasonCode := ""
+	if len(args) == 3 {
+		reasonCode = args[2]
+	}
+
+	reasonCode, err := checkReasonCode(reasonCode, fallback)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	return args[0], department, reasonCode, nil
+}
+
+// addDepartment - invoke function routing a referral to another department. Expects the referral id, the
+// department and an optional reason code. Only the departments the referral is already routed to can add one.
+func (t *ReferralChaincode) addDepartment(stub ledger.Stub, caller Caller, args []string) ([]byte, error) {
+
+	key, department, reasonCode, err := parseDepartmentArgs(args, ReasonDepartmentAdded)
+	if err != nil {
+		return nil, err
+	}
+
+	referral, err := getReferral(key, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = caller.authorizeChange("addDepartment", referral)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkNotArchived(key, referral)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range referral.Departments {
+		if referral.Departments[i] == department {
+			return nil, newError(ErrCodeAlreadyExists, "Referral "+key+" is already routed to department "+department)
+		}
+	}
+
+	oldAsbytes, err := json.Marshal(referral)
+	if err != nil {
+		return nil, err
+	}
+
+	referral.Departments = append(referral.Departments, department)
+	err = touchReferral(&referral, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	valAsbytes, err := json.Marshal(referral)
+	if err != nil {
+		return nil, err
+	}
+
+	err = putReferralBytes(key, valAsbytes, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = appendAuditEntry(key, oldAsbytes, valAsbytes, "addDepartment", reasonCode, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = emitReferralEvent(events.DepartmentAdded, referral.Status, referral, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.indexByDepartment(key, department, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	return valAsbytes, nil
+}
+
+// removeDepartment - invoke function taking a department off a referral. Expects the referral id, the
+// department and an optional reason code. A referral must always be routed to at least one department.
+func (t *ReferralChaincode) removeDepartment(stub ledger.Stub, caller Caller, args []string) ([]byte, error) {
+
+	key, department, reasonCode, err := parseDepartmentArgs(args, ReasonDepartmentRemoved)
+	if err != nil {
+		return nil, err
+	}
+
+	referral, err := getReferral(key, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = caller.authorizeChange("removeDepartment", referral)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkNotArchived(key, referral)
+	if err != nil {
+		return nil, err
+	}
+
+	var departments []string
+	for i := range referral.Departments {
+		if referral.Departments[i] != department {
+			departments = append(departments, referral.Departments[i])
+		}
+	}
+
+	if len(departments) == len(referral.Departments) {
+		return nil, newError(ErrCodeFailedPrecondition, "Referral "+key+" is not routed to department "+department)
+	}
+
+	if len(departments) == 0 {
+		return nil, newError(ErrCodeFailedPrecondition, "Cannot remove "+department+", the last department on referral "+key)
+	}
+
+	oldAsbytes, err := json.Marshal(referral)
+	if err != nil {
+		return nil, err
+	}
+
+	referral.Departments = departments
+	err = touchReferral(&referral, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	valAsbytes, err := json.Marshal(referral)
+	if err != nil {
+		return nil, err
+	}
+
+	err = putReferralBytes(key, valAsbytes, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = appendAuditEntry(key, oldAsbytes, valAsbytes, "removeDepartment", reasonCode, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = emitReferralEvent(events.DepartmentRemoved, referral.Status, referral, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.removeDepartmentReferralIndex(key, department, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	return valAsbytes, nil
+}
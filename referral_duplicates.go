@@ -0,0 +1,323 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+
+	"github.com/joerust/mortgage-referrals/chaincode"
+	"github.com/joerust/mortgage-referrals/ledger"
+)
+
+// IdempotencyRecord remembers the outcome of a createReferral call made with a client idempotency token
+type IdempotencyRecord struct {
+	ReferralId  string `json:"referralId"`
+	RequestHash string `json:"requestHash"`
+	Result      []byte `json:"result"`
+}
+
+// hashRequest fingerprints the arguments of a create so a reused token can be told apart from a retry
+func hashRequest(args ...string) string {
+	hash := sha256.New()
+	for _, arg := range args {
+		hash.Write([]byte(arg))
+		hash.Write([]byte(compositeKeySeparator))
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// contactIndexValue is the value a contact number is indexed under, also stored on the referral as its
+// contactHash. Only digits are kept so formatting differences still match. The digits are hashed with an
+// HMAC under the piiKey, so the number never appears in a ledger key and cannot be recovered by hashing
+// every possible number without the key.
+func contactIndexValue(contactNumber string, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(contactIndex + compositeKeySeparator + phoneNumberSeparator.Replace(contactNumber)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// legacyContactIndexValue is the value contact numbers were indexed under before the index was keyed, an
+// unsalted hash of the digits. Referrals without a contactHash are still indexed under it.
+func legacyContactIndexValue(contactNumber string) string {
+	return hashRequest(phoneNumberSeparator.Replace(contactNumber))
+}
+
+// setContactHash works out the contactHash of a referral from its contact number, which must be in the clear
+func setContactHash(referral *CustomerReferral, stub ledger.Stub) error {
+	key, err := requireSealingKey(stub)
+	if err != nil {
+		return err
+	}
+
+	referral.ContactHash = contactIndexValue(referral.ContactNumber, key)
+	return nil
+}
+
+// storedContactIndexValue returns the value a stored referral is indexed under in the contact number index.
+// That is its contactHash, unless the referral predates it and is still indexed under the legacy hash, which
+// can only be worked out with the number in the clear.
+func storedContactIndexValue(referral CustomerReferral, stub ledger.Stub) (string, error) {
+	if referral.ContactHash != "" {
+		return referral.ContactHash, nil
+	}
+
+	err := openReferralPII(&referral, stub)
+	if err != nil {
+		return "", err
+	}
+
+	return legacyContactIndexValue(referral.ContactNumber), nil
+}
+
+// touchReferral moves the referral on to its next version, stamped with the transaction time
+func touchReferral(referral *CustomerReferral, stub ledger.Stub) error {
+	updatedAt, err := chaincode.TxTime(stub)
+	if err != nil {
+		return err
+	}
+
+	referral.Version++
+	referral.UpdatedDate = updatedAt
+	return nil
+}
+
+// idempotencyKey returns the ledger key of a caller's idempotency token. Tokens are scoped to the caller's
+// identity, so one caller can neither read another's result nor block their token.
+func idempotencyKey(callerId string, token string) (string, error) {
+	return createCompositeKey(idempotencyNamespace, callerId, token)
+}
+
+// getIdempotentResult returns the stored result of an earlier create the caller made with the same token,
+// or nil if the token has not been seen. A token reused for a different request is an error.
+func getIdempotentResult(caller Caller, token string, requestHash string, stub ledger.Stub) ([]byte, error) {
+	key, err := idempotencyKey(caller.Id, token)
+	if err != nil {
+		return nil, err
+	}
+
+	valAsbytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Failed to get state for idempotency token "+token)
+	}
+
+	if valAsbytes == nil {
+		return nil, nil
+	}
+
+	var record IdempotencyRecord
+	err = json.Unmarshal(valAsbytes, &record)
+	if err != nil {
+		return nil, err
+	}
+
+	if record.RequestHash != requestHash {
+		return nil, newError(ErrCodeAlreadyExists, "Idempotency token "+token+" was already used for referral "+record.ReferralId)
+	}
+
+	return record.Result, nil
+}
+
+// putIdempotentResult stores the result of a create against the caller's idempotency token, and indexes
+// the token by the referral so purgeReferral can find it
+func putIdempotentResult(caller Caller, token string, requestHash string, referralId string, result []byte, stub ledger.Stub) error {
+	key, err := idempotencyKey(caller.Id, token)
+	if err != nil {
+		return err
+	}
+
+	valAsbytes, err := json.Marshal(IdempotencyRecord{ReferralId: referralId, RequestHash: requestHash, Result: result})
+	if err != nil {
+		return err
+	}
+
+	err = stub.PutState(key, valAsbytes)
+	if err != nil {
+		return newError(ErrCodeLedger, "Failed to update state for idempotency token "+token)
+	}
+
+	indexKey, err := createCompositeKey(idempotencyIndex, referralId, caller.Id, token)
+	if err != nil {
+		return err
+	}
+
+	err = stub.PutState(indexKey, indexEntryValue)
+	if err != nil {
+		return newError(ErrCodeLedger, "Failed to update idempotency index for "+referralId)
+	}
+
+	return nil
+}
+
+// findDuplicateCustomers returns the ids of referrals for the same customer id or contact number made within
+// the configured window before referredAt
+func findDuplicateCustomers(referral CustomerReferral, referredAt int64, stub ledger.Stub) ([]string, error) {
+	config, err := getConfig(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	var duplicates []string
+	seen := make(map[string]bool)
+
+	lookups := []struct{ indexName, value string }{
+		{customerIndex, referral.CustomerId},
+		{contactIndex, referral.ContactHash},
+	}
+	for _, lookup := range lookups {
+		entries, err := getIndexEntries(lookup.indexName, lookup.value, stub)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range entries {
+			if seen[entries[i].ReferralId] {
+				continue
+			}
+
+			earlierReferredAt, err := strconv.ParseInt(string(entries[i].Value), 10, 64)
+			if err != nil {
+				continue
+			}
+
+			if referredAt-earlierReferredAt <= config.DuplicateWindowSeconds {
+				seen[entries[i].ReferralId] = true
+				duplicates = append(duplicates, entries[i].ReferralId)
+			}
+		}
+	}
+
+	return duplicates, nil
+}
+
+// indexByCustomer adds the referral to the customer and contact number indexes, recording when it was referred
+func (t *ReferralChaincode) indexByCustomer(referralId string, referral CustomerReferral, referredAt int64, stub ledger.Stub) error {
+	contactValue, err := storedContactIndexValue(referral, stub)
+	if err != nil {
+		return err
+	}
+
+	entryValue := []byte(strconv.FormatInt(referredAt, 10))
+
+	err = putIndexEntryValue(customerIndex, referral.CustomerId, referralId, entryValue, stub)
+	if err != nil {
+		return err
+	}
+
+	return putIndexEntryValue(contactIndex, contactValue, referralId, entryValue, stub)
+}
+
+// removeCustomerReferralIndex removes the referral from the customer and contact number indexes, if it is there
+func (t *ReferralChaincode) removeCustomerReferralIndex(referralId string, referral CustomerReferral, stub ledger.Stub) error {
+	contactValue, err := storedContactIndexValue(referral, stub)
+	if err != nil {
+		return err
+	}
+
+	err = delIndexEntry(customerIndex, referral.CustomerId, referralId, stub)
+	if err != nil {
+		return err
+	}
+
+	return delIndexEntry(contactIndex, contactValue, referralId, stub)
+}
+
+// moveContactIndex re-files the referral from one contact number index value to another, keeping the time
+// it was referred
+func (t *ReferralChaincode) moveContactIndex(referralId string, oldValue string, newValue string, stub ledger.Stub) error {
+	key, err := createCompositeKey(contactIndex, oldValue, referralId)
+	if err != nil {
+		return err
+	}
+
+	entryValue, err := stub.GetState(key)
+	if err != nil {
+		return newError(ErrCodeLedger, "Failed to read contact index for "+referralId)
+	}
+
+	if entryValue == nil {
+		entryValue = indexEntryValue
+	}
+
+	err = delIndexEntry(contactIndex, oldValue, referralId, stub)
+	if err != nil {
+		return err
+	}
+
+	return putIndexEntryValue(contactIndex, newValue, referralId, entryValue, stub)
+}
+
+// migrateContactIndex - invoke function moving referrals from the legacy contact number index to the
+// keyed one. Expects the ids of the referrals to migrate and a piiKey in the transaction metadata. Each
+// referral without a contactHash is given one and its index entry is moved under it. Returns the ids of
+// the referrals that were migrated.
+func (t *ReferralChaincode) migrateContactIndex(stub ledger.Stub, args []string) ([]byte, error) {
+	if len(args) < 1 || len(args) > maxRebuildBatchSize {
+		return nil, newError(ErrCodeInvalidArgument, "Incorrect number of arguments. Expecting between 1 and "+strconv.Itoa(maxRebuildBatchSize)+" referral ids to migrate")
+	}
+
+	migrated := []string{}
+	for _, referralId := range args {
+		referral, err := getReferral(referralId, stub)
+		if err != nil {
+			return nil, err
+		}
+
+		if referral.ContactHash != "" {
+			continue
+		}
+
+		legacyValue, err := storedContactIndexValue(referral, stub)
+		if err != nil {
+			return nil, err
+		}
+
+		clear := referral
+		err = openReferralPII(&clear, stub)
+		if err != nil {
+			return nil, err
+		}
+
+		err = setContactHash(&clear, stub)
+		if err != nil {
+			return nil, err
+		}
+		referral.ContactHash = clear.ContactHash
+
+		// Archived referrals are not indexed, they are filed under the new value when they are restored
+		if !referral.Archived {
+			err = t.moveContactIndex(referralId, legacyValue, referral.ContactHash, stub)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		valAsbytes, err := json.Marshal(referral)
+		if err != nil {
+			return nil, err
+		}
+
+		err = putReferralBytes(referralId, valAsbytes, stub)
+		if err != nil {
+			return nil, err
+		}
+		migrated = append(migrated, referralId)
+	}
+
+	return json.Marshal(migrated)
+}
@@ -0,0 +1,57 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"github.com/joerust/mortgage-referrals/chaincode"
+)
+
+// Error codes returned in the error envelope, the codes both chaincodes share. Clients should branch on
+// the code, the message is for people and may change.
+const (
+	ErrCodeInvalidArgument    = chaincode.ErrCodeInvalidArgument
+	ErrCodeValidation         = chaincode.ErrCodeValidation
+	ErrCodeNotFound           = chaincode.ErrCodeNotFound
+	ErrCodeAlreadyExists      = chaincode.ErrCodeAlreadyExists
+	ErrCodeAccessDenied       = chaincode.ErrCodeAccessDenied
+	ErrCodeInvalidTransition  = chaincode.ErrCodeInvalidTransition
+	ErrCodeVersionConflict    = chaincode.ErrCodeVersionConflict
+	ErrCodeFailedPrecondition = chaincode.ErrCodeFailedPrecondition
+	ErrCodeUnknownFunction    = chaincode.ErrCodeUnknownFunction
+	ErrCodeLedger             = chaincode.ErrCodeLedger
+	ErrCodeInternal           = chaincode.ErrCodeInternal
+)
+
+// ChaincodeError is the error envelope every Invoke and Query function fails with
+type ChaincodeError = chaincode.Error
+
+// newError returns an error envelope without details
+func newError(code string, message string) *ChaincodeError {
+	return chaincode.NewError(code, message)
+}
+
+// newErrorDetails returns an error envelope carrying details about what went wrong
+func newErrorDetails(code string, message string, details interface{}) *ChaincodeError {
+	return chaincode.NewErrorDetails(code, message, details)
+}
+
+// notFound returns the error for a referral that does not exist
+func notFound(referralId string) *ChaincodeError {
+	return newErrorDetails(ErrCodeNotFound, "Referral "+referralId+" does not exist", map[string]string{"referralId": referralId})
+}
+
+// asChaincodeError converts any error into the envelope
+func asChaincodeError(err error) *ChaincodeError {
+	return chaincode.AsError(err)
+}
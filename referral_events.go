@@ -0,0 +1,56 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"github.com/joerust/mortgage-referrals/chaincode"
+	"github.com/joerust/mortgage-referrals/events"
+	"github.com/joerust/mortgage-referrals/ledger"
+)
+
+// encodeReferralEvent returns the event payload for a change to a referral
+func encodeReferralEvent(eventType string, oldStatus string, referral CustomerReferral, stub ledger.Stub) ([]byte, error) {
+	timestamp, err := chaincode.TxTime(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	return events.ReferralEvent{
+		EventType:   eventType,
+		ReferralId:  referral.ReferralId,
+		OldStatus:   oldStatus,
+		NewStatus:   referral.Status,
+		Departments: referral.Departments,
+		Version:     referral.Version,
+		TxId:        stub.GetTxID(),
+		Timestamp:   timestamp,
+	}.Encode()
+}
+
+// emitReferralEvent sets the chaincode event for a change to a referral. A transaction carries a single
+// event, so each mutating function emits exactly one, after its writes have succeeded. The functions only
+// the mortgage chaincode calls return their event instead, the peer drops events set by a called chaincode.
+func emitReferralEvent(eventType string, oldStatus string, referral CustomerReferral, stub ledger.Stub) error {
+	payload, err := encodeReferralEvent(eventType, oldStatus, referral, stub)
+	if err != nil {
+		return err
+	}
+
+	err = stub.SetEvent(eventType, payload)
+	if err != nil {
+		return newError(ErrCodeLedger, "Failed to set "+eventType+" event for "+referral.ReferralId)
+	}
+
+	return nil
+}
@@ -0,0 +1,370 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/joerust/mortgage-referrals/events"
+	"github.com/joerust/mortgage-referrals/ledger"
+)
+
+// Callers the tests run as, described by their certificate attributes
+var (
+	adminCaller = map[string]string{
+		roleAttribute: RoleAdmin,
+		piiAttribute:  "true",
+	}
+	mortgagesEmployee = map[string]string{
+		roleAttribute:        RoleEmployee,
+		employeeIdAttribute:  "E1",
+		departmentsAttribute: "MORTGAGES",
+		piiAttribute:         "true",
+	}
+	savingsEmployee = map[string]string{
+		roleAttribute:        RoleEmployee,
+		employeeIdAttribute:  "E2",
+		departmentsAttribute: "SAVINGS",
+	}
+	mortgageService = map[string]string{
+		roleAttribute: RoleMortgage,
+	}
+	noRole = map[string]string{}
+)
+
+// testPIIKey is the key every test transaction carries in its metadata
+var testPIIKey = []byte("0123456789abcdef0123456789abcdef")
+
+// testMortgageChaincode is the mortgage chaincode every test ledger is configured with
+const testMortgageChaincode = "mortgage"
+
+// testReferralId is the id allocated to the first referral created on a fresh ledger
+const testReferralId = "REF-0000000001"
+
+// testReferralJSON is a valid referral made by the mortgages employee
+const testReferralJSON = `{"customerName":"Jane Doe","contactNumber":"+15551234567","customerId":"C1","employeeId":"E1","departments":["MORTGAGES"],"status":"NEW"}`
+
+// testTime is the transaction timestamp the ledger starts at
+const testTime = 1500000000
+
+// harness runs the referral chaincode's unexported Invoke and Query functions against the mock ledger
+type harness struct {
+	t    *testing.T
+	cc   *ReferralChaincode
+	stub *ledger.MockStub
+}
+
+// newHarness returns a harness for a ledger holding only the configuration, calling as the mortgages employee
+func newHarness(t *testing.T) *harness {
+	stub := ledger.NewMockStub()
+	stub.Time = testTime
+	stub.Metadata = piiMetadata(testPIIKey)
+	stub.SetCaller(mortgagesEmployee)
+
+	h := &harness{t: t, cc: new(ReferralChaincode), stub: stub}
+	h.mustInvoke(adminCaller, "init", "", "", testMortgageChaincode)
+	return h
+}
+
+// piiMetadata returns transaction metadata carrying the key
+func piiMetadata(key []byte) []byte {
+	valAsbytes, _ := json.Marshal(TransactionMetadata{PIIKey: base64.StdEncoding.EncodeToString(key)})
+	return valAsbytes
+}
+
+// as switches the caller for the following transactions. Callers with the mortgage role call through the
+// mortgage chaincode, unless the test has already said which chaincode they invoked.
+func (h *harness) as(caller map[string]string) *harness {
+	h.stub.SetCaller(caller)
+	if caller[roleAttribute] == RoleMortgage && h.stub.InvokedChaincode == "" {
+		h.stub.InvokedChaincode = testMortgageChaincode
+	}
+	return h
+}
+
+func (h *harness) invoke(function string, args ...string) ([]byte, error) {
+	return h.stub.Invoke(func(stub ledger.Stub) ([]byte, error) {
+		return h.cc.invoke(stub, function, args)
+	})
+}
+
+func (h *harness) query(function string, args ...string) ([]byte, error) {
+	return h.stub.Query(func(stub ledger.Stub) ([]byte, error) {
+		return h.cc.query(stub, function, args)
+	})
+}
+
+// mustInvoke runs an invoke function that has to succeed, leaving the caller as it found it
+func (h *harness) mustInvoke(caller map[string]string, function string, args ...string) []byte {
+	h.t.Helper()
+
+	previous := h.stub.Attributes
+	h.as(caller)
+	defer func() { h.stub.Attributes = previous }()
+
+	result, err := h.invoke(function, args...)
+	if err != nil {
+		h.t.Fatalf("%s(%s) failed: %v", function, strings.Join(args, ", "), err)
+	}
+
+	return result
+}
+
+// createReferral creates a referral as the admin and returns its allocated id
+func (h *harness) createReferral(referralJSON string) string {
+	h.t.Helper()
+
+	var result CreateReferralResult
+	err := json.Unmarshal(h.mustInvoke(adminCaller, "createReferral", referralJSON), &result)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+
+	return result.ReferralId
+}
+
+// seed creates the test referral, which is allocated testReferralId
+func (h *harness) seed() {
+	h.t.Helper()
+
+	if referralId := h.createReferral(testReferralJSON); referralId != testReferralId {
+		h.t.Fatalf("seed referral was allocated %s, want %s", referralId, testReferralId)
+	}
+}
+
+// stored returns the referral as it is stored on the ledger
+func (h *harness) stored(referralId string) CustomerReferral {
+	h.t.Helper()
+
+	key, _ := referralKey(referralId)
+	valAsbytes := h.stub.State[key]
+	if valAsbytes == nil {
+		h.t.Fatalf("referral %s is not on the ledger", referralId)
+	}
+
+	var referral CustomerReferral
+	err := json.Unmarshal(valAsbytes, &referral)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+
+	return referral
+}
+
+// unkeyContactIndex turns a seeded referral back into one from before the contact hash, indexed under the
+// legacy hash of its contact number
+func (h *harness) unkeyContactIndex(referralId string, contactNumber string) {
+	h.t.Helper()
+
+	referral := h.stored(referralId)
+	oldKey, _ := createCompositeKey(contactIndex, referral.ContactHash, referralId)
+	newKey, _ := createCompositeKey(contactIndex, legacyContactIndexValue(contactNumber), referralId)
+	h.stub.State[newKey] = h.stub.State[oldKey]
+	delete(h.stub.State, oldKey)
+
+	referral.ContactHash = ""
+	h.store(referral)
+}
+
+// store overwrites a referral on the ledger as it is
+func (h *harness) store(referral CustomerReferral) {
+	h.t.Helper()
+
+	valAsbytes, err := json.Marshal(referral)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+
+	key, _ := referralKey(referral.ReferralId)
+	h.stub.State[key] = valAsbytes
+}
+
+// legacyEnvelope returns an envelope sealed by sealPII in the legacy format, with its mask in plaintext
+func legacyEnvelope(sealed string, mask string) string {
+	return legacyEnvelopePrefix + mask + ":" + strings.TrimPrefix(sealed, piiEnvelopePrefix)
+}
+
+// exists reports whether a referral record is on the ledger
+func (h *harness) exists(referralId string) bool {
+	key, _ := referralKey(referralId)
+	_, ok := h.stub.State[key]
+	return ok
+}
+
+// indexed returns the committed referral ids indexed under a value
+func (h *harness) indexed(indexName string, value string) []string {
+	h.t.Helper()
+
+	var referralIds []string
+	_, err := h.stub.Query(func(stub ledger.Stub) ([]byte, error) {
+		var err error
+		referralIds, err = getIndexedReferralIds(indexName, value, stub)
+		return nil, err
+	})
+	if err != nil {
+		h.t.Fatal(err)
+	}
+
+	return referralIds
+}
+
+// checkEvent fails the test unless the last committed event is of the wanted type and referral version
+func checkEvent(t *testing.T, h *harness, eventType string, version int64) events.ReferralEvent {
+	t.Helper()
+
+	last := h.stub.LastEvent()
+	if last == nil || last.Name != eventType {
+		t.Fatalf("last event is %+v, want %s", last, eventType)
+	}
+
+	event, err := events.Decode(last.Payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if event.EventType != eventType || event.Version != version || event.TxId != last.TxID || event.Timestamp != h.stub.Time {
+		t.Fatalf("event %+v, want %s at version %d in %s", event, eventType, version, last.TxID)
+	}
+
+	return event
+}
+
+// checkReturnedEvent fails the test unless a function called by the mortgage chaincode returned the wanted
+// referral event rather than setting it, as the peer would drop it
+func checkReturnedEvent(t *testing.T, h *harness, result []byte, eventType string, version int64) events.ReferralEvent {
+	t.Helper()
+
+	if last := h.stub.LastEvent(); last != nil && last.Name == eventType {
+		t.Fatalf("%s was set as the transaction's event", eventType)
+	}
+
+	event, err := events.Decode(result)
+	if err != nil {
+		t.Fatalf("result %s is not a referral event: %v", result, err)
+	}
+
+	if event.EventType != eventType || event.Version != version || event.Timestamp != h.stub.Time {
+		t.Fatalf("event %+v, want %s at version %d", event, eventType, version)
+	}
+
+	return event
+}
+
+// errorCode returns the envelope code of an error, or an empty string for nil
+func errorCode(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	return asChaincodeError(err).Code
+}
+
+// checkCode fails the test unless err carries the wanted envelope code, an empty code meaning success
+func checkCode(t *testing.T, err error, code string) {
+	t.Helper()
+
+	if errorCode(err) != code {
+		t.Fatalf("got error %v, want code %q", err, code)
+	}
+}
+
+// decodeJSON unmarshals a result, failing the test if it is not valid JSON
+func decodeJSON(t *testing.T, valAsbytes []byte, into interface{}) {
+	t.Helper()
+
+	err := json.Unmarshal(valAsbytes, into)
+	if err != nil {
+		t.Fatalf("result %s is not valid JSON: %v", valAsbytes, err)
+	}
+}
+
+// sameStrings compares string slices treating nil and empty alike
+func sameStrings(got []string, want []string) bool {
+	if len(got) == 0 && len(want) == 0 {
+		return true
+	}
+
+	return reflect.DeepEqual(got, want)
+}
+
+// invokeCase is one case of a table driven Invoke or Query test. Each case runs on a fresh ledger holding the
+// seeded test referral, after its setup.
+type invokeCase struct {
+	name   string
+	setup  func(h *harness)
+	caller map[string]string
+	args   []string
+	code   string
+	check  func(t *testing.T, h *harness, result []byte)
+}
+
+// runInvokeCases runs the cases of a table driven Invoke test. A failed case must leave the ledger as it
+// was after setup.
+func runInvokeCases(t *testing.T, function string, cases []invokeCase) {
+	runCases(t, function, (*harness).invoke, cases)
+}
+
+// runQueryCases runs the cases of a table driven Query test
+func runQueryCases(t *testing.T, function string, cases []invokeCase) {
+	runCases(t, function, (*harness).query, cases)
+}
+
+func runCases(t *testing.T, function string, run func(h *harness, function string, args ...string) ([]byte, error), cases []invokeCase) {
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h := newHarness(t)
+			h.seed()
+			if c.setup != nil {
+				c.setup(h)
+			}
+
+			caller := c.caller
+			if caller == nil {
+				caller = mortgagesEmployee
+			}
+			h.as(caller)
+
+			before := snapshot(h.stub.State)
+			events := len(h.stub.Events)
+
+			result, err := run(h, function, c.args...)
+			checkCode(t, err, c.code)
+
+			if c.code != "" {
+				if !reflect.DeepEqual(before, snapshot(h.stub.State)) || len(h.stub.Events) != events {
+					t.Fatalf("failed %s changed the ledger", function)
+				}
+				return
+			}
+
+			if c.check != nil {
+				c.check(t, h, result)
+			}
+		})
+	}
+}
+
+// snapshot copies the world state
+func snapshot(state map[string][]byte) map[string]string {
+	copied := make(map[string]string, len(state))
+	for key, value := range state {
+		copied[key] = string(value)
+	}
+
+	return copied
+}
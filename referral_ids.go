@@ -0,0 +1,66 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/joerust/mortgage-referrals/ledger"
+)
+
+// referralSequenceName is the counter referral ids are allocated from
+const referralSequenceName = "referral"
+
+// referralIdWidth zero pads the counter in allocated ids so they sort in the order they were created
+const referralIdWidth = 10
+
+// CreateReferralResult is the response to createReferral
+type CreateReferralResult struct {
+	ReferralId string          `json:"referralId"`
+	Referral   json.RawMessage `json:"referral"`
+}
+
+// allocateReferralId returns the next unused referral id, the configured prefix followed by the counter.
+// Ids taken by referrals created before the chaincode allocated them are skipped.
+func allocateReferralId(stub ledger.Stub) (string, error) {
+	config, err := getConfig(stub)
+	if err != nil {
+		return "", err
+	}
+
+	key, err := createCompositeKey(sequenceNamespace, referralSequenceName)
+	if err != nil {
+		return "", err
+	}
+
+	format := func(sequence int64) string {
+		return fmt.Sprintf("%s-%0*d", config.ReferralIdPrefix, referralIdWidth, sequence)
+	}
+
+	lookupFailed := false
+	sequence, err := ledger.AllocateSequence(stub, key, func(sequence int64) (bool, error) {
+		existing, err := getReferralBytes(format(sequence), stub)
+		lookupFailed = err != nil
+		return existing != nil, err
+	})
+	if err != nil {
+		if lookupFailed {
+			return "", err
+		}
+		return "", newError(ErrCodeLedger, "Failed to allocate a referral id from the "+referralSequenceName+" sequence")
+	}
+
+	return format(sequence), nil
+}
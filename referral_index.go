@@ -0,0 +1,172 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/joerust/mortgage-referrals/ledger"
+)
+
+// indexEntry is a single referral id found under an index value, along with the value stored against it
+type indexEntry struct {
+	ReferralId string
+	Value      []byte
+}
+
+// getIndexEntries range scans the entries of an index for a single value
+func getIndexEntries(indexName string, value string, stub ledger.Stub) ([]indexEntry, error) {
+	prefix, err := createCompositeKey(indexName, value)
+	if err != nil {
+		return nil, err
+	}
+
+	keysIter, err := stub.RangeQueryState(prefix, prefix+maxUnicodeRune)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Failed to scan "+indexName+" index for "+value)
+	}
+	defer keysIter.Close()
+
+	var entries []indexEntry
+	for keysIter.HasNext() {
+		key, valAsbytes, err := keysIter.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		_, attributes, err := splitCompositeKey(key)
+		if err != nil || len(attributes) != 2 {
+			fmt.Println("Skipping malformed index key " + key)
+			continue
+		}
+		entries = append(entries, indexEntry{ReferralId: attributes[1], Value: valAsbytes})
+	}
+
+	return entries, nil
+}
+
+// getIndexedReferralIds returns the referral ids indexed under a single value
+func getIndexedReferralIds(indexName string, value string, stub ledger.Stub) ([]string, error) {
+	entries, err := getIndexEntries(indexName, value, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	referralIds := make([]string, len(entries))
+	for i := range entries {
+		referralIds[i] = entries[i].ReferralId
+	}
+
+	return referralIds, nil
+}
+
+// putIndexEntry records that referralId is indexed under value in the named index
+func putIndexEntry(indexName string, value string, referralId string, stub ledger.Stub) error {
+	return putIndexEntryValue(indexName, value, referralId, indexEntryValue, stub)
+}
+
+// putIndexEntryValue records that referralId is indexed under value, storing entryValue against the entry
+func putIndexEntryValue(indexName string, value string, referralId string, entryValue []byte, stub ledger.Stub) error {
+	key, err := createCompositeKey(indexName, value, referralId)
+	if err != nil {
+		return err
+	}
+
+	err = stub.PutState(key, entryValue)
+	if err != nil {
+		return newError(ErrCodeLedger, "Failed to update "+indexName+" index for "+value)
+	}
+
+	return nil
+}
+
+// delIndexEntry removes referralId from value in the named index
+func delIndexEntry(indexName string, value string, referralId string, stub ledger.Stub) error {
+	key, err := createCompositeKey(indexName, value, referralId)
+	if err != nil {
+		return err
+	}
+
+	err = stub.DelState(key)
+	if err != nil {
+		return newError(ErrCodeLedger, "Failed to update "+indexName+" index for "+value)
+	}
+
+	return nil
+}
+
+// migrateIndexes - invoke function converting comma-delimited index values stored under the raw
+// status or department name into composite key entries. Expects the index name ("status" or
+// "department") followed by the legacy keys to convert. Statuses default to the lifecycle statuses.
+func (t *ReferralChaincode) migrateIndexes(stub ledger.Stub, args []string) ([]byte, error) {
+
+	if len(args) < 1 {
+		return nil, newError(ErrCodeInvalidArgument, "Incorrect number of arguments. Expecting the index name followed by the keys to migrate")
+	}
+
+	indexName := args[0]
+	legacyKeys := args[1:]
+	if indexName != statusIndex && indexName != departmentIndex {
+		return nil, newError(ErrCodeInvalidArgument, "Unknown index "+indexName)
+	}
+
+	if len(legacyKeys) == 0 {
+		if indexName != statusIndex {
+			return nil, newError(ErrCodeInvalidArgument, "Incorrect number of arguments. Expecting the department keys to migrate")
+		}
+		legacyKeys = statusOrder
+	}
+
+	migrated := make(map[string]int)
+	for _, legacyKey := range legacyKeys {
+		valAsbytes, err := stub.GetState(legacyKey)
+		if err != nil {
+			return nil, newError(ErrCodeLedger, "Failed to get state for "+legacyKey)
+		}
+
+		if valAsbytes == nil {
+			continue
+		}
+
+		// A referral stored under the same key is not an index value, leave it alone
+		var referral CustomerReferral
+		if json.Unmarshal(valAsbytes, &referral) == nil {
+			fmt.Println("Skipping " + legacyKey + ", it holds a referral record")
+			continue
+		}
+
+		count := 0
+		referralIds := strings.Split(string(valAsbytes), ",")
+		for i := range referralIds {
+			if referralIds[i] == "" {
+				continue
+			}
+			err = putIndexEntry(indexName, legacyKey, referralIds[i], stub)
+			if err != nil {
+				return nil, err
+			}
+			count++
+		}
+
+		err = stub.DelState(legacyKey)
+		if err != nil {
+			return nil, newError(ErrCodeLedger, "Failed to delete state for "+legacyKey)
+		}
+		migrated[legacyKey] = count
+	}
+
+	return json.Marshal(migrated)
+}
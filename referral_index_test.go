@@ -0,0 +1,447 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/joerust/mortgage-referrals/ledger"
+)
+
+// putStatusEntries commits status index entries for the referral ids
+func putStatusEntries(h *harness, status string, referralIds ...string) {
+	for _, referralId := range referralIds {
+		key, _ := createCompositeKey(statusIndex, status, referralId)
+		h.stub.State[key] = indexEntryValue
+	}
+}
+
+func TestRemoveStatusReferralIndex(t *testing.T) {
+	cases := []struct {
+		name       string
+		entries    map[string][]string
+		referralId string
+		status     string
+		code       string
+		want       map[string][]string
+	}{
+		{
+			name:       "only entry",
+			entries:    map[string][]string{StatusNew: {"REF-1"}},
+			referralId: "REF-1",
+			status:     StatusNew,
+			want:       map[string][]string{StatusNew: nil},
+		},
+		{
+			name:       "first of several",
+			entries:    map[string][]string{StatusNew: {"REF-1", "REF-2", "REF-3"}},
+			referralId: "REF-1",
+			status:     StatusNew,
+			want:       map[string][]string{StatusNew: {"REF-2", "REF-3"}},
+		},
+		{
+			name:       "last of several",
+			entries:    map[string][]string{StatusNew: {"REF-1", "REF-2", "REF-3"}},
+			referralId: "REF-3",
+			status:     StatusNew,
+			want:       map[string][]string{StatusNew: {"REF-1", "REF-2"}},
+		},
+		{
+			name:       "middle of several",
+			entries:    map[string][]string{StatusNew: {"REF-1", "REF-2", "REF-3"}},
+			referralId: "REF-2",
+			status:     StatusNew,
+			want:       map[string][]string{StatusNew: {"REF-1", "REF-3"}},
+		},
+		{
+			name:       "id that prefixes another id",
+			entries:    map[string][]string{StatusNew: {"REF-1", "REF-10", "REF-11"}},
+			referralId: "REF-1",
+			status:     StatusNew,
+			want:       map[string][]string{StatusNew: {"REF-10", "REF-11"}},
+		},
+		{
+			name:       "id prefixed by another id",
+			entries:    map[string][]string{StatusNew: {"REF-1", "REF-10"}},
+			referralId: "REF-10",
+			status:     StatusNew,
+			want:       map[string][]string{StatusNew: {"REF-1"}},
+		},
+		{
+			name:       "id not in the index",
+			entries:    map[string][]string{StatusNew: {"REF-1", "REF-2"}},
+			referralId: "REF-3",
+			status:     StatusNew,
+			want:       map[string][]string{StatusNew: {"REF-1", "REF-2"}},
+		},
+		{
+			name:       "empty index",
+			referralId: "REF-1",
+			status:     StatusNew,
+			want:       map[string][]string{StatusNew: nil},
+		},
+		{
+			name:       "other statuses are untouched",
+			entries:    map[string][]string{StatusNew: {"REF-1"}, StatusContacted: {"REF-1", "REF-2"}},
+			referralId: "REF-1",
+			status:     StatusContacted,
+			want:       map[string][]string{StatusNew: {"REF-1"}, StatusContacted: {"REF-2"}},
+		},
+		{
+			name:       "status that prefixes another status",
+			entries:    map[string][]string{"APPROVED": {"REF-1"}, "APPROVED_PENDING": {"REF-1"}},
+			referralId: "REF-1",
+			status:     "APPROVED",
+			want:       map[string][]string{"APPROVED": nil, "APPROVED_PENDING": {"REF-1"}},
+		},
+		{
+			name:       "empty status",
+			entries:    map[string][]string{StatusNew: {"REF-1"}},
+			referralId: "REF-1",
+			status:     "",
+			want:       map[string][]string{StatusNew: {"REF-1"}},
+		},
+		{
+			name:       "id with a null character",
+			entries:    map[string][]string{StatusNew: {"REF-1"}},
+			referralId: "REF-1\x00",
+			status:     StatusNew,
+			code:       ErrCodeInvalidArgument,
+		},
+		{
+			name:       "status with a null character",
+			entries:    map[string][]string{StatusNew: {"REF-1"}},
+			referralId: "REF-1",
+			status:     StatusNew + "\x00",
+			code:       ErrCodeInvalidArgument,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			h := newHarness(t)
+			for status, referralIds := range c.entries {
+				putStatusEntries(h, status, referralIds...)
+			}
+
+			_, err := h.stub.Invoke(func(stub ledger.Stub) ([]byte, error) {
+				return nil, h.cc.removeStatusReferralIndex(c.referralId, c.status, stub)
+			})
+			checkCode(t, err, c.code)
+
+			for status, want := range c.want {
+				if got := h.indexed(statusIndex, status); !sameStrings(got, want) {
+					t.Errorf("%s index holds %v, want %v", status, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRemoveStatusReferralIndexTwice(t *testing.T) {
+	h := newHarness(t)
+	putStatusEntries(h, StatusNew, "REF-1", "REF-2")
+
+	// Removing and removing again in one transaction, as a retried step would
+	_, err := h.stub.Invoke(func(stub ledger.Stub) ([]byte, error) {
+		err := h.cc.removeStatusReferralIndex("REF-1", StatusNew, stub)
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, h.cc.removeStatusReferralIndex("REF-1", StatusNew, stub)
+	})
+	checkCode(t, err, "")
+
+	if got := h.indexed(statusIndex, StatusNew); !sameStrings(got, []string{"REF-2"}) {
+		t.Fatalf("NEW index holds %v", got)
+	}
+}
+
+func TestRemoveStatusReferralIndexLeavesLegacyValues(t *testing.T) {
+	h := newHarness(t)
+	h.stub.State[StatusNew] = []byte("REF-1,REF-2")
+	putStatusEntries(h, StatusNew, "REF-1")
+
+	_, err := h.stub.Invoke(func(stub ledger.Stub) ([]byte, error) {
+		return nil, h.cc.removeStatusReferralIndex("REF-1", StatusNew, stub)
+	})
+	checkCode(t, err, "")
+
+	if got := string(h.stub.State[StatusNew]); got != "REF-1,REF-2" {
+		t.Fatalf("legacy index value is %q, migrateIndexes should be left to convert it", got)
+	}
+}
+
+func TestMigrateIndexes(t *testing.T) {
+	runInvokeCases(t, "migrateIndexes", []invokeCase{
+		{
+			name: "converts the lifecycle statuses by default",
+			setup: func(h *harness) {
+				h.stub.State[StatusContacted] = []byte("OLD-1,OLD-2,")
+				h.stub.State[StatusFunded] = []byte("OLD-3")
+			},
+			caller: adminCaller,
+			args:   []string{statusIndex},
+			check: func(t *testing.T, h *harness, result []byte) {
+				var migrated map[string]int
+				decodeJSON(t, result, &migrated)
+				if len(migrated) != 2 || migrated[StatusContacted] != 2 || migrated[StatusFunded] != 1 {
+					t.Fatalf("migrated %v", migrated)
+				}
+
+				if got := h.indexed(statusIndex, StatusContacted); !sameStrings(got, []string{"OLD-1", "OLD-2"}) {
+					t.Fatalf("CONTACTED index holds %v", got)
+				}
+
+				if _, ok := h.stub.State[StatusContacted]; ok {
+					t.Fatal("legacy value was not deleted")
+				}
+			},
+		},
+		{
+			name:   "converts the named department keys",
+			setup:  func(h *harness) { h.stub.State["LOANS"] = []byte("OLD-1") },
+			caller: adminCaller,
+			args:   []string{departmentIndex, "LOANS", "MISSING"},
+			check: func(t *testing.T, h *harness, result []byte) {
+				if got := h.indexed(departmentIndex, "LOANS"); !sameStrings(got, []string{"OLD-1"}) {
+					t.Fatalf("LOANS index holds %v", got)
+				}
+			},
+		},
+		{
+			name:   "leaves referral records alone",
+			setup:  func(h *harness) { h.stub.State["LOANS"] = []byte(`{"referralId":"LOANS"}`) },
+			caller: adminCaller,
+			args:   []string{departmentIndex, "LOANS"},
+			check: func(t *testing.T, h *harness, result []byte) {
+				if string(result) != "{}" || h.stub.State["LOANS"] == nil {
+					t.Fatalf("migrated %s", result)
+				}
+			},
+		},
+		{name: "department without keys", caller: adminCaller, args: []string{departmentIndex}, code: ErrCodeInvalidArgument},
+		{name: "unknown index", caller: adminCaller, args: []string{customerIndex}, code: ErrCodeInvalidArgument},
+		{name: "no arguments", caller: adminCaller, code: ErrCodeInvalidArgument},
+		{name: "employee", args: []string{statusIndex}, code: ErrCodeAccessDenied},
+	})
+}
+
+func TestMigrateReferralKeys(t *testing.T) {
+	runInvokeCases(t, "migrateReferralKeys", []invokeCase{
+		{
+			name: "moves referrals into the namespace",
+			setup: func(h *harness) {
+				h.stub.State["OLD-1"] = []byte(`{"referralId":"OLD-1","status":"NEW"}`)
+				h.stub.State[StatusNew] = []byte("OLD-1")
+			},
+			caller: adminCaller,
+			args:   []string{"OLD-1", StatusNew, "MISSING"},
+			check: func(t *testing.T, h *harness, result []byte) {
+				var migrated []string
+				decodeJSON(t, result, &migrated)
+				if !sameStrings(migrated, []string{"OLD-1"}) {
+					t.Fatalf("migrated %v", migrated)
+				}
+
+				if h.stored("OLD-1").Status != StatusNew {
+					t.Fatal("referral was not moved")
+				}
+
+				if _, ok := h.stub.State["OLD-1"]; ok {
+					t.Fatal("bare key was not deleted")
+				}
+
+				if h.stub.State[StatusNew] == nil {
+					t.Fatal("legacy index value was moved")
+				}
+			},
+		},
+		{name: "no arguments", caller: adminCaller, code: ErrCodeInvalidArgument},
+		{name: "employee", args: []string{"OLD-1"}, code: ErrCodeAccessDenied},
+	})
+}
+
+func TestMigrateContactIndex(t *testing.T) {
+	runInvokeCases(t, "migrateContactIndex", []invokeCase{
+		{
+			name:   "moves legacy entries under the keyed hash",
+			setup:  func(h *harness) { h.unkeyContactIndex(testReferralId, "+15551234567") },
+			caller: adminCaller,
+			args:   []string{testReferralId},
+			check: func(t *testing.T, h *harness, result []byte) {
+				var migrated []string
+				decodeJSON(t, result, &migrated)
+				if !sameStrings(migrated, []string{testReferralId}) {
+					t.Fatalf("migrated %v", migrated)
+				}
+
+				hash := contactIndexValue("+15551234567", testPIIKey)
+				if referral := h.stored(testReferralId); referral.ContactHash != hash || referral.Version != 1 {
+					t.Fatalf("stored %+v", referral)
+				}
+
+				if got := h.indexed(contactIndex, hash); !sameStrings(got, []string{testReferralId}) {
+					t.Errorf("keyed index holds %v", got)
+				}
+
+				if got := h.indexed(contactIndex, legacyContactIndexValue("+15551234567")); len(got) != 0 {
+					t.Errorf("legacy index still holds %v", got)
+				}
+			},
+		},
+		{
+			name: "archived referrals are only given the hash",
+			setup: func(h *harness) {
+				h.mustInvoke(adminCaller, "archiveReferral", testReferralId)
+				h.unkeyContactIndex(testReferralId, "+15551234567")
+			},
+			caller: adminCaller,
+			args:   []string{testReferralId},
+			check: func(t *testing.T, h *harness, result []byte) {
+				hash := contactIndexValue("+15551234567", testPIIKey)
+				if h.stored(testReferralId).ContactHash != hash {
+					t.Fatal("contact hash was not stored")
+				}
+
+				if got := h.indexed(contactIndex, hash); len(got) != 0 {
+					t.Errorf("archived referral was indexed under %v", got)
+				}
+			},
+		},
+		{
+			name:   "skips referrals already migrated",
+			caller: adminCaller,
+			args:   []string{testReferralId},
+			check: func(t *testing.T, h *harness, result []byte) {
+				if string(result) != "[]" {
+					t.Errorf("migrated %s", result)
+				}
+			},
+		},
+		{
+			name: "needs the piiKey",
+			setup: func(h *harness) {
+				h.unkeyContactIndex(testReferralId, "+15551234567")
+				h.stub.Metadata = nil
+			},
+			caller: adminCaller,
+			args:   []string{testReferralId},
+			code:   ErrCodeInvalidArgument,
+		},
+		{name: "unknown referral", caller: adminCaller, args: []string{"REF-0000000099"}, code: ErrCodeNotFound},
+		{name: "no arguments", caller: adminCaller, code: ErrCodeInvalidArgument},
+		{name: "employee", args: []string{testReferralId}, code: ErrCodeAccessDenied},
+	})
+}
+
+func TestCompositeKeys(t *testing.T) {
+	cases := []struct {
+		namespace  string
+		attributes []string
+	}{
+		{referralNamespace, []string{"REF-1"}},
+		{statusIndex, []string{StatusNew, "REF-1"}},
+		{configNamespace, nil},
+		{auditNamespace, []string{"REF-1", "0000000001"}},
+		{departmentIndex, []string{"", "REF-1"}},
+	}
+
+	for _, c := range cases {
+		key, err := createCompositeKey(c.namespace, c.attributes...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		namespace, attributes, err := splitCompositeKey(key)
+		if err != nil || namespace != c.namespace || !sameStrings(attributes, c.attributes) {
+			t.Errorf("split %q into %s %v, want %s %v", key, namespace, attributes, c.namespace, c.attributes)
+		}
+	}
+
+	_, err := createCompositeKey("")
+	checkCode(t, err, ErrCodeInternal)
+
+	_, _, err = splitCompositeKey("REF-1")
+	if err == nil {
+		t.Fatal("split a bare key")
+	}
+}
+
+func TestSealLegacyPII(t *testing.T) {
+	runInvokeCases(t, "sealLegacyPII", []invokeCase{
+		{
+			name: "seals details stored in the clear",
+			setup: func(h *harness) {
+				referral := h.stored(testReferralId)
+				referral.CustomerName = "Jane Doe"
+				referral.ContactNumber = "+15551234567"
+				h.store(referral)
+			},
+			caller: adminCaller,
+			args:   []string{testReferralId},
+			check: func(t *testing.T, h *harness, result []byte) {
+				var sealed []string
+				decodeJSON(t, result, &sealed)
+				if !sameStrings(sealed, []string{testReferralId}) {
+					t.Fatalf("sealed %v", sealed)
+				}
+
+				stored := h.stored(testReferralId)
+				if !strings.HasPrefix(stored.CustomerName, piiEnvelopePrefix) || !strings.HasPrefix(stored.ContactNumber, piiEnvelopePrefix) || stored.Version != 1 {
+					t.Fatalf("stored %+v", stored)
+				}
+
+				if referral := h.read(mortgagesEmployee, testReferralId); referral.CustomerName != "Jane Doe" || referral.ContactNumber != "+15551234567" {
+					t.Fatalf("read %+v", referral)
+				}
+			},
+		},
+		{
+			name: "replaces legacy envelopes",
+			setup: func(h *harness) {
+				referral := h.stored(testReferralId)
+				referral.CustomerName = legacyEnvelope(referral.CustomerName, "J. D.")
+				h.store(referral)
+			},
+			caller: adminCaller,
+			args:   []string{testReferralId},
+			check: func(t *testing.T, h *harness, result []byte) {
+				if stored := h.stored(testReferralId); !strings.HasPrefix(stored.CustomerName, piiEnvelopePrefix) {
+					t.Fatalf("customer name stored as %s", stored.CustomerName)
+				}
+
+				if referral := h.read(mortgagesEmployee, testReferralId); referral.CustomerName != "Jane Doe" {
+					t.Fatalf("read %+v", referral)
+				}
+			},
+		},
+		{
+			name:   "skips referrals already sealed",
+			caller: adminCaller,
+			args:   []string{testReferralId},
+			check: func(t *testing.T, h *harness, result []byte) {
+				if string(result) != "[]" {
+					t.Errorf("sealed %s", result)
+				}
+			},
+		},
+		{name: "needs the piiKey", setup: func(h *harness) { h.stub.Metadata = nil }, caller: adminCaller, args: []string{testReferralId}, code: ErrCodeInvalidArgument},
+		{name: "unknown referral", caller: adminCaller, args: []string{"REF-0000000099"}, code: ErrCodeNotFound},
+		{name: "no arguments", caller: adminCaller, code: ErrCodeInvalidArgument},
+		{name: "employee", args: []string{testReferralId}, code: ErrCodeAccessDenied},
+	})
+}
@@ -0,0 +1,161 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/joerust/mortgage-referrals/ledger"
+)
+
+// Key namespaces. Every ledger key the chaincode writes is a composite key whose first
+// component is one of these, so records of one type can never overwrite another.
+const (
+	referralNamespace      = "referral"
+	configNamespace        = "config"
+	idempotencyNamespace   = "callerIdempotency"
+	legacyIdempotency      = "idempotency"
+	auditNamespace         = "audit"
+	auditSequenceNamespace = "auditSequence"
+	sequenceNamespace      = "sequence"
+	statusIndex            = "status"
+	departmentIndex        = "department"
+	employeeIndex          = "employee"
+	customerIndex          = "customer"
+	contactIndex           = "contact"
+	idempotencyIndex       = "referralIdempotency"
+)
+
+const (
+	compositeKeySeparator = "\x00"
+	maxUnicodeRune        = "\U0010FFFF"
+)
+
+// indexEntryValue is stored against every index key, the key itself carries all of the information
+var indexEntryValue = []byte{0x00}
+
+// createCompositeKey joins the namespace and attributes into a single ledger key.
+// Keys start with the separator so they can never be mistaken for a raw client supplied key.
+func createCompositeKey(namespace string, attributes ...string) (string, error) {
+	if namespace == "" {
+		return "", newError(ErrCodeInternal, "Key namespace must not be empty")
+	}
+
+	key := compositeKeySeparator + namespace + compositeKeySeparator
+	for _, attribute := range attributes {
+		if strings.Contains(attribute, compositeKeySeparator) {
+			return "", newError(ErrCodeInvalidArgument, fmt.Sprintf("Key attribute %q must not contain a null character", attribute))
+		}
+		key += attribute + compositeKeySeparator
+	}
+
+	return key, nil
+}
+
+// splitCompositeKey returns the namespace and attributes a composite key was built from
+func splitCompositeKey(key string) (string, []string, error) {
+	if !strings.HasPrefix(key, compositeKeySeparator) || !strings.HasSuffix(key, compositeKeySeparator) || len(key) < 2 {
+		return "", nil, fmt.Errorf("Key %q is not a composite key", key)
+	}
+
+	components := strings.Split(key[1:len(key)-1], compositeKeySeparator)
+	return components[0], components[1:], nil
+}
+
+// referralKey returns the ledger key a referral record is stored under
+func referralKey(referralId string) (string, error) {
+	if referralId == "" {
+		return "", newError(ErrCodeInvalidArgument, "Referral id must not be empty")
+	}
+
+	key, err := createCompositeKey(referralNamespace, referralId)
+	if err != nil {
+		return "", newError(ErrCodeInvalidArgument, "Key "+referralId+" is outside the referral namespace")
+	}
+
+	return key, nil
+}
+
+// getReferralBytes reads the raw referral record for the given id, returning nil if it does not exist
+func getReferralBytes(referralId string, stub ledger.Stub) ([]byte, error) {
+	key, err := referralKey(referralId)
+	if err != nil {
+		return nil, err
+	}
+
+	valAsbytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, newError(ErrCodeLedger, "Failed to get state for "+referralId)
+	}
+
+	return valAsbytes, nil
+}
+
+// putReferralBytes writes the raw referral record for the given id
+func putReferralBytes(referralId string, valAsbytes []byte, stub ledger.Stub) error {
+	key, err := referralKey(referralId)
+	if err != nil {
+		return err
+	}
+
+	err = stub.PutState(key, valAsbytes)
+	if err != nil {
+		return newError(ErrCodeLedger, "Failed to update state for "+referralId)
+	}
+
+	return nil
+}
+
+// migrateReferralKeys - invoke function moving referral records stored under their bare id
+// into the referral namespace. Expects the ids of the referrals to move.
+func (t *ReferralChaincode) migrateReferralKeys(stub ledger.Stub, args []string) ([]byte, error) {
+
+	if len(args) < 1 {
+		return nil, newError(ErrCodeInvalidArgument, "Incorrect number of arguments. Expecting the referral ids to migrate")
+	}
+
+	migrated := []string{}
+	for _, referralId := range args {
+		valAsbytes, err := stub.GetState(referralId)
+		if err != nil {
+			return nil, newError(ErrCodeLedger, "Failed to get state for "+referralId)
+		}
+
+		if valAsbytes == nil {
+			continue
+		}
+
+		// Anything that isn't a referral, such as a legacy index value, is left for migrateIndexes
+		var referral CustomerReferral
+		if json.Unmarshal(valAsbytes, &referral) != nil {
+			fmt.Println("Skipping " + referralId + ", it does not hold a referral record")
+			continue
+		}
+
+		err = putReferralBytes(referralId, valAsbytes, stub)
+		if err != nil {
+			return nil, err
+		}
+
+		err = stub.DelState(referralId)
+		if err != nil {
+			return nil, newError(ErrCodeLedger, "Failed to delete state for "+referralId)
+		}
+		migrated = append(migrated, referralId)
+	}
+
+	return json.Marshal(migrated)
+}
@@ -0,0 +1,339 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/joerust/mortgage-referrals/decimal"
+	"github.com/joerust/mortgage-referrals/events"
+	"github.com/joerust/mortgage-referrals/ledger"
+)
+
+// mortgageSchemaVersion is written with every mortgage. Version 1 records, written before the
+// schema was versioned, hold the rate and amount as free-form strings. The rate and amount are
+// decoded by their JSON type rather than the version, so clients may send either form without one.
+const mortgageSchemaVersion = 2
+
+// mortgageFields mirrors Mortgage with the rate and amount left raw so either form can be decoded
+type mortgageFields struct {
+	SchemaVersion  int             `json:"schemaVersion"`
+	MortgageNumber string          `json:"mortgageNumber"`
+	MortgageType   string          `json:"mortgageType"`
+	ReferralId     string          `json:"referralId"`
+	Rate           json.RawMessage `json:"rate"`
+	Amount         json.RawMessage `json:"amount"`
+	LegacyRate     string          `json:"legacyRate"`
+	LegacyAmount   string          `json:"legacyAmount"`
+}
+
+// MarshalJSON always writes the current schema version
+func (m Mortgage) MarshalJSON() ([]byte, error) {
+	type mortgage Mortgage
+	return json.Marshal(struct {
+		SchemaVersion int `json:"schemaVersion"`
+		mortgage
+	}{mortgageSchemaVersion, mortgage(m)})
+}
+
+// UnmarshalJSON decodes a mortgage written with any schema version, rejecting unknown fields. A rate or
+// amount given as a string is read as free-form legacy text. Legacy text that cannot be parsed, such as
+// "TBD", is decoded as zero and kept in legacyRate or legacyAmount to flag it for correction.
+func (m *Mortgage) UnmarshalJSON(valAsbytes []byte) error {
+	var fields mortgageFields
+
+	decoder := json.NewDecoder(bytes.NewReader(valAsbytes))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&fields)
+	if err != nil {
+		return err
+	}
+
+	if fields.SchemaVersion < 0 || fields.SchemaVersion > mortgageSchemaVersion {
+		return fmt.Errorf("unsupported mortgage schema version %d", fields.SchemaVersion)
+	}
+
+	decoded := Mortgage{
+		MortgageNumber: fields.MortgageNumber,
+		MortgageType:   fields.MortgageType,
+		ReferralId:     fields.ReferralId,
+		LegacyRate:     fields.LegacyRate,
+		LegacyAmount:   fields.LegacyAmount,
+	}
+
+	switch jsonType(fields.Rate) {
+	case '"':
+		var rate string
+		err = json.Unmarshal(fields.Rate, &rate)
+		if err != nil {
+			return fmt.Errorf("mortgage rate: %s", err)
+		}
+		decoded.Rate, err = decimal.ParseLegacyRate(rate)
+		if err != nil {
+			decoded.Rate, decoded.LegacyRate = 0, rate
+		}
+	case 'n', 0:
+		// null or left out, the rate stays zero
+	default:
+		err = json.Unmarshal(fields.Rate, &decoded.Rate)
+		if err != nil {
+			return fmt.Errorf("mortgage rate must be a whole number of basis points or a string: %s", err)
+		}
+	}
+
+	switch jsonType(fields.Amount) {
+	case '"':
+		var amount string
+		err = json.Unmarshal(fields.Amount, &amount)
+		if err != nil {
+			return fmt.Errorf("mortgage amount: %s", err)
+		}
+		decoded.Amount, err = decimal.ParseLegacyMoney(amount)
+		if err != nil {
+			decoded.Amount, decoded.LegacyAmount = decimal.Money{}, amount
+		}
+	case 'n', 0:
+		// null or left out, the amount stays zero
+	default:
+		amountDecoder := json.NewDecoder(bytes.NewReader(fields.Amount))
+		amountDecoder.DisallowUnknownFields()
+		err = amountDecoder.Decode(&decoded.Amount)
+		if err != nil {
+			return fmt.Errorf("mortgage amount must be an object with minorUnits and currency or a string: %s", err)
+		}
+	}
+
+	*m = decoded
+	return nil
+}
+
+// jsonType returns the first byte of a raw JSON value, which tells its type, or 0 if it is absent
+func jsonType(value json.RawMessage) byte {
+	value = bytes.TrimLeft(value, " \t\r\n")
+	if len(value) == 0 {
+		return 0
+	}
+
+	return value[0]
+}
+
+// getReferral loads the referral stored under the given id
+func getReferral(referralId string, stub ledger.Stub) (CustomerReferral, error) {
+	var referral CustomerReferral
+
+	valAsbytes, err := getReferralBytes(referralId, stub)
+	if err != nil {
+		return referral, err
+	}
+
+	if valAsbytes == nil {
+		return referral, notFound(referralId)
+	}
+
+	err = json.Unmarshal(valAsbytes, &referral)
+	if err != nil {
+		return referral, newError(ErrCodeInternal, "Failed to unmarshal referral "+referralId)
+	}
+
+	return referral, nil
+}
+
+// checkMortgageChaincodeCall rejects a call that was not made by the mortgage chaincode set by init. The
+// mortgage chaincode only links a referral or moves it along once its application has done so, which the
+// referral chaincode cannot check for itself: querying the mortgage chaincode back during its call would
+// only see the application as it was before the transaction.
+func checkMortgageChaincodeCall(function string, stub ledger.Stub) error {
+	config, err := getConfig(stub)
+	if err != nil {
+		return err
+	}
+
+	if config.MortgageChaincode == "" {
+		return newError(ErrCodeFailedPrecondition, "The mortgage chaincode name has not been set by init")
+	}
+
+	invoked, err := stub.GetInvokedChaincode()
+	if err != nil {
+		return newError(ErrCodeInternal, "Failed to read the chaincode the proposal invoked")
+	}
+
+	if invoked != config.MortgageChaincode {
+		return newError(ErrCodeAccessDenied, function+" can only be called by the "+config.MortgageChaincode+" chaincode")
+	}
+
+	return nil
+}
+
+// linkMortgage - invoke function called by the mortgage chaincode when an application is opened for a
+// referral. Expects the referral id and the mortgage JSON, which is stored on the referral. Returns the
+// referral event payload for the mortgage chaincode to carry in its own event, as the peer only records
+// the event of the chaincode the transaction was sent to.
+func (t *ReferralChaincode) linkMortgage(stub ledger.Stub, args []string) ([]byte, error) {
+
+	err := checkMortgageChaincodeCall("linkMortgage", stub)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(args) != 2 {
+		return nil, newError(ErrCodeInvalidArgument, "Incorrect number of arguments. Expecting 2, the referral id and mortgage JSON")
+	}
+
+	key := args[0]
+
+	var mortgage Mortgage
+	err = json.Unmarshal([]byte(args[1]), &mortgage)
+	if err != nil || mortgage.MortgageNumber == "" {
+		return nil, newError(ErrCodeInvalidArgument, "Mortgage JSON with a mortgageNumber is required")
+	}
+
+	if mortgage.ReferralId != key {
+		return nil, newError(ErrCodeInvalidArgument, "Mortgage "+mortgage.MortgageNumber+" belongs to referral "+mortgage.ReferralId)
+	}
+
+	referral, err := getReferral(key, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkNotArchived(key, referral)
+	if err != nil {
+		return nil, err
+	}
+
+	if referral.Mortgage.MortgageNumber != "" && referral.Mortgage.MortgageNumber != mortgage.MortgageNumber {
+		return nil, newError(ErrCodeAlreadyExists, "Referral "+key+" is already linked to mortgage "+referral.Mortgage.MortgageNumber)
+	}
+
+	if len(statusTransitions[referral.Status]) == 0 {
+		return nil, newError(ErrCodeFailedPrecondition, "Referral "+key+" is "+referral.Status+" and cannot take a mortgage")
+	}
+
+	oldAsbytes, err := json.Marshal(referral)
+	if err != nil {
+		return nil, err
+	}
+
+	referral.Mortgage = mortgage
+	err = touchReferral(&referral, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	valAsbytes, err := json.Marshal(referral)
+	if err != nil {
+		return nil, err
+	}
+
+	err = putReferralBytes(key, valAsbytes, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = appendAuditEntry(key, oldAsbytes, valAsbytes, "linkMortgage", ReasonMortgageLinked, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	return encodeReferralEvent(events.MortgageLinked, referral.Status, referral, stub)
+}
+
+// followMortgageStatus - invoke function called by the mortgage chaincode when a linked mortgage changes
+// status. Expects the referral id, the mortgage number and the status the referral should move to. The
+// referral is walked through any intermediate lifecycle statuses it has not reached yet. Returns the
+// referral event payload like linkMortgage, or nothing if the referral had already reached the status.
+func (t *ReferralChaincode) followMortgageStatus(stub ledger.Stub, args []string) ([]byte, error) {
+
+	err := checkMortgageChaincodeCall("followMortgageStatus", stub)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(args) != 3 {
+		return nil, newError(ErrCodeInvalidArgument, "Incorrect number of arguments. Expecting 3, the referral id, mortgage number and status")
+	}
+
+	key := args[0]
+	mortgageNumber := args[1]
+	status := args[2]
+
+	referral, err := getReferral(key, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkNotArchived(key, referral)
+	if err != nil {
+		return nil, err
+	}
+
+	if referral.Mortgage.MortgageNumber != mortgageNumber {
+		return nil, newError(ErrCodeFailedPrecondition, "Referral "+key+" is not linked to mortgage "+mortgageNumber)
+	}
+
+	path := statusPath(referral.Status, status)
+	if path == nil {
+		return nil, statusLifecycle.Check(key, referral.Status, status)
+	}
+
+	if len(path) == 0 {
+		return nil, nil
+	}
+
+	oldAsbytes, err := json.Marshal(referral)
+	if err != nil {
+		return nil, err
+	}
+
+	oldStatus := referral.Status
+	referral.Status = status
+	err = touchReferral(&referral, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	// Statuses walked through on the way are entered and left in this transaction
+	for _, step := range path {
+		enterStatus(&referral, step, referral.UpdatedDate)
+	}
+
+	valAsbytes, err := json.Marshal(referral)
+	if err != nil {
+		return nil, err
+	}
+
+	err = putReferralBytes(key, valAsbytes, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = appendAuditEntry(key, oldAsbytes, valAsbytes, "followMortgageStatus", ReasonMortgageProgress, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.removeStatusReferralIndex(key, oldStatus, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.indexByStatus(key, status, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	return encodeReferralEvent(events.ReferralStatusChanged, oldStatus, referral, stub)
+}
@@ -0,0 +1,401 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/joerust/mortgage-referrals/ledger"
+)
+
+// The referral fields holding the customer's personal details, or derived from them, by their JSON names
+const (
+	customerNameField  = "customerName"
+	contactNumberField = "contactNumber"
+	contactHashField   = "contactHash"
+)
+
+// piiEnvelopePrefix starts every personal detail stored encrypted. The envelope is the prefix followed by
+// the base64 nonce and ciphertext.
+const piiEnvelopePrefix = "pii:v2:"
+
+// legacyEnvelopePrefix started the envelopes first stored, which carried the detail's mask in plaintext
+// between the prefix and a colon before the ciphertext. They are still opened, and sealLegacyPII replaces them.
+const legacyEnvelopePrefix = "pii:v1:"
+
+// redactedPII stands in for a personal detail that cannot be decrypted to mask it
+const redactedPII = "****"
+
+// piiKeySize is the length of the AES-256 key clients pass in the transaction metadata
+const piiKeySize = 32
+
+// piiKeyFingerprintLabel is the fixed message a piiKey fingerprint is the HMAC of
+const piiKeyFingerprintLabel = "referral piiKey fingerprint"
+
+// TransactionMetadata is the JSON clients attach to a transaction as its metadata, in the transient data
+// entry named by ledger.MetadataTransientKey. Transient data is not written to the ledger, so the key is
+// only used while the transaction runs. Before transient data the metadata was recorded with the
+// transaction, so a key passed then can be read from those blocks along with everything it sealed.
+type TransactionMetadata struct {
+	PIIKey string `json:"piiKey"`
+}
+
+// getPIIKey returns the key passed in the transaction metadata, or nil if the transaction does not carry one
+func getPIIKey(stub ledger.Stub) ([]byte, error) {
+	metadata, err := stub.GetCallerMetadata()
+	if err != nil || len(metadata) == 0 {
+		return nil, nil
+	}
+
+	var decoded TransactionMetadata
+	err = json.Unmarshal(metadata, &decoded)
+	if err != nil {
+		return nil, newError(ErrCodeInvalidArgument, "Transaction metadata must be a JSON object")
+	}
+
+	if decoded.PIIKey == "" {
+		return nil, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(decoded.PIIKey)
+	if err != nil || len(key) != piiKeySize {
+		return nil, newError(ErrCodeInvalidArgument, "piiKey must be a base64 encoded 32 byte key")
+	}
+
+	config, err := getConfig(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.PIIKeyFingerprint != "" && !hmac.Equal([]byte(config.PIIKeyFingerprint), []byte(piiKeyFingerprint(key))) {
+		return nil, newError(ErrCodeInvalidArgument, "piiKey is not the key the customer details are sealed with")
+	}
+
+	return key, nil
+}
+
+// piiKeyFingerprint identifies a piiKey without revealing it, so a transaction carrying a wrong or rotated key
+// can be refused before it seals details the real key cannot open or files a contact number under another hash
+func piiKeyFingerprint(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(piiKeyFingerprintLabel))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// requireSealingKey returns the key passed in the transaction metadata to seal customer details with,
+// failing if there is none. The first key used to seal anything has its fingerprint recorded, and getPIIKey
+// refuses any other key from then on.
+func requireSealingKey(stub ledger.Stub) ([]byte, error) {
+	key, err := requirePIIKey(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err := getConfig(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.PIIKeyFingerprint == "" {
+		config.PIIKeyFingerprint = piiKeyFingerprint(key)
+		err = putConfig(config, stub)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return key, nil
+}
+
+// requirePIIKey returns the key passed in the transaction metadata, failing if there is none
+func requirePIIKey(stub ledger.Stub) ([]byte, error) {
+	key, err := getPIIKey(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	if key == nil {
+		return nil, newError(ErrCodeInvalidArgument, "A piiKey is required in the transaction metadata to read or write customer details")
+	}
+
+	return key, nil
+}
+
+// newPIICipher returns the AES-GCM cipher for the key
+func newPIICipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// isSealed reports whether a stored value is an encrypted envelope, in either format
+func isSealed(value string) bool {
+	return strings.HasPrefix(value, piiEnvelopePrefix) || strings.HasPrefix(value, legacyEnvelopePrefix)
+}
+
+// envelopeCiphertext returns the base64 nonce and ciphertext of an envelope
+func envelopeCiphertext(value string) string {
+	if strings.HasPrefix(value, legacyEnvelopePrefix) {
+		envelope := strings.TrimPrefix(value, legacyEnvelopePrefix)
+		return envelope[strings.LastIndex(envelope, ":")+1:]
+	}
+
+	return strings.TrimPrefix(value, piiEnvelopePrefix)
+}
+
+// maskPII returns the part of a personal detail that may be shown to anyone, the last four digits of a
+// contact number or the initials of a name
+func maskPII(field string, value string) string {
+	if field == contactNumberField {
+		digits := strings.TrimPrefix(phoneNumberSeparator.Replace(value), "+")
+		if len(digits) <= 4 {
+			return "****"
+		}
+		return "****" + digits[len(digits)-4:]
+	}
+
+	var initials []string
+	for _, word := range strings.Fields(value) {
+		initials = append(initials, string([]rune(word)[0])+".")
+	}
+
+	return strings.Join(initials, " ")
+}
+
+// maskedValue returns the mask of a stored personal detail. An envelope is decrypted to mask it, so
+// without the key, or with the wrong one, the detail is redacted instead. Legacy envelopes carry their mask.
+func maskedValue(referralId string, field string, value string, key []byte) string {
+	if !isSealed(value) {
+		return maskPII(field, value)
+	}
+
+	if strings.HasPrefix(value, legacyEnvelopePrefix) {
+		envelope := strings.TrimPrefix(value, legacyEnvelopePrefix)
+		return envelope[:strings.LastIndex(envelope, ":")]
+	}
+
+	if key == nil {
+		return redactedPII
+	}
+
+	plaintext, err := openPII(referralId, field, value, key)
+	if err != nil {
+		return redactedPII
+	}
+
+	return maskPII(field, plaintext)
+}
+
+// sealPII encrypts a personal detail of a referral. Every peer has to write the same ciphertext, so
+// the nonce is derived from the key and the transaction rather than drawn at random. It is unique as
+// long as a transaction seals each field of a referral once. The referral id and field are
+// authenticated with the value so an envelope cannot be copied onto another referral or field.
+func sealPII(referralId string, field string, value string, key []byte, stub ledger.Stub) (string, error) {
+	aead, err := newPIICipher(key)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(stub.GetTxID() + compositeKeySeparator + referralId + compositeKeySeparator + field))
+	nonce := mac.Sum(nil)[:aead.NonceSize()]
+
+	sealed := aead.Seal(nonce, nonce, []byte(value), []byte(referralId+compositeKeySeparator+field))
+	return piiEnvelopePrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// openPII decrypts a personal detail of a referral. Values stored before encryption are returned as they are.
+func openPII(referralId string, field string, value string, key []byte) (string, error) {
+	if !isSealed(value) {
+		return value, nil
+	}
+
+	failed := newError(ErrCodeInvalidArgument, "Failed to decrypt "+field+" of referral "+referralId+", check the piiKey")
+
+	sealed, err := base64.StdEncoding.DecodeString(envelopeCiphertext(value))
+	if err != nil {
+		return "", failed
+	}
+
+	aead, err := newPIICipher(key)
+	if err != nil {
+		return "", err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return "", failed
+	}
+
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(referralId+compositeKeySeparator+field))
+	if err != nil {
+		return "", failed
+	}
+
+	return string(plaintext), nil
+}
+
+// sealReferralPII encrypts the personal details of a referral that are not encrypted yet
+func sealReferralPII(referral *CustomerReferral, stub ledger.Stub) error {
+	if isSealed(referral.CustomerName) && isSealed(referral.ContactNumber) {
+		return nil
+	}
+
+	key, err := requireSealingKey(stub)
+	if err != nil {
+		return err
+	}
+
+	if !isSealed(referral.CustomerName) {
+		referral.CustomerName, err = sealPII(referral.ReferralId, customerNameField, referral.CustomerName, key, stub)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !isSealed(referral.ContactNumber) {
+		referral.ContactNumber, err = sealPII(referral.ReferralId, contactNumberField, referral.ContactNumber, key, stub)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// openReferralPII decrypts the personal details of a referral in place. The key is only needed if
+// something is encrypted.
+func openReferralPII(referral *CustomerReferral, stub ledger.Stub) error {
+	if !isSealed(referral.CustomerName) && !isSealed(referral.ContactNumber) {
+		return nil
+	}
+
+	key, err := requirePIIKey(stub)
+	if err != nil {
+		return err
+	}
+
+	referral.CustomerName, err = openPII(referral.ReferralId, customerNameField, referral.CustomerName, key)
+	if err != nil {
+		return err
+	}
+
+	referral.ContactNumber, err = openPII(referral.ReferralId, contactNumberField, referral.ContactNumber, key)
+	return err
+}
+
+// maskReferralPII replaces the personal details of a referral with their masks, using the key to decrypt
+// them if the transaction carries one
+func maskReferralPII(referral *CustomerReferral, key []byte) {
+	referral.CustomerName = maskedValue(referral.ReferralId, customerNameField, referral.CustomerName, key)
+	referral.ContactNumber = maskedValue(referral.ReferralId, contactNumberField, referral.ContactNumber, key)
+	referral.ContactHash = ""
+}
+
+// openAuditValue decrypts a personal detail recorded in an audit entry, leaving anything else as it is
+func openAuditValue(referralId string, field string, value json.RawMessage, stub ledger.Stub) (json.RawMessage, error) {
+	var sealed string
+	if json.Unmarshal(value, &sealed) != nil || !isSealed(sealed) {
+		return value, nil
+	}
+
+	key, err := requirePIIKey(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := openPII(referralId, field, sealed, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(plaintext)
+}
+
+// sealLegacyPII - invoke function encrypting the personal details of referrals stored before they were
+// encrypted, and moving details sealed in the legacy envelope to the current one so their masks are no
+// longer stored in plaintext. Expects the ids of the referrals and a piiKey in the transaction metadata.
+// Returns the ids of the referrals that were sealed. The ledger's history still holds the values as they
+// were stored before.
+func (t *ReferralChaincode) sealLegacyPII(stub ledger.Stub, args []string) ([]byte, error) {
+	if len(args) < 1 || len(args) > maxRebuildBatchSize {
+		return nil, newError(ErrCodeInvalidArgument, "Incorrect number of arguments. Expecting between 1 and "+strconv.Itoa(maxRebuildBatchSize)+" referral ids to seal")
+	}
+
+	key, err := requireSealingKey(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := []string{}
+	for _, referralId := range args {
+		referral, err := getReferral(referralId, stub)
+		if err != nil {
+			return nil, err
+		}
+
+		fields := []struct {
+			name  string
+			value *string
+		}{
+			{customerNameField, &referral.CustomerName},
+			{contactNumberField, &referral.ContactNumber},
+		}
+
+		changed := false
+		for _, field := range fields {
+			if strings.HasPrefix(*field.value, piiEnvelopePrefix) {
+				continue
+			}
+
+			plaintext, err := openPII(referralId, field.name, *field.value, key)
+			if err != nil {
+				return nil, err
+			}
+
+			*field.value, err = sealPII(referralId, field.name, plaintext, key, stub)
+			if err != nil {
+				return nil, err
+			}
+			changed = true
+		}
+
+		if !changed {
+			continue
+		}
+
+		valAsbytes, err := json.Marshal(referral)
+		if err != nil {
+			return nil, err
+		}
+
+		err = putReferralBytes(referralId, valAsbytes, stub)
+		if err != nil {
+			return nil, err
+		}
+		sealed = append(sealed, referralId)
+	}
+
+	return json.Marshal(sealed)
+}
@@ -0,0 +1,236 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/joerust/mortgage-referrals/chaincode"
+	"github.com/joerust/mortgage-referrals/ledger"
+)
+
+// queryTokenIndex ties queryReferrals continuation tokens to the filter they were issued for
+const queryTokenIndex = "query"
+
+// Bounds on the index entries a single queryReferrals call reads. Each indexed criterion's index is counted
+// up to selectivityProbe entries to choose the one driving the search, and at most maxQueryScan entries of
+// that index are then read looking for matches.
+const (
+	selectivityProbe = maxPageSize
+	maxQueryScan     = 10 * maxPageSize
+)
+
+// ReferralFilter selects referrals matching every criterion that is set
+type ReferralFilter struct {
+	Status      string `json:"status"`
+	Department  string `json:"department"`
+	EmployeeId  string `json:"employeeId"`
+	CustomerId  string `json:"customerId"`
+	CreatedFrom *int64 `json:"createdFrom"`
+	CreatedTo   *int64 `json:"createdTo"`
+}
+
+// indexCriterion is a filter criterion that can be answered from an index
+type indexCriterion struct {
+	indexName string
+	value     string
+}
+
+// indexedCriteria returns the filter criteria that have an index behind them, narrowest kind of index first
+func (f ReferralFilter) indexedCriteria() []indexCriterion {
+	var criteria []indexCriterion
+
+	if f.CustomerId != "" {
+		criteria = append(criteria, indexCriterion{customerIndex, f.CustomerId})
+	}
+	if f.EmployeeId != "" {
+		criteria = append(criteria, indexCriterion{employeeIndex, f.EmployeeId})
+	}
+	if f.Department != "" {
+		criteria = append(criteria, indexCriterion{departmentIndex, f.Department})
+	}
+	if f.Status != "" {
+		criteria = append(criteria, indexCriterion{statusIndex, f.Status})
+	}
+
+	return criteria
+}
+
+// matches checks the criteria that are not answered by an index against the stored referral
+func (f ReferralFilter) matches(referral CustomerReferral) bool {
+	if f.CreatedFrom != nil && referral.CreateDate < *f.CreatedFrom {
+		return false
+	}
+	if f.CreatedTo != nil && referral.CreateDate > *f.CreatedTo {
+		return false
+	}
+
+	return true
+}
+
+// hasIndexEntry reports whether referralId is indexed under value in the named index
+func hasIndexEntry(indexName string, value string, referralId string, stub ledger.Stub) (bool, error) {
+	key, err := createCompositeKey(indexName, value, referralId)
+	if err != nil {
+		return false, err
+	}
+
+	valAsbytes, err := stub.GetState(key)
+	if err != nil {
+		return false, newError(ErrCodeLedger, "Failed to read "+indexName+" index for "+value)
+	}
+
+	return valAsbytes != nil, nil
+}
+
+// selectDriver returns the criterion whose index has the fewest entries under its value. Each index is only
+// counted up to selectivityProbe entries, an index with more counting as larger than any that could be
+// counted, and ties go to the narrower kind of index.
+func selectDriver(criteria []indexCriterion, stub ledger.Stub) (int, error) {
+	selected := -1
+	fewest := 0
+	for i := range criteria {
+		_, bookmark, count, err := getIndexPage(criteria[i].indexName, criteria[i].value, "", selectivityProbe, stub)
+		if err != nil {
+			return 0, err
+		}
+		if bookmark != "" {
+			count++
+		}
+
+		if selected == -1 || count < fewest {
+			selected = i
+			fewest = count
+		}
+	}
+
+	return selected, nil
+}
+
+// queryReferrals - query function returning a page of the referrals matching a JSON filter. Expects the
+// filter, an optional page size and an optional continuation token. The filter must set at least one
+// indexed criterion. The smallest matching index drives the search and the others are checked against each
+// entry. A call reads at most maxQueryScan entries of the driving index, so a page can hold fewer
+// results than the page size, or none, and still have a continuation token. Counting the matches would mean
+// checking every entry, so the total count is an estimate, the number of entries of the driving index when
+// the search started, which is at least the number of matches.
+func (t *ReferralChaincode) queryReferrals(stub ledger.Stub, caller Caller, args []string) ([]byte, error) {
+
+	if len(args) < 1 {
+		return nil, newError(ErrCodeInvalidArgument, "Incorrect number of arguments. Expecting the filter JSON, an optional page size and an optional continuation token")
+	}
+
+	var filter ReferralFilter
+	err := chaincode.DecodeStrict(args[0], &filter)
+	if err != nil {
+		return nil, err
+	}
+
+	if filter.CreatedFrom != nil && filter.CreatedTo != nil && *filter.CreatedFrom > *filter.CreatedTo {
+		return nil, newError(ErrCodeInvalidArgument, "createdFrom must not be after createdTo")
+	}
+
+	criteria := filter.indexedCriteria()
+	if len(criteria) == 0 {
+		return nil, newError(ErrCodeInvalidArgument, "The filter must set at least one of status, department, employeeId or customerId")
+	}
+
+	// Token arguments are checked against a fingerprint of the filter rather than the filter itself
+	pageArgs := append([]string{hashRequest(args[0])}, args[1:]...)
+	_, pageSize, token, err := parsePageArgs(queryTokenIndex, pageArgs)
+	if err != nil {
+		return nil, err
+	}
+
+	// A continuing search keeps to the index it started from
+	driver := -1
+	if token.Driver == "" {
+		driver, err = selectDriver(criteria, stub)
+		if err != nil {
+			return nil, err
+		}
+		token.Driver = criteria[driver].indexName
+
+		token.Total, err = countIndexEntries(criteria[driver].indexName, criteria[driver].value, stub)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		for i := range criteria {
+			if criteria[i].indexName == token.Driver {
+				driver = i
+			}
+		}
+		if driver == -1 {
+			return nil, invalidPageToken()
+		}
+	}
+
+	var matched []string
+	bookmark := token.Bookmark
+	scanned := 0
+	for {
+		referralIds, next, read, err := getIndexPage(criteria[driver].indexName, criteria[driver].value, bookmark, min(pageSize-len(matched), maxQueryScan-scanned), stub)
+		if err != nil {
+			return nil, err
+		}
+		bookmark = next
+		scanned += read
+
+		for _, referralId := range referralIds {
+			match, err := filter.matchesReferral(referralId, criteria, driver, stub)
+			if err != nil {
+				return nil, err
+			}
+			if match {
+				matched = append(matched, referralId)
+			}
+		}
+
+		if bookmark == "" || len(matched) == pageSize || scanned >= maxQueryScan {
+			break
+		}
+	}
+
+	page := SearchPage{}
+	page.Results, err = t.processIndexedReferrals(matched, caller, stub)
+	if err != nil {
+		return nil, err
+	}
+	page.nextPage(token, bookmark)
+
+	return json.Marshal(page)
+}
+
+// matchesReferral reports whether the referral found in the driving index is indexed under every other
+// criterion and matches the rest of the filter
+func (f ReferralFilter) matchesReferral(referralId string, criteria []indexCriterion, driver int, stub ledger.Stub) (bool, error) {
+	for i := range criteria {
+		if i == driver {
+			continue
+		}
+
+		found, err := hasIndexEntry(criteria[i].indexName, criteria[i].value, referralId, stub)
+		if err != nil || !found {
+			return false, err
+		}
+	}
+
+	referral, err := getReferral(referralId, stub)
+	if err != nil {
+		return false, nil
+	}
+
+	return f.matches(referral), nil
+}
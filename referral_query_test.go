@@ -0,0 +1,430 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/joerust/mortgage-referrals/chaincode"
+)
+
+// secondCustomerJSON is a referral of another customer, made by the savings employee
+const secondCustomerJSON = `{"customerName":"John Smith","contactNumber":"+15559876543","customerId":"C2","employeeId":"E2","departments":["SAVINGS"],"status":"NEW"}`
+
+// checkPage decodes a search page and checks the ids of its results and the total count every page carries
+func checkPage(t *testing.T, result []byte, referralIds []string, total int) SearchPage {
+	t.Helper()
+
+	var page SearchPage
+	decodeJSON(t, result, &page)
+
+	var got []string
+	for i := range page.Results {
+		var referral CustomerReferral
+		decodeJSON(t, page.Results[i], &referral)
+		got = append(got, referral.ReferralId)
+	}
+
+	if !sameStrings(got, referralIds) {
+		t.Fatalf("page holds %v, want %v", got, referralIds)
+	}
+
+	if page.TotalCount != total {
+		t.Fatalf("page counts %d results, want %d", page.TotalCount, total)
+	}
+
+	return page
+}
+
+// pageOf returns a check for a search page holding the referral ids
+func pageOf(referralIds []string, total int) func(t *testing.T, h *harness, result []byte) {
+	return func(t *testing.T, h *harness, result []byte) {
+		checkPage(t, result, referralIds, total)
+	}
+}
+
+// seedMore creates referrals REF-0000000002 to REF-0000000004 for the first customer
+func seedMore(h *harness) {
+	for i := 0; i < 3; i++ {
+		h.createReferral(testReferralJSON)
+	}
+}
+
+func TestRead(t *testing.T) {
+	runQueryCases(t, "read", []invokeCase{
+		{
+			name: "decrypts customer details for the referral's departments",
+			args: []string{testReferralId},
+			check: func(t *testing.T, h *harness, result []byte) {
+				var referral CustomerReferral
+				decodeJSON(t, result, &referral)
+				if referral.CustomerName != "Jane Doe" || referral.ContactNumber != "+15551234567" {
+					t.Fatalf("read %+v", referral)
+				}
+			},
+		},
+		{
+			name:   "masks customer details for other departments",
+			caller: savingsEmployee,
+			args:   []string{testReferralId},
+			check: func(t *testing.T, h *harness, result []byte) {
+				var referral CustomerReferral
+				decodeJSON(t, result, &referral)
+				if referral.CustomerName != "J. D." || referral.ContactNumber != "****4567" || referral.ContactHash != "" {
+					t.Fatalf("read %+v", referral)
+				}
+			},
+		},
+		{
+			name:   "masks customer details for callers without the pii attribute",
+			caller: map[string]string{roleAttribute: RoleEmployee, departmentsAttribute: "MORTGAGES"},
+			args:   []string{testReferralId},
+			check: func(t *testing.T, h *harness, result []byte) {
+				var referral CustomerReferral
+				decodeJSON(t, result, &referral)
+				if referral.CustomerName != "J. D." || referral.ContactNumber != "****4567" {
+					t.Fatalf("read %+v", referral)
+				}
+			},
+		},
+		{
+			name:   "masked reads need no key",
+			setup:  func(h *harness) { h.stub.Metadata = nil },
+			caller: mortgageService,
+			args:   []string{testReferralId},
+			check: func(t *testing.T, h *harness, result []byte) {
+				var referral CustomerReferral
+				decodeJSON(t, result, &referral)
+				if referral.CustomerName != redactedPII || referral.ContactNumber != redactedPII {
+					t.Fatalf("read %+v", referral)
+				}
+			},
+		},
+		{
+			name: "legacy envelopes",
+			setup: func(h *harness) {
+				referral := h.stored(testReferralId)
+				referral.CustomerName = legacyEnvelope(referral.CustomerName, "J. D.")
+				referral.ContactNumber = legacyEnvelope(referral.ContactNumber, "****4567")
+				h.store(referral)
+			},
+			args: []string{testReferralId},
+			check: func(t *testing.T, h *harness, result []byte) {
+				var referral CustomerReferral
+				decodeJSON(t, result, &referral)
+				if referral.CustomerName != "Jane Doe" || referral.ContactNumber != "+15551234567" {
+					t.Fatalf("read %+v", referral)
+				}
+
+				h.stub.Metadata = nil
+				result, err := h.as(savingsEmployee).query("read", testReferralId)
+				checkCode(t, err, "")
+				decodeJSON(t, result, &referral)
+				if referral.CustomerName != "J. D." || referral.ContactNumber != "****4567" {
+					t.Fatalf("masked read %+v", referral)
+				}
+			},
+		},
+		{
+			name: "returns referrals stored before encryption as they are",
+			setup: func(h *harness) {
+				h.stub.State[mustReferralKey("LEGACY")] = []byte(`{"referralId":"LEGACY","customerName":"Old Customer","contactNumber":"5550001111","departments":["MORTGAGES"],"status":"NEW"}`)
+				h.stub.Metadata = nil
+			},
+			args: []string{"LEGACY"},
+			check: func(t *testing.T, h *harness, result []byte) {
+				var referral CustomerReferral
+				decodeJSON(t, result, &referral)
+				if referral.CustomerName != "Old Customer" {
+					t.Fatalf("read %+v", referral)
+				}
+			},
+		},
+		{name: "decrypting without a key", setup: func(h *harness) { h.stub.Metadata = nil }, args: []string{testReferralId}, code: ErrCodeInvalidArgument},
+		{name: "unknown referral", args: []string{"REF-0000000099"}, code: ErrCodeNotFound},
+		{name: "keys outside the referral namespace", setup: func(h *harness) { h.stub.State["secret"] = []byte(`{}`) }, args: []string{"secret"}, code: ErrCodeNotFound},
+		{name: "archived referral", setup: func(h *harness) { h.mustInvoke(adminCaller, "archiveReferral", testReferralId) }, args: []string{testReferralId}, code: ErrCodeNotFound},
+		{name: "no role", caller: noRole, args: []string{testReferralId}, code: ErrCodeAccessDenied},
+		{name: "no arguments", code: ErrCodeInvalidArgument},
+	})
+}
+
+func TestSearchByStatus(t *testing.T) {
+	firstPageToken := func(h *harness) string {
+		h.t.Helper()
+
+		result, err := h.query("searchByStatus", StatusNew, "2")
+		if err != nil {
+			h.t.Fatal(err)
+		}
+
+		var page SearchPage
+		decodeJSON(h.t, result, &page)
+		return page.NextToken
+	}
+
+	runQueryCases(t, "searchByStatus", []invokeCase{
+		{name: "matches", args: []string{StatusNew}, check: pageOf([]string{testReferralId}, 1)},
+		{name: "no matches", args: []string{StatusFunded}, check: pageOf(nil, 0)},
+		{
+			name:  "first page",
+			setup: seedMore,
+			args:  []string{StatusNew, "2"},
+			check: func(t *testing.T, h *harness, result []byte) {
+				if page := checkPage(t, result, []string{testReferralId, "REF-0000000002"}, 4); page.NextToken == "" {
+					t.Fatal("first page has no continuation token")
+				}
+			},
+		},
+		{
+			name:  "last page",
+			setup: seedMore,
+			check: func(t *testing.T, h *harness, result []byte) {
+				result, err := h.query("searchByStatus", StatusNew, "2", firstPageToken(h))
+				checkCode(t, err, "")
+
+				if page := checkPage(t, result, []string{"REF-0000000003", "REF-0000000004"}, 4); page.NextToken != "" {
+					t.Fatalf("last page has continuation token %s", page.NextToken)
+				}
+			},
+			args: []string{StatusNew},
+		},
+		{
+			name:  "token from another search",
+			setup: seedMore,
+			check: func(t *testing.T, h *harness, result []byte) {
+				_, err := h.query("searchByStatus", StatusContacted, "2", firstPageToken(h))
+				checkCode(t, err, ErrCodeInvalidArgument)
+
+				_, err = h.query("searchByDepartment", StatusNew, "2", firstPageToken(h))
+				checkCode(t, err, ErrCodeInvalidArgument)
+			},
+			args: []string{StatusNew},
+		},
+		{name: "malformed token", args: []string{StatusNew, "2", "not-a-token"}, code: ErrCodeInvalidArgument},
+		{
+			name:  "opaque bookmark is passed to the peer",
+			args:  []string{StatusNew, "2", encodePageToken(pageToken{Index: statusIndex, Value: StatusNew, Bookmark: "g1AAAAB4eJzLYWBgYMpgSmHgKy5JLCrJTq2MT8lPzkzJBYqzFKQWFeUXpeZlpuYVpQEAHuEN4w", Total: 1})},
+			check: pageOf(nil, 1),
+		},
+		{name: "page size too large", args: []string{StatusNew, "201"}, code: ErrCodeInvalidArgument},
+		{name: "page size not a number", args: []string{StatusNew, "ten"}, code: ErrCodeInvalidArgument},
+		{name: "default page size", args: []string{StatusNew, ""}, check: pageOf([]string{testReferralId}, 1)},
+		{
+			name: "skips index entries of missing referrals",
+			setup: func(h *harness) {
+				key, _ := createCompositeKey(statusIndex, StatusNew, "REF-0000000000")
+				h.stub.State[key] = indexEntryValue
+			},
+			args:  []string{StatusNew},
+			check: pageOf([]string{testReferralId}, 2),
+		},
+		{name: "no arguments", code: ErrCodeInvalidArgument},
+		{name: "too many arguments", args: []string{StatusNew, "2", "", "x"}, code: ErrCodeInvalidArgument},
+	})
+}
+
+func TestSearchByIndex(t *testing.T) {
+	seedSecondCustomer := func(h *harness) { h.createReferral(secondCustomerJSON) }
+
+	for _, function := range []struct {
+		name  string
+		match string
+		other string
+	}{
+		{"searchByDepartment", "MORTGAGES", "SAVINGS"},
+		{"searchByEmployee", "E1", "E2"},
+		{"searchByCustomer", "C1", "C2"},
+	} {
+		t.Run(function.name, func(t *testing.T) {
+			runQueryCases(t, function.name, []invokeCase{
+				{name: "matches", setup: seedSecondCustomer, args: []string{function.match}, check: pageOf([]string{testReferralId}, 1)},
+				{name: "other value", setup: seedSecondCustomer, args: []string{function.other}, check: pageOf([]string{"REF-0000000002"}, 1)},
+				{name: "no matches", args: []string{"UNKNOWN"}, check: pageOf(nil, 0)},
+				{name: "value with a null character", args: []string{"bad\x00value"}, code: ErrCodeInvalidArgument},
+				{name: "no role", caller: noRole, args: []string{function.match}, code: ErrCodeAccessDenied},
+				{name: "no arguments", code: ErrCodeInvalidArgument},
+			})
+		})
+	}
+}
+
+func TestGetStatusTransitions(t *testing.T) {
+	runQueryCases(t, "getStatusTransitions", []invokeCase{
+		{
+			name: "full table",
+			check: func(t *testing.T, h *harness, result []byte) {
+				var table []chaincode.StatusTransition
+				decodeJSON(t, result, &table)
+				if len(table) != len(statusOrder) || table[0].Status != StatusNew {
+					t.Fatalf("table %+v", table)
+				}
+			},
+		},
+		{
+			name: "single status",
+			args: []string{StatusFunded},
+			check: func(t *testing.T, h *harness, result []byte) {
+				var table []chaincode.StatusTransition
+				decodeJSON(t, result, &table)
+				if len(table) != 1 || !table[0].Terminal || len(table[0].Next) != 0 {
+					t.Fatalf("table %+v", table)
+				}
+			},
+		},
+		{name: "unknown status", args: []string{"LOST"}, code: ErrCodeInvalidArgument},
+		{name: "too many arguments", args: []string{StatusNew, StatusFunded}, code: ErrCodeInvalidArgument},
+	})
+}
+
+func TestGetReferralHistory(t *testing.T) {
+	update := func(h *harness) {
+		h.stub.Time += 60
+		h.mustInvoke(mortgagesEmployee, "updateReferral", testReferralId, `{"customerName":"Janet Doe"}`, "1")
+		h.mustInvoke(mortgagesEmployee, "updateReferralStatus", testReferralId, StatusContacted)
+	}
+
+	// nameChange returns the customerName change of an audit entry
+	nameChange := func(t *testing.T, entry AuditEntry) FieldChange {
+		for _, change := range entry.Changes {
+			if change.Field == customerNameField {
+				return change
+			}
+		}
+
+		t.Fatalf("entry %d does not change the customer name", entry.Sequence)
+		return FieldChange{}
+	}
+
+	runQueryCases(t, "getReferralHistory", []invokeCase{
+		{
+			name:  "lists every change, oldest first",
+			setup: update,
+			args:  []string{testReferralId},
+			check: func(t *testing.T, h *harness, result []byte) {
+				var history []AuditEntry
+				decodeJSON(t, result, &history)
+
+				want := []struct{ action, reasonCode string }{
+					{"createReferral", ReasonCreated},
+					{"updateReferral", ReasonReferralUpdated},
+					{"updateReferralStatus", ReasonStatusChanged},
+				}
+				if len(history) != len(want) {
+					t.Fatalf("history has %d entries, want %d", len(history), len(want))
+				}
+
+				for i := range want {
+					if history[i].Sequence != int64(i+1) || history[i].Action != want[i].action || history[i].ReasonCode != want[i].reasonCode {
+						t.Errorf("entry %d is %+v, want %s %s", i, history[i], want[i].action, want[i].reasonCode)
+					}
+				}
+
+				if history[0].ActorRole != RoleAdmin || history[1].EmployeeId != "E1" || history[2].Timestamp != testTime+60 {
+					t.Fatalf("actors and times %+v", history)
+				}
+			},
+		},
+		{
+			name:  "decrypts personal details for the referral's departments",
+			setup: update,
+			args:  []string{testReferralId},
+			check: func(t *testing.T, h *harness, result []byte) {
+				var history []AuditEntry
+				decodeJSON(t, result, &history)
+				if change := nameChange(t, history[1]); string(change.Old) != `"Jane Doe"` || string(change.New) != `"Janet Doe"` {
+					t.Fatalf("name change %s -> %s", change.Old, change.New)
+				}
+			},
+		},
+		{
+			name:   "hides personal details from other departments",
+			setup:  update,
+			caller: savingsEmployee,
+			args:   []string{testReferralId},
+			check: func(t *testing.T, h *harness, result []byte) {
+				var history []AuditEntry
+				decodeJSON(t, result, &history)
+				if change := nameChange(t, history[1]); string(change.Old) != "null" || string(change.New) != "null" {
+					t.Fatalf("name change %s -> %s", change.Old, change.New)
+				}
+			},
+		},
+		{name: "unknown referral", args: []string{"REF-0000000099"}, code: ErrCodeNotFound},
+		{name: "no arguments", code: ErrCodeInvalidArgument},
+	})
+}
+
+func TestQueryReferrals(t *testing.T) {
+	seed := func(h *harness) {
+		h.createReferral(secondCustomerJSON)
+		h.stub.Time += 100
+		h.createReferral(testReferralJSON)
+		h.mustInvoke(mortgagesEmployee, "updateReferralStatus", testReferralId, StatusContacted)
+	}
+
+	// The total count of a query is the number of entries of its driving index
+	runQueryCases(t, "queryReferrals", []invokeCase{
+		{name: "single criterion", setup: seed, args: []string{`{"status":"NEW"}`}, check: pageOf([]string{"REF-0000000002", "REF-0000000003"}, 2)},
+		{name: "intersects criteria", setup: seed, args: []string{`{"status":"NEW","department":"MORTGAGES"}`}, check: pageOf([]string{"REF-0000000003"}, 2)},
+		{name: "employee and customer", setup: seed, args: []string{`{"employeeId":"E1","customerId":"C1"}`}, check: pageOf([]string{testReferralId, "REF-0000000003"}, 2)},
+		{name: "created from", setup: seed, args: []string{`{"customerId":"C1","createdFrom":1500000050}`}, check: pageOf([]string{"REF-0000000003"}, 2)},
+		{name: "created to", setup: seed, args: []string{`{"customerId":"C1","createdTo":1500000050}`}, check: pageOf([]string{testReferralId}, 2)},
+		{name: "no matches", setup: seed, args: []string{`{"status":"FUNDED"}`}, check: pageOf(nil, 0)},
+		{
+			name:  "pages",
+			setup: seed,
+			args:  []string{`{"employeeId":"E1"}`, "1"},
+			check: func(t *testing.T, h *harness, result []byte) {
+				page := checkPage(t, result, []string{testReferralId}, 2)
+
+				result, err := h.query("queryReferrals", `{"employeeId":"E1"}`, "1", page.NextToken)
+				checkCode(t, err, "")
+				checkPage(t, result, []string{"REF-0000000003"}, 2)
+
+				_, err = h.query("queryReferrals", `{"employeeId":"E2"}`, "1", page.NextToken)
+				checkCode(t, err, ErrCodeInvalidArgument)
+			},
+		},
+		{
+			name: "stops reading after the scan limit",
+			setup: func(h *harness) {
+				// Two large indexes that share no referral, so every entry read is a miss
+				for i := 0; i < maxQueryScan+1; i++ {
+					key, _ := createCompositeKey(statusIndex, StatusFunded, fmt.Sprintf("REF-1%09d", i))
+					h.stub.State[key] = indexEntryValue
+					key, _ = createCompositeKey(employeeIndex, "E9", fmt.Sprintf("REF-2%09d", i))
+					h.stub.State[key] = indexEntryValue
+				}
+			},
+			args: []string{`{"status":"FUNDED","employeeId":"E9"}`},
+			check: func(t *testing.T, h *harness, result []byte) {
+				page := checkPage(t, result, nil, maxQueryScan+1)
+				if page.NextToken == "" {
+					t.Fatal("partial page has no continuation token")
+				}
+
+				result, err := h.query("queryReferrals", `{"status":"FUNDED","employeeId":"E9"}`, "", page.NextToken)
+				checkCode(t, err, "")
+				checkPage(t, result, nil, maxQueryScan+1)
+			},
+		},
+		{name: "no indexed criterion", args: []string{`{"createdFrom":0}`}, code: ErrCodeInvalidArgument},
+		{name: "empty range", args: []string{`{"status":"NEW","createdFrom":10,"createdTo":5}`}, code: ErrCodeInvalidArgument},
+		{name: "unknown criterion", args: []string{`{"customerName":"Jane Doe"}`}, code: ErrCodeInvalidArgument},
+		{name: "trailing data", args: []string{`{"status":"NEW"} {}`}, code: ErrCodeInvalidArgument},
+		{name: "no arguments", code: ErrCodeInvalidArgument},
+	})
+}
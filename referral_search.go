@@ -0,0 +1,219 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/joerust/mortgage-referrals/ledger"
+)
+
+// Page sizes for the search queries
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// SearchPage is a single page of search results. Every page reports the total count taken when the search
+// started, the number of referrals indexed under the value searched for. Index entries of referrals that
+// no longer exist are counted but left out of the results.
+type SearchPage struct {
+	Results    []json.RawMessage `json:"results"`
+	NextToken  string            `json:"nextToken"`
+	TotalCount int               `json:"totalCount"`
+}
+
+// pageToken is the continuation state behind the opaque token handed to clients. It is tied to the
+// index and value it was issued for so it cannot be replayed against a different search.
+type pageToken struct {
+	Index string `json:"i"`
+	Value string `json:"v"`
+	// After is the referral id a batch resumes after
+	After string `json:"a,omitempty"`
+	// Bookmark is the peer's bookmark for the next page of an index scan, Driver the index scanned
+	Bookmark string `json:"b,omitempty"`
+	Driver   string `json:"d,omitempty"`
+	// Total is the total count taken on the first page
+	Total int `json:"t,omitempty"`
+}
+
+// encodePageToken returns the opaque token for the continuation state
+func encodePageToken(token pageToken) string {
+	valAsbytes, _ := json.Marshal(token)
+	return base64.RawURLEncoding.EncodeToString(valAsbytes)
+}
+
+// decodePageToken returns the continuation state behind a token, checking it was issued for this search
+func decodePageToken(token string, indexName string, value string) (pageToken, error) {
+	var decoded pageToken
+
+	valAsbytes, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return decoded, invalidPageToken()
+	}
+
+	err = json.Unmarshal(valAsbytes, &decoded)
+	if err != nil || decoded.Index != indexName || decoded.Value != value || decoded.Total < 0 {
+		return decoded, invalidPageToken()
+	}
+
+	return decoded, nil
+}
+
+// invalidPageToken is the error for a continuation token that cannot resume the search
+func invalidPageToken() error {
+	return newError(ErrCodeInvalidArgument, "Invalid continuation token")
+}
+
+// parsePageArgs reads the search value, optional page size and optional continuation token. A search
+// without a token starts from a zero continuation state.
+func parsePageArgs(indexName string, args []string) (string, int, pageToken, error) {
+	if len(args) < 1 || len(args) > 3 {
+		return "", 0, pageToken{}, newError(ErrCodeInvalidArgument, "Incorrect number of arguments. Expecting the "+indexName+" to search for, an optional page size and an optional continuation token")
+	}
+
+	value := args[0]
+	pageSize := defaultPageSize
+	token := pageToken{Index: indexName, Value: value}
+
+	if len(args) > 1 && args[1] != "" {
+		size, err := strconv.Atoi(args[1])
+		if err != nil || size < 1 || size > maxPageSize {
+			return "", 0, pageToken{}, newError(ErrCodeInvalidArgument, "Page size must be between 1 and "+strconv.Itoa(maxPageSize))
+		}
+		pageSize = size
+	}
+
+	if len(args) > 2 && args[2] != "" {
+		var err error
+		token, err = decodePageToken(args[2], indexName, value)
+		if err != nil {
+			return "", 0, pageToken{}, err
+		}
+	}
+
+	return value, pageSize, token, nil
+}
+
+// getIndexPage reads up to pageSize entries of the index under value with the peer's paged range query,
+// starting at the bookmark of the previous page if one is given. It returns the referral ids read, the
+// bookmark of the next page, empty once the index is exhausted, and the number of entries read.
+func getIndexPage(indexName string, value string, bookmark string, pageSize int, stub ledger.Stub) ([]string, string, int, error) {
+	prefix, err := createCompositeKey(indexName, value)
+	if err != nil {
+		return nil, "", 0, err
+	}
+
+	keysIter, next, err := stub.RangeQueryStatePage(prefix, prefix+maxUnicodeRune, int32(pageSize), bookmark)
+	if err != nil {
+		return nil, "", 0, newError(ErrCodeLedger, "Failed to scan "+indexName+" index for "+value)
+	}
+	defer keysIter.Close()
+
+	var referralIds []string
+	read := 0
+	for keysIter.HasNext() {
+		key, _, err := keysIter.Next()
+		if err != nil {
+			return nil, "", 0, err
+		}
+		read++
+
+		// The bookmark is opaque and comes back from the client, keys outside the index are never results
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		_, attributes, err := splitCompositeKey(key)
+		if err != nil || len(attributes) != 2 {
+			fmt.Println("Skipping malformed index key " + key)
+			continue
+		}
+
+		referralIds = append(referralIds, attributes[1])
+	}
+
+	return referralIds, next, read, nil
+}
+
+// countIndexEntries returns the number of entries of the index under value
+func countIndexEntries(indexName string, value string, stub ledger.Stub) (int, error) {
+	prefix, err := createCompositeKey(indexName, value)
+	if err != nil {
+		return 0, err
+	}
+
+	keysIter, err := stub.RangeQueryState(prefix, prefix+maxUnicodeRune)
+	if err != nil {
+		return 0, newError(ErrCodeLedger, "Failed to count "+indexName+" index for "+value)
+	}
+	defer keysIter.Close()
+
+	count := 0
+	for keysIter.HasNext() {
+		_, _, err := keysIter.Next()
+		if err != nil {
+			return 0, err
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+// nextPage fills in the total count of a page, and its continuation token unless it is the last one
+func (page *SearchPage) nextPage(token pageToken, bookmark string) {
+	page.TotalCount = token.Total
+	if bookmark == "" {
+		return
+	}
+
+	token.Bookmark = bookmark
+	page.NextToken = encodePageToken(token)
+}
+
+// searchIndex - query function returning a page of the referrals indexed under a single value
+func (t *ReferralChaincode) searchIndex(indexName string, caller Caller, args []string, stub ledger.Stub) ([]byte, error) {
+	_, pageSize, token, err := parsePageArgs(indexName, args)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the first page has no bookmark, the pages after it carry the count taken then
+	if token.Bookmark == "" {
+		token.Total, err = countIndexEntries(indexName, token.Value, stub)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	referralIds, bookmark, _, err := getIndexPage(indexName, token.Value, token.Bookmark, pageSize, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := t.processIndexedReferrals(referralIds, caller, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	page := SearchPage{Results: results}
+	page.nextPage(token, bookmark)
+
+	return json.Marshal(page)
+}
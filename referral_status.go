@@ -0,0 +1,123 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/joerust/mortgage-referrals/chaincode"
+)
+
+// Referral lifecycle statuses
+const (
+	StatusNew          = "NEW"
+	StatusContacted    = "CONTACTED"
+	StatusApplication  = "APPLICATION"
+	StatusUnderwriting = "UNDERWRITING"
+	StatusApproved     = "APPROVED"
+	StatusDeclined     = "DECLINED"
+	StatusFunded       = "FUNDED"
+	StatusWithdrawn    = "WITHDRAWN"
+)
+
+// initialStatus is the status every referral is created in
+const initialStatus = StatusNew
+
+// statusOrder lists the lifecycle statuses in the order a referral normally moves through them
+var statusOrder = []string{
+	StatusNew,
+	StatusContacted,
+	StatusApplication,
+	StatusUnderwriting,
+	StatusApproved,
+	StatusDeclined,
+	StatusFunded,
+	StatusWithdrawn,
+}
+
+// statusTransitions maps each status to the statuses a referral may move to next.
+// Statuses with no entries are terminal.
+var statusTransitions = map[string][]string{
+	StatusNew:          {StatusContacted, StatusWithdrawn},
+	StatusContacted:    {StatusApplication, StatusWithdrawn},
+	StatusApplication:  {StatusUnderwriting, StatusWithdrawn},
+	StatusUnderwriting: {StatusApproved, StatusDeclined, StatusWithdrawn},
+	StatusApproved:     {StatusFunded, StatusWithdrawn},
+	StatusDeclined:     {},
+	StatusFunded:       {},
+	StatusWithdrawn:    {},
+}
+
+// statusLifecycle checks referral status changes against statusTransitions
+var statusLifecycle = chaincode.Lifecycle{IdField: "referralId", Order: statusOrder, Transitions: statusTransitions}
+
+// getStatusTransitions - query function returning the allowed transition table, or the entry for a single status
+func (t *ReferralChaincode) getStatusTransitions(args []string) ([]byte, error) {
+	if len(args) > 1 {
+		return nil, newError(ErrCodeInvalidArgument, "Incorrect number of arguments. Expecting at most 1, the status to look up")
+	}
+
+	table := statusLifecycle.Table()
+	if len(args) == 1 {
+		entry, ok := statusLifecycle.Entry(args[0])
+		if !ok {
+			return nil, newError(ErrCodeInvalidArgument, "Unknown status "+args[0])
+		}
+		table = []chaincode.StatusTransition{entry}
+	}
+
+	return json.Marshal(table)
+}
+
+// enterStatus records when the referral entered a status, so the time spent in each stage can be measured
+func enterStatus(referral *CustomerReferral, status string, enteredAt int64) {
+	if referral.StatusEnteredAt == nil {
+		referral.StatusEnteredAt = make(map[string]int64)
+	}
+
+	referral.StatusEnteredAt[status] = enteredAt
+}
+
+// statusPath returns the shortest sequence of statuses leading from one status to another, excluding from
+// itself, or nil if the lifecycle offers no way there
+func statusPath(from string, to string) []string {
+	if from == to {
+		return []string{}
+	}
+
+	previous := map[string]string{from: ""}
+	queue := []string{from}
+	for len(queue) > 0 {
+		status := queue[0]
+		queue = queue[1:]
+
+		for _, next := range statusTransitions[status] {
+			if _, seen := previous[next]; seen {
+				continue
+			}
+			previous[next] = status
+
+			if next == to {
+				var path []string
+				for step := to; step != from; step = previous[step] {
+					path = append([]string{step}, path...)
+				}
+				return path
+			}
+			queue = append(queue, next)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,188 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/joerust/mortgage-referrals/chaincode"
+	"github.com/joerust/mortgage-referrals/events"
+	"github.com/joerust/mortgage-referrals/ledger"
+)
+
+// ReferralPatch lists the referral fields updateReferral may change. A field left out of the patch keeps
+// its stored value, and any field not listed here is rejected. The mortgage can only be patched until the
+// mortgage chaincode links an application to the referral.
+type ReferralPatch struct {
+	CustomerName  *string   `json:"customerName"`
+	ContactNumber *string   `json:"contactNumber"`
+	Mortgage      *Mortgage `json:"mortgage"`
+}
+
+// VersionError is returned when a write is based on a version of the referral that is no longer current
+type VersionError struct {
+	ReferralId string `json:"referralId"`
+	Expected   int64  `json:"expectedVersion"`
+	Current    int64  `json:"currentVersion"`
+}
+
+func (e *VersionError) Error() string {
+	return e.Envelope().Error()
+}
+
+func (e *VersionError) Envelope() *ChaincodeError {
+	return newErrorDetails(ErrCodeVersionConflict, "Referral has changed since it was read", e)
+}
+
+// updateReferral - invoke function applying a JSON patch to a referral. Expects the referral id, the patch,
+// the version of the referral the caller last read and an optional reason code. The write is rejected if
+// the referral has been changed since that version.
+func (t *ReferralChaincode) updateReferral(stub ledger.Stub, caller Caller, args []string) ([]byte, error) {
+
+	if len(args) != 3 && len(args) != 4 {
+		return nil, newError(ErrCodeInvalidArgument, "Incorrect number of arguments. Expecting the referral id, the patch JSON, the expected version and an optional reason code")
+	}
+
+	key := args[0]
+
+	expectedVersion, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || expectedVersion < 0 {
+		return nil, newError(ErrCodeInvalidArgument, "Expected version "+args[2]+" must be a non-negative integer")
+	}
+
+	reasonCode := ""
+	if len(args) == 4 {
+		reasonCode = args[3]
+	}
+
+	reasonCode, err = checkReasonCode(reasonCode, ReasonReferralUpdated)
+	if err != nil {
+		return nil, err
+	}
+
+	var patch ReferralPatch
+	err = chaincode.DecodeStrict(args[1], &patch)
+	if err != nil {
+		return nil, err
+	}
+
+	if patch.CustomerName == nil && patch.ContactNumber == nil && patch.Mortgage == nil {
+		return nil, newError(ErrCodeInvalidArgument, "The patch must set at least one of customerName, contactNumber or mortgage")
+	}
+
+	referral, err := getReferral(key, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = caller.authorizeChange("updateReferral", referral)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkNotArchived(key, referral)
+	if err != nil {
+		return nil, err
+	}
+
+	if referral.Version != expectedVersion {
+		return nil, &VersionError{ReferralId: key, Expected: expectedVersion, Current: referral.Version}
+	}
+
+	oldAsbytes, err := json.Marshal(referral)
+	if err != nil {
+		return nil, err
+	}
+
+	// Referrals from before the contact hash are still indexed under the legacy value
+	previousContact, err := storedContactIndexValue(referral, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	if patch.CustomerName != nil {
+		referral.CustomerName = *patch.CustomerName
+	}
+
+	if patch.ContactNumber != nil {
+		referral.ContactNumber = *patch.ContactNumber
+	}
+
+	if patch.Mortgage != nil {
+		// Once linked, the mortgage chaincode owns the mortgage, its rate and amount included
+		linked := referral.Mortgage.MortgageNumber
+		if linked != "" {
+			return nil, newError(ErrCodeFailedPrecondition, "Referral "+key+" is linked to mortgage "+linked+", its mortgage is changed by the mortgage chaincode")
+		}
+		referral.Mortgage = *patch.Mortgage
+	}
+
+	updated := referral
+	err = openReferralPII(&updated, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = validateReferral(updated)
+	if err != nil {
+		return nil, err
+	}
+
+	err = setContactHash(&updated, stub)
+	if err != nil {
+		return nil, err
+	}
+	referral.ContactHash = updated.ContactHash
+
+	// Only the patched details are encrypted again, the others keep their stored envelopes
+	err = sealReferralPII(&referral, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = touchReferral(&referral, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	valAsbytes, err := json.Marshal(referral)
+	if err != nil {
+		return nil, err
+	}
+
+	err = putReferralBytes(key, valAsbytes, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = appendAuditEntry(key, oldAsbytes, valAsbytes, "updateReferral", reasonCode, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	err = emitReferralEvent(events.ReferralUpdated, referral.Status, referral, stub)
+	if err != nil {
+		return nil, err
+	}
+
+	if previousContact != referral.ContactHash {
+		err = t.moveContactIndex(key, previousContact, referral.ContactHash, stub)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return valAsbytes, nil
+}
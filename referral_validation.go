@@ -0,0 +1,143 @@
+/*
+Copyright IBM Corp 2016 All Rights Reserved.
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+		 http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/joerust/mortgage-referrals/chaincode"
+)
+
+// Violation codes reported by referral validation
+const (
+	ViolationRequired      = "REQUIRED"
+	ViolationFormat        = "INVALID_FORMAT"
+	ViolationUnknown       = "UNKNOWN_VALUE"
+	ViolationMismatch      = "MISMATCH"
+	ViolationMalformed     = "MALFORMED_JSON"
+	ViolationReadOnly      = "READ_ONLY"
+	ViolationInitialStatus = "NOT_INITIAL_STATUS"
+)
+
+var (
+	referralIdPattern    = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+	phoneNumberPattern   = regexp.MustCompile(`^\+?[0-9]{7,15}$`)
+	phoneNumberSeparator = strings.NewReplacer(" ", "", "-", "", ".", "", "(", "", ")", "")
+)
+
+// Violation describes a single problem found with a referral
+type Violation struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ValidationError is returned when a referral fails validation and lists every violation found
+type ValidationError struct {
+	Violations []Violation `json:"violations"`
+}
+
+func (e *ValidationError) Error() string {
+	return e.Envelope().Error()
+}
+
+func (e *ValidationError) Envelope() *ChaincodeError {
+	return newErrorDetails(ErrCodeValidation, "Invalid referral", e)
+}
+
+func (e *ValidationError) add(field string, code string, message string) {
+	e.Violations = append(e.Violations, Violation{Field: field, Code: code, Message: message})
+}
+
+// decodeReferral strictly parses a referral, rejecting unknown fields and trailing data
+func decodeReferral(valAsbytes []byte) (CustomerReferral, error) {
+	var referral CustomerReferral
+
+	err := chaincode.UnmarshalStrict(valAsbytes, &referral)
+	if err != nil {
+		validationErr := &ValidationError{}
+		validationErr.add("", ViolationMalformed, err.Error())
+		return referral, validationErr
+	}
+
+	return referral, nil
+}
+
+// validateReferral checks a referral against the schema rules, returning a ValidationError listing every violation
+func validateReferral(referral CustomerReferral) error {
+	validationErr := &ValidationError{}
+
+	if referral.ReferralId == "" {
+		validationErr.add("referralId", ViolationRequired, "referralId is required")
+	} else if !referralIdPattern.MatchString(referral.ReferralId) {
+		validationErr.add("referralId", ViolationFormat, "referralId must be 1-64 letters, digits, '.', '_' or '-'")
+	}
+
+	if strings.TrimSpace(referral.CustomerName) == "" {
+		validationErr.add("customerName", ViolationRequired, "customerName is required")
+	}
+
+	if referral.ContactNumber == "" {
+		validationErr.add("contactNumber", ViolationRequired, "contactNumber is required")
+	} else if !phoneNumberPattern.MatchString(phoneNumberSeparator.Replace(referral.ContactNumber)) {
+		validationErr.add("contactNumber", ViolationFormat, "contactNumber must be 7-15 digits with an optional leading '+'")
+	}
+
+	if referral.CustomerId == "" {
+		validationErr.add("customerId", ViolationRequired, "customerId is required")
+	}
+
+	if referral.EmployeeId == "" {
+		validationErr.add("employeeId", ViolationRequired, "employeeId is required")
+	}
+
+	if referral.Status == "" {
+		validationErr.add("status", ViolationRequired, "status is required")
+	} else if !statusLifecycle.IsKnown(referral.Status) {
+		validationErr.add("status", ViolationUnknown, "status "+referral.Status+" is not a referral lifecycle status")
+	}
+
+	if len(referral.Departments) == 0 {
+		validationErr.add("departments", ViolationRequired, "at least one department is required")
+	}
+	for i := range referral.Departments {
+		if strings.TrimSpace(referral.Departments[i]) == "" {
+			validationErr.add("departments", ViolationFormat, "department names must not be empty")
+			break
+		}
+	}
+
+	if referral.Mortgage != (Mortgage{}) {
+		if referral.Mortgage.ReferralId != referral.ReferralId {
+			validationErr.add("mortgage.referralId", ViolationMismatch, "mortgage.referralId must match referralId")
+		}
+
+		if err := referral.Mortgage.Rate.Validate(); err != nil {
+			validationErr.add("mortgage.rate", ViolationFormat, err.Error())
+		}
+
+		if !referral.Mortgage.Amount.IsZero() {
+			if err := referral.Mortgage.Amount.Validate(); err != nil {
+				validationErr.add("mortgage.amount", ViolationFormat, err.Error())
+			}
+		}
+	}
+
+	if len(validationErr.Violations) > 0 {
+		return validationErr
+	}
+
+	return nil
+}